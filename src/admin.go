@@ -0,0 +1,399 @@
+// admin.go
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const redactedValue = "***"
+
+// configSnapshot returns a copy of the running configuration taken under the config mutex
+func configSnapshot() Config {
+	appCtx.configMu.RLock()
+	defer appCtx.configMu.RUnlock()
+	return appCtx.Config
+}
+
+// redactConfig blanks out every non-empty string field tagged with `redact:"true"`
+func redactConfig(cfg Config) Config {
+	v := reflect.ValueOf(&cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("redact") != "true" {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() == reflect.String && f.String() != "" {
+			f.SetString(redactedValue)
+		}
+	}
+	return cfg
+}
+
+// adminAuthorized checks the Bearer token of the request against AdminAPIKey
+func adminAuthorized(r *http.Request) bool {
+	key := configSnapshot().AdminAPIKey
+	if key == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(key)) == 1
+}
+
+// withAdminAuth wraps an admin handler with the Bearer token check
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r) {
+			appCtx.AccessLogger.Printf("Admin request rejected: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		appCtx.ErrorLogger.Printf("Error encoding admin response: %v", err)
+		http.Error(w, "encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// handleConfig returns the effective configuration with secrets redacted
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appCtx.AccessLogger.Printf("Config snapshot requested from %s", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, redactConfig(configSnapshot()))
+}
+
+// currentWeights returns a copy of the rerank weights in use (they can be changed at runtime)
+func currentWeights() []float64 {
+	appCtx.configMu.RLock()
+	defer appCtx.configMu.RUnlock()
+	return slices.Clone(appCtx.Config.DefaultWeights)
+}
+
+// weightsResponse lists rerank weights together with the features they apply to
+type weightsResponse struct {
+	Features []string  `json:"features"`
+	Weights  []float64 `json:"weights"`
+}
+
+// checkWeightNames checks the optional feature names of a weights update: when given, they must be
+// the featureNames of the n weights, in order
+func checkWeightNames(names []string, n int) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if len(names) != n {
+		return fmt.Errorf("has %d names for %d weights", len(names), n)
+	}
+	for i, name := range names {
+		if !slices.Contains(featureNames, name) {
+			return fmt.Errorf("element [%d] is unknown: %q", i, name)
+		}
+		if name != featureNames[i] {
+			return fmt.Errorf("element [%d] is %q, want %q", i, name, featureNames[i])
+		}
+	}
+	return nil
+}
+
+// handleWeights returns (GET) or replaces (PUT) the rerank weights without restart
+func handleWeights(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req weightsResponse
+		dec := json.NewDecoder(io.LimitReader(r.Body, 1<<16))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := validateWeights(req.Weights); err != nil {
+			http.Error(w, fmt.Sprintf("weights %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := checkWeightNames(req.Features, len(req.Weights)); err != nil {
+			http.Error(w, fmt.Sprintf("features %v", err), http.StatusBadRequest)
+			return
+		}
+		appCtx.configMu.Lock()
+		old := appCtx.Config.DefaultWeights
+		appCtx.Config.DefaultWeights = slices.Clone(req.Weights)
+		appCtx.configMu.Unlock()
+		appCtx.AccessLogger.Printf("Rerank weights changed from %v to %v by %s", old, req.Weights, r.RemoteAddr)
+		appCtx.JournaldLogger.Printf("Rerank weights changed at runtime: %v", req.Weights)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	weights := currentWeights()
+	writeJSON(w, http.StatusOK, weightsResponse{
+		Features: featureNames[:len(weights)],
+		Weights:  weights,
+	})
+}
+
+// explainCandidate describes one reranked candidate for /admin/explain
+type explainCandidate struct {
+	PointID   string             `json:"point_id"`
+	PacketID  string             `json:"packet_id"`
+	Role      string             `json:"role"`
+	Path      string             `json:"path,omitempty"`
+	Timestamp float64            `json:"timestamp"`
+	Tokens    int                `json:"tokens"`
+	Score     float64            `json:"score"`
+	Features  map[string]float64 `json:"features"`
+	Preview   string             `json:"preview"`
+}
+
+// explainResponse is the /admin/explain result
+type explainResponse struct {
+	Query      string             `json:"query"`
+	Weights    []float64          `json:"weights"`
+	Candidates []explainCandidate `json:"candidates"`
+}
+
+// explainPreviewRunes limits the body preview in /admin/explain
+const explainPreviewRunes = 200
+
+// handleExplain runs embedding, search and rerank for a query and returns per-feature values of the
+// surviving candidates. Nothing is forwarded to Ollama's chat model and the DB is not modified.
+func handleExplain(w http.ResponseWriter, r *http.Request) {
+	var query string
+	switch r.Method {
+	case http.MethodGet:
+		query = r.URL.Query().Get("q")
+	case http.MethodPost:
+		var req struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		query = req.Query
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.TrimSpace(query) == "" {
+		http.Error(w, "empty query", http.StatusBadRequest)
+		return
+	}
+
+	vector, err := embedText(r.Context(), query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("embedding error: %v", err), http.StatusBadGateway)
+		return
+	}
+	// Retrieval override headers apply here too, so their effect can be inspected
+	opts := requestOptionsFromHeaders(r.Header)
+	opts.MustInclude = mergeTerms(opts.MustInclude, extractMustInclude(query))
+	candidates, err := rerankCandidates(r.Context(), vector, query, hashContent(query), opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("search error: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	resp := explainResponse{
+		Query:      query,
+		Weights:    currentWeights(),
+		Candidates: make([]explainCandidate, 0, len(candidates)),
+	}
+	for _, cand := range candidates {
+		values := featureVector(cand.Features)
+		features := make(map[string]float64, len(values))
+		for i, name := range featureNames {
+			features[name] = values[i]
+		}
+		preview := []rune(cand.Payload.Body)
+		if len(preview) > explainPreviewRunes {
+			preview = preview[:explainPreviewRunes]
+		}
+		resp.Candidates = append(resp.Candidates, explainCandidate{
+			PointID:   cand.PointID,
+			PacketID:  cand.Payload.PacketID,
+			Role:      cand.Payload.Role,
+			Path:      cand.Payload.FileMeta.Path,
+			Timestamp: cand.Payload.Timestamp,
+			Tokens:    cand.Payload.TokenCount,
+			Score:     cand.Score,
+			Features:  features,
+			Preview:   string(preview),
+		})
+	}
+	appCtx.AccessLogger.Printf("Explain request from %s returned %d candidates", r.RemoteAddr, len(resp.Candidates))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// feedbackRequest is the /admin/feedback body: one of PointID or PacketID, and a non-zero signal
+type feedbackRequest struct {
+	PointID  string  `json:"point_id"`
+	PacketID string  `json:"packet_id"`
+	Signal   float64 `json:"signal"`
+}
+
+// maxFeedbackSignal bounds a single feedback signal
+const maxFeedbackSignal = 10.0
+
+// handleFeedback records that a retrieved document helped (positive signal) or did not (negative)
+func handleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req feedbackRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if (req.PointID == "") == (req.PacketID == "") {
+		http.Error(w, "exactly one of point_id and packet_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.Signal == 0 || math.IsNaN(req.Signal) || math.Abs(req.Signal) > maxFeedbackSignal {
+		http.Error(w, fmt.Sprintf("signal must be non-zero and within ±%.0f", maxFeedbackSignal), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := addFeedback(req.PointID, req.PacketID, req.Signal)
+	if err != nil {
+		appCtx.ErrorLogger.Printf("Error storing feedback: %v", err)
+		http.Error(w, fmt.Sprintf("storing feedback failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	if updated == 0 {
+		http.Error(w, "no matching points", http.StatusNotFound)
+		return
+	}
+	appCtx.AccessLogger.Printf("Feedback %+.2f stored for %d points (point_id=%q packet_id=%q)", req.Signal, updated, req.PointID, req.PacketID)
+	writeJSON(w, http.StatusOK, map[string]int{"updated": updated})
+}
+
+// idfTerm is one token of the /admin/idf top list
+type idfTerm struct {
+	ID    uint32  `json:"id"`
+	Token string  `json:"token"`
+	IDF   float64 `json:"idf"`
+	DF    int     `json:"df"`
+}
+
+// idfResponse is the /admin/idf result
+type idfResponse struct {
+	Role        string    `json:"role,omitempty"`
+	N           uint64    `json:"n"`
+	TotalTokens int64     `json:"total_tokens"`
+	Tokens      int       `json:"tokens"`
+	Ngrams      int       `json:"ngrams"`
+	Top         []idfTerm `json:"top"`
+}
+
+// defaultIDFTop and maxIDFTop bound the number of tokens listed by /admin/idf
+const (
+	defaultIDFTop = 20
+	maxIDFTop     = 1000
+)
+
+// handleIDF returns the IDF store summary and its top tokens by IDF (?top=K); ?role= selects a
+// PerRoleIDF store
+func handleIDF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	top := defaultIDFTop
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxIDFTop {
+			http.Error(w, fmt.Sprintf("top must be 0..%d", maxIDFTop), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	role := r.URL.Query().Get("role")
+
+	appCtx.idfMu.RLock()
+	store := &appCtx.IDFStore
+	if role != "" {
+		var ok bool
+		if store, ok = appCtx.RoleIDFStores[role]; !ok {
+			appCtx.idfMu.RUnlock()
+			http.Error(w, fmt.Sprintf("no IDF store for role %q", role), http.StatusNotFound)
+			return
+		}
+	}
+	resp := idfResponse{
+		Role:        role,
+		N:           store.N,
+		TotalTokens: store.TotalTokens,
+		Tokens:      len(store.IDF),
+		Ngrams:      len(store.NgramIDF),
+		Top:         topIDF(store, nil, top),
+	}
+	appCtx.idfMu.RUnlock()
+
+	for i := range resp.Top {
+		resp.Top[i].Token = appCtx.Tokenizer.Decode([]uint32{resp.Top[i].ID}, false)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// adminHandler is one endpoint served by ragproxy itself instead of being proxied to Ollama
+type adminHandler struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+// adminHandlers lists the admin endpoints enabled by config
+func adminHandlers(config Config) []adminHandler {
+	var handlers []adminHandler
+	if config.ConfigEndpointEnabled {
+		handlers = append(handlers, adminHandler{"/ragproxy/config", handleConfig})
+		if config.ConfigReloadDiff {
+			handlers = append(handlers, adminHandler{"/ragproxy/config/last-reload", handleLastReload})
+		}
+	}
+
+	// Runtime tuning endpoints are available whenever an admin key is configured
+	if config.AdminAPIKey != "" {
+		handlers = append(handlers,
+			adminHandler{"/admin/weights", handleWeights},
+			adminHandler{"/admin/explain", handleExplain},
+			adminHandler{"/admin/feedback", handleFeedback},
+			adminHandler{"/admin/idf", handleIDF})
+	}
+	return handlers
+}
+
+// registerAdminHandlers adds the admin endpoints to the default mux
+func registerAdminHandlers() {
+	for _, h := range adminHandlers(appCtx.Config) {
+		http.HandleFunc(h.path, withRecover(withCORS(withAdminAuth(h.handler))))
+		appCtx.JournaldLogger.Printf("Admin endpoint enabled at %s", h.path)
+	}
+}
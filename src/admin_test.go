@@ -0,0 +1,221 @@
+// admin_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigEndpointRedactsSecrets(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.QdrantAPIKey = "qdrant-secret"
+	appCtx.Config.TokenizerHFAPI = "hf-secret"
+	appCtx.Config.AdminAPIKey = "admin-secret"
+	handler := withAdminAuth(handleConfig)
+
+	req := httptest.NewRequest(http.MethodGet, "/ragproxy/config", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	for _, secret := range []string{"qdrant-secret", "hf-secret", "admin-secret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("config output contains the secret %q", secret)
+		}
+	}
+	var got Config
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.QdrantAPIKey != redactedValue || got.TokenizerHFAPI != redactedValue || got.AdminAPIKey != redactedValue {
+		t.Errorf("secrets %q, %q, %q; want %q", got.QdrantAPIKey, got.TokenizerHFAPI, got.AdminAPIKey, redactedValue)
+	}
+	if got.QdrantCollection != appCtx.Config.QdrantCollection {
+		t.Errorf("QdrantCollection %q, want the running value", got.QdrantCollection)
+	}
+	if appCtx.Config.QdrantAPIKey != "qdrant-secret" {
+		t.Error("redaction changed the running config")
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/ragproxy/config", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request: status %d, want 401", rec.Code)
+	}
+}
+
+func TestWeightsEndpointUpdatesRerank(t *testing.T) {
+	newTestApp(t)
+	useRerankTestConfig(onlyFeature("EmbSim"))
+	putTestPoint(t, appCtx.memStore, "similar but old", "rag-user", 365*24*time.Hour)
+	putTestPoint(t, appCtx.memStore, "fresh other", "rag-user", time.Minute)
+	if got := rerankBodies(t, "similar but old", RequestOptions{}); len(got) != 2 || got[0] != "similar but old" {
+		t.Fatalf("rerank by EmbSim = %q", got)
+	}
+
+	put := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleWeights(rec, httptest.NewRequest(http.MethodPut, "/admin/weights", strings.NewReader(body)))
+		return rec
+	}
+	recency := onlyFeature("Recency")
+	data, _ := json.Marshal(weightsResponse{Features: featureNames, Weights: recency})
+	rec := put(string(data))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid update: status %d: %s", rec.Code, rec.Body)
+	}
+	var resp weightsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resp.Weights, recency) || !slices.Equal(resp.Features, featureNames) {
+		t.Errorf("response %+v, want the new weights with their features", resp)
+	}
+	if got := rerankBodies(t, "similar but old", RequestOptions{}); len(got) != 2 || got[0] != "fresh other" {
+		t.Errorf("rerank after the update = %q, want the fresh point first", got)
+	}
+
+	for name, body := range map[string]string{
+		"too few":       `{"weights":[1,1,1,1,1,1,1,1]}`,
+		"too many":      `{"weights":[` + strings.Repeat("1,", len(featureNames)) + `1]}`,
+		"negative":      `{"weights":[1,1,1,1,1,1,1,1,-1]}`,
+		"unknown name":  `{"features":["EmbSim","Recency","RoleScore","BodyLen","KeywordOverlap","WeightedOverlap","BM25","NgramOverlap","Typo"],"weights":[1,1,1,1,1,1,1,1,1]}`,
+		"name order":    `{"features":["Recency","EmbSim","RoleScore","BodyLen","KeywordOverlap","WeightedOverlap","BM25","NgramOverlap","WeightedNgram"],"weights":[1,1,1,1,1,1,1,1,1]}`,
+		"name count":    `{"features":["EmbSim"],"weights":[1,1,1,1,1,1,1,1,1]}`,
+		"unknown field": `{"weight":[1,1,1,1,1,1,1,1,1]}`,
+	} {
+		if rec := put(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, rec.Code)
+		}
+	}
+	if !slices.Equal(currentWeights(), recency) {
+		t.Errorf("rejected updates changed the weights to %v", currentWeights())
+	}
+}
+
+func TestExplainReturnsFeatureBreakdownWithoutForwarding(t *testing.T) {
+	newTestApp(t)
+	embeddings := &fakeEmbeddings{}
+	useFakeOllama(t, embeddings)
+	useRerankTestConfig(appCtx.Config.DefaultWeights)
+	putTestPoint(t, appCtx.memStore, "how to rotate the logs", "rag-user", time.Hour)
+	putTestPoint(t, appCtx.memStore, "unrelated answer", "rag-assistant", time.Hour)
+	before := len(appCtx.memStore.points)
+
+	rec := httptest.NewRecorder()
+	handleExplain(rec, httptest.NewRequest(http.MethodPost, "/admin/explain", strings.NewReader(`{"query":"how to rotate the logs"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Query      string                       `json:"query"`
+		Weights    []float64                    `json:"weights"`
+		Candidates []map[string]json.RawMessage `json:"candidates"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Query != "how to rotate the logs" || len(resp.Weights) == 0 {
+		t.Errorf("query %q weights %v", resp.Query, resp.Weights)
+	}
+	if len(resp.Candidates) != 2 {
+		t.Fatalf("got %d candidates, want both seeded points", len(resp.Candidates))
+	}
+	for _, cand := range resp.Candidates {
+		for _, key := range []string{"point_id", "role", "score", "preview"} {
+			if _, ok := cand[key]; !ok {
+				t.Errorf("candidate has no %q: %s", key, rec.Body)
+			}
+		}
+		var features map[string]float64
+		if err := json.Unmarshal(cand["features"], &features); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range featureNames {
+			if _, ok := features[name]; !ok {
+				t.Errorf("features have no %q: %v", name, features)
+			}
+		}
+	}
+	var first map[string]float64
+	json.Unmarshal(resp.Candidates[0]["features"], &first)
+	if first["EmbSim"] < 0.99 {
+		t.Errorf("best candidate EmbSim = %v, want the identical vector", first["EmbSim"])
+	}
+
+	if got := embeddings.embedded(); len(got) != 1 || got[0] != "how to rotate the logs" {
+		t.Errorf("Ollama got %q, want only the query embedded", got)
+	}
+	if len(appCtx.memStore.points) != before {
+		t.Errorf("explain changed the store from %d to %d points", before, len(appCtx.memStore.points))
+	}
+}
+
+func TestFeedbackIncrementsSignalAndBoostsRanking(t *testing.T) {
+	newTestApp(t)
+	weights := onlyFeature("FeedbackScore")
+	weights[slices.Index(featureNames, "EmbSim")] = 0.1
+	useRerankTestConfig(weights)
+	appCtx.Config.FeedbackScale = 3
+	putTestPoint(t, appCtx.memStore, "similar answer", "rag-assistant", time.Hour)
+	putTestPoint(t, appCtx.memStore, "helpful answer", "rag-assistant", time.Hour)
+	if got := rerankBodies(t, "similar answer", RequestOptions{}); len(got) != 2 || got[0] != "similar answer" {
+		t.Fatalf("rerank before feedback = %q, want the similar point first", got)
+	}
+
+	var helpfulID string
+	feedbackOf := func() float64 {
+		for _, p := range storedPoints(t, "rag-assistant") {
+			if payloadBody(p.GetPayload()) == "helpful answer" {
+				helpfulID = pointIDString(p.GetId())
+				return p.GetPayload()["feedback"].GetDoubleValue()
+			}
+		}
+		t.Fatal("helpful point not found")
+		return 0
+	}
+	feedbackOf()
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleFeedback(rec, httptest.NewRequest(http.MethodPost, "/admin/feedback", strings.NewReader(body)))
+		return rec
+	}
+
+	for i, want := range []float64{2, 3.5} {
+		signal := []string{"2", "1.5"}[i]
+		if rec := post(`{"point_id":"` + helpfulID + `","signal":` + signal + `}`); rec.Code != http.StatusOK {
+			t.Fatalf("feedback: status %d: %s", rec.Code, rec.Body)
+		}
+		if got := feedbackOf(); got != want {
+			t.Errorf("stored feedback %v after signal %s, want %v", got, signal, want)
+		}
+	}
+	if got := rerankBodies(t, "similar answer", RequestOptions{}); len(got) != 2 || got[0] != "helpful answer" {
+		t.Errorf("rerank after feedback = %q, want the helpful point first", got)
+	}
+
+	for name, tc := range map[string]struct {
+		body string
+		code int
+	}{
+		"zero signal":    {`{"point_id":"` + helpfulID + `","signal":0}`, http.StatusBadRequest},
+		"too large":      {`{"point_id":"` + helpfulID + `","signal":100}`, http.StatusBadRequest},
+		"both ids":       {`{"point_id":"` + helpfulID + `","packet_id":"p","signal":1}`, http.StatusBadRequest},
+		"unknown packet": {`{"packet_id":"no-such-packet","signal":1}`, http.StatusNotFound},
+	} {
+		if rec := post(tc.body); rec.Code != tc.code {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tc.code)
+		}
+	}
+	if got := feedbackOf(); got != 3.5 {
+		t.Errorf("rejected feedback changed the stored signal to %v", got)
+	}
+}
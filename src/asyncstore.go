@@ -0,0 +1,98 @@
+// asyncstore.go
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// outboundJob holds the arguments of one processOutbound call and its progress
+type outboundJob struct {
+	cleanAssistantContent string
+	cleanUserContent      string
+	attachments           []Attachment
+	promptVector          []float32
+	queryHash             string
+	thread                ThreadRef
+	ttl                   time.Duration // RequestOptions.TTL
+	packetID              string        // set by processOutbound on the first attempt
+	userStored            bool
+	assistantStored       bool
+}
+
+// startStoreWorkers starts the AsyncStore worker pool reading from a queue of queueSize jobs
+func startStoreWorkers(workers int, queueSize int) {
+	queue := make(chan outboundJob, queueSize)
+	appCtx.storeMu.Lock()
+	appCtx.storeQueue = queue
+	appCtx.storeMu.Unlock()
+	for i := 0; i < workers; i++ {
+		appCtx.storeWG.Add(1)
+		go func() {
+			defer appCtx.storeWG.Done()
+			for job := range queue {
+				runOutboundJob(job)
+			}
+		}()
+	}
+	appCtx.JournaldLogger.Printf("Async store started: %d workers, queue of %d", workers, queueSize)
+}
+
+// runOutboundJob stores one exchange; a panic does not stop the worker (see storeExchange)
+func runOutboundJob(job outboundJob) {
+	storeExchange(&job)
+}
+
+// storeExchange runs processOutbound and writes a failed job to the dead-letter dir. A panic is
+// recovered, logged and dead-lettered like an error.
+func storeExchange(job *outboundJob) {
+	defer func() {
+		if p := recover(); p != nil {
+			appCtx.ErrorLogger.Printf("Panic storing exchange: %v\n%s", p, debug.Stack())
+			appCtx.JournaldLogger.Printf("Panic storing exchange: %v", p)
+			writeDeadLetter(job, fmt.Errorf("panic: %v", p))
+		}
+	}()
+	if err := processOutbound(job); err != nil {
+		appCtx.ErrorLogger.Printf("Error storing exchange: %v", err)
+		writeDeadLetter(job, err)
+	}
+}
+
+// storeOutbound stores the exchange: queued for the workers with AsyncStore, otherwise in place.
+// A full queue stores in place as well, so the client waits instead of the exchange being lost.
+func storeOutbound(job outboundJob) {
+	appCtx.storeMu.RLock()
+	queued := false
+	if appCtx.storeQueue != nil {
+		select {
+		case appCtx.storeQueue <- job:
+			queued = true
+		default:
+			appCtx.AccessLogger.Printf("Async store queue is full (%d), storing synchronously", cap(appCtx.storeQueue))
+		}
+	}
+	appCtx.storeMu.RUnlock()
+
+	if !queued {
+		storeExchange(&job)
+	}
+}
+
+// drainStoreWorkers stops accepting jobs and waits until the queued stores are done.
+// Requests still running afterwards store synchronously.
+func drainStoreWorkers() {
+	appCtx.storeMu.Lock()
+	queue := appCtx.storeQueue
+	appCtx.storeQueue = nil
+	appCtx.storeMu.Unlock()
+	if queue == nil {
+		return
+	}
+
+	appCtx.JournaldLogger.Printf("Waiting for %d pending async stores", len(queue))
+	close(queue)
+	appCtx.storeWG.Wait()
+	appCtx.JournaldLogger.Printf("Async store drained")
+}
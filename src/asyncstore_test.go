@@ -0,0 +1,123 @@
+// asyncstore_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// panicTokenizer panics on every Encode
+type panicTokenizer struct{ testTokenizer }
+
+func (panicTokenizer) Encode(string, bool) ([]uint32, []string) { panic("tokenizer crashed") }
+
+func TestRunOutboundJobDeadLettersPanic(t *testing.T) {
+	newTestApp(t)
+	dir := t.TempDir()
+	appCtx.Config.DeadLetterDir = dir
+	appCtx.Tokenizer = panicTokenizer{}
+	appCtx.Config.EmbeddingMaxTokens = 8 // the embedding input cap tokenizes first
+
+	runOutboundJob(outboundJob{cleanUserContent: "question", cleanAssistantContent: "answer", promptVector: make([]float32, appCtx.Config.QdrantVectorSize)})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(entries))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d deadLetter
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.UserContent != "question" || d.Error != "panic: tokenizer crashed" {
+		t.Errorf("dead letter %+v does not record the job and the panic", d)
+	}
+}
+
+// streamUpstream answers every request with an Ollama stream of the words of answer
+type streamUpstream struct{ answer string }
+
+func (u streamUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	for _, word := range strings.SplitAfter(u.answer, " ") {
+		fmt.Fprintf(w, `{"model":"m","created_at":"2026-01-01T00:00:01Z","response":%q,"done":false}`+"\n", word)
+	}
+	io.WriteString(w, `{"model":"m","created_at":"2026-01-01T00:00:02Z","response":"","done":true}`+"\n")
+}
+
+func TestAsyncStoreAnswersClientBeforeStoring(t *testing.T) {
+	newTestApp(t)
+	if err := initConfigState(); err != nil {
+		t.Fatal(err)
+	}
+	const question, answer = "where are the logs written?", "They go to the journal."
+	// Embedding the answer for storage blocks until the client has its response
+	release := make(chan struct{})
+	embeddings := &fakeEmbeddings{}
+	useFakeOllama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), answer) {
+			<-release
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		embeddings.ServeHTTP(w, r)
+	}))
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+
+	// Something to feed, so the request is augmented and the turn gets stored
+	useRerankTestConfig(appCtx.Config.DefaultWeights)
+	putTestPoint(t, appCtx.memStore, "logs rotate daily", "rag-file", time.Hour)
+
+	appCtx.Config.AsyncStore = true
+	startStoreWorkers(1, 4)
+	t.Cleanup(drainStoreWorkers)
+
+	body := `{"model":"m","messages":[{"role":"user","content":"<userRequest>` + question + `</userRequest>"}]}`
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		proxyHandler(streamUpstream{answer})(rec, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body)))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		unblock()
+		<-done
+		t.Fatal("the client waited for the store")
+	}
+	if !strings.Contains(rec.Body.String(), `"done":true`) {
+		t.Errorf("client got an unfinished stream: %s", rec.Body)
+	}
+	if n := len(storedPoints(t, "rag-assistant")); n != 0 {
+		t.Errorf("%d assistant points stored before the embedding finished", n)
+	}
+
+	unblock()
+	drainStoreWorkers()
+	if n := len(storedPoints(t, "rag-assistant")); n != 1 {
+		t.Errorf("%d assistant points stored after the drain, want 1", n)
+	}
+	if n := len(storedPoints(t, "rag-user")); n != 1 {
+		t.Errorf("%d user points stored after the drain, want 1", n)
+	}
+}
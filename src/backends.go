@@ -0,0 +1,224 @@
+// backends.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	balancingRoundRobin  = "round-robin"
+	balancingLeastLoaded = "least-loaded"
+)
+
+// ollamaBackend is one upstream Ollama server
+type ollamaBackend struct {
+	url       *url.URL
+	inFlight  atomic.Int64
+	downUntil atomic.Int64 // UnixNano; the backend is skipped until then
+	probing   atomic.Bool  // a probeOllamaBackend goroutine is running
+}
+
+// ollamaProbePath is requested by probeOllamaBackend to tell whether a backend is back
+const ollamaProbePath = "/api/version"
+
+// ollamaPool holds the upstream Ollama servers: OllamaBase followed by OllamaBackends. It is built
+// once at startup; a config reload does not change it.
+var ollamaPool struct {
+	backends []*ollamaBackend
+	next     atomic.Uint64
+}
+
+// ollamaTransport sends every Ollama request (proxied or made by ragproxy) to the backend picked for it
+var ollamaTransport http.RoundTripper = ollamaBackendTransport{base: http.DefaultTransport}
+
+// ollamaClient is the client of ollamaRequest
+var ollamaClient = &http.Client{Transport: ollamaTransport}
+
+// ollamaBackendBases returns the base URLs of all backends, OllamaBase first
+func ollamaBackendBases(config Config) []string {
+	return append([]string{config.OllamaBase}, config.OllamaBackends...)
+}
+
+// initOllamaBackends builds the backend pool from the config
+func initOllamaBackends(config Config) error {
+	bases := ollamaBackendBases(config)
+	backends := make([]*ollamaBackend, 0, len(bases))
+	for _, base := range bases {
+		u, err := url.Parse(base)
+		if err != nil {
+			return fmt.Errorf("error parsing Ollama URL %s: %w", base, err)
+		}
+		backends = append(backends, &ollamaBackend{url: u})
+	}
+	ollamaPool.backends = backends
+	return nil
+}
+
+// pickOllamaBackend selects the backend of a request by OllamaBalancing, skipping the ones marked
+// down. When all are down the next one in turn is tried anyway.
+func pickOllamaBackend() *ollamaBackend {
+	backends := ollamaPool.backends
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	now := time.Now().UnixNano()
+	start := ollamaPool.next.Add(1) - 1
+	var best *ollamaBackend
+	for i := range uint64(len(backends)) {
+		b := backends[(start+i)%uint64(len(backends))]
+		if b.downUntil.Load() > now {
+			continue
+		}
+		if appCtx.Config.OllamaBalancing != balancingLeastLoaded {
+			return b
+		}
+		if best == nil || b.inFlight.Load() < best.inFlight.Load() {
+			best = b
+		}
+	}
+	if best == nil {
+		return backends[start%uint64(len(backends))]
+	}
+	return best
+}
+
+// markDown makes pickOllamaBackend skip b after a failed connection until probeOllamaBackend finds
+// it back up
+func (b *ollamaBackend) markDown(err error) {
+	cooldown := appCtx.Config.OllamaBackendCooldown.Duration
+	if cooldown <= 0 || len(ollamaPool.backends) == 1 {
+		return
+	}
+	b.downUntil.Store(time.Now().Add(cooldown).UnixNano())
+	appCtx.ErrorLogger.Printf("Ollama backend %s failed, skipping it: %v", b.url.Host, err)
+	if b.probing.CompareAndSwap(false, true) {
+		go b.probe(cooldown)
+	}
+}
+
+// probe requests ollamaProbePath of b every cooldown, keeping it skipped while that fails and
+// returning it to the pool on the first answer
+func (b *ollamaBackend) probe(cooldown time.Duration) {
+	defer b.probing.Store(false)
+	client := &http.Client{Timeout: cooldown}
+	for {
+		// skipped until this probe has answered
+		b.downUntil.Store(time.Now().Add(2 * cooldown).UnixNano())
+		time.Sleep(cooldown)
+		resp, err := client.Get(b.url.JoinPath(ollamaProbePath).String())
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			b.downUntil.Store(0)
+			appCtx.JournaldLogger.Printf("Ollama backend %s is back up", b.url.Host)
+			return
+		}
+	}
+}
+
+// ollamaBackendTransport points each request at a picked backend and tracks its in-flight requests
+// (until the response body is closed). Requests carry the Ollama path only, the backend adds its
+// scheme, host and base path. An idempotent request failing to connect is retried once on the next
+// backend.
+type ollamaBackendTransport struct {
+	base http.RoundTripper
+}
+
+func (t ollamaBackendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := pickOllamaBackend()
+	resp, err := t.roundTripTo(b, req)
+	if err == nil || req.Context().Err() != nil || !isRetryable(req) {
+		return resp, err
+	}
+	next := nextOllamaBackend(b)
+	if next == nil {
+		return nil, err
+	}
+	appCtx.ErrorLogger.Printf("Retrying %s %s on Ollama backend %s", req.Method, req.URL.Path, next.url.Host)
+	if req.GetBody != nil {
+		retry := req.Clone(req.Context())
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		req = retry
+	}
+	return t.roundTripTo(next, req)
+}
+
+// roundTripTo sends req to backend b
+func (t ollamaBackendTransport) roundTripTo(b *ollamaBackend, req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	if out.Host == out.URL.Host {
+		out.Host = "" // send the Host of the picked backend
+	}
+	out.URL = b.target(req.URL)
+
+	b.inFlight.Add(1)
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		b.inFlight.Add(-1)
+		if req.Context().Err() == nil {
+			b.markDown(err)
+		}
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { b.inFlight.Add(-1) }}
+	return resp, nil
+}
+
+// target returns u pointed at b: the scheme and host of b, and the base path of b prefixed to the path of u
+func (b *ollamaBackend) target(u *url.URL) *url.URL {
+	out := *u
+	out.Scheme, out.Host = b.url.Scheme, b.url.Host
+	if base := strings.TrimSuffix(b.url.Path, "/"); base != "" {
+		out.Path = base + "/" + strings.TrimPrefix(u.Path, "/")
+		out.RawPath = ""
+	}
+	return &out
+}
+
+// nextOllamaBackend returns the backend following b in the pool that is not marked down, nil when
+// there is none
+func nextOllamaBackend(b *ollamaBackend) *ollamaBackend {
+	backends := ollamaPool.backends
+	i := slices.Index(backends, b)
+	now := time.Now().UnixNano()
+	for j := 1; j < len(backends); j++ {
+		next := backends[(i+j)%len(backends)]
+		if next.downUntil.Load() <= now {
+			return next
+		}
+	}
+	return nil
+}
+
+// isRetryable reports whether req may be sent again: an idempotent method and a body that is
+// empty or can be read again
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// releaseOnClose calls release once when the body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	r.once.Do(r.release)
+	return r.ReadCloser.Close()
+}
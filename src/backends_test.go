@@ -0,0 +1,142 @@
+// backends_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMarkedDownBackendIsProbedBackUp(t *testing.T) {
+	newTestApp(t)
+	var probes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == ollamaProbePath {
+			probes.Add(1)
+		}
+	}))
+	defer srv.Close()
+	appCtx.Config.OllamaBase, appCtx.Config.OllamaBackends = srv.URL, []string{"http://127.0.0.1:1"}
+	appCtx.Config.OllamaBackendCooldown.Duration = 10 * time.Millisecond
+	if err := initOllamaBackends(appCtx.Config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ollamaPool.backends = nil })
+
+	b := ollamaPool.backends[0]
+	b.markDown(errors.New("connection refused"))
+	if b.downUntil.Load() == 0 {
+		t.Fatal("backend was not marked down")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.downUntil.Load() != 0 || b.probing.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("backend was not probed back up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if probes.Load() == 0 {
+		t.Errorf("no request to %s", ollamaProbePath)
+	}
+}
+
+// pathRecorder is a stub Ollama backend recording the paths requested from it
+type pathRecorder struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (p *pathRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.paths = append(p.paths, r.Method+" "+r.URL.Path)
+	p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"embedding":[]}`)
+}
+
+func (p *pathRecorder) requested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.paths...)
+}
+
+// useOllamaBackends points the pool at the given base URLs, first one as OllamaBase
+func useOllamaBackends(t *testing.T, bases ...string) {
+	t.Helper()
+	appCtx.Config.OllamaBase, appCtx.Config.OllamaBackends = bases[0], bases[1:]
+	appCtx.Config.OllamaBalancing = balancingRoundRobin
+	if err := validateConfig(appCtx.Config); err != nil {
+		t.Fatal(err)
+	}
+	if err := initOllamaBackends(appCtx.Config); err != nil {
+		t.Fatal(err)
+	}
+	ollamaPool.next.Store(0)
+	t.Cleanup(func() { ollamaPool.backends = nil })
+}
+
+func TestRequestsUseBasePathOfPickedBackend(t *testing.T) {
+	newTestApp(t)
+	a, b := &pathRecorder{}, &pathRecorder{}
+	srvA, srvB := httptest.NewServer(a), httptest.NewServer(b)
+	defer srvA.Close()
+	defer srvB.Close()
+	useOllamaBackends(t, srvA.URL+"/ollama-a", srvB.URL+"/b/")
+
+	proxy := newOllamaProxy()
+	for range 2 {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("proxied status %d", rec.Code)
+		}
+	}
+	for range 2 {
+		if _, err := ollamaRequest(context.Background(), "/api/embeddings", map[string]any{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantA := []string{"GET /ollama-a/api/tags", "POST /ollama-a/api/embeddings"}
+	wantB := []string{"GET /b/api/tags", "POST /b/api/embeddings"}
+	if got := a.requested(); !slices.Equal(got, wantA) {
+		t.Errorf("backend a got %q, want %q", got, wantA)
+	}
+	if got := b.requested(); !slices.Equal(got, wantB) {
+		t.Errorf("backend b got %q, want %q", got, wantB)
+	}
+}
+
+func TestIdempotentRequestRetriedOnNextBackend(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.OllamaBackendCooldown.Duration = 0 // keep the dead backend in turn
+	live := &pathRecorder{}
+	srv := httptest.NewServer(live)
+	defer srv.Close()
+	useOllamaBackends(t, "http://127.0.0.1:1", srv.URL)
+
+	proxy := newOllamaProxy()
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET on a dead backend: status %d, want 200 from the retry", rec.Code)
+	}
+
+	ollamaPool.next.Store(0)
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("POST on a dead backend: status %d, want 502 without a retry", rec.Code)
+	}
+	if got, want := live.requested(), []string{"GET /api/tags"}; !slices.Equal(got, want) {
+		t.Errorf("live backend got %q, want %q", got, want)
+	}
+}
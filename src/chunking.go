@@ -0,0 +1,162 @@
+// chunking.go
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// feedChunkGapMarker stands for the part of a file between two fed chunks that were not found
+const feedChunkGapMarker = "...\n"
+
+// fileChunk is one part of a file body stored as its own point
+type fileChunk struct {
+	Body   string
+	Offset int // byte offset in the file body
+}
+
+// splitAttachment splits a file body into chunks of at most AttachmentChunkTokens tokens, each next
+// chunk repeating up to AttachmentChunkOverlap tokens of the previous one. Chunks end on line
+// boundaries, preferably where chunkBreakFunc starts a new block. A body that fits one chunk (or
+// chunking disabled) is returned whole.
+func splitAttachment(att Attachment) []fileChunk {
+	size := appCtx.Config.AttachmentChunkTokens
+	if size <= 0 || calculateTokens(att.Body) <= size {
+		return []fileChunk{{Body: att.Body}}
+	}
+
+	lines := strings.SplitAfter(att.Body, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	tokens := make([]int, len(lines))
+	offsets := make([]int, len(lines)+1)
+	for i, ln := range lines {
+		tokens[i] = calculateTokens(ln)
+		offsets[i+1] = offsets[i] + len(ln)
+	}
+	breakAt := chunkBreakFunc(att.Path)
+
+	var chunks []fileChunk
+	for start := 0; start < len(lines); {
+		// Take lines up to the token limit, at least one
+		end, total := start, 0
+		for end < len(lines) && (end == start || total+tokens[end] <= size) {
+			total += tokens[end]
+			end++
+		}
+		// Move the end back to a block start, keeping at least half of the chunk
+		if end < len(lines) {
+			for e, t := end, total; e > start+1 && t >= size/2; e-- {
+				if breakAt(lines, e) {
+					end = e
+					break
+				}
+				t -= tokens[e-1]
+			}
+		}
+		chunks = append(chunks, fileChunk{Body: att.Body[offsets[start]:offsets[end]], Offset: offsets[start]})
+		if end == len(lines) {
+			break
+		}
+
+		// The next chunk starts up to AttachmentChunkOverlap tokens back, always after this start
+		next, overlap := end, 0
+		for next > start+1 && overlap+tokens[next-1] <= appCtx.Config.AttachmentChunkOverlap {
+			next--
+			overlap += tokens[next]
+		}
+		start = next
+	}
+	return chunks
+}
+
+// chunkBreakFunc returns whether a chunk of a file of this type preferably starts at lines[i] (i > 0):
+// text and markup at a heading or paragraph, code at an unindented line after a blank line or a
+// closing brace/end, i.e. a top-level declaration.
+func chunkBreakFunc(filePath string) func(lines []string, i int) bool {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".md", ".markdown", ".rst", ".adoc", ".txt":
+		return func(lines []string, i int) bool {
+			return strings.HasPrefix(lines[i], "#") || strings.TrimSpace(lines[i-1]) == ""
+		}
+	}
+	return func(lines []string, i int) bool {
+		ln := lines[i]
+		if strings.TrimSpace(ln) == "" || ln[0] == ' ' || ln[0] == '\t' {
+			return false
+		}
+		prev := strings.TrimSpace(lines[i-1])
+		return prev == "" || prev == "}" || prev == "end"
+	}
+}
+
+// mergeFileChunks joins the chunks of one file found by the search into a single payload at the
+// place of its most relevant chunk. Chunks are put in file order without their overlaps, the parts
+// not found are replaced by feedChunkGapMarker. The joined file is then fitted to the feed budget
+// like any stored file.
+func mergeFileChunks(payloads []Payload) []Payload {
+	isChunk := func(p Payload) bool { return p.Role == "rag-file" && p.FileMeta.Chunks > 1 }
+
+	groups := make(map[string][]Payload)
+	for _, p := range payloads {
+		if isChunk(p) {
+			groups[p.FileMeta.ID] = append(groups[p.FileMeta.ID], p)
+		}
+	}
+	if len(groups) == 0 {
+		return payloads
+	}
+
+	merged := make([]Payload, 0, len(payloads))
+	for _, p := range payloads {
+		if !isChunk(p) {
+			merged = append(merged, p)
+			continue
+		}
+		chunks := groups[p.FileMeta.ID]
+		if chunks == nil {
+			continue // joined at its most relevant chunk
+		}
+		groups[p.FileMeta.ID] = nil
+		merged = append(merged, joinFileChunks(chunks))
+	}
+	return merged
+}
+
+// joinFileChunks joins chunks of one file into one payload based on the first (most relevant) one
+func joinFileChunks(chunks []Payload) Payload {
+	joined := chunks[0]
+	sorted := slices.Clone(chunks)
+	slices.SortFunc(sorted, func(a, b Payload) int { return a.FileMeta.Chunk - b.FileMeta.Chunk })
+
+	var body strings.Builder
+	end := 0 // byte offset in the file written up to
+	for i, c := range sorted {
+		start := c.FileMeta.Offset
+		switch {
+		case i > 0 && start+len(c.Body) <= end:
+			continue // same or fully overlapped chunk
+		case i > 0 && start <= end:
+			body.WriteString(c.Body[end-start:])
+		default:
+			if start > 0 {
+				body.WriteString(feedChunkGapMarker)
+			}
+			body.WriteString(c.Body)
+		}
+		end = start + len(c.Body)
+	}
+	if sorted[len(sorted)-1].FileMeta.Chunk < joined.FileMeta.Chunks-1 {
+		body.WriteString(feedChunkGapMarker)
+	}
+
+	joined.Body = body.String()
+	joined.Hash = hashContent(joined.Body)
+	joined.CleanTokenCount = calculateTokens(joined.Body)
+	joined.TokenCount, _ = calcFileSize(Attachment{ID: joined.FileMeta.ID, Path: joined.FileMeta.Path, Body: joined.Body})
+	joined.FileMeta.Chunk, joined.FileMeta.Offset = 0, 0
+	appCtx.AccessLogger.Printf("Joined %d of %d chunks of file %s for feeding", len(chunks), joined.FileMeta.Chunks, joined.FileMeta.Path)
+	return joined
+}
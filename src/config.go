@@ -2,14 +2,22 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"fmt"
+	"maps"
 	"math"
+	"net"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
 )
 
 // validateEnumList validates each value in a list against allowed options
@@ -52,11 +60,51 @@ func compileFilePatterns(cfg *Config) error {
 	return nil
 }
 
+// Defaults of the attachment path rules, used when the config lists none
+var (
+	defaultAttachmentPathPatterns     = []string{`(?i)^[ \t]*//[ \t]*filepath:[ \t]*(.+)$`}
+	defaultAttachmentPathAttrPatterns = []string{`(?i)\bfilepath\s*=\s*"([^"]+)"`}
+	defaultAttachmentStripPatterns    = []string{`(?im)^[ \t]*user(?:'s)?[ \t]+active[ \t]+file(?:[ \t]+for[ \t]+additional[ \t]+context)?:[ \t]*$`}
+)
+
+// compileAttachmentPatterns compiles the attachment path rules (or their defaults) into regexps.
+// Path patterns must capture the path in their first group.
+func compileAttachmentPatterns(cfg *Config) error {
+	compile := func(name string, patterns, defaults []string, withPath bool) ([]*regexp.Regexp, error) {
+		if len(patterns) == 0 {
+			patterns = defaults
+		}
+		regs := make([]*regexp.Regexp, 0, len(patterns))
+		for i, p := range patterns {
+			r, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s[%d]: %w", name, i, err)
+			}
+			if withPath && r.NumSubexp() < 1 {
+				return nil, fmt.Errorf("invalid %s[%d]: no capture group for the path", name, i)
+			}
+			regs = append(regs, r)
+		}
+		return regs, nil
+	}
+
+	var err error
+	if cfg.AttachmentPathPatternsReg, err = compile("AttachmentPathPatterns", cfg.AttachmentPathPatterns, defaultAttachmentPathPatterns, true); err != nil {
+		return err
+	}
+	if cfg.AttachmentPathAttrPatternsReg, err = compile("AttachmentPathAttrPatterns", cfg.AttachmentPathAttrPatterns, defaultAttachmentPathAttrPatterns, true); err != nil {
+		return err
+	}
+	cfg.AttachmentStripPatternsReg, err = compile("AttachmentStripPatterns", cfg.AttachmentStripPatterns, defaultAttachmentStripPatterns, false)
+	return err
+}
+
 // CheckEmbeddingNormalization tests embedding normalization by embedding a test string
-// and calculating the L2 norm of the resulting vector.
+// and calculating the L2 norm of the resulting vector. The raw model output is checked,
+// before NormalizeEmbeddings.
 func checkEmbeddingNormalization() error {
 	const testStr = "embedding normalization test"
-	vec, err := embedText(testStr)
+	vec, err := embedTextOnce(context.Background(), testStr)
 	if err != nil {
 		return fmt.Errorf("embedding error: %w", err)
 	}
@@ -66,8 +114,10 @@ func checkEmbeddingNormalization() error {
 	}
 	norm := math.Sqrt(sum)
 	appCtx.AccessLogger.Printf("Embedding vector L2 norm for test string: %.6f", norm)
-	if math.Abs(norm-1.0) > 0.01 {
-		appCtx.ErrorLogger.Printf("WARNING: Embedding vector is NOT normalized (norm=%.6f). Consider normalizing output of embedText().", norm)
+	if math.Abs(norm-1.0) > 0.01 && appCtx.Config.NormalizeEmbeddings {
+		appCtx.JournaldLogger.Printf("Embedding vector is NOT normalized (norm=%.6f), NormalizeEmbeddings normalizes it.", norm)
+	} else if math.Abs(norm-1.0) > 0.01 {
+		appCtx.ErrorLogger.Printf("WARNING: Embedding vector is NOT normalized (norm=%.6f). Consider enabling NormalizeEmbeddings.", norm)
 	} else {
 		appCtx.JournaldLogger.Printf("Embedding vector is normalized (norm=%.6f).", norm)
 	}
@@ -175,25 +225,32 @@ func validateReplaceGroups(findGroups int, replaceTpl string) error {
 	return nil
 }
 
-// initResponseReplaceRules инициализирует правила замены из конфига.
+// initResponseReplaceRules инициализирует правила замены из конфига (appCtx.Config).
+func initResponseReplaceRules() error {
+	records, maxTriggerLen, err := buildResponseReplaceRules(appCtx.Config)
+	if err != nil {
+		return err
+	}
+	appCtx.responseReplaceRules = records
+	appCtx.responseReplaceMaxTriggerLen = maxTriggerLen
+	return nil
+}
+
+// buildResponseReplaceRules компилирует правила замены конфига, не трогая appCtx.
 // - Триггер (ключ) тримится; find и replace НЕ тримятся (пробелы могут быть значимы).
 // - Для find используется regexp.Compile (ошибка возвращается при некорректной regex).
 // - Пустой repl означает удаление совпадений.
-func initResponseReplaceRules() error {
-	// reset storage
-	appCtx.responseReplaceRules = nil
-	appCtx.responseReplaceMaxTriggerLen = 0
-
-	if len(appCtx.Config.ResponseReplacer) == 0 {
-		return nil
+func buildResponseReplaceRules(config Config) (records []ResponseReplaceRecord, maxTriggerLen int, err error) {
+	if len(config.ResponseReplacer) == 0 {
+		return nil, 0, nil
 	}
 
-	records := make([]ResponseReplaceRecord, 0, len(appCtx.Config.ResponseReplacer))
+	records = make([]ResponseReplaceRecord, 0, len(config.ResponseReplacer))
 
-	for rawTrig, m := range appCtx.Config.ResponseReplacer {
+	for rawTrig, m := range config.ResponseReplacer {
 		trig := strings.TrimSpace(rawTrig)
 		if trig == "" {
-			return fmt.Errorf("ResponseReplacer contains empty trigger key")
+			return nil, 0, fmt.Errorf("ResponseReplacer contains empty trigger key")
 		}
 		if len(m) == 0 {
 			// нет правил для триггера — пропускаем (можно логировать)
@@ -205,18 +262,18 @@ func initResponseReplaceRules() error {
 		for find, repl := range m {
 			// НЕ тримим find и repl — пробелы в regex/replace могут быть значимы
 			if strings.TrimSpace(find) == "" {
-				return fmt.Errorf("ResponseReplacer[%s] contains empty find regex", trig)
+				return nil, 0, fmt.Errorf("ResponseReplacer[%s] contains empty find regex", trig)
 			}
 
 			findReg, err := regexp.Compile(find)
 			if err != nil {
-				return fmt.Errorf("ResponseReplacer[%s] invalid find regex '%s': %v", trig, find, err)
+				return nil, 0, fmt.Errorf("ResponseReplacer[%s] invalid find regex '%s': %v", trig, find, err)
 			}
 
 			// repl может быть пустой — это означает удаление
 			if repl != "" {
 				if err := validateReplaceGroups(findReg.NumSubexp(), repl); err != nil {
-					return fmt.Errorf("ResponseReplacer[%s] invalid replace '%s': %v", trig, repl, err)
+					return nil, 0, fmt.Errorf("ResponseReplacer[%s] invalid replace '%s': %v", trig, repl, err)
 				}
 			}
 
@@ -232,21 +289,131 @@ func initResponseReplaceRules() error {
 
 		records = append(records, ResponseReplaceRecord{
 			Trigger: trig,
+			Close:   config.ResponseReplacerClose[rawTrig],
 			Rules:   rules,
 		})
 
 		// считаем длину триггера в рунах (не в байтах)
-		if l := utf8.RuneCountInString(trig); l > appCtx.responseReplaceMaxTriggerLen {
-			appCtx.responseReplaceMaxTriggerLen = l
+		if l := utf8.RuneCountInString(trig); l > maxTriggerLen {
+			maxTriggerLen = l
+		}
+	}
+	maxTriggerLen *= config.MaxTriggerLengthMultiplier
+	maxTriggerLen += config.MaxTriggerLengthAdditional
+	return records, maxTriggerLen, nil
+}
+
+// currentReplaceRules returns the response replace rules and the trigger window length in use
+// (a config reload rebuilds them)
+func currentReplaceRules() ([]ResponseReplaceRecord, int) {
+	appCtx.configMu.RLock()
+	defer appCtx.configMu.RUnlock()
+	return appCtx.responseReplaceRules, appCtx.responseReplaceMaxTriggerLen
+}
+
+// validateWeights checks a rerank weights list: minWeightsCount..len(featureNames) non-negative values
+func validateWeights(weights []float64) error {
+	if len(weights) < minWeightsCount || len(weights) > len(featureNames) {
+		return fmt.Errorf("must have from %d to %d elements, got %d", minWeightsCount, len(featureNames), len(weights))
+	}
+	for i, w := range weights {
+		if w < 0.0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return fmt.Errorf("element [%d] is invalid: %f", i, w)
 		}
 	}
-	appCtx.responseReplaceMaxTriggerLen *= appCtx.Config.MaxTriggerLengthMultiplier
-	appCtx.responseReplaceMaxTriggerLen += appCtx.Config.MaxTriggerLengthAdditional
-	appCtx.responseReplaceRules = records
 	return nil
 }
 
-// validateConfig checks the configuration for correctness
+// underPath reports whether p is prefix or lies below it on a path segment boundary, as matched
+// by rewritePath
+func underPath(p, prefix string) bool {
+	rest, ok := strings.CutPrefix(p, prefix)
+	return ok && (rest == "" || strings.HasPrefix(rest, "/") || strings.HasSuffix(prefix, "/"))
+}
+
+// pathConflicts cross-checks the path based settings and returns one message per conflict:
+// PathRewrite rules overlapping the admin endpoints or each other, the embedding and
+// cross-encoder endpoints sharing a path, and OllamaBase pointing back at Listen.
+func pathConflicts(config Config) []string {
+	var conflicts []string
+
+	froms := slices.Sorted(maps.Keys(config.PathRewrite))
+	for _, h := range adminHandlers(config) {
+		for _, from := range froms {
+			if underPath(h.path, from) || underPath(from, h.path) {
+				conflicts = append(conflicts, fmt.Sprintf("`PathRewrite` rule %q overlaps the admin endpoint %s, which is served by ragproxy", from, h.path))
+			}
+		}
+	}
+	for i, from := range froms {
+		for _, other := range froms[i+1:] {
+			if strings.TrimSuffix(from, "/") == strings.TrimSuffix(other, "/") {
+				conflicts = append(conflicts, fmt.Sprintf("`PathRewrite` rules %q and %q match the same paths", from, other))
+			}
+		}
+	}
+
+	if config.CrossEncoderModel != "" && strings.TrimSuffix(config.CrossEncoderEndpoint, "/") == strings.TrimSuffix(config.EmbeddingsEndpoint, "/") {
+		conflicts = append(conflicts, fmt.Sprintf("`CrossEncoderEndpoint` and `EmbeddingsEndpoint` are the same path: %s", config.EmbeddingsEndpoint))
+	}
+
+	// Requests to OllamaBase (and the other backends) must not come back to ragproxy
+	for _, ollamaBase := range ollamaBackendBases(config) {
+		base, err := url.Parse(ollamaBase)
+		if err != nil {
+			continue
+		}
+		listenHost, listenPort, _ := net.SplitHostPort(config.Listen)
+		basePort := base.Port()
+		if basePort == "" {
+			basePort = map[string]string{"http": "80", "https": "443"}[base.Scheme]
+		}
+		baseHost := base.Hostname()
+		loopback := baseHost == "localhost" || net.ParseIP(baseHost).IsLoopback()
+		anyHost := listenHost == "" || net.ParseIP(listenHost).IsUnspecified()
+		if basePort == listenPort && (baseHost == listenHost || (loopback && (anyHost || net.ParseIP(listenHost).IsLoopback()))) {
+			conflicts = append(conflicts, fmt.Sprintf("Ollama backend %s points at ragproxy itself (`Listen` %s)", ollamaBase, config.Listen))
+		}
+	}
+
+	return conflicts
+}
+
+// initConfigState builds the state derived from appCtx.Config that the request path reads: compiled
+// file and attachment patterns, packet regexps, the must-include extractor, stopword lookups (needs the
+// tokenizer) and response replace rules. Call once after validateConfig accepted the config.
+func initConfigState() error {
+	var err error
+	if err = compileFilePatterns(&appCtx.Config); err != nil {
+		return err
+	}
+	if err = compileAttachmentPatterns(&appCtx.Config); err != nil {
+		return err
+	}
+	if appCtx.ssePrefixReg, err = regexp.Compile(appCtx.Config.SSEPrefixReg); err != nil {
+		return err
+	}
+	if appCtx.streamingPacketFlagReg, err = regexp.Compile(appCtx.Config.StreamingPacketFlagReg); err != nil {
+		return err
+	}
+	if appCtx.streamingPacketStopReg, err = regexp.Compile(appCtx.Config.StreamingPacketStopReg); err != nil {
+		return err
+	}
+	if appCtx.directPacketFlagReg, err = regexp.Compile(appCtx.Config.DirectPacketFlagReg); err != nil {
+		return err
+	}
+	appCtx.mustIncludeExtractReg = nil
+	if appCtx.Config.MustIncludeEnabled && appCtx.Config.MustIncludeExtractReg != "" {
+		if appCtx.mustIncludeExtractReg, err = regexp.Compile(appCtx.Config.MustIncludeExtractReg); err != nil {
+			return err
+		}
+	}
+	buildStopWords(appCtx.Config.StopWords)
+	return initResponseReplaceRules()
+}
+
+// validateConfig checks the configuration for correctness. It has no side effects besides
+// warnings, so it can check a config that is not (yet) the running one.
 func validateConfig(config Config) error {
 	// Listen: IP:port or :port
 
@@ -258,6 +425,13 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`Listen` address regex compilation failed: %v", err)
 	}
 
+	// RequireRagproxyUser: boolean (no validation needed, unset means true)
+
+	// RagproxyUser: empty (ragproxy) or a user name
+	if config.RagproxyUser != "" && !regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`).MatchString(config.RagproxyUser) {
+		return fmt.Errorf("`RagproxyUser` is invalid: %s", config.RagproxyUser)
+	}
+
 	// IDFFile: path to IDF DB file (non-empty)
 	if strings.TrimSpace(config.IDFFile) == "" {
 		return fmt.Errorf("`IDFFile` path is invalid: %s", config.IDFFile)
@@ -266,34 +440,94 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`IDFFile` path is invalid or inaccessible: %v", err)
 	}
 
-	// TokenizerHFModelName: only letters, digits, _, -, :, /
+	// IDFCheckInterval: 0 (disabled) or positive duration
+	if config.IDFCheckInterval.Duration < 0 {
+		return fmt.Errorf("`IDFCheckInterval` is invalid: %s", config.IDFCheckInterval.Duration)
+	}
+
+	// IDFDriftThreshold: relative drift between 0 and 1
+	if config.IDFDriftThreshold < 0 || config.IDFDriftThreshold > 1 {
+		return fmt.Errorf("`IDFDriftThreshold` must be between 0 and 1: %f", config.IDFDriftThreshold)
+	}
+
+	// IDFDriftCorrect: boolean (no validation needed)
+
+	// TokenReservePercent: 0-100
+	if config.TokenReservePercent < 0 || config.TokenReservePercent > 100 {
+		return fmt.Errorf("`TokenReservePercent` must be between 0 and 100: %d", config.TokenReservePercent)
+	}
+
+	// TokenizerBackend: "hf" or "tiktoken" (empty means "hf")
+	if config.TokenizerBackend != "" && !slices.Contains([]string{tokenizerBackendHF, tokenizerBackendTiktoken}, config.TokenizerBackend) {
+		return fmt.Errorf("`TokenizerBackend` is invalid: %s", config.TokenizerBackend)
+	}
+
+	// TokenizerTiktokenEncoding: empty (cl100k_base) or a tiktoken encoding name
+	if config.TokenizerTiktokenEncoding != "" && !slices.Contains([]string{tiktoken.MODEL_O200K_BASE, tiktoken.MODEL_CL100K_BASE,
+		tiktoken.MODEL_P50K_BASE, tiktoken.MODEL_P50K_EDIT, tiktoken.MODEL_R50K_BASE}, config.TokenizerTiktokenEncoding) {
+		return fmt.Errorf("`TokenizerTiktokenEncoding` is invalid: %s", config.TokenizerTiktokenEncoding)
+	}
+
+	// TokenizerHFModelName: only letters, digits, _, -, :, / (hf backend only)
 	if re, err := regexp.Compile(`^[a-zA-Z0-9_\-:/]+$`); err == nil {
-		if !re.MatchString(config.TokenizerHFModelName) {
+		if config.TokenizerBackend != tokenizerBackendTiktoken && !re.MatchString(config.TokenizerHFModelName) {
 			return fmt.Errorf("`TokenizerHFModelName` is invalid: %s", config.TokenizerHFModelName)
 		}
 	} else {
 		return fmt.Errorf("`TokenizerHFModelName` regex compilation failed: %v", err)
 	}
 
-	// TokenizerPretrainedCacheDir: path to cache directory (non-empty)
-	if strings.TrimSpace(config.TokenizerPretrainedCacheDir) == "" {
-		return fmt.Errorf("`TokenizerPretrainedCacheDir` path is invalid: %s", config.TokenizerPretrainedCacheDir)
-	}
-	if fi, err := os.Stat(config.TokenizerPretrainedCacheDir); err != nil {
-		return fmt.Errorf("`TokenizerPretrainedCacheDir` does not exist: %v", err)
-	} else if !fi.IsDir() {
-		return fmt.Errorf("`TokenizerPretrainedCacheDir` is not a directory: %s", config.TokenizerPretrainedCacheDir)
+	// TokenizerPretrainedCacheDir: existing cache directory (hf backend only; optional for tiktoken)
+	if config.TokenizerBackend != tokenizerBackendTiktoken {
+		if strings.TrimSpace(config.TokenizerPretrainedCacheDir) == "" {
+			return fmt.Errorf("`TokenizerPretrainedCacheDir` path is invalid: %s", config.TokenizerPretrainedCacheDir)
+		}
+		if fi, err := os.Stat(config.TokenizerPretrainedCacheDir); err != nil {
+			return fmt.Errorf("`TokenizerPretrainedCacheDir` does not exist: %v", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("`TokenizerPretrainedCacheDir` is not a directory: %s", config.TokenizerPretrainedCacheDir)
+		}
 	}
 
 	// TokenizerHFAPI Key: can be empty, no further validation needed
 
 	var err error
+	// RequestMaxDuration: 0 (disabled) or positive duration
+	if config.RequestMaxDuration.Duration < 0 {
+		return fmt.Errorf("`RequestMaxDuration` must not be negative: %v", config.RequestMaxDuration)
+	}
+
+	// MaxConcurrentRequests: 0 (unlimited) or positive integer
+	if config.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("`MaxConcurrentRequests` is invalid: %d", config.MaxConcurrentRequests)
+	}
+
+	// ConcurrencyQueueTimeout: 0 (no waiting) or positive duration
+	if config.ConcurrencyQueueTimeout.Duration < 0 {
+		return fmt.Errorf("`ConcurrencyQueueTimeout` must not be negative: %v", config.ConcurrencyQueueTimeout)
+	}
+
+	// PanicPassthrough: no validation needed
+
+	// ExposeAugmentationErrors: no validation needed
+
+	// RAGStatusHeader: no validation needed
+
+	// RequestContentPaths: optional list of non-empty gjson paths
+	for i, p := range config.RequestContentPaths {
+		if strings.TrimSpace(p) == "" {
+			return fmt.Errorf("`RequestContentPaths[%d]` is empty", i)
+		}
+	}
+
 	// UserMessageTags and UserMessageAttachmentTags: comma-separated list of tags (only letters)
 	err = validateEnumList(config.UserMessageTags, appConsts.AvailableMessageTags)
 	if err != nil {
 		return fmt.Errorf("`UserMessageTags` is invalid: %v", err)
 	}
 
+	// EmbedFullUserMessage: boolean (no validation needed)
+
 	// UserMessageAskAttachmentTags: comma-separated list of tags (only letters)
 	err = validateEnumList(config.UserMessageAskAttachmentTags, appConsts.AvailableMessageAskAttachmentTags)
 	if err != nil {
@@ -306,20 +540,58 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`UserMessageAgentAttachmentTags` is invalid: %v", err)
 	}
 
-	// Temperature: 0.0 - 1.0
+	// AttachmentScanDepth: 0 or 1 (last user message only) or more
+	if config.AttachmentScanDepth < 0 {
+		return fmt.Errorf("`AttachmentScanDepth` is invalid: %d", config.AttachmentScanDepth)
+	}
+
+	// OverrideTemperature: boolean (no validation needed)
+
+	// Temperature: 0.0 - 1.0, validated even when not applied
 	if config.Temperature < 0.0 || config.Temperature > 1.0 {
 		return fmt.Errorf("`Temperature` is invalid: %f", config.Temperature)
 	}
 
-	// OllamaBase: http(s)://host:port
-	if re, err := regexp.Compile(`^https?://[\w\.\-]+(:\d+)?$`); err == nil {
+	// OllamaBase: http(s)://host:port with an optional base path
+	if re, err := regexp.Compile(`^https?://[\w\.\-]+(:\d+)?(/[\w\.\-~%/]*)?$`); err == nil {
 		if !re.MatchString(config.OllamaBase) {
 			return fmt.Errorf("`OllamaBase` is invalid: %s", config.OllamaBase)
 		}
+		// OllamaBackends: additional backends of the same form, distinct from OllamaBase and each other
+		seen := map[string]bool{config.OllamaBase: true}
+		for _, base := range config.OllamaBackends {
+			if !re.MatchString(base) {
+				return fmt.Errorf("`OllamaBackends` entry is invalid: %s", base)
+			}
+			if seen[base] {
+				return fmt.Errorf("`OllamaBackends` entry is duplicated: %s", base)
+			}
+			seen[base] = true
+		}
 	} else {
 		return fmt.Errorf("`OllamaBase` regex compilation failed: %v", err)
 	}
 
+	// OllamaBalancing: round-robin (default when empty) | least-loaded
+	if !slices.Contains([]string{"", balancingRoundRobin, balancingLeastLoaded}, config.OllamaBalancing) {
+		return fmt.Errorf("`OllamaBalancing` is invalid: %s", config.OllamaBalancing)
+	}
+
+	// OllamaBackendCooldown: non-negative duration (0 disables skipping failed backends)
+	if config.OllamaBackendCooldown.Duration < 0 {
+		return fmt.Errorf("`OllamaBackendCooldown` is invalid: %v", config.OllamaBackendCooldown)
+	}
+
+	// PathRewrite: inbound path prefix -> Ollama path prefix, both absolute paths
+	for from, to := range config.PathRewrite {
+		if !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+			return fmt.Errorf("`PathRewrite` rule is invalid: %q -> %q", from, to)
+		}
+		if strings.ContainsAny(from+to, "?# ") {
+			return fmt.Errorf("`PathRewrite` rule must contain paths only: %q -> %q", from, to)
+		}
+	}
+
 	// OllamaKeepAlive: duration in format like 30s, 5m, 2h, 1d
 	if re, err := regexp.Compile(`^\d+[smhd]$`); err == nil {
 		if !re.MatchString(config.OllamaKeepAlive) {
@@ -329,6 +601,17 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`OllamaKeepAlive` regex compilation failed: %v", err)
 	}
 
+	// EmbeddingKeepAlive: optional, same format as OllamaKeepAlive (empty = use OllamaKeepAlive)
+	if config.EmbeddingKeepAlive != "" {
+		if re, err := regexp.Compile(`^\d+[smhd]$`); err == nil {
+			if !re.MatchString(config.EmbeddingKeepAlive) {
+				return fmt.Errorf("`EmbeddingKeepAlive` is invalid: %s", config.EmbeddingKeepAlive)
+			}
+		} else {
+			return fmt.Errorf("`EmbeddingKeepAlive` regex compilation failed: %v", err)
+		}
+	}
+
 	// OllamaUnloadOnLoVRAM: boolean, no further validation needed
 
 	// EmbeddingModel: only letters, digits, _, -, :, /
@@ -345,11 +628,45 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`EmbeddingsEndpoint` must start with '/': %s", config.EmbeddingsEndpoint)
 	}
 
+	// EmbeddingsAPIVersion: legacy (default when empty), new or auto
+	if config.EmbeddingsAPIVersion != "" && !slices.Contains([]string{"legacy", "new", "auto"}, config.EmbeddingsAPIVersion) {
+		return fmt.Errorf("`EmbeddingsAPIVersion` is invalid: %s", config.EmbeddingsAPIVersion)
+	}
+
 	// EmbeddingsModeWindowSize: positive integer
 	if config.EmbeddingsModeWindowSize <= 0 {
 		return fmt.Errorf("`EmbeddingsModeWindowSize` is invalid: %d", config.EmbeddingsModeWindowSize)
 	}
 
+	// EmbeddingMaxTokens: 0 (disabled) or positive integer
+	if config.EmbeddingMaxTokens < 0 {
+		return fmt.Errorf("`EmbeddingMaxTokens` is invalid: %d", config.EmbeddingMaxTokens)
+	}
+
+	// EmbeddingSingleFlight: boolean, no further validation needed
+
+	// NormalizeEmbeddings: boolean (no validation needed)
+
+	// RAGModels: valid path.Match patterns, require ModelNamePath
+	for i, pattern := range config.RAGModels {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			return fmt.Errorf("`RAGModels[%d]` is invalid: %q", i, pattern)
+		}
+	}
+	if len(config.RAGModels) > 0 && strings.TrimSpace(config.ModelNamePath) == "" {
+		return fmt.Errorf("`ModelNamePath` is required when `RAGModels` is set")
+	}
+
+	// RAGDisabledModels: valid path.Match patterns, require ModelNamePath
+	for i, pattern := range config.RAGDisabledModels {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			return fmt.Errorf("`RAGDisabledModels[%d]` is invalid: %q", i, pattern)
+		}
+	}
+	if len(config.RAGDisabledModels) > 0 && strings.TrimSpace(config.ModelNamePath) == "" {
+		return fmt.Errorf("`ModelNamePath` is required when `RAGDisabledModels` is set")
+	}
+
 	// MainModel: only letters, digits, _, -, :, /
 	if re, err := regexp.Compile(`^[a-zA-Z0-9:._-]+$`); err == nil {
 		if !re.MatchString(config.MainModel) {
@@ -364,6 +681,21 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`MainModelWindowSize` is invalid: %d", config.MainModelWindowSize)
 	}
 
+	// StorageBackend: "qdrant" (default) or "in-memory"
+	if !slices.Contains([]string{"", "qdrant", storageInMemory}, config.StorageBackend) {
+		return fmt.Errorf("`StorageBackend` is invalid: %s", config.StorageBackend)
+	}
+
+	// MemoryStoreFile: optional snapshot path, in-memory backend only
+	if config.MemoryStoreFile != "" {
+		if config.StorageBackend != storageInMemory {
+			return fmt.Errorf("`MemoryStoreFile` requires `StorageBackend` = \"%s\"", storageInMemory)
+		}
+		if _, err := os.Stat(config.MemoryStoreFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("`MemoryStoreFile` path is invalid or inaccessible: %v", err)
+		}
+	}
+
 	// QdrantHost: localhost or IP or hostname
 	if re, err := regexp.Compile(`^(localhost|(\d{1,3}\.){3}\d{1,3}|[a-zA-Z0-9\-\.]+)$`); err == nil {
 		if !re.MatchString(config.QdrantHost) {
@@ -378,11 +710,25 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`QdrantPort` is invalid: %d", config.QdrantPort)
 	}
 
+	// QdrantAPIKey: optional, should only be sent over TLS
+	if config.QdrantAPIKey != "" && !config.QdrantUseTLS {
+		appCtx.JournaldLogger.Printf("WARNING: `QdrantAPIKey` is set but `QdrantUseTLS` is disabled, the key will be sent in plain text")
+		appCtx.ErrorLogger.Printf("WARNING: `QdrantAPIKey` is set but `QdrantUseTLS` is disabled, the key will be sent in plain text")
+	}
+
 	// QdrantKeepAlive: non-negative integer
 	if config.QdrantKeepAlive < 0 {
 		return fmt.Errorf("`QdrantKeepAlive` is invalid: %d", config.QdrantKeepAlive)
 	}
 
+	// QdrantBreakerThreshold: 0 (disabled) or positive; QdrantBreakerCooldown: positive when enabled
+	if config.QdrantBreakerThreshold < 0 {
+		return fmt.Errorf("`QdrantBreakerThreshold` is invalid: %d", config.QdrantBreakerThreshold)
+	}
+	if config.QdrantBreakerThreshold > 0 && config.QdrantBreakerCooldown.Duration <= 0 {
+		return fmt.Errorf("`QdrantBreakerCooldown` must be positive: %v", config.QdrantBreakerCooldown)
+	}
+
 	// QdrantCollection: only letters, digits, _
 	if re, err := regexp.Compile(`^[a-zA-Z0-9_]+$`); err == nil {
 		if !re.MatchString(config.QdrantCollection) {
@@ -392,6 +738,33 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`QdrantCollection` regex compilation failed: %v", err)
 	}
 
+	// KnowledgeBaseCollection: empty (disabled) or letters, digits, _; another Qdrant collection than QdrantCollection
+	if config.KnowledgeBaseCollection != "" {
+		if !regexp.MustCompile(`^[a-zA-Z0-9_]+$`).MatchString(config.KnowledgeBaseCollection) {
+			return fmt.Errorf("`KnowledgeBaseCollection` is invalid: %s", config.KnowledgeBaseCollection)
+		}
+		if config.KnowledgeBaseCollection == config.QdrantCollection {
+			return fmt.Errorf("`KnowledgeBaseCollection` must differ from `QdrantCollection`: %s", config.KnowledgeBaseCollection)
+		}
+		if config.StorageBackend == storageInMemory {
+			return fmt.Errorf("`KnowledgeBaseCollection` requires `StorageBackend` = \"qdrant\"")
+		}
+	}
+
+	// SearchCollections: collection names (letters, digits, _) with positive score multipliers. Collections
+	// other than QdrantCollection need the qdrant backend
+	for name, weight := range config.SearchCollections {
+		if !regexp.MustCompile(`^[a-zA-Z0-9_]+$`).MatchString(name) {
+			return fmt.Errorf("`SearchCollections` collection name is invalid: %s", name)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("`SearchCollections` multiplier of %s must be positive: %f", name, weight)
+		}
+		if name != config.QdrantCollection && config.StorageBackend == storageInMemory {
+			return fmt.Errorf("`SearchCollections` other than `QdrantCollection` require `StorageBackend` = \"qdrant\": %s", name)
+		}
+	}
+
 	// QdrantMetric: Cosine, Euclid, Dot
 	if config.QdrantMetric != "Cosine" && config.QdrantMetric != "Euclid" && config.QdrantMetric != "Dot" {
 		return fmt.Errorf("`QdrantMetric` is invalid: %s", config.QdrantMetric)
@@ -402,32 +775,234 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`QdrantVectorSize` must be between 1 and 32768: %d", config.QdrantVectorSize)
 	}
 
+	// DedupCosineThreshold: 0 (disabled) or (0,1], only meaningful for Cosine/Dot metrics
+	if config.DedupCosineThreshold < 0 || config.DedupCosineThreshold > 1 {
+		return fmt.Errorf("`DedupCosineThreshold` is invalid: %f", config.DedupCosineThreshold)
+	}
+	if config.DedupCosineThreshold > 0 && config.QdrantMetric == "Euclid" {
+		appCtx.JournaldLogger.Printf("WARNING: `DedupCosineThreshold` is ignored with Euclid metric")
+	}
+
 	// MaxFileSize: -1 or greater than zero
 	if config.MaxFileSize < -1 || config.MaxFileSize == 0 {
 		return fmt.Errorf("`MaxFileSize` is invalid: %d", config.MaxFileSize)
 	}
 
-	// FilePatterns compiled into FilePatterns
-	if err := compileFilePatterns(&appCtx.Config); err != nil {
+	// MaxTurnBodyBytes: -1 or 0 (no limit) or greater than zero
+	if config.MaxTurnBodyBytes < -1 {
+		return fmt.Errorf("`MaxTurnBodyBytes` is invalid: %d", config.MaxTurnBodyBytes)
+	}
+
+	// MaxRequestBytes: -1 or 0 (unlimited) or greater than zero
+	if config.MaxRequestBytes < -1 {
+		return fmt.Errorf("`MaxRequestBytes` is invalid: %d", config.MaxRequestBytes)
+	}
+
+	// MaxTurnBodyMode: truncate (default when empty) | skip
+	if !slices.Contains([]string{"", "truncate", "skip"}, config.MaxTurnBodyMode) {
+		return fmt.Errorf("`MaxTurnBodyMode` is invalid: %s", config.MaxTurnBodyMode)
+	}
+
+	// MaxAttachmentIDsPerRequest: 0 (unlimited) or positive
+	if config.MaxAttachmentIDsPerRequest < 0 {
+		return fmt.Errorf("`MaxAttachmentIDsPerRequest` is invalid: %d", config.MaxAttachmentIDsPerRequest)
+	}
+
+	// MaxAttachmentsPerRequest: 0 (unlimited) or positive
+	if config.MaxAttachmentsPerRequest < 0 {
+		return fmt.Errorf("`MaxAttachmentsPerRequest` is invalid: %d", config.MaxAttachmentsPerRequest)
+	}
+
+	// AttachmentScrollPageSize: 0 (number of looked up files) or positive
+	if config.AttachmentScrollPageSize < 0 {
+		return fmt.Errorf("`AttachmentScrollPageSize` is invalid: %d", config.AttachmentScrollPageSize)
+	}
+
+	// AttachmentChunkTokens: 0 (files are stored whole) or positive
+	if config.AttachmentChunkTokens < 0 {
+		return fmt.Errorf("`AttachmentChunkTokens` is invalid: %d", config.AttachmentChunkTokens)
+	}
+
+	// AttachmentChunkOverlap: 0 or positive, less than AttachmentChunkTokens
+	if config.AttachmentChunkOverlap < 0 || (config.AttachmentChunkTokens > 0 && config.AttachmentChunkOverlap >= config.AttachmentChunkTokens) {
+		return fmt.Errorf("`AttachmentChunkOverlap` must be between 0 and `AttachmentChunkTokens`: %d", config.AttachmentChunkOverlap)
+	}
+
+	// StoreRoles: empty (all) or subset of AvailableSearchSources
+	if len(config.StoreRoles) > 0 {
+		if err := validateEnumList(config.StoreRoles, appConsts.AvailableSearchSources); err != nil {
+			return fmt.Errorf("`StoreRoles` is invalid: %v", err)
+		}
+	}
+
+	// SummaryEmbedding: boolean; SummaryMinTokens positive, SummaryHeadTokens/SummaryTailTokens
+	// non-negative with a positive sum when enabled
+	if config.SummaryEmbedding {
+		if config.SummaryMinTokens <= 0 {
+			return fmt.Errorf("`SummaryMinTokens` is invalid: %d", config.SummaryMinTokens)
+		}
+		if config.SummaryHeadTokens < 0 || config.SummaryTailTokens < 0 || config.SummaryHeadTokens+config.SummaryTailTokens == 0 {
+			return fmt.Errorf("`SummaryHeadTokens`/`SummaryTailTokens` are invalid: %d/%d", config.SummaryHeadTokens, config.SummaryTailTokens)
+		}
+		if config.SummaryHeadTokens+config.SummaryTailTokens >= config.SummaryMinTokens {
+			return fmt.Errorf("`SummaryHeadTokens` + `SummaryTailTokens` must be less than `SummaryMinTokens`")
+		}
+	}
+
+	// AsyncStore: boolean; AsyncStoreWorkers, AsyncStoreQueueSize: positive when enabled
+	if config.AsyncStore {
+		if config.AsyncStoreWorkers <= 0 {
+			return fmt.Errorf("`AsyncStoreWorkers` is invalid: %d", config.AsyncStoreWorkers)
+		}
+		if config.AsyncStoreQueueSize <= 0 {
+			return fmt.Errorf("`AsyncStoreQueueSize` is invalid: %d", config.AsyncStoreQueueSize)
+		}
+	}
+
+	// DeadLetterDir: empty (disabled) or a directory path (created on first failed store)
+	if config.DeadLetterDir != "" {
+		if info, err := os.Stat(config.DeadLetterDir); err == nil && !info.IsDir() {
+			return fmt.Errorf("`DeadLetterDir` is not a directory: %s", config.DeadLetterDir)
+		} else if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("`DeadLetterDir` path is invalid or inaccessible: %v", err)
+		}
+	}
+
+	// TTLHeader: empty (no header) or valid header name
+	if config.TTLHeader != "" && !regexp.MustCompile(`^[A-Za-z0-9-]+$`).MatchString(config.TTLHeader) {
+		return fmt.Errorf("`TTLHeader` is invalid: %s", config.TTLHeader)
+	}
+
+	// TTLByRole: stored roles only, positive durations
+	for role, ttl := range config.TTLByRole {
+		if !slices.Contains(appConsts.AvailableSearchSources, role) {
+			return fmt.Errorf("`TTLByRole` has unknown role: %s", role)
+		}
+		if ttl.Duration <= 0 {
+			return fmt.Errorf("`TTLByRole` duration for %s must be positive: %v", role, ttl.Duration)
+		}
+	}
+
+	// TTLSweepInterval: 0 (disabled) or positive duration
+	if config.TTLSweepInterval.Duration < 0 {
+		return fmt.Errorf("`TTLSweepInterval` must not be negative: %v", config.TTLSweepInterval)
+	}
+
+	// FilePatterns: valid regexps (compiled into FilePatternsReg by initConfigState)
+	if err := compileFilePatterns(&config); err != nil {
 		return fmt.Errorf("`FilePatterns` Invalid file pattern: %v", err)
 	}
 
+	// AttachmentPathPatterns, AttachmentPathAttrPatterns, AttachmentStripPatterns: empty (defaults) or regexps
+	if err := compileAttachmentPatterns(&config); err != nil {
+		return fmt.Errorf("`AttachmentPathPatterns` Invalid attachment pattern: %v", err)
+	}
+
+	// ThreadHeader: optional request header carrying a session id (falls back to a conversation hash)
+	if config.ThreadHeader != "" && !regexp.MustCompile(`^[A-Za-z0-9-]+$`).MatchString(config.ThreadHeader) {
+		return fmt.Errorf("`ThreadHeader` is invalid: %s", config.ThreadHeader)
+	}
+
+	// ThreadNeighborWindow: 0 (disabled) or positive, requires ThreadsEnabled
+	if config.ThreadNeighborWindow < 0 {
+		return fmt.Errorf("`ThreadNeighborWindow` is invalid: %d", config.ThreadNeighborWindow)
+	}
+	if config.ThreadNeighborWindow > 0 && !config.ThreadsEnabled {
+		return fmt.Errorf("`ThreadNeighborWindow` requires `ThreadsEnabled`")
+	}
+
 	// SearchSource: comma-separated list of tags (only letters)
 	err = validateEnumList(config.SearchSource, appConsts.AvailableSearchSources)
 	if err != nil {
 		return fmt.Errorf("`SearchSource` is invalid: %v", err)
 	}
 
+	// MustInclude*: optional required-terms filter
+	if config.MustIncludeEnabled {
+		// MustIncludeHeader: empty (no header) or valid header name
+		if config.MustIncludeHeader != "" && !regexp.MustCompile(`^[A-Za-z0-9-]+$`).MatchString(config.MustIncludeHeader) {
+			return fmt.Errorf("`MustIncludeHeader` is invalid: %s", config.MustIncludeHeader)
+		}
+		// MustIncludeExtractReg: empty (no extraction) or valid regexp with a capture group
+		if config.MustIncludeExtractReg != "" {
+			reg, err := regexp.Compile(config.MustIncludeExtractReg)
+			if err != nil {
+				return fmt.Errorf("`MustIncludeExtractReg` is invalid: %v", err)
+			}
+			if reg.NumSubexp() < 1 {
+				return fmt.Errorf("`MustIncludeExtractReg` must have a capture group: %s", config.MustIncludeExtractReg)
+			}
+		}
+		if config.MustIncludeHeader == "" && config.MustIncludeExtractReg == "" {
+			return fmt.Errorf("`MustIncludeEnabled` requires `MustIncludeHeader` or `MustIncludeExtractReg`")
+		}
+		// MustIncludeMaxTerms: positive integer
+		if config.MustIncludeMaxTerms <= 0 {
+			return fmt.Errorf("`MustIncludeMaxTerms` is invalid: %d", config.MustIncludeMaxTerms)
+		}
+	}
+
+	// LangMode: off or empty (no query language use) | filter (same language or untagged only) | boost (LangBoost)
+	if !slices.Contains([]string{"", "off", "filter", "boost"}, config.LangMode) {
+		return fmt.Errorf("`LangMode` is invalid: %s", config.LangMode)
+	}
+	if (config.LangMode == "filter" || config.LangMode == "boost") && !config.LangDetectEnabled {
+		return fmt.Errorf("`LangMode` %s requires `LangDetectEnabled`", config.LangMode)
+	}
+
+	// LangBoost: non-negative, score multiplier is 1+LangBoost for same-language documents
+	if config.LangBoost < 0 {
+		return fmt.Errorf("`LangBoost` is invalid: %f", config.LangBoost)
+	}
+
+	// EditRecencyBoost: non-negative, score multiplier is up to 1+EditRecencyBoost for recently edited files (0 disabled)
+	if config.EditRecencyBoost < 0 {
+		return fmt.Errorf("`EditRecencyBoost` is invalid: %f", config.EditRecencyBoost)
+	}
+
+	// EditRecencyWindow: non-negative, required when EditRecencyBoost is set
+	if config.EditRecencyWindow.Duration < 0 || (config.EditRecencyBoost > 0 && config.EditRecencyWindow.Duration == 0) {
+		return fmt.Errorf("`EditRecencyWindow` is invalid: %s", config.EditRecencyWindow.Duration)
+	}
+
+	// StopWords: language code -> list of non-empty words
+	for lang, words := range config.StopWords {
+		if !regexp.MustCompile(`^[a-z]{2,3}$`).MatchString(lang) {
+			return fmt.Errorf("`StopWords` language is invalid: %s", lang)
+		}
+		for i, w := range words {
+			if strings.TrimSpace(w) == "" {
+				return fmt.Errorf("`StopWords` %s[%d] is empty", lang, i)
+			}
+		}
+	}
+
 	// SearchMaxAgeDays: -1 or greater than zero
 	if config.SearchMaxAgeDays < -1 || config.SearchMaxAgeDays == 0 {
 		return fmt.Errorf("`SearchMaxAgeDays` is invalid: %d", config.SearchMaxAgeDays)
 	}
 
+	// SearchMinAgeHours: 0 (disabled) or positive; must leave a non-empty window with SearchMaxAgeDays
+	if config.SearchMinAgeHours < 0 {
+		return fmt.Errorf("`SearchMinAgeHours` is invalid: %d", config.SearchMinAgeHours)
+	}
+	if config.SearchMinAgeHours > 0 && config.SearchMaxAgeDays > 0 && config.SearchMinAgeHours >= config.SearchMaxAgeDays*24 {
+		return fmt.Errorf("`SearchMinAgeHours` (%d) must be less than `SearchMaxAgeDays` (%d days = %d hours)", config.SearchMinAgeHours, config.SearchMaxAgeDays, config.SearchMaxAgeDays*24)
+	}
+
 	// SearchTopK: -1 or greater than zero
 	if config.SearchTopK < -1 || config.SearchTopK == 0 {
 		return fmt.Errorf("`SearchTopK` is invalid: %d", config.SearchTopK)
 	}
 
+	// SearchHardLimit: 0 (default 10000) or greater than zero, caps SearchTopK
+	if config.SearchHardLimit < 0 {
+		return fmt.Errorf("`SearchHardLimit` is invalid: %d", config.SearchHardLimit)
+	}
+	if limit := searchLimit(config.SearchTopK, config.SearchHardLimit); config.SearchTopK > int64(limit) {
+		appCtx.JournaldLogger.Printf("WARNING: `SearchTopK` (%d) is clipped to `SearchHardLimit` (%d)", config.SearchTopK, limit)
+	}
+
 	// CosineMinScore: 0.0 - 1.0
 	if config.CosineMinScore < 0.0 || config.CosineMinScore > 1.0 {
 		return fmt.Errorf("`CosineMinScore` is invalid: %f", config.CosineMinScore)
@@ -446,16 +1021,56 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`RerankTopN` (%d) cannot be greater than `SearchTopK` (%d)", config.RerankTopN, config.SearchTopK)
 	}
 
+	// FeedDedupCosine: 0 (disabled) or (0,1]
+	if config.FeedDedupCosine < 0 || config.FeedDedupCosine > 1 {
+		return fmt.Errorf("`FeedDedupCosine` is invalid: %f", config.FeedDedupCosine)
+	}
+
+	// FeedDedupSimilarity: 0 (disabled) or (0,1]
+	if config.FeedDedupSimilarity < 0 || config.FeedDedupSimilarity > 1 {
+		return fmt.Errorf("`FeedDedupSimilarity` is invalid: %f", config.FeedDedupSimilarity)
+	}
+
+	// FeedDedupPrefixChars: 0 (whole text) or positive
+	if config.FeedDedupPrefixChars < 0 {
+		return fmt.Errorf("`FeedDedupPrefixChars` is invalid: %d", config.FeedDedupPrefixChars)
+	}
+
 	// MinRankScore: 0.0 - 1.0
 	if config.MinRankScore < 0.0 || config.MinRankScore > 1.0 {
 		return fmt.Errorf("`MinRankScore` is invalid: %f", config.MinRankScore)
 	}
 
+	// MinRankScoreMode: strict (default when empty) or fallback-topn
+	if config.MinRankScoreMode != "" && !slices.Contains([]string{"strict", "fallback-topn"}, config.MinRankScoreMode) {
+		return fmt.Errorf("`MinRankScoreMode` is invalid: %s", config.MinRankScoreMode)
+	}
+
+	// RankScoreNormalization: none (default when empty), weights, minmax or sigmoid
+	if config.RankScoreNormalization != "" && !slices.Contains([]string{"none", "weights", "minmax", "sigmoid"}, config.RankScoreNormalization) {
+		return fmt.Errorf("`RankScoreNormalization` is invalid: %s", config.RankScoreNormalization)
+	}
+
+	// RankSigmoidMidpoint: 0.0 - 1.0, RankSigmoidSlope: positive (sigmoid only)
+	if config.RankScoreNormalization == "sigmoid" {
+		if config.RankSigmoidMidpoint < 0.0 || config.RankSigmoidMidpoint > 1.0 {
+			return fmt.Errorf("`RankSigmoidMidpoint` is invalid: %f", config.RankSigmoidMidpoint)
+		}
+		if config.RankSigmoidSlope <= 0.0 {
+			return fmt.Errorf("`RankSigmoidSlope` is invalid: %f", config.RankSigmoidSlope)
+		}
+	}
+
 	// MaxQueryTokens: positive integer
 	if config.MaxQueryTokens <= 0 {
 		return fmt.Errorf("`MaxQueryTokens` is invalid: %d", config.MaxQueryTokens)
 	}
 
+	// QueryTokenStrategy: truncate-tail (default when empty), truncate-head or top-idf
+	if !slices.Contains([]string{"", queryTokensTruncateTail, queryTokensTruncateHead, queryTokensTopIDF}, config.QueryTokenStrategy) {
+		return fmt.Errorf("`QueryTokenStrategy` is invalid: %s", config.QueryTokenStrategy)
+	}
+
 	// TokensCacheTTL: not empty duration
 	if config.TokensCacheTTL.Duration <= 0 {
 		return fmt.Errorf("`TokensCacheTTL` must be positive: %v", config.TokensCacheTTL)
@@ -466,11 +1081,26 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`TokensCacheSize` is invalid: %d", config.TokensCacheSize)
 	}
 
+	// HashAlgo: sha512 (default when empty), sha256, blake3 or xxhash
+	if config.HashAlgo != "" && !slices.Contains([]string{hashAlgoSHA512, hashAlgoSHA256, hashAlgoBLAKE3, hashAlgoXXHash}, config.HashAlgo) {
+		return fmt.Errorf("`HashAlgo` is invalid: %s", config.HashAlgo)
+	}
+
 	// TauDays: positive float
 	if config.TauDays <= 0.0 {
 		return fmt.Errorf("`TauDays` is invalid: %f", config.TauDays)
 	}
 
+	// TauDaysByRole: stored roles only, positive floats (missing roles use TauDays)
+	for role, tau := range config.TauDaysByRole {
+		if !slices.Contains(appConsts.AvailableSearchSources, role) {
+			return fmt.Errorf("`TauDaysByRole` has unknown role: %s", role)
+		}
+		if tau <= 0.0 {
+			return fmt.Errorf("`TauDaysByRole` value for %s is invalid: %f", role, tau)
+		}
+	}
+
 	// MaxTokensNormalization: positive integer
 	if config.MaxTokensNormalization <= 0 {
 		return fmt.Errorf("`MaxTokensNormalization` is invalid: %d", config.MaxTokensNormalization)
@@ -481,49 +1111,85 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`MinTokensNormalization` is invalid: %d", config.MinTokensNormalization)
 	}
 
-	// DefaultWeights: non-empty list of 9 non-negative floats
-	if len(config.DefaultWeights) != 9 {
-		return fmt.Errorf("`DefaultWeights` must have exactly 9 elements, got %d", len(config.DefaultWeights))
+	// DefaultWeights: list of 9..len(featureNames) non-negative floats (omitted trailing weights are 0)
+	if err := validateWeights(config.DefaultWeights); err != nil {
+		return fmt.Errorf("`DefaultWeights` %v", err)
 	}
-	for i, w := range config.DefaultWeights {
-		if w < 0.0 {
-			return fmt.Errorf("`DefaultWeights[%d]` is invalid: %f", i, w)
+
+	// CrossEncoderModel: empty disables the cross-encoder, otherwise only letters, digits, :, ., _, -
+	if config.CrossEncoderModel != "" {
+		if re, err := regexp.Compile(`^[a-zA-Z0-9:._-]+$`); err == nil {
+			if !re.MatchString(config.CrossEncoderModel) {
+				return fmt.Errorf("`CrossEncoderModel` is invalid: %s", config.CrossEncoderModel)
+			}
+		} else {
+			return fmt.Errorf("`CrossEncoderModel` regex compilation failed: %v", err)
 		}
+
+		// CrossEncoderEndpoint: starts with /
+		if !strings.HasPrefix(config.CrossEncoderEndpoint, "/") {
+			return fmt.Errorf("`CrossEncoderEndpoint` must start with '/': %s", config.CrossEncoderEndpoint)
+		}
+
+		// CrossEncoderTopM: positive integer
+		if config.CrossEncoderTopM <= 0 {
+			return fmt.Errorf("`CrossEncoderTopM` is invalid: %d", config.CrossEncoderTopM)
+		}
+
+		// CrossEncoderWorkers: positive integer
+		if config.CrossEncoderWorkers <= 0 {
+			return fmt.Errorf("`CrossEncoderWorkers` is invalid: %d", config.CrossEncoderWorkers)
+		}
+	}
+
+	// FeedbackScale: non-negative, feedback count giving FeedbackScore ~0.76 (0 disables the feature)
+	if config.FeedbackScale < 0 {
+		return fmt.Errorf("`FeedbackScale` is invalid: %f", config.FeedbackScale)
 	}
 
 	// ReturnVectors: boolean (no validation needed)
 
-	// BM25K1: 1.2–1.8
-	// if config.BM25K1 < 1.2 || config.BM25K1 > 1.8 {
-	// 	return fmt.Errorf("`BM25K1` is invalid: %f", config.BM25K1)
-	// }
+	// FetchRerankVectors: boolean (no validation needed), redundant with ReturnVectors
+	if config.FetchRerankVectors && config.ReturnVectors {
+		appCtx.JournaldLogger.Printf("WARNING: `FetchRerankVectors` is ignored because `ReturnVectors` is enabled")
+	}
+
+	// BM25K1: (0, 3], usually 1.2–2.0
+	if config.BM25K1 <= 0.0 || config.BM25K1 > 3.0 {
+		return fmt.Errorf("`BM25K1` is invalid: %f", config.BM25K1)
+	}
+
+	// BM25B: 0.0 - 1.0
+	if config.BM25B < 0.0 || config.BM25B > 1.0 {
+		return fmt.Errorf("`BM25B` is invalid: %f", config.BM25B)
+	}
 
-	// BM25B: 0.5–0.75
-	// if config.BM25B < 0.5 || config.BM25B > 0.75 {
-	// 	return fmt.Errorf("`BM25B` is invalid: %f", config.BM25B)
-	// }
+	// BM25NormMode: "" (BM25UseLogNorm decides), logistic, log or exp
+	if config.BM25NormMode != "" && !slices.Contains([]string{bm25NormLogistic, bm25NormLog, bm25NormExp}, config.BM25NormMode) {
+		return fmt.Errorf("`BM25NormMode` is invalid: %s", config.BM25NormMode)
+	}
 
-	// BM25NormMidpoint: 0.0 - 1.0
-	// if config.BM25NormMidpoint < 0.0 {
-	// 	return fmt.Errorf("`BM25NormMidpoint` is invalid: %f", config.BM25NormMidpoint)
-	// }
+	// BM25NormMidpoint: non-negative raw score only if the logistic normalization is used
+	if bm25NormModeOf(config) == bm25NormLogistic && config.BM25NormMidpoint < 0.0 {
+		return fmt.Errorf("`BM25NormMidpoint` is invalid: %f", config.BM25NormMidpoint)
+	}
 
-	// BM25NormSlope: 0.0 - 1.0
-	// if config.BM25NormSlope < 0.0 || config.BM25NormSlope > 1.0 {
-	// 	return fmt.Errorf("`BM25NormSlope` is invalid: %f", config.BM25NormSlope)
-	// }
+	// BM25NormSlope: positive (0 maps every score to 0.5) only if the logistic normalization is used
+	if bm25NormModeOf(config) == bm25NormLogistic && config.BM25NormSlope <= 0.0 {
+		return fmt.Errorf("`BM25NormSlope` is invalid: %f", config.BM25NormSlope)
+	}
 
 	// BM25UseLogNorm: boolean (no validation needed)
 
-	// BM25LogNormScale: 0.0 - 1.0 only if BM25UseLogNorm is true
-	// if config.BM25UseLogNorm {
-	// 	if config.BM25LogNormScale < 0.0 || config.BM25LogNormScale > 1.0 {
-	// 		return fmt.Errorf("`BM25LogNormScale` is invalid: %f", config.BM25LogNormScale)
-	// 	}
-	// }
+	// BM25LogNormScale: positive raw score only if the log normalization is used
+	if bm25NormModeOf(config) == bm25NormLog && config.BM25LogNormScale <= 0.0 {
+		return fmt.Errorf("`BM25LogNormScale` is invalid: %f", config.BM25LogNormScale)
+	}
 
 	// UseBM25IDF: boolean (no validation needed)
 
+	// PerRoleIDF: boolean (no validation needed)
+
 	// RoleWeights: map of string to non-negative float
 	for role, weight := range config.RoleWeights {
 		if strings.TrimSpace(role) == "" {
@@ -547,8 +1213,70 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`FeedAugmentationPercent` is invalid: %d", config.FeedAugmentationPercent)
 	}
 
+	// OnWindowOverflow: proxy-unmodified (default when empty) | truncate-history | reject
+	if !slices.Contains([]string{"", "proxy-unmodified", "truncate-history", "reject"}, config.OnWindowOverflow) {
+		return fmt.Errorf("`OnWindowOverflow` is invalid: %s", config.OnWindowOverflow)
+	}
+
+	// FileFeedPercent: 0 (shared budget) or 1-99, share of the feed budget reserved for files
+	if config.FileFeedPercent < 0 || config.FileFeedPercent > 99 {
+		return fmt.Errorf("`FileFeedPercent` is invalid: %d", config.FileFeedPercent)
+	}
+
+	// FeedOrder: relevance-asc (default when empty), relevance-desc, recency or files-last
+	if config.FeedOrder != "" && !slices.Contains([]string{"relevance-asc", "relevance-desc", "recency", "files-last"}, config.FeedOrder) {
+		return fmt.Errorf("`FeedOrder` is invalid: %s", config.FeedOrder)
+	}
+
+	// FeedTruncateMinTokens: non-negative, smallest remaining budget worth filling with a truncated file
+	if config.FeedTruncateMinTokens < 0 {
+		return fmt.Errorf("`FeedTruncateMinTokens` is invalid: %d", config.FeedTruncateMinTokens)
+	}
+
+	// AggressiveNormalization: boolean (no validation needed)
+
+	// LogFormat: text or empty (prefixed text lines) | json (one JSON object per line)
+	if !slices.Contains([]string{"", logFormatText, logFormatJSON}, config.LogFormat) {
+		return fmt.Errorf("`LogFormat` is invalid: %s", config.LogFormat)
+	}
+
+	// AccessLogPath, ErrorLogPath, DebugLogPath, DumpLogPath: empty (default under /var/log/ragproxy) or
+	// distinct file paths (writability is checked when the logs are opened)
+	logPaths := map[string]string{}
+	for _, lp := range []struct{ name, path string }{
+		{"AccessLogPath", cmp.Or(config.AccessLogPath, defaultAccessLogPath)},
+		{"ErrorLogPath", cmp.Or(config.ErrorLogPath, defaultErrorLogPath)},
+		{"DebugLogPath", cmp.Or(config.DebugLogPath, defaultDebugLogPath)},
+		{"DumpLogPath", cmp.Or(config.DumpLogPath, defaultDumpLogPath)},
+	} {
+		if other, ok := logPaths[path.Clean(lp.path)]; ok {
+			return fmt.Errorf("`%s` and `%s` share the same file: %s", other, lp.name, lp.path)
+		}
+		logPaths[path.Clean(lp.path)] = lp.name
+	}
+
+	// LogMaxSizeMB: 0 (no rotation) or positive; LogMaxBackups: non-negative
+	if config.LogMaxSizeMB < 0 {
+		return fmt.Errorf("`LogMaxSizeMB` is invalid: %d", config.LogMaxSizeMB)
+	}
+	if config.LogMaxBackups < 0 {
+		return fmt.Errorf("`LogMaxBackups` is invalid: %d", config.LogMaxBackups)
+	}
+
+	// AsyncLogFlushInterval: positive duration, AsyncLogBufferSize: at least 4096 bytes (async logging only)
+	if config.AsyncLogging {
+		if config.AsyncLogFlushInterval.Duration <= 0 {
+			return fmt.Errorf("`AsyncLogFlushInterval` must be positive: %v", config.AsyncLogFlushInterval)
+		}
+		if config.AsyncLogBufferSize < 4096 {
+			return fmt.Errorf("`AsyncLogBufferSize` must be at least 4096: %d", config.AsyncLogBufferSize)
+		}
+	}
+
 	// VerboseDiskLogs: boolean (no validation needed)
 
+	// DebugRerankTable: boolean (no validation needed)
+
 	// InitialIncomingBufferPreAllocation: non-negative integer
 	if config.InitialIncomingBufferPreAllocation < 0 {
 		return fmt.Errorf("`InitialIncomingBufferPreAllocation` is invalid: %d", config.InitialIncomingBufferPreAllocation)
@@ -559,6 +1287,20 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`InitialOutgoingGorutineBufferCount` is invalid: %d", config.InitialOutgoingGorutineBufferCount)
 	}
 
+	// SmallResponseMaxBytes: positive integer when SmallResponseFastPath is enabled
+	if config.SmallResponseFastPath && config.SmallResponseMaxBytes <= 0 {
+		return fmt.Errorf("`SmallResponseMaxBytes` is invalid: %d", config.SmallResponseMaxBytes)
+	}
+
+	// DedupIdenticalChunks: boolean (no validation needed)
+
+	// ResponseHeaderSanitize: boolean (no validation needed)
+
+	// SynthesizedChunkSpacing: 0 (default 25ms) or positive duration
+	if config.SynthesizedChunkSpacing.Duration < 0 {
+		return fmt.Errorf("`SynthesizedChunkSpacing` is invalid: %s", config.SynthesizedChunkSpacing.Duration)
+	}
+
 	// MessageBodyPaths: non-empty array of non-empty strings
 	if len(config.MessageBodyPaths) == 0 {
 		return fmt.Errorf("`MessageBodyPaths` is empty")
@@ -569,12 +1311,18 @@ func validateConfig(config Config) error {
 		}
 	}
 
+	// ToolCallPaths: array of non-empty strings (empty disables tool-call detection)
+	for i, path := range config.ToolCallPaths {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("`ToolCallPaths[%d]` is empty", i)
+		}
+	}
+
 	// SSEPrefixReg: non-empty valid regexp
 	if strings.TrimSpace(config.SSEPrefixReg) == "" {
 		return fmt.Errorf("`SSEPrefixReg` is empty")
 	}
-	appCtx.ssePrefixReg, err = regexp.Compile(config.SSEPrefixReg)
-	if err != nil {
+	if _, err := regexp.Compile(config.SSEPrefixReg); err != nil {
 		return fmt.Errorf("`SSEPrefixReg` is invalid: %v", err)
 	}
 
@@ -582,8 +1330,7 @@ func validateConfig(config Config) error {
 	if strings.TrimSpace(config.StreamingPacketFlagReg) == "" {
 		return fmt.Errorf("`StreamingPacketFlagReg` is empty")
 	}
-	appCtx.streamingPacketFlagReg, err = regexp.Compile(config.StreamingPacketFlagReg)
-	if err != nil {
+	if _, err := regexp.Compile(config.StreamingPacketFlagReg); err != nil {
 		return fmt.Errorf("`StreamingPacketFlagReg` is invalid: %v", err)
 	}
 
@@ -591,8 +1338,7 @@ func validateConfig(config Config) error {
 	if strings.TrimSpace(config.StreamingPacketStopReg) == "" {
 		return fmt.Errorf("`StreamingPacketStopReg` is empty")
 	}
-	appCtx.streamingPacketStopReg, err = regexp.Compile(config.StreamingPacketStopReg)
-	if err != nil {
+	if _, err := regexp.Compile(config.StreamingPacketStopReg); err != nil {
 		return fmt.Errorf("`StreamingPacketStopReg` is invalid: %v", err)
 	}
 
@@ -600,8 +1346,7 @@ func validateConfig(config Config) error {
 	if strings.TrimSpace(config.DirectPacketFlagReg) == "" {
 		return fmt.Errorf("`DirectPacketFlagReg` is empty")
 	}
-	appCtx.directPacketFlagReg, err = regexp.Compile(config.DirectPacketFlagReg)
-	if err != nil {
+	if _, err := regexp.Compile(config.DirectPacketFlagReg); err != nil {
 		return fmt.Errorf("`DirectPacketFlagReg` is invalid: %v", err)
 	}
 
@@ -616,10 +1361,48 @@ func validateConfig(config Config) error {
 	}
 
 	// ResponseReplacer: map[string]map[string]string
-	if err := initResponseReplaceRules(); err != nil {
+	if _, _, err := buildResponseReplaceRules(config); err != nil {
 		return err
 	}
 
+	// ResponseReplacerClose: ResponseReplacer trigger -> non-empty closing marker
+	for trig, marker := range config.ResponseReplacerClose {
+		if _, ok := config.ResponseReplacer[trig]; !ok {
+			return fmt.Errorf("`ResponseReplacerClose` trigger is not in `ResponseReplacer`: %s", trig)
+		}
+		if marker == "" {
+			return fmt.Errorf("`ResponseReplacerClose[%s]` is empty", trig)
+		}
+	}
+
+	// CORSAllowedOrigins: non-empty when CORS is enabled, "*" or scheme://host[:port] entries
+	if config.CORSEnabled {
+		if len(config.CORSAllowedOrigins) == 0 {
+			return fmt.Errorf("`CORSAllowedOrigins` must not be empty when `CORSEnabled` is true")
+		}
+		for _, origin := range config.CORSAllowedOrigins {
+			if origin != "*" && !regexp.MustCompile(`^https?://[\w.\-]+(:\d+)?$`).MatchString(origin) {
+				return fmt.Errorf("`CORSAllowedOrigins` entry is invalid: %s", origin)
+			}
+		}
+		// CORSAllowCredentials: browsers reject credentials with a wildcard origin
+		if config.CORSAllowCredentials && slices.Contains(config.CORSAllowedOrigins, "*") {
+			return fmt.Errorf("`CORSAllowCredentials` cannot be used with wildcard `CORSAllowedOrigins`")
+		}
+		for _, header := range config.CORSAllowedHeaders {
+			if !regexp.MustCompile(`^[A-Za-z0-9-]+$`).MatchString(header) {
+				return fmt.Errorf("`CORSAllowedHeaders` entry is invalid: %s", header)
+			}
+		}
+	}
+
+	// ConfigEndpointEnabled: requires AdminAPIKey to authenticate requests
+	if config.ConfigEndpointEnabled && strings.TrimSpace(config.AdminAPIKey) == "" {
+		return fmt.Errorf("`AdminAPIKey` must be set when `ConfigEndpointEnabled` is true")
+	}
+
+	// ConfigReloadDiff: boolean (no validation needed)
+
 	// SystemMessageFile: path to IDF DB file (non-empty)
 	if strings.TrimSpace(config.SystemMessageFile) == "" {
 		return fmt.Errorf("`SystemMessageFile` path is invalid: %s", config.SystemMessageFile)
@@ -629,10 +1412,27 @@ func validateConfig(config Config) error {
 		return fmt.Errorf("`SystemMessageFile` path is invalid or inaccessible: %v", err)
 	}
 
+	// SystemMessageMode: system-role (default when empty) | prepend-user
+	if !slices.Contains([]string{"", "system-role", "prepend-user"}, config.SystemMessageMode) {
+		return fmt.Errorf("`SystemMessageMode` is invalid: %s", config.SystemMessageMode)
+	}
+
+	// SystemMessagePatchDisabled: boolean (no validation needed)
+
 	// SystemMessagePath struct
 	if err := validateSystemMessagePatch(&config.SystemMessagePatch); err != nil {
 		return err
 	}
 
+	// PathConflictsAllowed: path conflicts are logged instead of failing validation
+	if conflicts := pathConflicts(config); len(conflicts) > 0 {
+		if !config.PathConflictsAllowed {
+			return fmt.Errorf("path settings conflict: %s", strings.Join(conflicts, "; "))
+		}
+		for _, c := range conflicts {
+			appCtx.JournaldLogger.Printf("Warning: path settings conflict: %s", c)
+		}
+	}
+
 	return nil
 }
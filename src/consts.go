@@ -7,6 +7,7 @@ const (
 	DirectPacket
 	StreamPacket
 	FinishStreamPacket
+	ToolCallPacket
 )
 
 var appConsts struct {
@@ -25,10 +26,8 @@ var appConsts struct {
 	AttachmentRightWrapper              string
 }
 
+// initConsts sets the constants that do not need the tokenizer; initTokenConsts adds the token sizes
 func initConsts() {
-
-	appConsts.MessagesWrapperSize =
-		calculateTokens(`"messages":[`) + calculateTokens(`],`)
 	appConsts.AvailableMessageTags = []string{
 		"userRequest",
 		"prompt",
@@ -55,3 +54,9 @@ func initConsts() {
 	appConsts.AttachmentLeftWrapper = "{\"content\":\""
 	appConsts.AttachmentRightWrapper = "\",\"role\":\"rag-file\"},"
 }
+
+// initTokenConsts sets the token sizes of appConsts. Call once the tokenizer is loaded.
+func initTokenConsts() {
+	appConsts.MessagesWrapperSize =
+		calculateTokens(`"messages":[`) + calculateTokens(`],`)
+}
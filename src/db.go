@@ -2,16 +2,86 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/qdrant/go-client/qdrant"
 )
 
+const bodyEncodingGzip = "gzip+base64"
+
+// errRetrievalUnavailable is returned while the Qdrant circuit breaker is open
+var errRetrievalUnavailable = errors.New("retrieval unavailable: Qdrant circuit breaker is open")
+
+// circuitBreaker short-circuits retrieval for a cooldown window after repeated Qdrant failures
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var qdrantBreaker circuitBreaker
+
+// recordRetrieval feeds the outcome of a retrieval made with ctx to qdrantBreaker. A request
+// cancelled by the client says nothing about Qdrant health; one cut off by RequestMaxDuration
+// (DeadlineExceeded) does, as a hung Qdrant must trip the breaker.
+func recordRetrieval(ctx context.Context, err error) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	qdrantBreaker.record(err)
+}
+
+// allow reports whether a retrieval attempt may be made
+func (b *circuitBreaker) allow() bool {
+	if appCtx.Config.QdrantBreakerThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.openUntil)
+}
+
+// record counts a failed attempt (opening the breaker at the threshold) or resets on success
+func (b *circuitBreaker) record(err error) {
+	threshold := appCtx.Config.QdrantBreakerThreshold
+	if threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.failures > 0 {
+			appCtx.JournaldLogger.Printf("Qdrant retrieval recovered after %d failures", b.failures)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		cooldown := appCtx.Config.QdrantBreakerCooldown.Duration
+		b.openUntil = time.Now().Add(cooldown)
+		b.failures = 0
+		appCtx.ErrorLogger.Printf("Qdrant retrieval failed %d times in a row, skipping retrieval for %s", threshold, cooldown)
+		appCtx.JournaldLogger.Printf("Qdrant retrieval failed %d times in a row, skipping retrieval for %s", threshold, cooldown)
+	}
+}
+
 // initDB initializes the Qdrant database: creates collection if not exists
 func initDB() error {
 	collectionName := appCtx.Config.QdrantCollection
@@ -29,6 +99,13 @@ func initDB() error {
 		return fmt.Errorf("unsupported metric '%s'; supported: Cosine, Euclid, Dot", appCtx.Config.QdrantMetric)
 	}
 
+	if err := checkKnowledgeBaseCollection(distance); err != nil {
+		return err
+	}
+	if err := checkSearchCollections(distance); err != nil {
+		return err
+	}
+
 	// Check if collection exists
 	exists, err := appCtx.DB.CollectionExists(context.Background(), collectionName)
 	if err != nil {
@@ -55,12 +132,16 @@ func initDB() error {
 		}
 
 		if params.Size != uint64(appCtx.Config.QdrantVectorSize) || params.Distance != distance {
-			appCtx.JournaldLogger.Printf("collection '%s' config mismatch: expected size=%d, distance=%s; got size=%d, distance=%v. Run: ragproxy --flush-db --qhost %s --qport %d --qcollection %s to !!!FLASH ALL DATA IN CURRENT COLLECTION!!! after that restart service to initialize new DB with correct metrics and vector size defined in current config, or change metric and size in config to recongnize current collection", collectionName, appCtx.Config.QdrantVectorSize, appCtx.Config.QdrantMetric, params.Size, params.Distance, appCtx.Config.QdrantHost, appCtx.Config.QdrantPort, appCtx.Config.QdrantCollection)
+			appCtx.JournaldLogger.Printf("collection '%s' config mismatch: expected size=%d, distance=%s; got size=%d, distance=%v. Run: ragproxy --flush-db --qhost %s --qport %d --qcollection %s to !!!FLASH ALL DATA IN CURRENT COLLECTION!!! after that restart service to initialize new DB with correct metrics and vector size defined in current config, or change metric and size in config to recongnize current collection. To keep the stored data, set a new QdrantCollection and run: ragproxy --config <file> --reembed --from-collection %s", collectionName, appCtx.Config.QdrantVectorSize, appCtx.Config.QdrantMetric, params.Size, params.Distance, appCtx.Config.QdrantHost, appCtx.Config.QdrantPort, appCtx.Config.QdrantCollection, collectionName)
 			os.Exit(1)
 		}
 
+		if err := checkCollectionTokenizer(collectionName, info); err != nil {
+			return err
+		}
+
 		appCtx.JournaldLogger.Printf("Using existing collection '%s' with %d-dim vectors, %s distance", collectionName, appCtx.Config.QdrantVectorSize, appCtx.Config.QdrantMetric)
-		return nil
+		return ensurePayloadIndexes(info.GetPayloadSchema())
 	}
 
 	// Create collection
@@ -70,42 +151,224 @@ func initDB() error {
 			Size:     uint64(appCtx.Config.QdrantVectorSize),
 			Distance: distance,
 		}),
+		Metadata: map[string]*qdrant.Value{tokenizerMetadataKey: qdrant.NewValueString(tokenizerIdentity(appCtx.Config))},
 	})
 	if err != nil {
 		return fmt.Errorf("error creating collection '%s': %w", collectionName, err)
 	}
 	appCtx.JournaldLogger.Printf("Created collection '%s' with %d-dim vectors, %s distance", collectionName, appCtx.Config.QdrantVectorSize, appCtx.Config.QdrantMetric)
 
-	// Create index on "hash" field for faster lookups
-	yeah_wait := true
-	var indexRes *qdrant.UpdateResult
-	indexRes, err = appCtx.DB.CreateFieldIndex(context.Background(), &qdrant.CreateFieldIndexCollection{
-		CollectionName: appCtx.Config.QdrantCollection,
-		Wait:           &yeah_wait,
-		FieldName:      "hash",
-		FieldType:      qdrant.FieldType_FieldTypeKeyword.Enum(),
-	})
+	return ensurePayloadIndexes(nil)
+}
+
+// checkCollectionTokenizer compares the tokenizer recorded in the collection metadata with the
+// configured one and warns on a mismatch: the token counts of stored points are then off. A
+// collection created before the tokenizer was recorded gets it recorded now.
+func checkCollectionTokenizer(collectionName string, info *qdrant.CollectionInfo) error {
+	identity := tokenizerIdentity(appCtx.Config)
+	switch recorded := info.GetConfig().GetMetadata()[tokenizerMetadataKey].GetStringValue(); recorded {
+	case identity:
+		return nil
+	case "":
+		err := appCtx.DB.UpdateCollection(context.Background(), &qdrant.UpdateCollection{
+			CollectionName: collectionName,
+			Metadata:       map[string]*qdrant.Value{tokenizerMetadataKey: qdrant.NewValueString(identity)},
+		})
+		if err != nil {
+			return fmt.Errorf("error recording tokenizer of collection '%s': %w", collectionName, err)
+		}
+		return nil
+	default:
+		appCtx.JournaldLogger.Printf("WARNING: token counts in collection '%s' were made with tokenizer %s, configured is %s: feed budgets of points stored before the change are approximate",
+			collectionName, recorded, identity)
+		return nil
+	}
+}
+
+// checkKnowledgeBaseCollection verifies that KnowledgeBaseCollection (if configured) exists and
+// matches the main collection's vector size and distance. It is never created or written to.
+func checkKnowledgeBaseCollection(distance qdrant.Distance) error {
+	kb := appCtx.Config.KnowledgeBaseCollection
+	if kb == "" {
+		return nil
+	}
+	exists, err := appCtx.DB.CollectionExists(context.Background(), kb)
+	if err != nil {
+		return fmt.Errorf("error checking knowledge base collection existence: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("knowledge base collection '%s' does not exist", kb)
+	}
+	info, err := appCtx.DB.GetCollectionInfo(context.Background(), kb)
 	if err != nil {
-		appCtx.ErrorLogger.Printf("Error creating index on 'hash' field: %v", err)
-		return fmt.Errorf("error creating index: %w", err)
+		return fmt.Errorf("error getting knowledge base collection info: %w", err)
+	}
+	params := info.GetConfig().GetParams().GetVectorsConfig().GetParams()
+	if params == nil {
+		return fmt.Errorf("knowledge base collection '%s' has no vector params", kb)
+	}
+	if params.Size != uint64(appCtx.Config.QdrantVectorSize) || params.Distance != distance {
+		return fmt.Errorf("knowledge base collection '%s' config mismatch: expected size=%d, distance=%s; got size=%d, distance=%v",
+			kb, appCtx.Config.QdrantVectorSize, appCtx.Config.QdrantMetric, params.Size, params.Distance)
 	}
+	appCtx.JournaldLogger.Printf("Using knowledge base collection '%s' (read-only)", kb)
+	return nil
+}
 
-	if indexRes.GetStatus() == qdrant.UpdateStatus_Completed {
-		appCtx.JournaldLogger.Printf("Index on 'hash' field created successfully")
-	} else {
-		appCtx.JournaldLogger.Printf("Index creation on 'hash' field returned status: %s", indexRes.GetStatus())
-		return fmt.Errorf("index creation failed, status: %s", indexRes.GetStatus())
+// checkStoredHashAlgo warns when a stored point has a hash of another algorithm than HashAlgo: the
+// collection was filled with it and its hashes no longer match new content
+func checkStoredHashAlgo() error {
+	return withDB(func() error {
+		limit := uint32(1)
+		points, err := appCtx.DB.Scroll(context.Background(), &qdrant.ScrollPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Filter:         &qdrant.Filter{Must: []*qdrant.Condition{notSummary()}},
+			Limit:          &limit,
+			WithPayload:    qdrant.NewWithPayloadInclude("hash"),
+			WithVectors:    qdrant.NewWithVectors(false),
+		})
+		if err != nil {
+			return fmt.Errorf("error reading a stored hash: %w", err)
+		}
+		if len(points) == 0 {
+			return nil
+		}
+		hash := points[0].GetPayload()["hash"].GetStringValue()
+		if hash == "" {
+			return nil
+		}
+		if stored, want := hashAlgoOf(hash), cmp.Or(appCtx.Config.HashAlgo, hashAlgoSHA512); stored != want {
+			msg := fmt.Sprintf("WARNING: stored hashes in collection '%s' were made with %s, `HashAlgo` is %q: "+
+				"stored files will be re-stored, duplicates are not recognized and conversation threads start anew",
+				appCtx.Config.QdrantCollection, cmp.Or(stored, "an unknown algorithm"), want)
+			appCtx.JournaldLogger.Print(msg)
+			appCtx.ErrorLogger.Print(msg)
+		}
+		return nil
+	})
+}
+
+// extraSearchCollections returns the SearchCollections searched besides QdrantCollection and
+// KnowledgeBaseCollection, sorted
+func extraSearchCollections() []string {
+	var names []string
+	for name := range appCtx.Config.SearchCollections {
+		if name != appCtx.Config.QdrantCollection && name != appCtx.Config.KnowledgeBaseCollection {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// collectionWeight returns the SearchCollections multiplier of the collection of cand, 1 when not listed
+func collectionWeight(cand Candidate) float64 {
+	name := cmp.Or(cand.Collection, appCtx.Config.QdrantCollection)
+	if w, ok := appCtx.Config.SearchCollections[name]; ok {
+		return w
+	}
+	return 1
+}
+
+// checkSearchCollections verifies the extra SearchCollections: existing ones must match the vector size
+// and distance, missing ones are created empty (they are filled by other instances or tools)
+func checkSearchCollections(distance qdrant.Distance) error {
+	for _, name := range extraSearchCollections() {
+		exists, err := appCtx.DB.CollectionExists(context.Background(), name)
+		if err != nil {
+			return fmt.Errorf("error checking collection '%s' existence: %w", name, err)
+		}
+		if !exists {
+			err = appCtx.DB.CreateCollection(context.Background(), &qdrant.CreateCollection{
+				CollectionName: name,
+				VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{
+					Size:     uint64(appCtx.Config.QdrantVectorSize),
+					Distance: distance,
+				}),
+			})
+			if err != nil {
+				return fmt.Errorf("error creating search collection '%s': %w", name, err)
+			}
+			appCtx.JournaldLogger.Printf("Created search collection '%s' (empty)", name)
+			continue
+		}
+		info, err := appCtx.DB.GetCollectionInfo(context.Background(), name)
+		if err != nil {
+			return fmt.Errorf("error getting collection '%s' info: %w", name, err)
+		}
+		params := info.GetConfig().GetParams().GetVectorsConfig().GetParams()
+		if params == nil {
+			return fmt.Errorf("search collection '%s' has no vector params", name)
+		}
+		if params.Size != uint64(appCtx.Config.QdrantVectorSize) || params.Distance != distance {
+			return fmt.Errorf("search collection '%s' config mismatch: expected size=%d, distance=%s; got size=%d, distance=%v",
+				name, appCtx.Config.QdrantVectorSize, appCtx.Config.QdrantMetric, params.Size, params.Distance)
+		}
+		appCtx.JournaldLogger.Printf("Searching collection '%s' too (read-only, multiplier %.2f)", name, appCtx.Config.SearchCollections[name])
+	}
+	return nil
+}
+
+// payloadIndex describes a payload field index the filters rely on
+type payloadIndex struct {
+	field     string
+	fieldType qdrant.FieldType
+}
+
+// ensurePayloadIndexes creates the payload indexes used by search and attachment sync filters,
+// skipping the ones already present in the collection schema
+func ensurePayloadIndexes(schema map[string]*qdrant.PayloadSchemaInfo) error {
+	indexes := []payloadIndex{
+		{field: "hash", fieldType: qdrant.FieldType_FieldTypeKeyword},
+		{field: "role", fieldType: qdrant.FieldType_FieldTypeKeyword},
+		{field: "file_meta.id", fieldType: qdrant.FieldType_FieldTypeKeyword},
+		{field: "timestamp", fieldType: qdrant.FieldType_FieldTypeFloat},
+	}
+	if appCtx.Config.ThreadsEnabled {
+		indexes = append(indexes,
+			payloadIndex{field: "thread_id", fieldType: qdrant.FieldType_FieldTypeKeyword},
+			payloadIndex{field: "seq", fieldType: qdrant.FieldType_FieldTypeInteger},
+		)
+	}
+	if appCtx.Config.LangDetectEnabled {
+		indexes = append(indexes, payloadIndex{field: "lang", fieldType: qdrant.FieldType_FieldTypeKeyword})
+	}
+	if ttlEnabled() {
+		indexes = append(indexes, payloadIndex{field: "expires_at", fieldType: qdrant.FieldType_FieldTypeFloat})
+	}
+
+	for _, idx := range indexes {
+		if _, ok := schema[idx.field]; ok {
+			appCtx.JournaldLogger.Printf("Index on '%s' field already exists", idx.field)
+			continue
+		}
+
+		yeah_wait := true
+		indexRes, err := appCtx.DB.CreateFieldIndex(context.Background(), &qdrant.CreateFieldIndexCollection{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Wait:           &yeah_wait,
+			FieldName:      idx.field,
+			FieldType:      idx.fieldType.Enum(),
+		})
+		if err != nil {
+			appCtx.ErrorLogger.Printf("Error creating index on '%s' field: %v", idx.field, err)
+			return fmt.Errorf("error creating index: %w", err)
+		}
+
+		if indexRes.GetStatus() == qdrant.UpdateStatus_Completed {
+			appCtx.JournaldLogger.Printf("Index on '%s' field created successfully", idx.field)
+		} else {
+			appCtx.JournaldLogger.Printf("Index creation on '%s' field returned status: %s", idx.field, indexRes.GetStatus())
+			return fmt.Errorf("index creation failed, status: %s", indexRes.GetStatus())
+		}
 	}
 
 	return nil
 }
 
 // flushDatabase connects to Qdrant and deletes the collection
-func flushDatabase(host string, port int, collection string) error {
-	db, err := qdrant.NewClient(&qdrant.Config{
-		Host: host,
-		Port: port,
-	})
+func flushDatabase(host string, port int, collection string, apiKey string, useTLS bool) error {
+	db, err := qdrant.NewClient(qdrantConfigOf(Config{QdrantHost: host, QdrantPort: port, QdrantAPIKey: apiKey, QdrantUseTLS: useTLS}))
 	if err != nil {
 		return fmt.Errorf("error connecting to Qdrant: %w", err)
 	}
@@ -118,56 +381,159 @@ func flushDatabase(host string, port int, collection string) error {
 	return nil
 }
 
+// deleteMatchingPoints deletes all points of the collection matching filter and removes the documents
+// among them from IDF (summary points are not IDF documents). Returns the number of deleted points.
+func deleteMatchingPoints(filter *qdrant.Filter) (int, error) {
+	deleted := 0
+	err := withDB(func() error {
+		ctx := context.Background()
+		limit := uint32(256)
+		wait := true
+		for {
+			// Deleted points leave the filter, so every page starts from the beginning
+			page, err := appCtx.DB.Scroll(ctx, &qdrant.ScrollPoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Filter:         filter,
+				Limit:          &limit,
+				WithPayload:    qdrant.NewWithPayload(true),
+				WithVectors:    qdrant.NewWithVectors(false),
+			})
+			if err != nil {
+				return fmt.Errorf("scroll points: %w", err)
+			}
+			if len(page) == 0 {
+				return nil
+			}
+
+			ids := make([]*qdrant.PointId, len(page))
+			for i, point := range page {
+				ids[i] = point.GetId()
+			}
+			_, err = appCtx.DB.Delete(ctx, &qdrant.DeletePoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Wait:           &wait, // the next scroll must not see them again
+				Points:         qdrant.NewPointsSelector(ids...),
+			})
+			if err != nil {
+				return fmt.Errorf("delete points: %w", err)
+			}
+			deleted += len(page)
+
+			for _, point := range page {
+				p := payloadFromQdrant(point.GetPayload())
+				if p.SummaryOf != "" {
+					continue
+				}
+				if err := removeDocumentFromIDF(p.Body, p.CleanTokenCount, p.Hash, p.Role); err != nil {
+					return fmt.Errorf("remove point %s from IDF: %w", pointIDString(point.GetId()), err)
+				}
+			}
+		}
+	})
+	return deleted, err
+}
+
+// prunePoints deletes the points stored more than olderThanDays days ago (0 any age), of role
+// ("" any) and of file fileID ("" any), removing them from IDF. Returns the number of deleted points.
+func prunePoints(olderThanDays int, role string, fileID string) (int, error) {
+	var must []*qdrant.Condition
+	if olderThanDays > 0 {
+		cutoff := float64(time.Now().AddDate(0, 0, -olderThanDays).UnixNano())
+		must = append(must, qdrant.NewRange("timestamp", &qdrant.Range{Lt: &cutoff}))
+	}
+	if role != "" {
+		must = append(must, qdrant.NewMatch("role", role))
+	}
+	if fileID != "" {
+		must = append(must, qdrant.NewMatch("file_meta.id", fileID))
+	}
+	if len(must) == 0 {
+		return 0, fmt.Errorf("no prune filter given")
+	}
+	return deleteMatchingPoints(&qdrant.Filter{Must: must})
+}
+
 // scoreCandidate computes a final score from Features using provided weights.
-// weights must have length == 10, corresponding to the Features fields in order.
+// weights must have between minWeightsCount and len(featureNames) elements, in Features field order;
+// omitted trailing weights count as zero.
 func scoreCandidate(f Features, weights []float64) (float64, error) {
-	if len(weights) != 9 {
-		return 0.0, fmt.Errorf("invalid weights length: expected 9, got %d", len(weights))
+	if len(weights) < minWeightsCount || len(weights) > len(featureNames) {
+		return 0.0, fmt.Errorf("invalid weights length: expected %d..%d, got %d", minWeightsCount, len(featureNames), len(weights))
 	}
 
-	vals := []float64{
-		f.EmbSim,          // 0
-		f.Recency,         // 1
-		f.RoleScore,       // 2
-		f.BodyLen,         // 3
-		f.KeywordOverlap,  // 4
-		f.WeightedOverlap, // 5
-		f.BM25,            // 6
-		f.NgramOverlap,    // 7
-		f.WeightedNgram,   // 8
-	}
+	vals := featureVector(f)
 
 	score := 0.0
-	for i := range vals {
+	for i := range weights {
 		score += vals[i] * weights[i]
 	}
 	return score, nil
 }
 
 // SearchRelevantContentWithRerank searches relevant records using initial vector search and then reranks them
-func SearchRelevantContentWithRerank(queryVector []float32, queryText string, queryHash string) ([]Payload, error) {
-	candidates, err := SearchRelevantContent(queryVector)
+func SearchRelevantContentWithRerank(ctx context.Context, queryVector []float32, queryText string, queryHash string, opts RequestOptions) ([]Payload, error) {
+	if !qdrantBreaker.allow() {
+		return nil, errRetrievalUnavailable
+	}
+	filtered, err := rerankCandidates(ctx, queryVector, queryText, queryHash, opts)
+	recordRetrieval(ctx, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect payloads of top candidates
+	payloads := make([]Payload, len(filtered))
+	for i, cand := range filtered {
+		payloads[i] = cand.Payload
+	}
+
+	// Pull coherent windows around relevant conversation turns (if configured)
+	payloads = expandThreadNeighbors(ctx, payloads)
+
+	return payloads, nil
+}
+
+// rerankCandidates runs the vector search, fills the heavy features, scores candidates and returns
+// the top ones that pass MinRankScore, best first. Candidates missing any opts.MustInclude term are
+// dropped; opts.Sources and opts.TopN override SearchSource and RerankTopN.
+func rerankCandidates(ctx context.Context, queryVector []float32, queryText string, queryHash string, opts RequestOptions) ([]Candidate, error) {
+	mustInclude := opts.MustInclude
+	queryLang, filterLang := "", ""
+	if appCtx.Config.LangDetectEnabled {
+		var hits int
+		queryLang, hits = detectLanguage(queryText)
+		// A weak guess still boosts, but does not drop documents
+		if hits >= langFilterMinHits {
+			filterLang = queryLang
+		} else if appCtx.Config.LangMode == "filter" && queryLang != "" {
+			appCtx.AccessLogger.Printf("Query language %q has %d stopword hits (< %d), language filter skipped", queryLang, hits, langFilterMinHits)
+		}
+	}
+
+	candidates, err := SearchRelevantContent(ctx, queryVector, filterLang, opts.Sources)
 	if err != nil {
 		return nil, err
 	}
 
+	// Drop embedding-similar candidates that lack a required term
+	if len(mustInclude) > 0 {
+		before := len(candidates)
+		candidates = filterMustInclude(candidates, mustInclude)
+		appCtx.AccessLogger.Printf("Must-include filter kept %d of %d candidates", len(candidates), before)
+	}
+
 	// appCtx.DebugLogger.Printf("Search returned %d candidates before reranking", len(candidates))
 	qFull, err := getCachedTokenIDs(queryHash, queryText)
 	if err != nil {
 		appCtx.ErrorLogger.Printf("tokenize query error: %v", err)
 		qFull = []uint32{}
 	}
+	qFull = removeStopWordIDs(qFull, queryLang)
 	qUnique := uniqueInts(qFull)
 
-	queryLimit := len(qUnique)
-	if queryLimit > appCtx.Config.MaxQueryTokens {
-		queryLimit = appCtx.Config.MaxQueryTokens
-		if len(qUnique) > 2*queryLimit {
-			queryLimit = len(qUnique) / 2
-		}
-	}
-	if len(qUnique) > queryLimit {
-		qUnique = qUnique[:queryLimit] // mutate once here is fine
+	if len(qUnique) > appCtx.Config.MaxQueryTokens {
+		appCtx.AccessLogger.Printf("Query limited to %d of %d unique tokens (%s)", appCtx.Config.MaxQueryTokens, len(qUnique), appCtx.Config.QueryTokenStrategy)
+		qUnique = limitQueryTokens(qUnique, appCtx.Config.MaxQueryTokens)
 	}
 
 	docUnique := make([][]uint32, len(candidates))
@@ -186,7 +552,7 @@ func SearchRelevantContentWithRerank(queryVector []float32, queryText string, qu
 
 	appCtx.idfMu.RLock()
 	for i := range candidates {
-		err := updateFeaturesForCandidate(qUnique, qFull, docFull[i], docUnique[i], docTFs[i], &candidates[i])
+		err := updateFeaturesForCandidate(queryVector, qUnique, qFull, docFull[i], docUnique[i], docTFs[i], &candidates[i])
 		if err != nil {
 			appCtx.ErrorLogger.Printf("Error updating features for candidate: %v", err)
 		}
@@ -199,15 +565,48 @@ func SearchRelevantContentWithRerank(queryVector []float32, queryText string, qu
 	// 	appCtx.DebugLogger.Printf("\tCandidate %d body (first 100 chars): %.100s", i, candidates[i].Payload.Body)
 	// }
 
-	for i := range candidates {
-		score, err := scoreCandidate(candidates[i].Features, appCtx.Config.DefaultWeights)
-		if err != nil {
-			appCtx.ErrorLogger.Printf("Error scoring candidate: %v", err)
-			candidates[i].Score = 0.0
-		} else {
-			candidates[i].Score = score
+	weights := currentWeights()
+	appCtx.configMu.RLock()
+	minRankScore, topN := appCtx.Config.MinRankScore, appCtx.Config.RerankTopN
+	appCtx.configMu.RUnlock()
+	if opts.TopN > 0 {
+		topN = opts.TopN
+	}
+	scoreAll := func() {
+		for i := range candidates {
+			score, err := scoreCandidate(candidates[i].Features, weights)
+			if err != nil {
+				appCtx.ErrorLogger.Printf("Error scoring candidate: %v", err)
+				candidates[i].Score = 0.0
+			} else {
+				candidates[i].Score = score
+			}
+			if appCtx.Config.LangMode == "boost" && queryLang != "" && candidates[i].Payload.Lang == queryLang {
+				candidates[i].Score *= 1 + appCtx.Config.LangBoost
+			}
+			candidates[i].Score *= editRecencyBoost(candidates[i].Payload)
+			candidates[i].Score *= collectionWeight(candidates[i])
 		}
 	}
+	scoreAll()
+
+	// LocalCosine for the RerankTopN set only (if configured), then rescore
+	if appCtx.Config.FetchRerankVectors && !appCtx.Config.ReturnVectors {
+		fetchRerankVectors(ctx, queryVector, candidates, topN)
+		scoreAll()
+	}
+
+	// Optional cross-encoder pass over the lexical top-M, then rescore
+	if appCtx.Config.CrossEncoderModel != "" {
+		applyCrossEncoder(ctx, queryText, candidates)
+		scoreAll()
+	}
+
+	// Calibrate scores so MinRankScore means the same across metrics and weight scales
+	normalizeRankScores(candidates, weights)
+	if appCtx.Config.DebugRerankTable && len(candidates) > 0 {
+		appCtx.DebugLogger.Printf("Rerank of %d candidates:\n%s", len(candidates), rerankTable(candidates))
+	}
 	// appCtx.DebugLogger.Printf("Reranked %d candidates", len(candidates))
 	// for i := range candidates {
 	// 	appCtx.DebugLogger.Printf("\tCandidate %d final score: %.4f", i, candidates[i].Score)
@@ -215,18 +614,27 @@ func SearchRelevantContentWithRerank(queryVector []float32, queryText string, qu
 
 	filtered := make([]Candidate, 0, len(candidates))
 	for _, cand := range candidates {
-		if cand.Score >= appCtx.Config.MinRankScore {
-			// appCtx.DebugLogger.Printf("Candidate passed MinRankScore %.4f: score=%.4f", appCtx.Config.MinRankScore, cand.Score)
+		if cand.Score >= minRankScore {
+			// appCtx.DebugLogger.Printf("Candidate passed MinRankScore %.4f: score=%.4f", minRankScore, cand.Score)
 			filtered = append(filtered, cand)
 		}
 	}
 	// appCtx.DebugLogger.Printf("%d candidates passed MinRankScore %.4f", len(filtered), appCtx.Config.MinRankScore)
+	if len(filtered) == 0 && len(candidates) > 0 && appCtx.Config.MinRankScoreMode == "fallback-topn" {
+		appCtx.AccessLogger.Printf("No candidate passed MinRankScore %.4f, MinRankScoreMode fallback-topn keeps the best of %d", minRankScore, len(candidates))
+		filtered = append(filtered, candidates...)
+	}
 
 	sort.Slice(filtered, func(i, j int) bool {
 		return filtered[i].Score > filtered[j].Score
 	})
 
-	topN := appCtx.Config.RerankTopN
+	// Near-duplicates would take the feed budget twice; the ones dropped are refilled from below the cut
+	if appCtx.Config.FeedDedupCosine > 0 {
+		before := len(filtered)
+		filtered = dedupCandidates(filtered, appCtx.Config.FeedDedupCosine, topN)
+		appCtx.AccessLogger.Printf("Feed de-dup kept %d of %d candidates (top N %d)", len(filtered), before, topN)
+	}
 	if topN > 0 && len(filtered) > topN {
 		filtered = filtered[:topN]
 	}
@@ -236,29 +644,107 @@ func SearchRelevantContentWithRerank(queryVector []float32, queryText string, qu
 	// 	appCtx.DebugLogger.Printf("\tFinal Candidate %d body (first 100 chars): %.100s", i, filtered[i].Payload.Body)
 	// }
 
-	// collect payloads of top candidates
-	payloads := make([]Payload, len(filtered))
-	for i, cand := range filtered {
-		payloads[i] = cand.Payload
+	return filtered, nil
+}
+
+// dedupCandidates drops, from candidates sorted best first, each one whose cosine similarity to a kept
+// candidate is above threshold. Without both vectors the normalized bodies are compared instead.
+// It stops once limit candidates are kept (0 no limit), the rest would be cut anyway.
+func dedupCandidates(candidates []Candidate, threshold float64, limit int) []Candidate {
+	kept := make([]Candidate, 0, len(candidates))
+	normalized := make([]string, 0, len(candidates)) // normalized bodies of kept, computed when needed
+	for _, cand := range candidates {
+		if limit > 0 && len(kept) == limit {
+			break
+		}
+		duplicate := false
+		var norm string
+		for i, k := range kept {
+			if cand.EmbeddingVector != nil && k.EmbeddingVector != nil {
+				if cosineSimilarity(cand.EmbeddingVector, k.EmbeddingVector) > threshold {
+					duplicate = true
+					break
+				}
+				continue
+			}
+			if norm == "" {
+				norm = normalizeText(cand.Payload.Body)
+			}
+			if normalized[i] == "" {
+				normalized[i] = normalizeText(k.Payload.Body)
+			}
+			if norm == normalized[i] {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, cand)
+			normalized = append(normalized, "")
+		}
 	}
+	return kept
+}
 
-	return payloads, nil
+// filterMustInclude keeps candidates whose body contains every term (case-insensitive)
+func filterMustInclude(candidates []Candidate, terms []string) []Candidate {
+	lowered := make([]string, len(terms))
+	for i, t := range terms {
+		lowered[i] = strings.ToLower(t)
+	}
+	kept := candidates[:0]
+	for _, cand := range candidates {
+		body := strings.ToLower(cand.Payload.Body)
+		ok := true
+		for _, t := range lowered {
+			if !strings.Contains(body, t) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			kept = append(kept, cand)
+		}
+	}
+	return kept
+}
+
+// defaultSearchHardLimit is the SearchHardLimit used when it is 0 (unset)
+const defaultSearchHardLimit = 10000
+
+// searchLimit returns the number of points to request from one search: SearchTopK bounded by
+// SearchHardLimit, also when SearchTopK is -1 (no limit).
+func searchLimit(topK, hardLimit int64) uint64 {
+	if hardLimit == 0 {
+		hardLimit = defaultSearchHardLimit
+	}
+	if topK > 0 && topK < hardLimit {
+		return uint64(topK)
+	}
+	return uint64(hardLimit)
 }
 
 // SearchRelevantContent searches Qdrant and returns a slice of Candidate with fast features filled.
 // - cheap features (EmbSim, Recency, RoleScore, BodyLen are computed here.
 // - expensive features (IDF overlap, BM25, ngrams, cross-encoder) should be computed later in rerank step for top-K.
-func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
+// - queryLang is the LangMode filter language, "" for no filter.
+func SearchRelevantContent(ctx context.Context, queryVector []float32, queryLang string, sources []string) ([]Candidate, error) {
 	var results []Candidate
 
 	err := withDB(func() error {
-		// Retrieve filter parameters from config
+		// Retrieve filter parameters from config (roles can be overridden per request)
 		roles := appCtx.Config.SearchSource
+		if len(sources) > 0 {
+			roles = sources
+		}
 		maxAgeDays := appCtx.Config.SearchMaxAgeDays
-		topKCfg := appCtx.Config.SearchTopK
+		minAgeHours := appCtx.Config.SearchMinAgeHours
+		appCtx.configMu.RLock()
+		topKCfg, hardLimit := appCtx.Config.SearchTopK, appCtx.Config.SearchHardLimit
+		appCtx.configMu.RUnlock()
 
-		appCtx.AccessLogger.Printf("Searching relevant content with roles: %v, maxAgeDays: %d, topK: %d, queryVector length: %d",
-			roles, maxAgeDays, topKCfg, len(queryVector))
+		appCtx.AccessLogger.Printf("Searching relevant content with roles: %v, maxAgeDays: %d, minAgeHours: %d, topK: %d, queryVector length: %d",
+			roles, maxAgeDays, minAgeHours, topKCfg, len(queryVector))
 		// appCtx.DebugLogger.Printf("Searching relevant content with roles: %v, maxAgeDays: %d, topK: %d, queryVector length: %d",
 		// roles, maxAgeDays, topKCfg, len(queryVector))
 
@@ -279,31 +765,55 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 			},
 		})
 
-		// Filter by time (if configured)
-		if maxAgeDays > 0 {
-			minTs := time.Now().Add(-time.Duration(maxAgeDays) * 24 * time.Hour).UnixNano()
-			minTsFloat := float64(minTs)
-			conditions = append(conditions, &qdrant.Condition{
+		// Filter by time window (if configured): older bound from maxAgeDays, newer bound from minAgeHours.
+		// The knowledge base is curated, not aged, so the window applies to the main collection only.
+		var timeWindow *qdrant.Condition
+		if maxAgeDays > 0 || minAgeHours > 0 {
+			now := time.Now()
+			tsRange := &qdrant.Range{}
+			if maxAgeDays > 0 {
+				minTsFloat := float64(now.Add(-time.Duration(maxAgeDays) * 24 * time.Hour).UnixNano())
+				tsRange.Gte = &minTsFloat
+			}
+			if minAgeHours > 0 {
+				maxTsFloat := float64(now.Add(-time.Duration(minAgeHours) * time.Hour).UnixNano())
+				tsRange.Lte = &maxTsFloat
+			}
+			timeWindow = &qdrant.Condition{
 				ConditionOneOf: &qdrant.Condition_Field{
 					Field: &qdrant.FieldCondition{
-						Key: "timestamp",
-						Range: &qdrant.Range{
-							Gte: &minTsFloat,
-						},
+						Key:   "timestamp",
+						Range: tsRange,
 					},
 				},
-			})
+			}
+		}
+
+		// Expired points stay stored until the TTL sweep, but are not retrieved
+		conditions = append(conditions, notExpired())
+
+		// Filter by query language (untagged documents stay eligible)
+		if appCtx.Config.LangMode == "filter" && queryLang != "" {
+			conditions = append(conditions, qdrant.NewFilterAsCondition(&qdrant.Filter{
+				Should: []*qdrant.Condition{
+					qdrant.NewMatch("lang", queryLang),
+					qdrant.NewIsEmpty("lang"),
+				},
+			}))
 		}
 
 		filter := &qdrant.Filter{Must: conditions}
+		if timeWindow != nil {
+			filter = &qdrant.Filter{Must: append(slices.Clone(conditions), timeWindow)}
+		}
 
-		var topK uint64 = 100000
-		if topKCfg > 0 {
-			topK = uint64(topKCfg)
+		topK := searchLimit(topKCfg, hardLimit)
+		if topKCfg > int64(topK) {
+			appCtx.AccessLogger.Printf("WARNING: SearchTopK %d clipped to SearchHardLimit %d", topKCfg, topK)
 		}
 
 		// Query Qdrant. WithVectors controlled by config (may be expensive).
-		resp, err := appCtx.DB.Query(context.Background(), &qdrant.QueryPoints{
+		resp, err := appCtx.DB.Query(ctx, &qdrant.QueryPoints{
 			CollectionName: appCtx.Config.QdrantCollection,
 			Query:          qdrant.NewQuery(queryVector...),
 			Filter:         filter,
@@ -317,6 +827,51 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 		}
 
 		appCtx.AccessLogger.Printf("Qdrant search returned %d results", len(resp))
+
+		sources := make([]string, len(resp)) // source collection of each hit, "" for QdrantCollection
+
+		// Search the read-only knowledge base (if configured) with the same conditions but without the
+		// time window; its hits are merged with the main ones and reranked together
+		if kb := appCtx.Config.KnowledgeBaseCollection; kb != "" {
+			kbResp, err := appCtx.DB.Query(ctx, &qdrant.QueryPoints{
+				CollectionName: kb,
+				Query:          qdrant.NewQuery(queryVector...),
+				Filter:         &qdrant.Filter{Must: conditions},
+				Limit:          &topK,
+				WithPayload:    qdrant.NewWithPayload(true),
+				WithVectors:    qdrant.NewWithVectors(appCtx.Config.ReturnVectors),
+			})
+			if err != nil {
+				appCtx.ErrorLogger.Printf("Error during knowledge base search: %v", err)
+				return fmt.Errorf("error during knowledge base search: %w", err)
+			}
+			appCtx.AccessLogger.Printf("Knowledge base search returned %d results", len(kbResp))
+			resp = append(resp, kbResp...)
+			for range kbResp {
+				sources = append(sources, kb)
+			}
+		}
+
+		// Search the other SearchCollections with the main filter, their hits are weighted in rerank
+		for _, name := range extraSearchCollections() {
+			extraResp, err := appCtx.DB.Query(ctx, &qdrant.QueryPoints{
+				CollectionName: name,
+				Query:          qdrant.NewQuery(queryVector...),
+				Filter:         filter,
+				Limit:          &topK,
+				WithPayload:    qdrant.NewWithPayload(true),
+				WithVectors:    qdrant.NewWithVectors(appCtx.Config.ReturnVectors),
+			})
+			if err != nil {
+				appCtx.ErrorLogger.Printf("Error during search of collection %s: %v", name, err)
+				return fmt.Errorf("error during search of collection %s: %w", name, err)
+			}
+			appCtx.AccessLogger.Printf("Search of collection %s returned %d results", name, len(extraResp))
+			resp = append(resp, extraResp...)
+			for range extraResp {
+				sources = append(sources, name)
+			}
+		}
 		// appCtx.DebugLogger.Printf("Qdrant search returned %d results", len(resp))
 
 		// cutoff by score/distance depending on metric
@@ -332,45 +887,14 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 		}
 
 		results = make([]Candidate, 0, len(resp))
-		for _, point := range resp {
+		for i, point := range resp {
 			if !pass(point.Score) {
 				// appCtx.DebugLogger.Printf("Skipping point %s with score %.4f due to cutoff", point.Id, point.Score)
 				continue
 			}
 
 			// populate payload from point.Payload
-			var payload Payload
-			if v, ok := point.Payload["packet_id"]; ok {
-				payload.PacketID = v.GetStringValue()
-			}
-			if v, ok := point.Payload["timestamp"]; ok {
-				payload.Timestamp = v.GetDoubleValue()
-			}
-			if v, ok := point.Payload["role"]; ok {
-				payload.Role = v.GetStringValue()
-			}
-			if v, ok := point.Payload["body"]; ok {
-				payload.Body = v.GetStringValue()
-			}
-			if v, ok := point.Payload["token_count"]; ok {
-				payload.TokenCount = int(v.GetIntegerValue())
-			}
-			if v, ok := point.Payload["clean_token_count"]; ok {
-				payload.CleanTokenCount = int(v.GetIntegerValue())
-			}
-			if v, ok := point.Payload["hash"]; ok {
-				payload.Hash = v.GetStringValue()
-			}
-			if v, ok := point.Payload["file_meta"]; ok {
-				if fm := v.GetStructValue(); fm != nil {
-					if id, ok := fm.Fields["id"]; ok {
-						payload.FileMeta.ID = id.GetStringValue()
-					}
-					if path, ok := fm.Fields["path"]; ok {
-						payload.FileMeta.Path = path.GetStringValue()
-					}
-				}
-			}
+			payload := payloadFromQdrant(point.Payload)
 
 			// Verbose logging
 			if appCtx.Config.VerboseDiskLogs {
@@ -384,7 +908,7 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 			}
 
 			// build candidate and fill cheap features
-			cand := Candidate{Payload: payload}
+			cand := Candidate{PointID: pointIDString(point.GetId()), Payload: payload, Collection: sources[i]}
 
 			// use raw score but clamp to [0,1] to be safe
 			raw := float64(point.Score)
@@ -405,13 +929,13 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 				cand.Features.EmbSim = 1.0 / (1.0 + d)
 			}
 
-			// If vectors were returned and config requests them, keep vector for optional local cosine
+			// If vectors were returned and config requests them, keep vector for the local cosine feature
 			if appCtx.Config.ReturnVectors && point.Vectors.GetVector() != nil {
 				cand.EmbeddingVector = convertPointVectorToFloat64(point.Vectors.GetVector())
 			}
 
 			// Recency
-			cand.Features.Recency = timeDecay(cand.Payload.Timestamp)
+			cand.Features.Recency = timeDecay(cand.Payload.Timestamp, cand.Payload.Role)
 
 			// Role score
 			cand.Features.RoleScore = appCtx.Config.RoleWeights[cand.Payload.Role]
@@ -419,6 +943,9 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 			// Body length normalized
 			cand.Features.BodyLen = bodyLenNorm(cand.Payload.CleanTokenCount)
 
+			// Feedback signals
+			cand.Features.FeedbackScore = feedbackScore(cand.Payload.Feedback)
+
 			/*
 				Ramain for second step (rerank):
 
@@ -431,6 +958,7 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 
 			results = append(results, cand)
 		}
+		results = collapseSummaries(results)
 
 		appCtx.AccessLogger.Printf("Filtered to %d results after applying score/distance cutoff", len(results))
 		// appCtx.DebugLogger.Printf("Filtered to %d results after applying score/distance cutoff", len(results))
@@ -443,10 +971,268 @@ func SearchRelevantContent(queryVector []float32) ([]Candidate, error) {
 	return results, nil
 }
 
+// encodeBody gzips and base64-encodes a body for compact storage
+func encodeBody(body string) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeBody reverses encodeBody
+func decodeBody(encoded string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// payloadBody returns the plain body of a stored point. Points written with StoreBodyCompressed carry
+// body_encoding; points without it are returned as is, so old and new data can be mixed.
+func payloadBody(fields map[string]*qdrant.Value) string {
+	body := fields["body"].GetStringValue()
+	if fields["body_encoding"].GetStringValue() != bodyEncodingGzip {
+		return body
+	}
+	decoded, err := decodeBody(body)
+	if err != nil {
+		appCtx.ErrorLogger.Printf("Error decoding compressed body: %v", err)
+		return ""
+	}
+	return decoded
+}
+
+// payloadFromQdrant converts a Qdrant payload map into a Payload
+func payloadFromQdrant(fields map[string]*qdrant.Value) Payload {
+	var payload Payload
+	if v, ok := fields["packet_id"]; ok {
+		payload.PacketID = v.GetStringValue()
+	}
+	if v, ok := fields["timestamp"]; ok {
+		payload.Timestamp = v.GetDoubleValue()
+	}
+	if v, ok := fields["role"]; ok {
+		payload.Role = v.GetStringValue()
+	}
+	payload.Body = payloadBody(fields)
+	if v, ok := fields["token_count"]; ok {
+		payload.TokenCount = int(v.GetIntegerValue())
+	}
+	if v, ok := fields["clean_token_count"]; ok {
+		payload.CleanTokenCount = int(v.GetIntegerValue())
+	}
+	if v, ok := fields["hash"]; ok {
+		payload.Hash = v.GetStringValue()
+	}
+	if v, ok := fields["file_meta"]; ok {
+		if fm := v.GetStructValue(); fm != nil {
+			if id, ok := fm.Fields["id"]; ok {
+				payload.FileMeta.ID = id.GetStringValue()
+			}
+			if path, ok := fm.Fields["path"]; ok {
+				payload.FileMeta.Path = path.GetStringValue()
+			}
+			payload.FileMeta.Hash = fm.Fields["hash"].GetStringValue()
+			payload.FileMeta.Chunk = int(fm.Fields["chunk"].GetIntegerValue())
+			payload.FileMeta.Chunks = int(fm.Fields["chunks"].GetIntegerValue())
+			payload.FileMeta.Offset = int(fm.Fields["offset"].GetIntegerValue())
+		}
+	}
+	if v, ok := fields["thread_id"]; ok {
+		payload.ThreadID = v.GetStringValue()
+	}
+	if v, ok := fields["seq"]; ok {
+		payload.Seq = int(v.GetIntegerValue())
+	}
+	if v, ok := fields["feedback"]; ok {
+		payload.Feedback = v.GetDoubleValue()
+	}
+	if v, ok := fields["lang"]; ok {
+		payload.Lang = v.GetStringValue()
+	}
+	if v, ok := fields["summary_of"]; ok {
+		payload.SummaryOf = v.GetStringValue()
+	}
+	if v, ok := fields["expires_at"]; ok {
+		payload.ExpiresAt = v.GetDoubleValue()
+	}
+	return payload
+}
+
+// expandThreadNeighbors appends, right after each conversation turn, the stored turns of the same
+// thread within ThreadNeighborWindow sequence steps. Turns already present are not repeated.
+func expandThreadNeighbors(ctx context.Context, payloads []Payload) []Payload {
+	window := appCtx.Config.ThreadNeighborWindow
+	if window <= 0 || len(payloads) == 0 {
+		return payloads
+	}
+
+	key := func(p Payload) string { return p.Role + ":" + p.Hash }
+	seen := make(map[string]struct{}, len(payloads))
+	for _, p := range payloads {
+		seen[key(p)] = struct{}{}
+	}
+
+	expanded := make([]Payload, 0, len(payloads))
+	for _, p := range payloads {
+		expanded = append(expanded, p)
+		if p.ThreadID == "" {
+			continue
+		}
+		neighbors, err := getThreadNeighbors(ctx, p.ThreadID, p.Seq-window, p.Seq+window)
+		if err != nil {
+			appCtx.ErrorLogger.Printf("Error fetching thread neighbors for thread %s: %v", p.ThreadID, err)
+			continue
+		}
+		added := 0
+		for _, n := range neighbors {
+			if _, ok := seen[key(n)]; ok {
+				continue
+			}
+			seen[key(n)] = struct{}{}
+			expanded = append(expanded, n)
+			added++
+		}
+		if added > 0 {
+			appCtx.AccessLogger.Printf("Added %d neighbor turns from thread %s around seq %d", added, p.ThreadID, p.Seq)
+		}
+	}
+	return expanded
+}
+
+// getThreadNeighbors returns the stored turns of a thread with seq in [fromSeq, toSeq], ordered by seq
+func getThreadNeighbors(ctx context.Context, threadID string, fromSeq, toSeq int) ([]Payload, error) {
+	var neighbors []Payload
+	err := withDB(func() error {
+		gte := float64(fromSeq)
+		lte := float64(toSeq)
+		limit := uint32(2 * (toSeq - fromSeq + 1)) // user + assistant per seq
+		resp, err := appCtx.DB.Scroll(ctx, &qdrant.ScrollPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Filter: &qdrant.Filter{
+				Must: []*qdrant.Condition{
+					qdrant.NewMatch("thread_id", threadID),
+					qdrant.NewRange("seq", &qdrant.Range{Gte: &gte, Lte: &lte}),
+					qdrant.NewMatchKeywords("role", appCtx.Config.SearchSource...),
+					notSummary(),
+					notExpired(),
+				},
+			},
+			Limit:       &limit,
+			WithPayload: qdrant.NewWithPayload(true),
+			WithVectors: qdrant.NewWithVectors(false),
+		})
+		if err != nil {
+			return fmt.Errorf("scroll thread neighbors: %w", err)
+		}
+		neighbors = make([]Payload, 0, len(resp))
+		for _, point := range resp {
+			neighbors = append(neighbors, payloadFromQdrant(point.Payload))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(neighbors, func(i, j int) bool {
+		if neighbors[i].Seq != neighbors[j].Seq {
+			return neighbors[i].Seq < neighbors[j].Seq
+		}
+		// user turn goes before the assistant answer
+		return neighbors[i].Role == "rag-user" && neighbors[j].Role != "rag-user"
+	})
+	return neighbors, nil
+}
+
+// fetchRerankVectors sorts candidates best first, loads the vectors of the first topN (0 all) and
+// fills their LocalCosine. The others are cut by RerankTopN anyway.
+func fetchRerankVectors(ctx context.Context, queryVector []float32, candidates []Candidate, topN int) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	rerankSet := candidates
+	if topN > 0 && len(rerankSet) > topN {
+		rerankSet = rerankSet[:topN]
+	}
+	if err := fetchCandidateVectors(ctx, rerankSet); err != nil {
+		appCtx.ErrorLogger.Printf("Error fetching candidate vectors: %v", err)
+		return
+	}
+	for i := range rerankSet {
+		if len(rerankSet[i].EmbeddingVector) > 0 {
+			rerankSet[i].Features.LocalCosine = math.Max(0, cosineSimilarity(queryVector, rerankSet[i].EmbeddingVector))
+		}
+	}
+}
+
+// fetchCandidateVectors loads embedding vectors for the given candidates with a single Get by IDs
+func fetchCandidateVectors(ctx context.Context, candidates []Candidate) error {
+	if len(candidates) == 0 {
+		return nil
+	}
+	ids := make([]*qdrant.PointId, 0, len(candidates))
+	index := make(map[string]int, len(candidates))
+	for i, cand := range candidates {
+		if cand.PointID == "" || cand.Collection != "" {
+			continue // vectors of other collections are not fetched
+		}
+		ids = append(ids, qdrant.NewID(cand.PointID))
+		index[cand.PointID] = i
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return withDB(func() error {
+		resp, err := appCtx.DB.Get(ctx, &qdrant.GetPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Ids:            ids,
+			WithPayload:    qdrant.NewWithPayload(false),
+			WithVectors:    qdrant.NewWithVectors(true),
+		})
+		if err != nil {
+			return fmt.Errorf("get candidate vectors: %w", err)
+		}
+		for _, point := range resp {
+			i, ok := index[pointIDString(point.GetId())]
+			if !ok || point.Vectors.GetVector() == nil {
+				continue
+			}
+			candidates[i].EmbeddingVector = convertPointVectorToFloat64(point.Vectors.GetVector())
+		}
+		appCtx.AccessLogger.Printf("Fetched vectors for %d of %d rerank candidates", len(resp), len(candidates))
+		return nil
+	})
+}
+
 // convertPointVectorToFloat64 converts Qdrant point.Vector to []float64.
 // It handles common underlying types returned by the client (e.g., []float32, []float64).
 func convertPointVectorToFloat64(vec interface{}) []float64 {
 	switch v := vec.(type) {
+	case *qdrant.VectorOutput:
+		// what point.Vectors.GetVector() returns: dense data, or the deprecated flat field
+		if dense := v.GetDense(); dense != nil {
+			return convertPointVectorToFloat64(dense.GetData())
+		}
+		if data := v.GetData(); len(data) > 0 {
+			return convertPointVectorToFloat64(data)
+		}
+		return nil
 	case []float32:
 		out := make([]float64, len(v))
 		for i, x := range v {
@@ -499,9 +1285,7 @@ func getPointBodyByID(pointID string) (string, error) {
 			return fmt.Errorf("point not found: %s", pointID)
 		}
 
-		if b := resp[0].Payload["body"]; b != nil {
-			body = b.GetStringValue()
-		}
+		body = payloadBody(resp[0].Payload)
 		return nil
 	})
 	if err != nil {
@@ -531,16 +1315,27 @@ func planAttachmentSync(attachments []Attachment) (toInsert []AttachmentReplacem
 		if len(order) == 0 {
 			return nil
 		}
+		if max := appCtx.Config.MaxAttachmentIDsPerRequest; max > 0 && len(order) > max {
+			appCtx.AccessLogger.Printf("Attachment sync limited to %d of %d distinct files", max, len(order))
+			for _, id := range order[max:] {
+				delete(latest, id)
+			}
+			order = order[:max]
+		}
 
-		existing := make(map[string]struct {
-			pointID         string
-			hash            string
-			tokenCount      int
-			cleanTokenCount int
-		}, len(order))
+		// existingFile is the stored version of a file: the hash of its newest point and all its points
+		type existingFile struct {
+			hash      string
+			timestamp float64
+			points    []AttachmentPoint
+		}
+		existing := make(map[string]*existingFile, len(order))
 
 		for _, chunk := range chunkStrings(order, 256) {
 			limit := uint32(len(chunk))
+			if appCtx.Config.AttachmentScrollPageSize > 0 {
+				limit = uint32(appCtx.Config.AttachmentScrollPageSize)
+			}
 			filter := &qdrant.Filter{
 				Must: []*qdrant.Condition{{
 					ConditionOneOf: &qdrant.Condition_Field{
@@ -553,18 +1348,29 @@ func planAttachmentSync(attachments []Attachment) (toInsert []AttachmentReplacem
 							},
 						},
 					},
-				}},
+				}, notSummary()},
 			}
 
-			resp, err := appCtx.DB.Scroll(ctx, &qdrant.ScrollPoints{
-				CollectionName: appCtx.Config.QdrantCollection,
-				Filter:         filter,
-				Limit:          &limit,
-				WithPayload:    qdrant.NewWithPayload(true),
-				WithVectors:    qdrant.NewWithVectors(false),
-			})
-			if err != nil {
-				return fmt.Errorf("scroll attachments: %w", err)
+			// Page through all points of the chunk: one file may be stored as several points
+			var resp []*qdrant.RetrievedPoint
+			var offset *qdrant.PointId
+			for {
+				page, next, err := appCtx.DB.ScrollAndOffset(ctx, &qdrant.ScrollPoints{
+					CollectionName: appCtx.Config.QdrantCollection,
+					Filter:         filter,
+					Limit:          &limit,
+					Offset:         offset,
+					WithPayload:    qdrant.NewWithPayloadInclude("file_meta", "hash", "token_count", "clean_token_count", "timestamp"),
+					WithVectors:    qdrant.NewWithVectors(false),
+				})
+				if err != nil {
+					return fmt.Errorf("scroll attachments: %w", err)
+				}
+				resp = append(resp, page...)
+				if next == nil || len(page) == 0 {
+					break
+				}
+				offset = next
 			}
 
 			for _, point := range resp {
@@ -602,24 +1408,37 @@ func planAttachmentSync(attachments []Attachment) (toInsert []AttachmentReplacem
 					pointID = strconv.FormatUint(pid.Num, 10)
 				}
 
-				existing[id] = struct {
-					pointID         string
-					hash            string
-					tokenCount      int
-					cleanTokenCount int
-				}{
-					pointID:         pointID,
-					hash:            hashVal,
-					tokenCount:      tokenCountVal,
-					cleanTokenCount: cleanTokenCountVal,
+				timestampVal := point.Payload["timestamp"].GetDoubleValue()
+
+				// Chunks carry the hash of the whole file in file_meta
+				versionHash := hashVal
+				if h := fields["hash"].GetStringValue(); h != "" {
+					versionHash = h
 				}
+
+				// Several points for one file (chunks, stale versions): the newest one is the current
+				// version, all of them are replaced
+				file := existing[id]
+				if file == nil {
+					file = &existingFile{}
+					existing[id] = file
+				}
+				if len(file.points) == 0 || timestampVal > file.timestamp {
+					file.hash, file.timestamp = versionHash, timestampVal
+				}
+				file.points = append(file.points, AttachmentPoint{
+					PointID:         pointID,
+					Hash:            hashVal,
+					TokenCount:      tokenCountVal,
+					CleanTokenCount: cleanTokenCountVal,
+				})
 			}
 		}
 
 		processed := make(map[string]struct{}, len(order))
 		for _, att := range attachments {
-			if att.ID == "" {
-				continue
+			if _, ok := latest[att.ID]; !ok {
+				continue // empty ID or over MaxAttachmentIDsPerRequest
 			}
 			if _, ok := processed[att.ID]; ok {
 				continue
@@ -628,19 +1447,12 @@ func planAttachmentSync(attachments []Attachment) (toInsert []AttachmentReplacem
 
 			if info, ok := existing[att.ID]; !ok {
 				toInsert = append(toInsert, AttachmentReplacement{
-					Attachment:         att,
-					OldPointID:         "-",
-					OldHash:            "-",
-					OldTokenCount:      0,
-					OldCleanTokenCount: 0,
+					Attachment: att,
 				})
 			} else if info.hash != att.Hash {
 				toReplace = append(toReplace, AttachmentReplacement{
-					Attachment:         att,
-					OldPointID:         info.pointID,
-					OldHash:            info.hash,
-					OldTokenCount:      info.tokenCount,
-					OldCleanTokenCount: info.cleanTokenCount,
+					Attachment: att,
+					OldPoints:  info.points,
 				})
 			}
 		}
@@ -653,6 +1465,39 @@ func planAttachmentSync(attachments []Attachment) (toInsert []AttachmentReplacem
 	return toInsert, toReplace, nil
 }
 
+// upsertFilePoints stores all chunk points of a file in one batch, then deletes the spare points of
+// its stored version together with their summary points, and the summary points in staleSummaries.
+// Nothing is deleted when the upsert fails.
+func upsertFilePoints(points []*qdrant.PointStruct, spare []AttachmentPoint, staleSummaries []string) error {
+	ids := make([]*qdrant.PointId, 0, 2*len(spare)+len(staleSummaries))
+	for _, p := range spare {
+		ids = append(ids, qdrant.NewID(p.PointID), qdrant.NewID(summaryPointID(p.PointID)))
+	}
+	for _, id := range staleSummaries {
+		ids = append(ids, qdrant.NewID(id))
+	}
+	return withDB(func() error {
+		_, err := appCtx.DB.Upsert(context.Background(), &qdrant.UpsertPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Points:         points,
+		})
+		if err != nil {
+			return fmt.Errorf("error upserting attachment points: %w", err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		_, err = appCtx.DB.Delete(context.Background(), &qdrant.DeletePoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Points:         qdrant.NewPointsSelector(ids...),
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting old attachment points: %w", err)
+		}
+		return nil
+	})
+}
+
 func chunkStrings(values []string, chunkSize int) [][]string {
 	if chunkSize <= 0 {
 		chunkSize = 256
@@ -668,16 +1513,185 @@ func chunkStrings(values []string, chunkSize int) [][]string {
 	return chunks
 }
 
-// upsertPoint adds a new point to the Qdrant database with the given parameters
-func upsertPoint(body string, vector []float32, role string, tokenCount, cleanTokenCount int, hash string, packetID string, fileMeta *FileMeta, pointID string) error {
+// pointIDString returns the string form of a Qdrant point ID (UUID or number)
+func pointIDString(id *qdrant.PointId) string {
+	switch pid := id.GetPointIdOptions().(type) {
+	case *qdrant.PointId_Uuid:
+		return pid.Uuid
+	case *qdrant.PointId_Num:
+		return strconv.FormatUint(pid.Num, 10)
+	}
+	return ""
+}
+
+// findDuplicatePoint searches the nearest point with the same role and returns its ID
+// when the similarity is at or above DedupCosineThreshold. Empty ID means no duplicate.
+func findDuplicatePoint(vector []float32, role string) (pointID string, score float32, err error) {
+	err = withDB(func() error {
+		limit := uint64(1)
+		resp, err := appCtx.DB.Query(context.Background(), &qdrant.QueryPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Query:          qdrant.NewQuery(vector...),
+			Filter:         &qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewMatch("role", role), notSummary(), notExpired()}},
+			Limit:          &limit,
+			WithPayload:    qdrant.NewWithPayload(false),
+			WithVectors:    qdrant.NewWithVectors(false),
+		})
+		if err != nil {
+			return fmt.Errorf("dedup search: %w", err)
+		}
+		if len(resp) == 0 || resp[0].Score < appCtx.Config.DedupCosineThreshold {
+			return nil
+		}
+		score = resp[0].Score
+		pointID = pointIDString(resp[0].GetId())
+		return nil
+	})
+	return pointID, score, err
+}
+
+// feedbackMu serializes read-modify-write updates of feedback counters
+var feedbackMu sync.Mutex
 
-	// add to IDF
+// addFeedback adds signal to the "feedback" counter of the point pointID, or of every point of
+// the exchange packetID when pointID is empty. Returns the number of updated points.
+func addFeedback(pointID string, packetID string, signal float64) (int, error) {
+	feedbackMu.Lock()
+	defer feedbackMu.Unlock()
 
-	if err := addDocumentToIDF(body, cleanTokenCount, hash); err != nil {
-		return fmt.Errorf("error adding document to IDF: %w", err)
+	updated := 0
+	err := withDB(func() error {
+		ctx := context.Background()
+
+		var points []*qdrant.RetrievedPoint
+		var err error
+		if pointID != "" {
+			points, err = appCtx.DB.Get(ctx, &qdrant.GetPoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Ids:            []*qdrant.PointId{qdrant.NewID(pointID)},
+				WithPayload:    qdrant.NewWithPayloadInclude("feedback"),
+				WithVectors:    qdrant.NewWithVectors(false),
+			})
+		} else {
+			limit := uint32(64)
+			points, err = appCtx.DB.Scroll(ctx, &qdrant.ScrollPoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Filter:         &qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewMatch("packet_id", packetID)}},
+				Limit:          &limit,
+				WithPayload:    qdrant.NewWithPayloadInclude("feedback"),
+				WithVectors:    qdrant.NewWithVectors(false),
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("get feedback points: %w", err)
+		}
+
+		for _, point := range points {
+			current := point.Payload["feedback"].GetDoubleValue()
+			_, err := appCtx.DB.SetPayload(ctx, &qdrant.SetPayloadPoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Payload: map[string]*qdrant.Value{
+					"feedback": qdrant.NewValueDouble(current + signal),
+				},
+				PointsSelector: qdrant.NewPointsSelector(point.GetId()),
+			})
+			if err != nil {
+				return fmt.Errorf("set feedback of point %s: %w", pointIDString(point.GetId()), err)
+			}
+			updated++
+		}
+		return nil
+	})
+	return updated, err
+}
+
+// touchPoint refreshes the timestamp of an existing point
+func touchPoint(pointID string) error {
+	return withDB(func() error {
+		_, err := appCtx.DB.SetPayload(context.Background(), &qdrant.SetPayloadPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Payload: map[string]*qdrant.Value{
+				"timestamp": qdrant.NewValueDouble(float64(time.Now().UnixNano())),
+			},
+			PointsSelector: qdrant.NewPointsSelector(qdrant.NewID(pointID)),
+		})
+		if err != nil {
+			return fmt.Errorf("touch point %s: %w", pointID, err)
+		}
+		return nil
+	})
+}
+
+// upsertOrTouchPoint stores a conversation turn, or only refreshes the timestamp of a near-identical
+// point with the same role when DedupCosineThreshold is enabled (Cosine/Dot metrics only)
+func upsertOrTouchPoint(body string, vector []float32, role string, tokenCount, cleanTokenCount int, hash string, packetID string, thread *ThreadRef, ttl time.Duration) error {
+	if appCtx.Config.DedupCosineThreshold > 0 && (appCtx.Config.QdrantMetric == "Cosine" || appCtx.Config.QdrantMetric == "Dot") {
+		dupID, score, err := findDuplicatePoint(vector, role)
+		if err != nil {
+			// Dedup is best effort: fall back to a regular insert
+			appCtx.ErrorLogger.Printf("Error checking for duplicate %s point: %v", role, err)
+		} else if dupID != "" {
+			appCtx.AccessLogger.Printf("Duplicate %s point %s found (score=%.4f), refreshing timestamp instead of inserting", role, dupID, score)
+			return touchPoint(dupID)
+		}
+	}
+	if err := upsertPoint(body, vector, role, tokenCount, cleanTokenCount, hash, packetID, nil, thread, uuid.NewString(), ttl); err != nil {
+		return err
+	}
+	appCtx.AccessLogger.Printf("Inserted point with packet_id: %s, role: %s", packetID, role)
+	return nil
+}
+
+// upsertPoint adds a new point to the Qdrant database with the given parameters.
+// ttl is the lifetime of the point, 0 for the TTLByRole default of role.
+func upsertPoint(body string, vector []float32, role string, tokenCount, cleanTokenCount int, hash string, packetID string, fileMeta *FileMeta, thread *ThreadRef, pointID string, ttl time.Duration) error {
+
+	// add to Qdrant (IDF is updated only after the point is stored)
+	points, err := buildPoints(body, vector, role, tokenCount, cleanTokenCount, hash, packetID, fileMeta, thread, pointID, ttl)
+	if err != nil {
+		return err
 	}
 
-	// add to Qdrant
+	return withDB(func() error {
+		_, err := appCtx.DB.Upsert(context.Background(), &qdrant.UpsertPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Points:         points,
+		})
+		if err != nil {
+			appCtx.ErrorLogger.Printf("Error inserting model response: %v", err)
+			return err
+		}
+
+		// A replaced file that became too short for a summary must not keep the old one
+		if len(points) == 1 && appCtx.Config.SummaryEmbedding && fileMeta != nil && fileMeta.ID != "" {
+			_, err := appCtx.DB.Delete(context.Background(), &qdrant.DeletePoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Points:         qdrant.NewPointsSelector(qdrant.NewID(summaryPointID(pointID))),
+			})
+			if err != nil {
+				return fmt.Errorf("error deleting stale summary point: %w", err)
+			}
+		}
+
+		// add to IDF
+		if err := addDocumentToIDF(body, cleanTokenCount, hash, role); err != nil {
+			return fmt.Errorf("error adding document to IDF: %w", err)
+		}
+		return nil
+	})
+}
+
+// buildPoints returns the point for body and, with SummaryEmbedding, its summary point second.
+func buildPoints(body string, vector []float32, role string, tokenCount, cleanTokenCount int, hash string, packetID string, fileMeta *FileMeta, thread *ThreadRef, pointID string, ttl time.Duration) ([]*qdrant.PointStruct, error) {
+
+	storedBody := body
+	if appCtx.Config.StoreBodyCompressed {
+		encoded, err := encodeBody(body)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing body: %w", err)
+		}
+		storedBody = encoded
+	}
 
 	timestamp := float64(time.Now().UnixNano())
 
@@ -694,50 +1708,89 @@ func upsertPoint(body string, vector []float32, role string, tokenCount, cleanTo
 	valPacketID := qdrant.NewValueString(packetID)
 	valTimestamp := qdrant.NewValueDouble(timestamp)
 	valRole := qdrant.NewValueString(role)
-	valBody := qdrant.NewValueString(body)
+	valBody := qdrant.NewValueString(storedBody)
 	valTokenCount := qdrant.NewValueInt(int64(tokenCount))
 	valCleanTokenCount := qdrant.NewValueInt(int64(cleanTokenCount))
 	valHash := qdrant.NewValueString(hash)
-	valFileMeta, _ := qdrant.NewValue(map[string]interface{}{
+	fileMetaFields := map[string]interface{}{
 		"id":   fileMeta.ID,
 		"path": fileMeta.Path,
-	})
-
-	return withDB(func() error {
-		_, err := appCtx.DB.Upsert(context.Background(), &qdrant.UpsertPoints{
-			CollectionName: appCtx.Config.QdrantCollection,
-			Points: []*qdrant.PointStruct{
-				{
-					Id:      &qdrant.PointId{PointIdOptions: &qdrant.PointId_Uuid{Uuid: pointID}},
-					Vectors: qdrant.NewVectors(vector...),
-					Payload: map[string]*qdrant.Value{
-						"packet_id":         valPacketID,
-						"timestamp":         valTimestamp,
-						"role":              valRole,
-						"body":              valBody,
-						"token_count":       valTokenCount,
-						"clean_token_count": valCleanTokenCount,
-						"hash":              valHash,
-						"file_meta":         valFileMeta,
-					},
-				},
-			},
-		})
-		if err != nil {
-			appCtx.ErrorLogger.Printf("Error inserting model response: %v", err)
-			return err
+	}
+	if fileMeta.Chunks > 1 {
+		fileMetaFields["hash"] = fileMeta.Hash
+		fileMetaFields["chunk"] = fileMeta.Chunk
+		fileMetaFields["chunks"] = fileMeta.Chunks
+		fileMetaFields["offset"] = fileMeta.Offset
+	}
+	valFileMeta, _ := qdrant.NewValue(fileMetaFields)
+
+	payload := map[string]*qdrant.Value{
+		"packet_id":         valPacketID,
+		"timestamp":         valTimestamp,
+		"role":              valRole,
+		"body":              valBody,
+		"token_count":       valTokenCount,
+		"clean_token_count": valCleanTokenCount,
+		"hash":              valHash,
+		"file_meta":         valFileMeta,
+	}
+	if appCtx.Config.StoreBodyCompressed {
+		payload["body_encoding"] = qdrant.NewValueString(bodyEncodingGzip)
+	}
+	if thread != nil && thread.ID != "" {
+		payload["thread_id"] = qdrant.NewValueString(thread.ID)
+		payload["seq"] = qdrant.NewValueInt(int64(thread.Seq))
+	}
+	if expiry := expiresAt(role, ttl); expiry > 0 {
+		payload["expires_at"] = qdrant.NewValueDouble(expiry)
+	}
+	if appCtx.Config.LangDetectEnabled {
+		if lang, _ := detectLanguage(body); lang != "" {
+			payload["lang"] = qdrant.NewValueString(lang)
 		}
-		return nil
-	})
+	}
+
+	points := []*qdrant.PointStruct{
+		{
+			Id:      &qdrant.PointId{PointIdOptions: &qdrant.PointId_Uuid{Uuid: pointID}},
+			Vectors: qdrant.NewVectors(vector...),
+			Payload: payload,
+		},
+	}
+	summary, err := summaryPoint(pointID, body, cleanTokenCount, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error embedding summary: %w", err)
+	}
+	if summary != nil {
+		points = append(points, summary)
+	}
+	return points, nil
 }
 
-// withDB creates a fresh Qdrant client, sets it in appCtx.DB, calls fn, then closes the client
+// qdrantConfigOf returns the Qdrant client settings of config (address, API key and TLS)
+func qdrantConfigOf(config Config) *qdrant.Config {
+	return &qdrant.Config{
+		Host:          config.QdrantHost,
+		Port:          config.QdrantPort,
+		APIKey:        config.QdrantAPIKey,
+		UseTLS:        config.QdrantUseTLS,
+		KeepAliveTime: config.QdrantKeepAlive,
+	}
+}
+
+// dialQdrant connects to the Qdrant server of the config; tests replace it with a fake store
+var dialQdrant = func() (VectorStore, error) {
+	return qdrant.NewClient(qdrantConfigOf(appCtx.Config))
+}
+
+// withDB creates a fresh Qdrant client, sets it in appCtx.DB, calls fn, then closes the client.
+// With the in-memory backend fn runs against the process-wide memStore.
 func withDB(fn func() error) error {
-	db, err := qdrant.NewClient(&qdrant.Config{
-		Host:          appCtx.Config.QdrantHost,
-		Port:          appCtx.Config.QdrantPort,
-		KeepAliveTime: appCtx.Config.QdrantKeepAlive,
-	})
+	if appCtx.Config.StorageBackend == storageInMemory {
+		appCtx.DB = appCtx.memStore
+		return fn()
+	}
+	db, err := dialQdrant()
 	if err != nil {
 		return fmt.Errorf("error connecting to Qdrant: %w", err)
 	}
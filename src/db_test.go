@@ -0,0 +1,935 @@
+// db_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qdrant/go-client/qdrant"
+)
+
+func TestRecordRetrievalCountsDeadlineNotCancel(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.QdrantBreakerThreshold = 2
+	appCtx.Config.QdrantBreakerCooldown.Duration = time.Minute
+	qdrantBreaker = circuitBreaker{}
+	t.Cleanup(func() { qdrantBreaker = circuitBreaker{} })
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range 3 {
+		recordRetrieval(cancelled, cancelled.Err())
+	}
+	if !qdrantBreaker.allow() {
+		t.Fatal("client cancellations opened the breaker")
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	for range 2 {
+		recordRetrieval(expired, expired.Err())
+	}
+	if qdrantBreaker.allow() {
+		t.Fatal("retrievals cut off by the deadline did not open the breaker")
+	}
+}
+
+func TestUpsertFilePointsDeletesSparesOnlyAfterUpsert(t *testing.T) {
+	newTestApp(t)
+	vector := make([]float32, appCtx.Config.QdrantVectorSize)
+	vector[0] = 1
+
+	var old []AttachmentPoint
+	for _, body := range []string{"chunk one", "chunk two", "chunk three"} {
+		id := uuid.NewString()
+		if err := upsertPoint(body, vector, "rag-file", 2, 2, hashContent(body), "", &FileMeta{ID: "f"}, nil, id, 0); err != nil {
+			t.Fatalf("upsertPoint: %v", err)
+		}
+		old = append(old, AttachmentPoint{PointID: id})
+	}
+
+	// A failed upsert (bad vector size) must leave the stored version in place
+	bad, err := buildPoints("new body", vector[:1], "rag-file", 2, 2, "h", "", &FileMeta{ID: "f"}, nil, old[0].PointID, 0)
+	if err != nil {
+		t.Fatalf("buildPoints: %v", err)
+	}
+	if err := upsertFilePoints(bad, old[1:], nil); err == nil {
+		t.Fatal("upsert with a bad vector succeeded")
+	}
+	if n := len(appCtx.memStore.points); n != 3 {
+		t.Fatalf("points after failed upsert = %d, want 3", n)
+	}
+
+	good, err := buildPoints("new body", vector, "rag-file", 2, 2, "h", "", &FileMeta{ID: "f"}, nil, old[0].PointID, 0)
+	if err != nil {
+		t.Fatalf("buildPoints: %v", err)
+	}
+	if err := upsertFilePoints(good, old[1:], nil); err != nil {
+		t.Fatalf("upsertFilePoints: %v", err)
+	}
+	if n := len(appCtx.memStore.points); n != 1 {
+		t.Fatalf("points after replace = %d, want 1", n)
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	tests := []struct {
+		topK, hardLimit int64
+		want            uint64
+	}{
+		{topK: 50, hardLimit: 10000, want: 50},
+		{topK: 50, hardLimit: 20, want: 20},
+		{topK: -1, hardLimit: 20, want: 20}, // no limit still stops at SearchHardLimit
+		{topK: -1, hardLimit: 0, want: defaultSearchHardLimit},
+		{topK: 20000, hardLimit: 0, want: defaultSearchHardLimit},
+	}
+	for _, tt := range tests {
+		if got := searchLimit(tt.topK, tt.hardLimit); got != tt.want {
+			t.Errorf("searchLimit(%d, %d) = %d, want %d", tt.topK, tt.hardLimit, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCollectionTokenizerRecordsIdentity(t *testing.T) {
+	newTestApp(t)
+	appCtx.DB = appCtx.memStore
+	collection := appCtx.Config.QdrantCollection
+	info, err := appCtx.DB.GetCollectionInfo(context.Background(), collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCollectionTokenizer(collection, info); err != nil {
+		t.Fatalf("checkCollectionTokenizer: %v", err)
+	}
+	info, _ = appCtx.DB.GetCollectionInfo(context.Background(), collection)
+	if got := info.GetConfig().GetMetadata()[tokenizerMetadataKey].GetStringValue(); got != tokenizerIdentity(appCtx.Config) {
+		t.Errorf("recorded tokenizer = %q, want %q", got, tokenizerIdentity(appCtx.Config))
+	}
+}
+
+func TestDedupCandidatesStopsAtLimit(t *testing.T) {
+	newTestApp(t)
+	cand := func(id string, v ...float64) Candidate {
+		return Candidate{PointID: id, EmbeddingVector: v}
+	}
+	candidates := []Candidate{cand("a", 1, 0), cand("a2", 1, 0.01), cand("b", 0, 1), cand("c", 0.7, 0.7), cand("d", -1, 0)}
+
+	got := dedupCandidates(candidates, 0.95, 2)
+	if len(got) != 2 || got[0].PointID != "a" || got[1].PointID != "b" {
+		t.Errorf("dedupCandidates(limit 2) = %v, want a and b (a2 dropped, b refilled)", got)
+	}
+	if all := dedupCandidates(candidates, 0.95, 0); len(all) != 4 {
+		t.Errorf("dedupCandidates(no limit) kept %d, want 4", len(all))
+	}
+}
+
+func TestFetchRerankVectorsOnlyForTopN(t *testing.T) {
+	newTestApp(t)
+	// A known pair: the stored vector is 45 degrees off the query
+	vector := make([]float32, appCtx.Config.QdrantVectorSize)
+	vector[0], vector[1] = 1, 1
+	query := make([]float32, appCtx.Config.QdrantVectorSize)
+	query[0] = 1
+
+	var candidates []Candidate
+	for i, body := range []string{"low", "best", "mid", "second"} {
+		id := uuid.NewString()
+		if err := upsertPoint(body, vector, "rag-user", 1, 1, hashContent(body), "", nil, nil, id, 0); err != nil {
+			t.Fatalf("upsertPoint: %v", err)
+		}
+		candidates = append(candidates, Candidate{PointID: id, Score: []float64{0.1, 0.9, 0.5, 0.8}[i], Payload: Payload{Body: body}})
+	}
+
+	fetchRerankVectors(context.Background(), query, candidates, 2)
+	for i, cand := range candidates {
+		fetched := cand.EmbeddingVector != nil
+		if want := i < 2; fetched != want {
+			t.Errorf("candidate %q (rank %d): vector fetched %t, want %t", cand.Payload.Body, i, fetched, want)
+		}
+		want := 0.0
+		if i < 2 {
+			want = math.Sqrt2 / 2
+		}
+		if math.Abs(cand.Features.LocalCosine-want) > 1e-6 {
+			t.Errorf("candidate %q (rank %d): LocalCosine %f, want %f", cand.Payload.Body, i, cand.Features.LocalCosine, want)
+		}
+	}
+	if candidates[0].Payload.Body != "best" || candidates[1].Payload.Body != "second" {
+		t.Errorf("rerank set %q, %q; want best, second", candidates[0].Payload.Body, candidates[1].Payload.Body)
+	}
+}
+
+// collectionStores is a Qdrant stand-in serving each collection from its own memStore and counting
+// the writes per collection
+type collectionStores struct {
+	mu     sync.Mutex
+	stores map[string]*memStore
+	writes map[string]int
+}
+
+// useCollectionStores switches withDB to a collectionStores holding the test memStore as
+// QdrantCollection and empty collections named extra
+func useCollectionStores(t *testing.T, extra ...string) *collectionStores {
+	t.Helper()
+	c := &collectionStores{
+		stores: map[string]*memStore{appCtx.Config.QdrantCollection: appCtx.memStore},
+		writes: make(map[string]int),
+	}
+	for _, name := range extra {
+		s := newMemStore()
+		s.collection, s.size, s.distance = name, uint64(appCtx.Config.QdrantVectorSize), qdrant.Distance_Cosine
+		c.stores[name] = s
+	}
+	appCtx.Config.StorageBackend = "qdrant"
+	dial := dialQdrant
+	dialQdrant = func() (VectorStore, error) { return c, nil }
+	t.Cleanup(func() { dialQdrant = dial })
+	return c
+}
+
+func (c *collectionStores) store(name string, write bool) *memStore {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if write {
+		c.writes[name]++
+	}
+	if s, ok := c.stores[name]; ok {
+		return s
+	}
+	return newMemStore() // answers "not found"
+}
+
+func (c *collectionStores) written(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes[name]
+}
+
+func (c *collectionStores) CollectionExists(ctx context.Context, name string) (bool, error) {
+	return c.store(name, false).CollectionExists(ctx, name)
+}
+
+func (c *collectionStores) GetCollectionInfo(ctx context.Context, name string) (*qdrant.CollectionInfo, error) {
+	return c.store(name, false).GetCollectionInfo(ctx, name)
+}
+
+func (c *collectionStores) CreateCollection(ctx context.Context, r *qdrant.CreateCollection) error {
+	s := c.store(r.GetCollectionName(), true)
+	if err := s.CreateCollection(ctx, r); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.stores[r.GetCollectionName()] = s
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *collectionStores) UpdateCollection(ctx context.Context, r *qdrant.UpdateCollection) error {
+	return c.store(r.GetCollectionName(), true).UpdateCollection(ctx, r)
+}
+
+func (c *collectionStores) CreateFieldIndex(ctx context.Context, r *qdrant.CreateFieldIndexCollection) (*qdrant.UpdateResult, error) {
+	return c.store(r.GetCollectionName(), true).CreateFieldIndex(ctx, r)
+}
+
+func (c *collectionStores) Upsert(ctx context.Context, r *qdrant.UpsertPoints) (*qdrant.UpdateResult, error) {
+	return c.store(r.GetCollectionName(), true).Upsert(ctx, r)
+}
+
+func (c *collectionStores) Delete(ctx context.Context, r *qdrant.DeletePoints) (*qdrant.UpdateResult, error) {
+	return c.store(r.GetCollectionName(), true).Delete(ctx, r)
+}
+
+func (c *collectionStores) Get(ctx context.Context, r *qdrant.GetPoints) ([]*qdrant.RetrievedPoint, error) {
+	return c.store(r.GetCollectionName(), false).Get(ctx, r)
+}
+
+func (c *collectionStores) Scroll(ctx context.Context, r *qdrant.ScrollPoints) ([]*qdrant.RetrievedPoint, error) {
+	return c.store(r.GetCollectionName(), false).Scroll(ctx, r)
+}
+
+func (c *collectionStores) ScrollAndOffset(ctx context.Context, r *qdrant.ScrollPoints) ([]*qdrant.RetrievedPoint, *qdrant.PointId, error) {
+	return c.store(r.GetCollectionName(), false).ScrollAndOffset(ctx, r)
+}
+
+func (c *collectionStores) Query(ctx context.Context, r *qdrant.QueryPoints) ([]*qdrant.ScoredPoint, error) {
+	return c.store(r.GetCollectionName(), false).Query(ctx, r)
+}
+
+func (c *collectionStores) SetPayload(ctx context.Context, r *qdrant.SetPayloadPoints) (*qdrant.UpdateResult, error) {
+	return c.store(r.GetCollectionName(), true).SetPayload(ctx, r)
+}
+
+func (c *collectionStores) Close() error { return nil }
+
+// putTestPoint stores body as a point of role into the collection, timestamped age ago
+func putTestPoint(t *testing.T, s *memStore, body, role string, age time.Duration) {
+	t.Helper()
+	points, err := buildPoints(body, testVector(body), role, 1, 1, hashContent(body), "", nil, nil, uuid.NewString(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points[0].Payload["timestamp"] = qdrant.NewValueDouble(float64(time.Now().Add(-age).UnixNano()))
+	if _, err := s.Upsert(context.Background(), &qdrant.UpsertPoints{CollectionName: s.collection, Points: points[:1]}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKnowledgeBaseSearchedWithoutTimeWindowAndNeverWritten(t *testing.T) {
+	newTestApp(t)
+	useFakeOllama(t, &fakeEmbeddings{})
+	stores := useCollectionStores(t, "kb")
+	appCtx.Config.KnowledgeBaseCollection = "kb"
+	appCtx.Config.SearchSource = []string{"rag-user", "rag-file"}
+	appCtx.Config.SearchMaxAgeDays, appCtx.Config.SearchMinAgeHours = 30, 0
+	appCtx.Config.SearchCollections = nil
+	appCtx.Config.CosineMinScore = 0
+
+	const year = 365 * 24 * time.Hour
+	putTestPoint(t, appCtx.memStore, "recent turn", "rag-user", time.Hour)
+	putTestPoint(t, appCtx.memStore, "old turn", "rag-user", year)
+	putTestPoint(t, stores.stores["kb"], "old manual", "rag-file", year)
+
+	if err := withDB(func() error { return checkKnowledgeBaseCollection(qdrant.Distance_Cosine) }); err != nil {
+		t.Fatalf("checkKnowledgeBaseCollection: %v", err)
+	}
+	candidates, err := SearchRelevantContent(context.Background(), testVector("query"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range candidates {
+		got = append(got, c.Collection+":"+c.Payload.Body)
+	}
+	slices.Sort(got)
+	if want := []string{":recent turn", "kb:old manual"}; !slices.Equal(got, want) {
+		t.Errorf("found %q, want %q: the time window applies to the main collection only", got, want)
+	}
+
+	job := outboundJob{cleanUserContent: "a question", cleanAssistantContent: "an answer"}
+	if err := processOutbound(&job); err != nil {
+		t.Fatal(err)
+	}
+	if n := stores.written(appCtx.Config.QdrantCollection); n == 0 {
+		t.Error("the exchange was not stored in QdrantCollection")
+	}
+	if n := stores.written("kb"); n != 0 {
+		t.Errorf("%d writes to the knowledge base collection, want none", n)
+	}
+}
+
+func TestSearchTimeWindow(t *testing.T) {
+	const day = 24 * time.Hour
+	ages := map[string]time.Duration{
+		"ten minutes": 10 * time.Minute,
+		"two hours":   2 * time.Hour,
+		"two days":    2 * day,
+		"ten days":    10 * day,
+		"forty days":  40 * day,
+	}
+	cases := []struct {
+		name        string
+		maxAgeDays  int64
+		minAgeHours int64
+		want        []string
+	}{
+		{"no window", 0, 0, []string{"forty days", "ten days", "ten minutes", "two days", "two hours"}},
+		{"older bound", 7, 0, []string{"ten minutes", "two days", "two hours"}},
+		{"newer bound", 0, 1, []string{"forty days", "ten days", "two days", "two hours"}},
+		{"range", 7, 1, []string{"two days", "two hours"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestApp(t)
+			useRerankTestConfig(appCtx.Config.DefaultWeights)
+			for body, age := range ages {
+				putTestPoint(t, appCtx.memStore, body, "rag-user", age)
+			}
+			appCtx.Config.SearchMaxAgeDays, appCtx.Config.SearchMinAgeHours = tc.maxAgeDays, tc.minAgeHours
+
+			candidates, err := SearchRelevantContent(context.Background(), testVector("query"), "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range candidates {
+				got = append(got, c.Payload.Body)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("found %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	newTestApp(t)
+	config := appCtx.Config
+	config.SearchMaxAgeDays, config.SearchMinAgeHours = 7, 1
+	if err := validateConfig(config); err != nil {
+		t.Errorf("window of 1 hour to 7 days rejected: %v", err)
+	}
+	config.SearchMaxAgeDays, config.SearchMinAgeHours = 1, 24
+	if err := validateConfig(config); err == nil {
+		t.Error("SearchMinAgeHours 24 accepted with SearchMaxAgeDays 1: the window is empty")
+	}
+}
+
+func TestDuplicateAssistantMessageStoredOnce(t *testing.T) {
+	cases := []struct {
+		threshold float32
+		want      int
+	}{
+		{0, 2},
+		{0.95, 1},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("threshold %v", tc.threshold), func(t *testing.T) {
+			newTestApp(t)
+			useFakeOllama(t, &fakeEmbeddings{})
+			appCtx.Config.QdrantMetric = "Cosine"
+			appCtx.Config.DedupCosineThreshold = tc.threshold
+
+			var stamps []float64
+			for _, prompt := range []string{"how do I restart it?", "and how do I restart it now?"} {
+				job := outboundJob{cleanUserContent: prompt, cleanAssistantContent: "Run systemctl restart ragproxy."}
+				if err := processOutbound(&job); err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range storedPoints(t, "rag-assistant") {
+					stamps = append(stamps, p.GetPayload()["timestamp"].GetDoubleValue())
+				}
+			}
+
+			if n := len(storedPoints(t, "rag-assistant")); n != tc.want {
+				t.Errorf("%d assistant points stored, want %d", n, tc.want)
+			}
+			if n := len(storedPoints(t, "rag-user")); n != 2 {
+				t.Errorf("%d user points stored, want both different prompts", n)
+			}
+			if tc.want == 1 && (len(stamps) != 2 || stamps[1] <= stamps[0]) {
+				t.Errorf("timestamps %v: the duplicate did not refresh the existing point", stamps)
+			}
+		})
+	}
+}
+
+// onlyFeature returns rerank weights scoring by the named feature alone
+func onlyFeature(name string) []float64 {
+	weights := make([]float64, len(featureNames))
+	weights[slices.Index(featureNames, name)] = 1
+	return weights
+}
+
+// useRerankTestConfig makes every search hit a rerank candidate and passes all of them, scored by weights
+func useRerankTestConfig(weights []float64) {
+	appCtx.Config.CosineMinScore = -1
+	appCtx.Config.MinRankScore = -1
+	appCtx.Config.RankScoreNormalization = "none"
+	appCtx.Config.FeedDedupCosine = 0
+	appCtx.Config.RerankTopN = 0
+	appCtx.Config.SearchMaxAgeDays, appCtx.Config.SearchMinAgeHours = 0, 0
+	appCtx.Config.SearchSource = []string{"rag-user", "rag-assistant", "rag-file"}
+	appCtx.Config.DefaultWeights = weights
+}
+
+// rerankBodies returns the bodies of the rerank result for query, best first
+func rerankBodies(t *testing.T, query string, opts RequestOptions) []string {
+	t.Helper()
+	candidates, err := rerankCandidates(context.Background(), testVector(query), query, hashContent(query), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := make([]string, len(candidates))
+	for i, c := range candidates {
+		bodies[i] = c.Payload.Body
+	}
+	return bodies
+}
+
+func TestCompressedBodyRoundTripsNextToPlainPoints(t *testing.T) {
+	newTestApp(t)
+	useRerankTestConfig(appCtx.Config.DefaultWeights)
+
+	// An old point from before StoreBodyCompressed, without body_encoding
+	plain := "plain body stored before compression was enabled"
+	putTestPoint(t, appCtx.memStore, plain, "rag-user", time.Hour)
+
+	appCtx.Config.StoreBodyCompressed = true
+	var sb strings.Builder
+	for i := 0; sb.Len() < 1<<20; i++ {
+		fmt.Fprintf(&sb, "line %d of a large attachment, with ünïcödé\n", i)
+	}
+	large := sb.String()
+	id := uuid.NewString()
+	points, err := buildPoints(large, testVector(large), "rag-file", 1, 1, hashContent(large), "", nil, nil, id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appCtx.memStore.Upsert(context.Background(), &qdrant.UpsertPoints{CollectionName: appCtx.memStore.collection, Points: points[:1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := appCtx.memStore.points[id].payload
+	if stored["body_encoding"].GetStringValue() != bodyEncodingGzip {
+		t.Fatalf("body_encoding = %q", stored["body_encoding"].GetStringValue())
+	}
+	if n := len(stored["body"].GetStringValue()); n >= len(large)/4 {
+		t.Errorf("stored body is %d bytes for a %d-byte text", n, len(large))
+	}
+
+	got, err := getPointBodyByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != large {
+		t.Errorf("round trip returned %d bytes, want the %d-byte original", len(got), len(large))
+	}
+
+	// Both kinds of points come back readable from the search
+	bodies := rerankBodies(t, plain, RequestOptions{})
+	slices.Sort(bodies)
+	if want := []string{large, plain}; !slices.Equal(bodies, want) {
+		t.Errorf("search returned %d bodies, not the plain and the decompressed one", len(bodies))
+	}
+}
+
+func TestPrunePointsDeletesOnlyMatching(t *testing.T) {
+	const day = 24 * time.Hour
+	seed := []struct {
+		body, role, fileID string
+		age                time.Duration
+	}{
+		{"old question", "rag-user", "", 60 * day},
+		{"new question", "rag-user", "", day},
+		{"old answer", "rag-assistant", "", 60 * day},
+		{"new answer", "rag-assistant", "", day},
+		{"old file part", "rag-file", "f1", 60 * day},
+		{"new file part", "rag-file", "f2", day},
+	}
+	cases := []struct {
+		name          string
+		olderThanDays int
+		role, fileID  string
+		deleted       []string
+	}{
+		{"age", 30, "", "", []string{"old answer", "old file part", "old question"}},
+		{"role", 0, "rag-assistant", "", []string{"new answer", "old answer"}},
+		{"file", 0, "", "f2", []string{"new file part"}},
+		{"age and role", 30, "rag-user", "", []string{"old question"}},
+		{"nothing matches", 90, "", "", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestApp(t)
+			appCtx.Config.SummaryEmbedding = false
+			for _, s := range seed {
+				id := uuid.NewString()
+				tokens := calculateTokens(s.body)
+				if err := upsertPoint(s.body, testVector(s.body), s.role, tokens, tokens, hashContent(s.body), "", &FileMeta{ID: s.fileID}, nil, id, 0); err != nil {
+					t.Fatal(err)
+				}
+				appCtx.memStore.points[id].payload["timestamp"] = qdrant.NewValueDouble(float64(time.Now().Add(-s.age).UnixNano()))
+			}
+
+			n, err := prunePoints(tc.olderThanDays, tc.role, tc.fileID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for _, p := range appCtx.memStore.points {
+				kept = append(kept, payloadBody(p.payload))
+			}
+			var deleted []string
+			for _, s := range seed {
+				if !slices.Contains(kept, s.body) {
+					deleted = append(deleted, s.body)
+				}
+			}
+			slices.Sort(deleted)
+			if n != len(tc.deleted) || !slices.Equal(deleted, tc.deleted) {
+				t.Errorf("deleted %d: %q, want %q", n, deleted, tc.deleted)
+			}
+			if got := appCtx.IDFStore.N; got != uint64(len(kept)) {
+				t.Errorf("IDF counts %d documents, %d are left", got, len(kept))
+			}
+		})
+	}
+
+	if _, err := prunePoints(0, "", ""); err == nil {
+		t.Error("prune without a filter accepted")
+	}
+}
+
+func TestPlanAttachmentSyncPagesThroughManyChunks(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.AttachmentScrollPageSize = 7
+	store := func(body string, meta FileMeta) {
+		t.Helper()
+		points, err := buildPoints(body, testVector(body), "rag-file", 1, 1, hashContent(body), "", &meta, nil, uuid.NewString(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := appCtx.memStore.Upsert(context.Background(), &qdrant.UpsertPoints{CollectionName: appCtx.memStore.collection, Points: points[:1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const chunks = 40
+	for i := range chunks {
+		store(fmt.Sprintf("chunk %d of the big file", i), FileMeta{ID: "big", Path: "big.go", Hash: "big-v1", Chunk: i, Chunks: chunks})
+	}
+	small := "the small file"
+	store(small, FileMeta{ID: "small", Path: "small.go"})
+
+	attachments := []Attachment{
+		{ID: "big", Path: "big.go", Body: "big file, second version", Hash: "big-v2"},
+		{ID: "small", Path: "small.go", Body: small, Hash: hashContent(small)},
+		{ID: "new", Path: "new.go", Body: "a new file", Hash: hashContent("a new file")},
+	}
+	toInsert, toReplace, err := planAttachmentSync(attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toReplace) != 1 || toReplace[0].Attachment.ID != "big" || len(toReplace[0].OldPoints) != chunks {
+		t.Fatalf("replace plan %+v, want the big file with all %d chunks", toReplace, chunks)
+	}
+	ids := make(map[string]bool)
+	for _, p := range toReplace[0].OldPoints {
+		ids[p.PointID] = true
+	}
+	if len(ids) != chunks {
+		t.Errorf("old points list %d distinct points, want %d", len(ids), chunks)
+	}
+	if len(toInsert) != 1 || toInsert[0].Attachment.ID != "new" {
+		t.Errorf("insert plan %+v, want the new file only", toInsert)
+	}
+
+	// Distinct files past the cap are left alone
+	appCtx.Config.MaxAttachmentIDsPerRequest = 2
+	toInsert, toReplace, err = planAttachmentSync(attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toInsert) != 0 || len(toReplace) != 1 {
+		t.Errorf("with a cap of 2 files: %d inserts, %d replacements; want 0 and 1", len(toInsert), len(toReplace))
+	}
+}
+
+func TestPlanAttachmentSyncSeesPointsPastTheScrollLimit(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.AttachmentScrollPageSize = 0 // one point per page for a single file ID
+	now := time.Now()
+	var stored []string
+	store := func(body string, meta FileMeta, age time.Duration) {
+		t.Helper()
+		id := uuid.NewString()
+		points, err := buildPoints(body, testVector(body), "rag-file", 1, 1, hashContent(body), "", &meta, nil, id, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points[0].Payload["timestamp"] = qdrant.NewValueDouble(float64(now.Add(-age).UnixNano()))
+		if _, err := appCtx.memStore.Upsert(context.Background(), &qdrant.UpsertPoints{CollectionName: appCtx.memStore.collection, Points: points[:1]}); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, id)
+	}
+	// Two stale versions left behind, then the current one in three chunks
+	store("first version", FileMeta{ID: "f", Path: "f.go"}, 3*time.Hour)
+	store("second version", FileMeta{ID: "f", Path: "f.go"}, 2*time.Hour)
+	for i := range 3 {
+		store(fmt.Sprintf("current chunk %d", i), FileMeta{ID: "f", Path: "f.go", Hash: "v3", Chunk: i, Chunks: 3}, time.Hour)
+	}
+
+	toInsert, toReplace, err := planAttachmentSync([]Attachment{{ID: "f", Path: "f.go", Body: "current", Hash: "v3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toInsert)+len(toReplace) != 0 {
+		t.Errorf("current version planned for %d inserts and %d replacements", len(toInsert), len(toReplace))
+	}
+
+	toInsert, toReplace, err = planAttachmentSync([]Attachment{{ID: "f", Path: "f.go", Body: "edited", Hash: "v4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toInsert) != 0 || len(toReplace) != 1 {
+		t.Fatalf("edited file planned for %d inserts and %d replacements, want one replacement", len(toInsert), len(toReplace))
+	}
+	var old []string
+	for _, p := range toReplace[0].OldPoints {
+		old = append(old, p.PointID)
+	}
+	slices.Sort(old)
+	slices.Sort(stored)
+	if !slices.Equal(old, stored) {
+		t.Errorf("replacement lists %d old points, want all %d stored", len(old), len(stored))
+	}
+}
+
+func TestMinRankScoreFallbackKeepsBestCandidate(t *testing.T) {
+	newTestApp(t)
+	useRerankTestConfig(onlyFeature("EmbSim"))
+	for _, body := range []string{"the best match", "some other text", "unrelated note"} {
+		putTestPoint(t, appCtx.memStore, body, "rag-user", time.Hour)
+	}
+	appCtx.Config.MinRankScore = 2 // above any candidate
+	appCtx.Config.RerankTopN = 1
+
+	appCtx.Config.MinRankScoreMode = "strict"
+	if got := rerankBodies(t, "the best match", RequestOptions{}); len(got) != 0 {
+		t.Errorf("strict mode returned %q", got)
+	}
+	appCtx.Config.MinRankScoreMode = "fallback-topn"
+	if got := rerankBodies(t, "the best match", RequestOptions{}); len(got) != 1 || got[0] != "the best match" {
+		t.Errorf("fallback-topn returned %q, want the single best candidate", got)
+	}
+}
+
+func TestCollectionAndLangMultipliersApplyBeforeMinRankScore(t *testing.T) {
+	newTestApp(t)
+	stores := useCollectionStores(t, "shared")
+	useRerankTestConfig(onlyFeature("EmbSim"))
+	appCtx.Config.LangDetectEnabled = true
+	appCtx.Config.KnowledgeBaseCollection = ""
+
+	// Both points match the query exactly, so only the multipliers tell them apart
+	const query = "parser notes"
+	for store, body := range map[*memStore]string{appCtx.memStore: "history parser notes", stores.stores["shared"]: "общие заметки о парсере"} {
+		points, err := buildPoints(body, testVector(query), "rag-user", 1, 1, hashContent(body), "", nil, nil, uuid.NewString(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Upsert(context.Background(), &qdrant.UpsertPoints{CollectionName: store.collection, Points: points[:1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name         string
+		shared       float64
+		langMode     string
+		minRankScore float64
+		want         []string
+	}{
+		{"shared weighted up", 2, "off", -1, []string{"общие заметки о парсере", "history parser notes"}},
+		{"shared weighted down", 0.5, "off", -1, []string{"history parser notes", "общие заметки о парсере"}},
+		{"filtered after weighting", 0.5, "off", 0.75, []string{"history parser notes"}},
+		{"lang boost outweighs collection", 1.5, "boost", -1, []string{"history parser notes", "общие заметки о парсере"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			appCtx.Config.SearchCollections = map[string]float64{appCtx.Config.QdrantCollection: 1, "shared": tc.shared}
+			appCtx.Config.LangMode, appCtx.Config.LangBoost = tc.langMode, 1
+			appCtx.Config.MinRankScore = tc.minRankScore
+			if got := rerankBodies(t, query, RequestOptions{}); !slices.Equal(got, tc.want) {
+				t.Errorf("rerank = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMustIncludeDropsSimilarCandidatesWithoutTheTerm(t *testing.T) {
+	newTestApp(t)
+	useRerankTestConfig(onlyFeature("EmbSim"))
+	appCtx.Config.MustIncludeEnabled = true
+	appCtx.mustIncludeExtractReg = regexp.MustCompile(appCtx.Config.MustIncludeExtractReg)
+
+	// All points are embedding-identical to the query
+	const query = `where is +"parseConfig" called?`
+	for _, body := range []string{"parseConfig is called from main", "the config parser is called from main", "PARSECONFIG fills the defaults"} {
+		points, err := buildPoints(body, testVector(query), "rag-user", 1, 1, hashContent(body), "", nil, nil, uuid.NewString(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := appCtx.memStore.Upsert(context.Background(), &qdrant.UpsertPoints{CollectionName: appCtx.memStore.collection, Points: points[:1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := rerankBodies(t, query, RequestOptions{}); len(got) != 3 {
+		t.Fatalf("without terms rerank = %q, want all three", got)
+	}
+	terms := extractMustInclude(query)
+	if !slices.Equal(terms, []string{"parseConfig"}) {
+		t.Fatalf("extracted terms %q, want [parseConfig]", terms)
+	}
+	got := rerankBodies(t, query, RequestOptions{MustInclude: terms})
+	slices.Sort(got)
+	if want := []string{"PARSECONFIG fills the defaults", "parseConfig is called from main"}; !slices.Equal(got, want) {
+		t.Errorf("rerank with must-include = %q, want %q", got, want)
+	}
+}
+
+// indexRecorder is the test memStore recording the CreateFieldIndex calls
+type indexRecorder struct {
+	*memStore
+	created map[string]qdrant.FieldType
+}
+
+func (r *indexRecorder) CreateFieldIndex(ctx context.Context, request *qdrant.CreateFieldIndexCollection) (*qdrant.UpdateResult, error) {
+	r.created[request.GetFieldName()] = request.GetFieldType()
+	return r.memStore.CreateFieldIndex(ctx, request)
+}
+
+func TestEnsurePayloadIndexesCreatesMissingOnes(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.ThreadsEnabled, appCtx.Config.LangDetectEnabled = false, false
+	appCtx.Config.TTLHeader, appCtx.Config.TTLByRole = "", nil
+	recorder := &indexRecorder{memStore: appCtx.memStore, created: make(map[string]qdrant.FieldType)}
+	appCtx.DB = recorder
+
+	if err := ensurePayloadIndexes(nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]qdrant.FieldType{
+		"hash":         qdrant.FieldType_FieldTypeKeyword,
+		"role":         qdrant.FieldType_FieldTypeKeyword,
+		"file_meta.id": qdrant.FieldType_FieldTypeKeyword,
+		"timestamp":    qdrant.FieldType_FieldTypeFloat,
+	}
+	if !maps.Equal(recorder.created, want) {
+		t.Errorf("created indexes %v, want %v", recorder.created, want)
+	}
+
+	// Indexes already in the schema are skipped
+	clear(recorder.created)
+	if err := ensurePayloadIndexes(map[string]*qdrant.PayloadSchemaInfo{"hash": {}, "timestamp": {}}); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "hash")
+	delete(want, "timestamp")
+	if !maps.Equal(recorder.created, want) {
+		t.Errorf("created indexes %v next to an existing schema, want %v", recorder.created, want)
+	}
+}
+
+func TestReplacingAttachmentKeepsIDFTotalTokens(t *testing.T) {
+	newTestApp(t)
+	useFakeOllama(t, &fakeEmbeddings{})
+	appCtx.Config.EmbeddingSingleFlight = false
+	appCtx.Config.SummaryEmbedding = false
+	appCtx.Config.PerRoleIDF = false
+	initEmptyIDFStore()
+
+	v1 := "func main() { run the server with the default config }"
+	v2 := "func main() { run }"
+	if err := storeAttachments([]Attachment{{ID: "main", Path: "main.go", Body: v1, Hash: hashContent(v1)}}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := appCtx.IDFStore.TotalTokens, int64(calculateTokens(v1)); got != want {
+		t.Fatalf("TotalTokens after insert = %d, want %d", got, want)
+	}
+
+	_, toReplace, err := planAttachmentSync([]Attachment{{ID: "main", Path: "main.go", Body: v2, Hash: hashContent(v2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toReplace) != 1 || len(toReplace[0].OldPoints) != 1 || toReplace[0].OldPoints[0].CleanTokenCount != calculateTokens(v1) {
+		t.Fatalf("replace plan %+v, want the stored clean token count %d", toReplace, calculateTokens(v1))
+	}
+
+	if err := storeAttachments([]Attachment{{ID: "main", Path: "main.go", Body: v2, Hash: hashContent(v2)}}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if appCtx.IDFStore.N != 1 || appCtx.IDFStore.TotalTokens != int64(calculateTokens(v2)) {
+		t.Errorf("after replace N = %d, TotalTokens = %d; want 1 and %d", appCtx.IDFStore.N, appCtx.IDFStore.TotalTokens, calculateTokens(v2))
+	}
+}
+
+func TestRecentlyEditedFileRanksAboveStaleChunks(t *testing.T) {
+	newTestApp(t)
+	useRerankTestConfig(onlyFeature("EmbSim"))
+	appCtx.Config.EmbeddingSingleFlight = false
+	appCtx.Config.SummaryEmbedding = false
+	appCtx.Config.EditRecencyBoost = 1
+	appCtx.Config.EditRecencyWindow.Duration = time.Hour
+	t.Cleanup(func() {
+		recentEdits.mu.Lock()
+		clear(recentEdits.at)
+		recentEdits.mu.Unlock()
+	})
+
+	// The query matches the stale chunk exactly and the attached file at 45 degrees
+	query := make([]float32, appCtx.Config.QdrantVectorSize)
+	query[0] = 1
+	useFakeOllama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vector := make([]float32, appCtx.Config.QdrantVectorSize)
+		vector[0], vector[1] = 1, 1
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"embedding": vector, "embeddings": [][]float32{vector}})
+	}))
+	const stale = "stale chunk of an old file"
+	points, err := buildPoints(stale, query, "rag-file", 1, 1, hashContent(stale), "", &FileMeta{ID: "old", Path: "old.go"}, nil, uuid.NewString(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appCtx.memStore.Upsert(context.Background(), &qdrant.UpsertPoints{CollectionName: appCtx.memStore.collection, Points: points[:1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	ranked := func() []string {
+		candidates, err := rerankCandidates(context.Background(), query, "main", hashContent("main"), RequestOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bodies []string
+		for _, c := range candidates {
+			bodies = append(bodies, c.Payload.Body)
+		}
+		return bodies
+	}
+	for i, body := range []string{"func main() {}", "func main() { run() }"} {
+		if err := storeAttachments([]Attachment{{ID: "main", Path: "main.go", Body: body, Hash: hashContent(body)}}, "", 0); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{stale, body} // first attached, not edited yet
+		if i > 0 {
+			want = []string{body, stale}
+		}
+		if got := ranked(); !slices.Equal(got, want) {
+			t.Errorf("after sync %d: ranked %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestQdrantConfigPassesAPIKeyAndTLS(t *testing.T) {
+	newTestApp(t)
+	config := appCtx.Config
+	config.QdrantHost, config.QdrantPort = "qdrant.example.com", 6334
+	config.QdrantAPIKey, config.QdrantUseTLS = "cloud-key", true
+	config.QdrantKeepAlive = 30
+
+	got := qdrantConfigOf(config)
+	if got.Host != "qdrant.example.com" || got.Port != 6334 || got.KeepAliveTime != 30 {
+		t.Errorf("address %s:%d keep-alive %d, want the configured ones", got.Host, got.Port, got.KeepAliveTime)
+	}
+	if got.APIKey != "cloud-key" || !got.UseTLS {
+		t.Errorf("APIKey %q, UseTLS %t; want the key over TLS", got.APIKey, got.UseTLS)
+	}
+
+	// An API key without TLS is accepted with a warning
+	var journal bytes.Buffer
+	appCtx.JournaldLogger = log.New(&journal, "", 0)
+	config.QdrantUseTLS = false
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("API key without TLS rejected: %v", err)
+	}
+	if !strings.Contains(journal.String(), "QdrantAPIKey") {
+		t.Errorf("no warning about the plain text API key, journal: %q", journal.String())
+	}
+	if qdrantConfigOf(config).UseTLS {
+		t.Error("UseTLS set although QdrantUseTLS is disabled")
+	}
+}
@@ -0,0 +1,145 @@
+// deadletter.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// deadLetter is the on-disk form of a failed outboundJob in DeadLetterDir
+type deadLetter struct {
+	At               time.Time    `json:"at"`
+	Error            string       `json:"error"`
+	Attempts         int          `json:"attempts"`
+	UserContent      string       `json:"user_content"`
+	AssistantContent string       `json:"assistant_content"`
+	Attachments      []Attachment `json:"attachments,omitempty"`
+	PromptVector     []float32    `json:"prompt_vector,omitempty"`
+	QueryHash        string       `json:"query_hash"`
+	ThreadID         string       `json:"thread_id,omitempty"`
+	ThreadSeq        int          `json:"thread_seq,omitempty"`
+	TTL              Duration     `json:"ttl,omitempty"`
+	PacketID         string       `json:"packet_id"`
+	UserStored       bool         `json:"user_stored"`
+	AssistantStored  bool         `json:"assistant_stored"`
+}
+
+// newDeadLetter records job with the error that stopped it
+func newDeadLetter(job *outboundJob, cause error) deadLetter {
+	return deadLetter{
+		At:               time.Now(),
+		Error:            cause.Error(),
+		Attempts:         1,
+		UserContent:      job.cleanUserContent,
+		AssistantContent: job.cleanAssistantContent,
+		Attachments:      job.attachments,
+		PromptVector:     job.promptVector,
+		QueryHash:        job.queryHash,
+		ThreadID:         job.thread.ID,
+		ThreadSeq:        job.thread.Seq,
+		TTL:              Duration{job.ttl},
+		PacketID:         job.packetID,
+		UserStored:       job.userStored,
+		AssistantStored:  job.assistantStored,
+	}
+}
+
+// job restores the outboundJob of the dead letter
+func (d deadLetter) job() outboundJob {
+	return outboundJob{
+		cleanAssistantContent: d.AssistantContent,
+		cleanUserContent:      d.UserContent,
+		attachments:           d.Attachments,
+		promptVector:          d.PromptVector,
+		queryHash:             d.QueryHash,
+		thread:                ThreadRef{ID: d.ThreadID, Seq: d.ThreadSeq},
+		ttl:                   d.TTL.Duration,
+		packetID:              d.PacketID,
+		userStored:            d.UserStored,
+		assistantStored:       d.AssistantStored,
+	}
+}
+
+// writeDeadLetter saves a failed job as a JSON file in DeadLetterDir. Does nothing when
+// DeadLetterDir is not set.
+func writeDeadLetter(job *outboundJob, cause error) {
+	dir := appCtx.Config.DeadLetterDir
+	if dir == "" {
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.json", time.Now().UTC().Format("20060102T150405"), uuid.NewString()))
+	if err := saveDeadLetter(path, newDeadLetter(job, cause)); err != nil {
+		appCtx.ErrorLogger.Printf("Error writing dead letter, exchange is lost: %v", err)
+		appCtx.JournaldLogger.Printf("Error writing dead letter, exchange is lost: %v", err)
+		return
+	}
+	appCtx.JournaldLogger.Printf("Failed store written to dead letter %s", path)
+}
+
+// saveDeadLetter writes d to path, creating DeadLetterDir if needed
+func saveDeadLetter(path string, d deadLetter) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// replayDeadLetters re-attempts every dead letter in dir, oldest first. Stored ones are removed;
+// failed ones are kept with the new error and progress. Returns the counts of both.
+func replayDeadLetters(dir string) (replayed int, failed int, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names) // names start with the UTC time of the failure
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return replayed, failed, err
+		}
+		var d deadLetter
+		if err := json.Unmarshal(data, &d); err != nil {
+			appCtx.ErrorLogger.Printf("Skipping unreadable dead letter %s: %v", path, err)
+			failed++
+			continue
+		}
+
+		job := d.job()
+		if err := processOutbound(&job); err != nil {
+			failed++
+			attempts := d.Attempts + 1
+			d = newDeadLetter(&job, err)
+			d.Attempts = attempts
+			if err := saveDeadLetter(path, d); err != nil {
+				return replayed, failed, err
+			}
+			appCtx.ErrorLogger.Printf("Replay of dead letter %s failed: %s", path, d.Error)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return replayed, failed, err
+		}
+		replayed++
+		appCtx.JournaldLogger.Printf("Dead letter %s replayed", path)
+	}
+	return replayed, failed, nil
+}
@@ -0,0 +1,48 @@
+// editrecency.go
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentEdits tracks when each file (file_meta.id) was last replaced by an attachment sync
+var recentEdits = struct {
+	mu sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// recordFileEdit notes that the stored version of fileID was just replaced, and forgets edits
+// older than EditRecencyWindow
+func recordFileEdit(fileID string) {
+	window := appCtx.Config.EditRecencyWindow.Duration
+	if appCtx.Config.EditRecencyBoost <= 0 || window <= 0 || fileID == "" {
+		return
+	}
+	now := time.Now()
+	recentEdits.mu.Lock()
+	defer recentEdits.mu.Unlock()
+	for id, at := range recentEdits.at {
+		if now.Sub(at) > window {
+			delete(recentEdits.at, id)
+		}
+	}
+	recentEdits.at[fileID] = now
+}
+
+// editRecencyBoost returns the score multiplier of a rag-file candidate: 1 + EditRecencyBoost for a
+// file edited just now, falling linearly to 1 at EditRecencyWindow
+func editRecencyBoost(p Payload) float64 {
+	window := appCtx.Config.EditRecencyWindow.Duration
+	if appCtx.Config.EditRecencyBoost <= 0 || window <= 0 || p.Role != "rag-file" || p.FileMeta.ID == "" {
+		return 1
+	}
+	recentEdits.mu.Lock()
+	at, ok := recentEdits.at[p.FileMeta.ID]
+	recentEdits.mu.Unlock()
+	age := time.Since(at)
+	if !ok || age >= window {
+		return 1
+	}
+	return 1 + appCtx.Config.EditRecencyBoost*(1-float64(age)/float64(window))
+}
@@ -2,13 +2,106 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"math"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
 )
 
+// minWeightsCount is the number of weights required in DefaultWeights; features added
+// after the original nine get a zero weight when their slot is omitted.
+const minWeightsCount = 9
+
+// BM25NormMode values
+const (
+	bm25NormLogistic = "logistic"
+	bm25NormLog      = "log"
+	bm25NormExp      = "exp"
+)
+
+// QueryTokenStrategy values
+const (
+	queryTokensTruncateTail = "truncate-tail"
+	queryTokensTruncateHead = "truncate-head"
+	queryTokensTopIDF       = "top-idf"
+)
+
+// featureNames lists the Features fields in weight order (index i is DefaultWeights[i]).
+var featureNames = []string{
+	"EmbSim",
+	"Recency",
+	"RoleScore",
+	"BodyLen",
+	"KeywordOverlap",
+	"WeightedOverlap",
+	"BM25",
+	"NgramOverlap",
+	"WeightedNgram",
+	"CrossEncoder",
+	"FeedbackScore",
+	"LocalCosine",
+}
+
+// featureVector returns the feature values in the same order as featureNames.
+func featureVector(f Features) []float64 {
+	return []float64{
+		f.EmbSim,          // 0
+		f.Recency,         // 1
+		f.RoleScore,       // 2
+		f.BodyLen,         // 3
+		f.KeywordOverlap,  // 4
+		f.WeightedOverlap, // 5
+		f.BM25,            // 6
+		f.NgramOverlap,    // 7
+		f.WeightedNgram,   // 8
+		f.CrossEncoder,    // 9
+		f.FeedbackScore,   // 10
+		f.LocalCosine,     // 11
+	}
+}
+
+// rerankTable renders candidates as an aligned table: one row per candidate with its role, every
+// feature in featureNames order, the final score and whether it passed MinRankScore
+func rerankTable(candidates []Candidate) string {
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "#\tRole\t%s\tScore\tPass\t\n", strings.Join(featureNames, "\t"))
+	for i, cand := range candidates {
+		fmt.Fprintf(tw, "%d\t%s\t", i, cand.Payload.Role)
+		for _, v := range featureVector(cand.Features) {
+			fmt.Fprintf(tw, "%.4f\t", v)
+		}
+		fmt.Fprintf(tw, "%.4f\t%t\t\n", cand.Score, cand.Score >= appCtx.Config.MinRankScore)
+	}
+	tw.Flush()
+	return sb.String()
+}
+
+// cosineSimilarity returns the cosine of a and b, 0 when the lengths differ or a vector is zero
+func cosineSimilarity[A, B float32 | float64](a []A, b []B) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		dot += x * y
+		normA += x * x
+		normB += y * y
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
 // adaptiveMaxTokensNormalization: adaptive normalization based on token count
 func adaptiveMaxTokensNormalization(tokenCount int) float64 {
 	norm := int(float64(tokenCount) * 0.75)
@@ -28,15 +121,75 @@ func bodyLenNorm(tokenCount int) float64 {
 	return v / math.Log(1+adaptiveMaxTokensNormalization(int(tokenCount)))
 }
 
-// timeDecay: recency = exp(-ageDays / tau)
-func timeDecay(timestamp float64) float64 {
+// timeDecay: recency = exp(-ageDays / tau), tau of the document role
+func timeDecay(timestamp float64, role string) float64 {
 	// timestamp is stored as UnixNano (float64)
 	ts := time.Unix(0, int64(timestamp)) // reinterpreting as nanoseconds from epoch
 	age := time.Since(ts).Hours() / 24.0 // age in days
 	if age < 0 {
 		age = 0 // protect against future dates
 	}
-	return math.Exp(-age / appCtx.Config.TauDays) // exponential decay
+	return math.Exp(-age / tauDays(role)) // exponential decay
+}
+
+// tauDays returns the recency decay constant of role: TauDaysByRole, falling back to TauDays
+func tauDays(role string) float64 {
+	if tau, ok := appCtx.Config.TauDaysByRole[role]; ok {
+		return tau
+	}
+	return appCtx.Config.TauDays
+}
+
+// feedbackScore maps the accumulated feedback signal of a document to [0,1):
+// tanh(feedback / FeedbackScale), non-positive feedback scores 0
+func feedbackScore(feedback float64) float64 {
+	if feedback <= 0 || appCtx.Config.FeedbackScale <= 0 {
+		return 0
+	}
+	return math.Tanh(feedback / appCtx.Config.FeedbackScale)
+}
+
+// normalizeRankScores rescales candidate scores according to RankScoreNormalization:
+//   - "none" (or empty): raw weighted sum
+//   - "weights": divided by the sum of weights, so the score is in [0,1] for any weight scale
+//   - "minmax": min-max over the current batch; batch-relative, the best candidate always gets 1
+//   - "sigmoid": weights-normalized score through 1/(1+exp(-(s-RankSigmoidMidpoint)/RankSigmoidSlope))
+func normalizeRankScores(candidates []Candidate, weights []float64) {
+	mode := appCtx.Config.RankScoreNormalization
+	if mode == "" || mode == "none" || len(candidates) == 0 {
+		return
+	}
+
+	switch mode {
+	case "weights", "sigmoid":
+		sum := 0.0
+		for _, w := range weights {
+			sum += w
+		}
+		if sum <= 0 {
+			return
+		}
+		for i := range candidates {
+			s := candidates[i].Score / sum
+			if mode == "sigmoid" {
+				s = 1.0 / (1.0 + math.Exp(-(s-appCtx.Config.RankSigmoidMidpoint)/appCtx.Config.RankSigmoidSlope))
+			}
+			candidates[i].Score = s
+		}
+	case "minmax":
+		lo, hi := candidates[0].Score, candidates[0].Score
+		for _, c := range candidates[1:] {
+			lo = math.Min(lo, c.Score)
+			hi = math.Max(hi, c.Score)
+		}
+		for i := range candidates {
+			if hi-lo < 1e-12 {
+				candidates[i].Score = 1.0 // single candidate or all equal
+			} else {
+				candidates[i].Score = (candidates[i].Score - lo) / (hi - lo)
+			}
+		}
+	}
 }
 
 // keywordOverlapIDs computes the keyword overlap ratio between query and document using token IDs.
@@ -55,14 +208,14 @@ func keywordOverlapIDs(qIDs []uint32, docIDs []uint32) float64 {
 }
 
 // weightedKeywordOverlapIDs computes the weighted keyword overlap ratio between query and document using token IDs and IDF weights.
-func weightedKeywordOverlapIDs(qIDs []uint32, docIDs []uint32, fallbackWeight float64) float64 {
+func weightedKeywordOverlapIDs(qIDs []uint32, docIDs []uint32, idf map[uint32]float64, fallbackWeight float64) float64 {
 	docSet := make(map[uint32]struct{}, len(docIDs))
 	for _, id := range docIDs {
 		docSet[id] = struct{}{}
 	}
 	var sumFound, sumTotal float64
 	for _, id := range qIDs {
-		w, ok := appCtx.IDFStore.IDF[id]
+		w, ok := idf[id]
 		if !ok {
 			w = fallbackWeight
 		}
@@ -173,6 +326,36 @@ func uniqueInts(ids []uint32) []uint32 {
 	return out
 }
 
+// limitQueryTokens keeps at most limit of the unique query tokens by QueryTokenStrategy: the first
+// ones (truncate-tail, also when unset), the last ones (truncate-head) or the ones of the highest IDF, in query
+// order (top-idf). Tokens unknown to the IDF store rank last, no document can match them anyway.
+func limitQueryTokens(qUnique []uint32, limit int) []uint32 {
+	if len(qUnique) <= limit {
+		return qUnique
+	}
+	switch appCtx.Config.QueryTokenStrategy {
+	case queryTokensTruncateHead:
+		return qUnique[len(qUnique)-limit:]
+	case queryTokensTopIDF:
+		idx := make([]int, len(qUnique))
+		for i := range idx {
+			idx[i] = i
+		}
+		appCtx.idfMu.RLock()
+		idf := appCtx.IDFStore.IDF
+		sort.SliceStable(idx, func(a, b int) bool { return idf[qUnique[idx[a]]] > idf[qUnique[idx[b]]] })
+		appCtx.idfMu.RUnlock()
+		idx = idx[:limit]
+		sort.Ints(idx)
+		kept := make([]uint32, limit)
+		for i, j := range idx {
+			kept[i] = qUnique[j]
+		}
+		return kept
+	}
+	return qUnique[:limit]
+}
+
 func buildTermFreq(ids []uint32) map[uint32]int {
 	tf := make(map[uint32]int, len(ids))
 	for _, id := range ids {
@@ -219,10 +402,27 @@ func bm25ScoreFromTF(qIDs []uint32, docTF map[uint32]int, docLen int, store IDFS
 	return score
 }
 
+// bm25NormModeOf returns the BM25 normalization of config: BM25NormMode, or when empty log with
+// BM25UseLogNorm and logistic otherwise
+func bm25NormModeOf(config Config) string {
+	switch {
+	case config.BM25NormMode != "":
+		return config.BM25NormMode
+	case config.BM25UseLogNorm:
+		return bm25NormLog
+	}
+	return bm25NormLogistic
+}
+
+// normalizeBM25 maps a raw BM25 score to [0,1] by the configured normalization
 func normalizeBM25(score float64) float64 {
-	// if log normalization is enabled
-	if appCtx.Config.BM25UseLogNorm {
-		return math.Log1p(score) / math.Log1p(appCtx.Config.BM25LogNormScale)
+	switch bm25NormModeOf(appCtx.Config) {
+	case bm25NormLog:
+		// BM25LogNormScale and above map to 1
+		return math.Min(math.Log1p(score)/math.Log1p(appCtx.Config.BM25LogNormScale), 1.0)
+	case bm25NormExp:
+		// parameter-free saturation, 0 at 0
+		return 1.0 - math.Exp(-score)
 	}
 	return 1.0 / (1.0 + math.Exp(-appCtx.Config.BM25NormSlope*(score-appCtx.Config.BM25NormMidpoint)))
 }
@@ -234,10 +434,15 @@ func normalizeBM25(score float64) float64 {
 // - docUnique: unique token ids for the document (computed before taking locks)
 // - docTF: term frequency map for the document (computed before taking locks)
 // - cand: pointer to candidate to fill features for
-func updateFeaturesForCandidate(qUnique []uint32, qFull []uint32, docFull []uint32, docUnique []uint32, docTF map[uint32]int, cand *Candidate) error {
+func updateFeaturesForCandidate(queryVector []float32, qUnique []uint32, qFull []uint32, docFull []uint32, docUnique []uint32, docTF map[uint32]int, cand *Candidate) error {
 	if cand == nil {
 		return nil
 	}
+
+	// Local cosine against the stored vector (ReturnVectors / FetchRerankVectors), independent of the Qdrant metric
+	if len(cand.EmbeddingVector) > 0 {
+		cand.Features.LocalCosine = math.Max(0, cosineSimilarity(queryVector, cand.EmbeddingVector))
+	}
 	if len(qUnique) == 0 || len(docFull) == 0 || len(docUnique) == 0 || len(qFull) == 0 || len(docTF) == 0 {
 		// nothing to compute
 		return nil
@@ -246,8 +451,11 @@ func updateFeaturesForCandidate(qUnique []uint32, qFull []uint32, docFull []uint
 	// Keyword overlap (set-based)
 	cand.Features.KeywordOverlap = keywordOverlapIDs(qUnique, docUnique)
 
+	// IDF statistics of the candidate's role (merged store unless PerRoleIDF)
+	store := idfStoreForRole(cand.Payload.Role)
+
 	// Weighted keyword overlap (uses IDF weights)
-	cand.Features.WeightedOverlap = weightedKeywordOverlapIDs(qUnique, docUnique, 1.0)
+	cand.Features.WeightedOverlap = weightedKeywordOverlapIDs(qUnique, docUnique, store.IDF, 1.0)
 
 	// Document length: prefer payload token count, fallback to actual full doc length
 	docLen := cand.Payload.CleanTokenCount
@@ -257,12 +465,12 @@ func updateFeaturesForCandidate(qUnique []uint32, qFull []uint32, docFull []uint
 
 	// avgdl for BM25
 	avgdl := 1.0
-	if appCtx.IDFStore.N > 0 {
-		avgdl = float64(appCtx.IDFStore.TotalTokens) / float64(appCtx.IDFStore.N)
+	if store.N > 0 {
+		avgdl = float64(store.TotalTokens) / float64(store.N)
 	}
 
 	// Compute BM25 using qUnique (query terms) and docTF (document frequencies)
-	rawBM25 := bm25ScoreFromTF(qUnique, docTF, docLen, appCtx.IDFStore, avgdl)
+	rawBM25 := bm25ScoreFromTF(qUnique, docTF, docLen, *store, avgdl)
 
 	// Optional debug: print per-term TFs (controlled by appCtx.Debug)
 	// fmt.Printf("BM25 debug: rawBM25=%.6f", rawBM25)
@@ -277,7 +485,62 @@ func updateFeaturesForCandidate(qUnique []uint32, qFull []uint32, docFull []uint
 	qBigrams := ngramHashes(qFull, 2)
 	dBigrams := ngramHashes(docFull, 2)
 	cand.Features.NgramOverlap = ngramOverlapHashes(qBigrams, dBigrams)
-	cand.Features.WeightedNgram = weightedNgramOverlapHashes(qBigrams, dBigrams, appCtx.IDFStore.NgramIDF, 1.0)
+	cand.Features.WeightedNgram = weightedNgramOverlapHashes(qBigrams, dBigrams, store.NgramIDF, 1.0)
 
 	return nil
 }
+
+// applyCrossEncoder asks the cross-encoder model to judge the top-M candidates (by current score)
+// and fills Features.CrossEncoder. Calls run concurrently on a bounded worker pool; a failed call
+// leaves the feature at 0. Candidates must already be scored; their order is not changed.
+func applyCrossEncoder(ctx context.Context, queryText string, candidates []Candidate) {
+	if appCtx.Config.CrossEncoderModel == "" || len(candidates) == 0 {
+		return
+	}
+
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return candidates[order[a]].Score > candidates[order[b]].Score
+	})
+	if m := appCtx.Config.CrossEncoderTopM; m > 0 && len(order) > m {
+		order = order[:m]
+	}
+
+	workers := appCtx.Config.CrossEncoderWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(order) {
+		workers = len(order)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				if ctx.Err() != nil {
+					continue // request cancelled: drain the remaining jobs
+				}
+				score, err := crossEncoderRelevance(ctx, queryText, candidates[idx].Payload.Body)
+				if err != nil {
+					appCtx.ErrorLogger.Printf("Cross-encoder failed for candidate %d: %v", idx, err)
+					score = 0.0
+				}
+				candidates[idx].Features.CrossEncoder = score
+			}
+		}()
+	}
+	for _, idx := range order {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	appCtx.AccessLogger.Printf("Cross-encoder scored %d of %d candidates", len(order), len(candidates))
+}
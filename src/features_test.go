@@ -0,0 +1,215 @@
+// features_test.go
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryTokenStrategyDefaultsToTruncateTail(t *testing.T) {
+	newTestApp(t)
+	config := appCtx.Config
+	config.QueryTokenStrategy = ""
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("validateConfig with empty QueryTokenStrategy: %v", err)
+	}
+
+	appCtx.Config.QueryTokenStrategy = ""
+	if got := limitQueryTokens([]uint32{1, 2, 3, 4}, 2); !slices.Equal(got, []uint32{1, 2}) {
+		t.Errorf("limitQueryTokens = %v, want the first tokens [1 2]", got)
+	}
+}
+
+func TestBM25NormSlopeValidatedOnlyForLogistic(t *testing.T) {
+	newTestApp(t)
+	config := appCtx.Config
+	config.BM25NormSlope = 0
+	config.BM25NormMode = bm25NormLog
+	config.BM25LogNormScale = 10
+	if err := validateConfig(config); err != nil {
+		t.Errorf("log normalization rejected an unused BM25NormSlope: %v", err)
+	}
+	config.BM25NormMode = bm25NormLogistic
+	if err := validateConfig(config); err == nil {
+		t.Error("logistic normalization accepted BM25NormSlope 0")
+	}
+}
+
+func TestNormalizeBM25Modes(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.BM25NormMidpoint = 1.6
+	appCtx.Config.BM25NormSlope = 0.8
+	appCtx.Config.BM25LogNormScale = 25
+	const raw = 2.0
+
+	cases := []struct {
+		mode   string
+		useLog bool
+		want   float64
+	}{
+		{bm25NormExp, false, 1 - math.Exp(-raw)},                      // 0.865
+		{bm25NormLogistic, false, 1 / (1 + math.Exp(-0.8*(raw-1.6)))}, // 0.579
+		{bm25NormLog, false, math.Log1p(raw) / math.Log1p(25)},        // 0.337
+		{"", true, math.Log1p(raw) / math.Log1p(25)},
+		{"", false, 1 / (1 + math.Exp(-0.8*(raw-1.6)))},
+	}
+	for _, tc := range cases {
+		appCtx.Config.BM25NormMode, appCtx.Config.BM25UseLogNorm = tc.mode, tc.useLog
+		if got := normalizeBM25(raw); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("mode %q (log %t): normalizeBM25(%v) = %v, want %v", tc.mode, tc.useLog, raw, got, tc.want)
+		}
+	}
+
+	// Same raw score, different saturation: exp > logistic > log here
+	scores := make(map[string]float64)
+	for _, mode := range []string{bm25NormExp, bm25NormLogistic, bm25NormLog} {
+		appCtx.Config.BM25NormMode = mode
+		scores[mode] = normalizeBM25(raw)
+		if hi := normalizeBM25(1000); hi > 1 || hi < 0.99 {
+			t.Errorf("mode %q: a huge score maps to %v, want about 1", mode, hi)
+		}
+	}
+	if !(scores[bm25NormExp] > scores[bm25NormLogistic] && scores[bm25NormLogistic] > scores[bm25NormLog]) {
+		t.Errorf("scores %v, want exp > logistic > log for raw %v", scores, raw)
+	}
+	appCtx.Config.BM25NormMode = bm25NormLogistic
+	if got := normalizeBM25(1.6); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("logistic at the midpoint = %v, want 0.5", got)
+	}
+}
+
+func TestTokenizerCacheDirCheckedOnlyForHF(t *testing.T) {
+	newTestApp(t)
+	config := appCtx.Config
+	config.TokenizerPretrainedCacheDir = t.TempDir() + "/missing"
+	config.TokenizerBackend = tokenizerBackendTiktoken
+	if err := validateConfig(config); err != nil {
+		t.Errorf("tiktoken backend rejected a missing cache dir: %v", err)
+	}
+	config.TokenizerBackend = tokenizerBackendHF
+	if err := validateConfig(config); err == nil {
+		t.Error("hf backend accepted a missing cache dir")
+	}
+}
+
+func TestRankScoreNormalizationConsistentAcrossMetricsAndScales(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.RankSigmoidMidpoint, appCtx.Config.RankSigmoidSlope = 0.5, 0.1
+
+	// EmbSim of the same three documents, best first, as each metric derives it
+	metrics := map[string][]float64{
+		"Cosine": {0.9, 0.6, 0.2},
+		"Euclid": {1 / (1 + 0.45), 1 / (1 + 0.89), 1 / (1 + 1.26)},
+		"Dot":    {1, 0.8, 0.1}, // clamped from 3.2
+	}
+	batch := func(embSims []float64, scale float64) []float64 {
+		weights := make([]float64, len(featureNames))
+		weights[slices.Index(featureNames, "EmbSim")] = 2 * scale
+		weights[slices.Index(featureNames, "Recency")] = scale
+		candidates := make([]Candidate, len(embSims))
+		for i, sim := range embSims {
+			candidates[i].Features = Features{EmbSim: sim, Recency: 0.5}
+			score, err := scoreCandidate(candidates[i].Features, weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates[i].Score = score
+		}
+		normalizeRankScores(candidates, weights)
+		scores := make([]float64, len(candidates))
+		for i, c := range candidates {
+			scores[i] = c.Score
+		}
+		return scores
+	}
+
+	for _, mode := range []string{"weights", "minmax", "sigmoid"} {
+		appCtx.Config.RankScoreNormalization = mode
+		for metric, embSims := range metrics {
+			base, scaled := batch(embSims, 1), batch(embSims, 10)
+			for i := range base {
+				if base[i] < 0 || base[i] > 1 {
+					t.Errorf("%s/%s: score %f outside [0,1]", mode, metric, base[i])
+				}
+				// The weight scale does not move a candidate across MinRankScore
+				if math.Abs(base[i]-scaled[i]) > 1e-9 {
+					t.Errorf("%s/%s: score %f with weights x10, %f without", mode, metric, scaled[i], base[i])
+				}
+				if i > 0 && base[i] > base[i-1] {
+					t.Errorf("%s/%s: scores %v out of order", mode, metric, base)
+				}
+			}
+			if mode == "minmax" && (base[0] != 1 || base[len(base)-1] != 0) {
+				t.Errorf("minmax/%s: scores %v, want the best at 1 and the worst at 0", metric, base)
+			}
+		}
+	}
+}
+
+func TestTauDaysByRoleAgesRolesDifferently(t *testing.T) {
+	newTestApp(t)
+	useRerankTestConfig(appCtx.Config.DefaultWeights)
+	appCtx.Config.TauDays = 10
+	appCtx.Config.TauDaysByRole = map[string]float64{"rag-file": 365}
+	const age = 30 * 24 * time.Hour
+	putTestPoint(t, appCtx.memStore, "an attached file", "rag-file", age)
+	putTestPoint(t, appCtx.memStore, "a user turn", "rag-user", age)
+
+	candidates, err := SearchRelevantContent(context.Background(), testVector("query"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"rag-file": math.Exp(-30.0 / 365), "rag-user": math.Exp(-30.0 / 10)}
+	if len(candidates) != len(want) {
+		t.Fatalf("got %d candidates, want %d", len(candidates), len(want))
+	}
+	for _, c := range candidates {
+		if got := c.Features.Recency; math.Abs(got-want[c.Payload.Role]) > 1e-3 {
+			t.Errorf("%s Recency = %f, want %f", c.Payload.Role, got, want[c.Payload.Role])
+		}
+	}
+
+	config := appCtx.Config
+	config.TauDaysByRole = map[string]float64{"rag-file": 0}
+	if err := validateConfig(config); err == nil {
+		t.Error("TauDaysByRole 0 accepted")
+	}
+}
+
+func TestRerankTableColumnsAndValues(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.MinRankScore = 0.5
+	candidates := []Candidate{
+		{Payload: Payload{Role: "rag-file"}, Features: Features{EmbSim: 0.9, Recency: 0.25, BM25: 1.5, LocalCosine: 0.75}, Score: 0.8},
+		{Payload: Payload{Role: "rag-user"}, Features: Features{RoleScore: 1, FeedbackScore: 0.125}, Score: 0.1},
+	}
+	lines := strings.Split(strings.TrimSpace(rerankTable(candidates)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("table has %d lines, want a header and 2 rows:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	header := strings.Fields(lines[0])
+	if want := append(append([]string{"#", "Role"}, featureNames...), "Score", "Pass"); !slices.Equal(header, want) {
+		t.Fatalf("header = %q, want %q", header, want)
+	}
+	column := func(row []string, name string) string { return row[slices.Index(header, name)] }
+
+	want := []map[string]string{
+		{"#": "0", "Role": "rag-file", "EmbSim": "0.9000", "Recency": "0.2500", "BM25": "1.5000", "LocalCosine": "0.7500", "RoleScore": "0.0000", "Score": "0.8000", "Pass": "true"},
+		{"#": "1", "Role": "rag-user", "RoleScore": "1.0000", "FeedbackScore": "0.1250", "EmbSim": "0.0000", "Score": "0.1000", "Pass": "false"},
+	}
+	for i, cells := range want {
+		row := strings.Fields(lines[i+1])
+		if len(row) != len(header) {
+			t.Fatalf("row %d has %d columns, want %d: %q", i, len(row), len(header), lines[i+1])
+		}
+		for name, value := range cells {
+			if got := column(row, name); got != value {
+				t.Errorf("row %d %s = %q, want %q", i, name, got, value)
+			}
+		}
+	}
+}
@@ -8,7 +8,6 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/hashicorp/golang-lru v1.0.2
 	github.com/pelletier/go-toml/v2 v2.2.4
-	// github.com/pkoukk/tiktoken-go v0.1.8
 	github.com/qdrant/go-client v1.16.0
 	github.com/tidwall/gjson v1.18.0
 	golang.org/x/text v0.31.0
@@ -16,15 +15,20 @@ require (
 
 require (
 	github.com/gammazero/deque v1.2.0
+	github.com/pkoukk/tiktoken-go v0.1.8
 	github.com/tidwall/sjson v1.2.5
+	github.com/zeebo/blake3 v0.2.4
+	golang.org/x/sync v0.18.0
+	google.golang.org/protobuf v1.36.10
 )
 
 require (
+	github.com/dlclark/regexp2 v1.10.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251111163417-95abcf5c77ba // indirect
 	google.golang.org/grpc v1.76.0 // indirect
-	google.golang.org/protobuf v1.36.10 // indirect
 )
@@ -0,0 +1,54 @@
+// hash.go
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+)
+
+// HashAlgo values
+const (
+	hashAlgoSHA512 = "sha512"
+	hashAlgoSHA256 = "sha256"
+	hashAlgoBLAKE3 = "blake3"
+	hashAlgoXXHash = "xxhash"
+)
+
+// hashContent returns the hex hash of text by HashAlgo (empty: sha512). It keys stored points, the
+// token cache, embedding single-flight and thread ids. Hashes other than sha512 carry an "algo:"
+// prefix so stored ones tell which algorithm made them; sha512 stays bare as in older collections.
+func hashContent(text string) string {
+	switch appCtx.Config.HashAlgo {
+	case hashAlgoSHA256:
+		hash := sha256.Sum256([]byte(text))
+		return hashAlgoSHA256 + ":" + hex.EncodeToString(hash[:])
+	case hashAlgoBLAKE3:
+		hash := blake3.Sum256([]byte(text))
+		return hashAlgoBLAKE3 + ":" + hex.EncodeToString(hash[:])
+	case hashAlgoXXHash:
+		return fmt.Sprintf("%s:%016x", hashAlgoXXHash, xxhash.Sum64String(text))
+	}
+	hash := sha512.Sum512([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+// hashAlgoOf returns the algorithm of a hash made by hashContent, "" when it cannot be told
+func hashAlgoOf(hash string) string {
+	if algo, _, ok := strings.Cut(hash, ":"); ok {
+		if slices.Contains([]string{hashAlgoSHA256, hashAlgoBLAKE3, hashAlgoXXHash}, algo) {
+			return algo
+		}
+		return ""
+	}
+	if len(hash) == sha512.Size*2 {
+		return hashAlgoSHA512
+	}
+	return ""
+}
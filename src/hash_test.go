@@ -0,0 +1,28 @@
+// hash_test.go
+package main
+
+import "testing"
+
+func TestHashContentNamesItsAlgorithm(t *testing.T) {
+	newTestApp(t)
+	for _, algo := range []string{"", hashAlgoSHA512, hashAlgoSHA256, hashAlgoBLAKE3, hashAlgoXXHash} {
+		appCtx.Config.HashAlgo = algo
+		want := algo
+		if want == "" {
+			want = hashAlgoSHA512
+		}
+		if got := hashAlgoOf(hashContent("some text")); got != want {
+			t.Errorf("HashAlgo %q: hashAlgoOf = %q, want %q", algo, got, want)
+		}
+	}
+	// sha256 and blake3 digests of the same length are told apart
+	appCtx.Config.HashAlgo = hashAlgoSHA256
+	a := hashContent("x")
+	appCtx.Config.HashAlgo = hashAlgoBLAKE3
+	if b := hashContent("x"); hashAlgoOf(a) == hashAlgoOf(b) {
+		t.Errorf("%s and %s report the same algorithm", a, b)
+	}
+	if got := hashAlgoOf("0123456789abcdef"); got != "" {
+		t.Errorf("bare 16-char hash reported as %q", got)
+	}
+}
@@ -2,35 +2,214 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/qdrant/go-client/qdrant"
 )
 
-// SaveIDF writes the IDFStore to a file in JSON format.
-func saveIDF(withLock bool) error {
-	if withLock {
-		appCtx.idfMu.RLock()
-	}
-	store := appCtx.IDFStore
-	if withLock {
-		appCtx.idfMu.RUnlock()
+// saveIDF writes the IDFStore (and the per-role stores, if any) to files in JSON format. The stores
+// are snapshotted under idfMu, the files are written after it is released.
+func saveIDF() error {
+	appCtx.idfMu.RLock()
+	files, err := snapshotIDF()
+	appCtx.idfMu.RUnlock()
+	if err != nil {
+		return err
 	}
+	return writeIDFSnapshot(files)
+}
 
+// snapshotIDF marshals the merged and per-role IDF stores, by file path. Caller holds idfMu.
+func snapshotIDF() (map[string][]byte, error) {
+	files := make(map[string][]byte, 1+len(appCtx.RoleIDFStores))
+	identity := tokenizerIdentity(appCtx.Config)
+	store := appCtx.IDFStore
+	store.Tokenizer = identity
 	data, err := json.Marshal(store)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	files[appCtx.Config.IDFFile] = data
+	for role, roleStore := range appCtx.RoleIDFStores {
+		store := *roleStore
+		store.Tokenizer = identity
+		data, err := json.Marshal(store)
+		if err != nil {
+			return nil, err
+		}
+		files[idfFileForRole(role)] = data
+	}
+	return files, nil
+}
+
+// writeIDFSnapshot writes the files of snapshotIDF
+func writeIDFSnapshot(files map[string][]byte) error {
+	for path, data := range files {
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// idfFileForRole returns the file of the per-role IDF store: IDFFile with the role before the extension
+func idfFileForRole(role string) string {
+	return roleIDFFile(appCtx.Config.IDFFile, role)
+}
+
+// roleIDFFile returns the per-role IDF file of role next to idfFile
+func roleIDFFile(idfFile, role string) string {
+	ext := filepath.Ext(idfFile)
+	return strings.TrimSuffix(idfFile, ext) + "." + role + ext
+}
 
-	last := appCtx.Config.IDFFile + ".last"
+// idfStoreForRole returns the IDF store to use for documents of role: the per-role store when
+// PerRoleIDF is on, the merged store otherwise. Caller holds idfMu.
+func idfStoreForRole(role string) *IDFStore {
+	if store, ok := appCtx.RoleIDFStores[role]; ok {
+		return store
+	}
+	return &appCtx.IDFStore
+}
+
+// writeFileAtomic writes data next to path and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	last := path + ".last"
 	if err := os.WriteFile(last, data, 0644); err != nil {
 		// if write to tmp failed, try to remove tmp (best-effort) and return error
 		_ = os.Remove(last)
 		return err
 	}
 	// atomic replace
-	return os.Rename(last, appCtx.Config.IDFFile)
+	return os.Rename(last, path)
+}
+
+// idfExportFormat and idfExportVersion identify IDF export files; bump the version on IDFStore schema changes.
+// Version 2 added the per-role stores; version 1 files are still imported.
+const (
+	idfExportFormat  = "ragproxy-idf"
+	idfExportVersion = 2
+)
+
+// idfExport is the on-disk envelope for --export-idf / --import-idf.
+type idfExport struct {
+	Format  string              `json:"format"`
+	Version int                 `json:"version"`
+	Store   IDFStore            `json:"store"`
+	Roles   map[string]IDFStore `json:"roles,omitempty"` // per-role stores (PerRoleIDF) that exist
+}
+
+// validateIDFStore checks that all maps of the store are present.
+func validateIDFStore(store IDFStore) error {
+	if store.DF == nil || store.IDF == nil || store.NgramDF == nil || store.NgramIDF == nil {
+		return fmt.Errorf("IDF store is incomplete: missing DF/IDF/NgramDF/NgramIDF maps")
+	}
+	return nil
+}
+
+// readIDFFile reads and validates one IDF store file
+func readIDFFile(path string) (IDFStore, error) {
+	var store IDFStore
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return store, err
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return store, fmt.Errorf("parsing IDF file %s: %w", path, err)
+	}
+	return store, validateIDFStore(store)
+}
+
+// exportIDF copies the IDF store from idfFile, and the per-role stores next to it, into a versioned
+// export file at path.
+func exportIDF(idfFile, path string) error {
+	store, err := readIDFFile(idfFile)
+	if err != nil {
+		return fmt.Errorf("reading IDF file: %w", err)
+	}
+	exp := idfExport{Format: idfExportFormat, Version: idfExportVersion, Store: store}
+	for _, role := range appConsts.AvailableSearchSources {
+		roleStore, err := readIDFFile(roleIDFFile(idfFile, role))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s IDF file: %w", role, err)
+		}
+		if exp.Roles == nil {
+			exp.Roles = make(map[string]IDFStore)
+		}
+		exp.Roles[role] = roleStore
+	}
+
+	out, err := json.Marshal(exp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, out)
+}
+
+// importIDF reads a versioned export file at path and replaces idfFile with its store.
+func importIDF(path, idfFile string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading export file: %w", err)
+	}
+	var exp idfExport
+	if err := json.Unmarshal(data, &exp); err != nil {
+		return fmt.Errorf("parsing export file: %w", err)
+	}
+	if exp.Format != idfExportFormat {
+		return fmt.Errorf("not an IDF export file (format %q)", exp.Format)
+	}
+	if exp.Version < 1 || exp.Version > idfExportVersion {
+		return fmt.Errorf("unsupported IDF export version %d (expected 1..%d)", exp.Version, idfExportVersion)
+	}
+	if err := validateIDFStore(exp.Store); err != nil {
+		return err
+	}
+	for role, store := range exp.Roles {
+		if err := validateIDFStore(store); err != nil {
+			return fmt.Errorf("%s: %w", role, err)
+		}
+	}
+
+	out, err := json.Marshal(exp.Store)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(idfFile, out); err != nil {
+		return err
+	}
+	// A role store missing from the export would not match the imported merged store: remove its
+	// file, it is rebuilt from the collection at the next start with PerRoleIDF
+	for _, role := range appConsts.AvailableSearchSources {
+		path := roleIDFFile(idfFile, role)
+		store, ok := exp.Roles[role]
+		if !ok {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		out, err := json.Marshal(store)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, out); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // LoadIDF reads the IDFStore from a file.
@@ -55,17 +234,144 @@ func loadIDF() error {
 		return nil
 	}
 
+	// Token ids of another tokenizer are meaningless: the store is rebuilt from the stored documents
+	identity := tokenizerIdentity(appCtx.Config)
+	rebuild := store.Tokenizer != "" && store.Tokenizer != identity
+	if rebuild {
+		appCtx.JournaldLogger.Printf("WARNING: IDF file %s was built with tokenizer %s, configured is %s — rebuilding it from the stored documents",
+			appCtx.Config.IDFFile, store.Tokenizer, identity)
+		store = newIDFStore()
+	}
+
 	appCtx.idfMu.Lock()
 	appCtx.IDFStore = store
 	appCtx.idfMu.Unlock()
 	appCtx.AccessLogger.Printf("Loaded IDF store with N=%d TotalTokens=%d", store.N, store.TotalTokens)
+
+	// Role stores enabled on an existing corpus must count the documents already stored, or later
+	// removals would take their counters below zero
+	if missing := loadRoleIDFStores(); rebuild || (len(missing) > 0 && store.N > 0) {
+		if err := backfillIDFStores(missing, rebuild); err != nil {
+			return fmt.Errorf("rebuild IDF stores: %w", err)
+		}
+	}
 	return nil
 }
 
-// initEmptyIDFStore initializes an empty IDFStore.
-func initEmptyIDFStore() {
+// backfillIDFStores fills the (empty) IDF stores of roles, and with merged the merged store, from
+// the documents stored in the collection
+func backfillIDFStores(roles []string, merged bool) error {
+	counts := make(map[string]int, len(roles))
+	filled := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		filled[role] = true
+	}
+	conditions := []*qdrant.Condition{notSummary()} // summaries are not IDF documents
+	if !merged {
+		conditions = append(conditions, qdrant.NewMatchKeywords("role", roles...))
+	}
+	total := 0
+	err := withDB(func() error {
+		ctx := context.Background()
+		limit := uint32(256)
+		var offset *qdrant.PointId
+		for {
+			page, next, err := appCtx.DB.ScrollAndOffset(ctx, &qdrant.ScrollPoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Filter:         &qdrant.Filter{Must: conditions},
+				Limit:          &limit,
+				Offset:         offset,
+				WithPayload:    qdrant.NewWithPayloadInclude("body", "body_encoding", "role", "clean_token_count"),
+				WithVectors:    qdrant.NewWithVectors(false),
+			})
+			if err != nil {
+				return fmt.Errorf("scroll points: %w", err)
+			}
+			for _, point := range page {
+				fields := point.GetPayload()
+				role := fields["role"].GetStringValue()
+				body := payloadBody(fields)
+				tokenCount := int(fields["clean_token_count"].GetIntegerValue())
+				if tokenCount <= 0 && body != "" {
+					tokenCount = calculateTokens(body)
+				}
+				ids, err := tokenIDs(body)
+				if err != nil {
+					return err
+				}
+				appCtx.idfMu.Lock()
+				if merged {
+					updateIDFStore(&appCtx.IDFStore, ids, tokenCount, +1)
+					appCtx.IDFChanged = true
+					total++
+				}
+				if store, ok := appCtx.RoleIDFStores[role]; ok && filled[role] {
+					updateIDFStore(store, ids, tokenCount, +1)
+					appCtx.IDFChanged = true
+					counts[role]++
+				}
+				appCtx.idfMu.Unlock()
+			}
+			if next == nil || len(page) == 0 {
+				return nil
+			}
+			offset = next
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if merged {
+		appCtx.JournaldLogger.Printf("IDF store built from %d stored documents", total)
+	}
+	for _, role := range roles {
+		appCtx.JournaldLogger.Printf("Per-role IDF store %s built from %d stored documents", role, counts[role])
+	}
+	return nil
+}
+
+// loadRoleIDFStores reads the per-role IDF stores when PerRoleIDF is on. Missing or broken files
+// start empty; their roles are returned so that existing documents can be counted in.
+func loadRoleIDFStores() (missing []string) {
+	stores := make(map[string]*IDFStore)
+	if appCtx.Config.PerRoleIDF {
+		for _, role := range appConsts.AvailableSearchSources {
+			store := newIDFStore()
+			path := idfFileForRole(role)
+			data, err := os.ReadFile(path)
+			if err == nil {
+				var loaded IDFStore
+				if err := json.Unmarshal(data, &loaded); err == nil && validateIDFStore(loaded) == nil {
+					if loaded.Tokenizer != "" && loaded.Tokenizer != tokenizerIdentity(appCtx.Config) {
+						appCtx.JournaldLogger.Printf("WARNING: IDF file %s was built with tokenizer %s — rebuilding it", path, loaded.Tokenizer)
+						missing = append(missing, role)
+					} else {
+						store = loaded
+						appCtx.AccessLogger.Printf("Loaded %s IDF store with N=%d TotalTokens=%d", role, store.N, store.TotalTokens)
+					}
+				} else {
+					appCtx.ErrorLogger.Printf("IDF file %s parse error — initializing empty %s store", path, role)
+					missing = append(missing, role)
+				}
+			} else {
+				if !os.IsNotExist(err) {
+					appCtx.ErrorLogger.Printf("Error reading IDF file %s: %v — initializing empty %s store", path, err, role)
+				}
+				missing = append(missing, role)
+			}
+			stores[role] = &store
+		}
+	}
+
 	appCtx.idfMu.Lock()
-	appCtx.IDFStore = IDFStore{
+	appCtx.RoleIDFStores = stores
+	appCtx.idfMu.Unlock()
+	return missing
+}
+
+// newIDFStore returns an empty IDFStore.
+func newIDFStore() IDFStore {
+	return IDFStore{
 		DF:          make(map[uint32]int),
 		N:           0,
 		IDF:         make(map[uint32]float64),
@@ -73,7 +379,14 @@ func initEmptyIDFStore() {
 		NgramIDF:    make(map[uint64]float64),
 		TotalTokens: 0,
 	}
+}
+
+// initEmptyIDFStore initializes an empty IDFStore.
+func initEmptyIDFStore() {
+	appCtx.idfMu.Lock()
+	appCtx.IDFStore = newIDFStore()
 	appCtx.idfMu.Unlock()
+	loadRoleIDFStores()
 }
 
 // startIDFAutoSave starts a goroutine that periodically saves the IDFStore to disk.
@@ -88,55 +401,211 @@ func startIDFAutoSave(interval time.Duration) {
 			case <-appCtx.idfAutoSaveStopChan:
 				return
 			case <-ticker.C:
+				// Snapshot under the lock, write without it
+				var files map[string][]byte
+				var err error
 				appCtx.idfMu.Lock()
 				if appCtx.IDFChanged {
-					if err := saveIDF(false); err == nil {
+					if files, err = snapshotIDF(); err == nil {
 						appCtx.IDFChanged = false
-						appCtx.JournaldLogger.Printf("IDF autosaved")
-					} else {
-						appCtx.ErrorLogger.Printf("IDF autosave failed: %v", err)
 					}
 				}
 				appCtx.idfMu.Unlock()
+				if err == nil && files != nil {
+					err = writeIDFSnapshot(files)
+				}
+				if err != nil {
+					appCtx.ErrorLogger.Printf("IDF autosave failed: %v", err)
+					appCtx.idfMu.Lock()
+					appCtx.IDFChanged = true
+					appCtx.idfMu.Unlock()
+				} else if files != nil {
+					appCtx.JournaldLogger.Printf("IDF autosaved")
+				}
 			}
 		}
 	}()
 }
 
-// updateDocumentInIDF updates DF/IDF for tokens and n-grams of a document.
+// startIDFConsistencyCheck starts a goroutine that periodically compares the IDFStore totals with the stored points.
+func startIDFConsistencyCheck(interval time.Duration) {
+	appCtx.idfAutoSaveWG.Add(1)
+	go func() {
+		defer appCtx.idfAutoSaveWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-appCtx.idfAutoSaveStopChan:
+				return
+			case <-ticker.C:
+				if err := checkIDFConsistency(); err != nil {
+					appCtx.ErrorLogger.Printf("IDF consistency check failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// idfDrift returns the relative difference of actual against expected (0 when both are 0).
+func idfDrift(actual, expected float64) float64 {
+	if expected == 0 {
+		if actual == 0 {
+			return 0
+		}
+		return 1
+	}
+	return math.Abs(actual-expected) / expected
+}
+
+// checkIDFConsistency recomputes N and TotalTokens from the points in Qdrant (each stored point is
+// one IDF document of clean_token_count tokens) and compares them with the IDFStore and the per-role
+// stores. Drift above IDFDriftThreshold is logged and, with IDFDriftCorrect, the totals are replaced
+// and IDF weights recalculated. DF counters cannot be recovered this way and are left as they are.
+func checkIDFConsistency() error {
+	var points uint64
+	var tokens int64
+	rolePoints := make(map[string]uint64)
+	roleTokens := make(map[string]int64)
+	err := withDB(func() error {
+		ctx := context.Background()
+		limit := uint32(1024)
+		var offset *qdrant.PointId
+		for {
+			page, next, err := appCtx.DB.ScrollAndOffset(ctx, &qdrant.ScrollPoints{
+				CollectionName: appCtx.Config.QdrantCollection,
+				Filter:         &qdrant.Filter{Must: []*qdrant.Condition{notSummary()}}, // summaries are not IDF documents
+				Limit:          &limit,
+				Offset:         offset,
+				WithPayload:    qdrant.NewWithPayloadInclude("clean_token_count", "role"),
+				WithVectors:    qdrant.NewWithVectors(false),
+			})
+			if err != nil {
+				return fmt.Errorf("scroll points: %w", err)
+			}
+			for _, point := range page {
+				count := point.Payload["clean_token_count"].GetIntegerValue()
+				role := point.Payload["role"].GetStringValue()
+				points++
+				tokens += count
+				rolePoints[role]++
+				roleTokens[role] += count
+			}
+			if next == nil || len(page) == 0 {
+				return nil
+			}
+			offset = next
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	appCtx.idfMu.Lock()
+	defer appCtx.idfMu.Unlock()
+
+	if reconcileIDFStore("IDF", &appCtx.IDFStore, points, tokens) {
+		appCtx.IDFChanged = true
+	}
+	for role, store := range appCtx.RoleIDFStores {
+		if reconcileIDFStore(role+" IDF", store, rolePoints[role], roleTokens[role]) {
+			appCtx.IDFChanged = true
+		}
+	}
+	return nil
+}
+
+// reconcileIDFStore compares the totals of store with the stored points and tokens, and with
+// IDFDriftCorrect replaces them on drift. Returns whether the store was corrected. Caller holds idfMu.
+func reconcileIDFStore(name string, store *IDFStore, points uint64, tokens int64) bool {
+	nDrift := idfDrift(float64(store.N), float64(points))
+	tDrift := idfDrift(float64(store.TotalTokens), float64(tokens))
+	if nDrift <= appCtx.Config.IDFDriftThreshold && tDrift <= appCtx.Config.IDFDriftThreshold {
+		appCtx.AccessLogger.Printf("%s consistency check passed: N=%d (stored %d), TotalTokens=%d (stored %d)",
+			name, store.N, points, store.TotalTokens, tokens)
+		return false
+	}
+
+	appCtx.ErrorLogger.Printf("%s drift detected: N=%d vs %d stored points (%.1f%%), TotalTokens=%d vs %d stored (%.1f%%)",
+		name, store.N, points, nDrift*100, store.TotalTokens, tokens, tDrift*100)
+	if !appCtx.Config.IDFDriftCorrect {
+		return false
+	}
+
+	store.N = points
+	store.TotalTokens = tokens
+	recomputeIDFWeights(store)
+	appCtx.JournaldLogger.Printf("%s totals corrected to N=%d TotalTokens=%d", name, points, tokens)
+	return true
+}
+
+// recomputeIDFWeights recalculates all cached IDF weights of store from DF and N. Caller holds idfMu.
+func recomputeIDFWeights(store *IDFStore) {
+	N := float64(store.N)
+	weight := func(df int) float64 {
+		if N == 0 {
+			return 0
+		}
+		if appCtx.Config.UseBM25IDF {
+			return math.Log1p((N - float64(df) + 0.5) / (float64(df) + 0.5))
+		}
+		return math.Log1p(N / (1.0 + float64(df)))
+	}
+	for id, df := range store.DF {
+		store.IDF[id] = weight(df)
+	}
+	for h, df := range store.NgramDF {
+		store.NgramIDF[h] = weight(df)
+	}
+}
+
+// updateDocumentInIDF updates DF/IDF for tokens and n-grams of a document in the merged store and,
+// with PerRoleIDF, in the store of its role.
 // mode = +1 for adding a document, -1 for removing a document.
-func updateDocumentInIDF(body string, tokenCount int, hash string, mode int) error {
+func updateDocumentInIDF(body string, tokenCount int, hash string, role string, mode int) error {
 
 	ids, err := getCachedTokenIDs(hash, body)
 	if err != nil {
 		return err
 	}
 
-	seenTokens := make(map[uint32]struct{})
-	seenNgrams := make(map[uint64]struct{})
-
 	appCtx.idfMu.Lock()
 	defer appCtx.idfMu.Unlock()
 
+	updateIDFStore(&appCtx.IDFStore, ids, tokenCount, mode)
+	if store, ok := appCtx.RoleIDFStores[role]; ok {
+		updateIDFStore(store, ids, tokenCount, mode)
+	}
+
+	appCtx.IDFChanged = true
+
+	return nil
+}
+
+// updateIDFStore applies one document (token ids) to store. Caller holds idfMu.
+func updateIDFStore(store *IDFStore, ids []uint32, tokenCount int, mode int) {
+	seenTokens := make(map[uint32]struct{})
+	seenNgrams := make(map[uint64]struct{})
+
 	// Update total document count
 	if mode > 0 {
-		appCtx.IDFStore.N++
-		appCtx.IDFStore.TotalTokens += int64(tokenCount)
+		store.N++
+		store.TotalTokens += int64(tokenCount)
 	} else if mode < 0 {
-		if appCtx.IDFStore.N > 0 {
-			appCtx.IDFStore.N--
+		if store.N > 0 {
+			store.N--
 			// защититься от отрицательного TotalTokens
-			if appCtx.IDFStore.TotalTokens >= int64(tokenCount) {
-				appCtx.IDFStore.TotalTokens -= int64(tokenCount)
+			if store.TotalTokens >= int64(tokenCount) {
+				store.TotalTokens -= int64(tokenCount)
 			} else {
-				appCtx.IDFStore.TotalTokens = 0
+				store.TotalTokens = 0
 			}
 		} else {
 			appCtx.ErrorLogger.Printf("Attempted to remove document from IDF when N is 0")
 		}
 	}
 
-	N := appCtx.IDFStore.N
+	N := store.N
 
 	// Process tokens
 	for _, id := range ids {
@@ -146,19 +615,19 @@ func updateDocumentInIDF(body string, tokenCount int, hash string, mode int) err
 		seenTokens[id] = struct{}{}
 
 		if mode > 0 {
-			appCtx.IDFStore.DF[id]++
+			store.DF[id]++
 		} else if mode < 0 {
-			if appCtx.IDFStore.DF[id] > 0 {
-				appCtx.IDFStore.DF[id]--
+			if store.DF[id] > 0 {
+				store.DF[id]--
 			} else {
 				appCtx.ErrorLogger.Printf("Attempted to remove non-existent token from IDF")
 			}
 		}
 
-		df := appCtx.IDFStore.DF[id]
+		df := store.DF[id]
 		if df == 0 {
-			delete(appCtx.IDFStore.DF, id)
-			delete(appCtx.IDFStore.IDF, id)
+			delete(store.DF, id)
+			delete(store.IDF, id)
 			continue
 		}
 
@@ -166,13 +635,13 @@ func updateDocumentInIDF(body string, tokenCount int, hash string, mode int) err
 			// Recalculate IDF for this token
 			if appCtx.Config.UseBM25IDF {
 				// BM25-style idf: log1p((N - df + 0.5) / (df + 0.5))
-				appCtx.IDFStore.IDF[id] = math.Log1p((float64(N) - float64(df) + 0.5) / (float64(df) + 0.5))
+				store.IDF[id] = math.Log1p((float64(N) - float64(df) + 0.5) / (float64(df) + 0.5))
 			} else {
 				// legacy/alternative idf
-				appCtx.IDFStore.IDF[id] = math.Log1p(float64(N) / (1.0 + float64(df)))
+				store.IDF[id] = math.Log1p(float64(N) / (1.0 + float64(df)))
 			}
 		} else {
-			appCtx.IDFStore.IDF[id] = 0
+			store.IDF[id] = 0
 		}
 	}
 
@@ -186,45 +655,45 @@ func updateDocumentInIDF(body string, tokenCount int, hash string, mode int) err
 			seenNgrams[h] = struct{}{}
 
 			if mode > 0 {
-				appCtx.IDFStore.NgramDF[h]++
+				store.NgramDF[h]++
 			} else if mode < 0 {
-				if appCtx.IDFStore.NgramDF[h] > 0 {
-					appCtx.IDFStore.NgramDF[h]--
+				if store.NgramDF[h] > 0 {
+					store.NgramDF[h]--
 				} else {
 					appCtx.ErrorLogger.Printf("Attempted to remove non-existent ngram from IDF")
 				}
 			}
-			df := appCtx.IDFStore.NgramDF[h]
+			df := store.NgramDF[h]
 			if df == 0 {
-				delete(appCtx.IDFStore.NgramDF, h)
-				delete(appCtx.IDFStore.NgramIDF, h)
+				delete(store.NgramDF, h)
+				delete(store.NgramIDF, h)
 				continue
 			}
 			if N > 0 {
 				if appCtx.Config.UseBM25IDF {
-					appCtx.IDFStore.NgramIDF[h] = math.Log1p((float64(N) - float64(df) + 0.5) / (float64(df) + 0.5))
+					store.NgramIDF[h] = math.Log1p((float64(N) - float64(df) + 0.5) / (float64(df) + 0.5))
 				} else {
-					appCtx.IDFStore.NgramIDF[h] = math.Log1p(float64(N) / (1.0 + float64(df)))
+					store.NgramIDF[h] = math.Log1p(float64(N) / (1.0 + float64(df)))
 				}
 			} else {
-				appCtx.IDFStore.NgramIDF[h] = 0
+				store.NgramIDF[h] = 0
 			}
 		}
 	}
-
-	appCtx.IDFChanged = true
-
-	return nil
 }
 
 // Wrapper for adding a document
-func addDocumentToIDF(body string, tokenCount int, hash string) error {
-	return updateDocumentInIDF(body, tokenCount, hash, +1)
+func addDocumentToIDF(body string, tokenCount int, hash string, role string) error {
+	return updateDocumentInIDF(body, tokenCount, hash, role, +1)
 }
 
-// Wrapper for removing a document
-func removeDocumentFromIDF(body string, tokenCount int, hash string) error {
-	err := updateDocumentInIDF(body, tokenCount, hash, -1)
+// Wrapper for removing a document. Points stored before clean_token_count was persisted read back
+// 0; their count is recomputed from the body, as it was when they were added.
+func removeDocumentFromIDF(body string, tokenCount int, hash string, role string) error {
+	if tokenCount <= 0 && body != "" {
+		tokenCount = calculateTokens(body)
+	}
+	err := updateDocumentInIDF(body, tokenCount, hash, role, -1)
 	if err != nil {
 		return err
 	}
@@ -232,3 +701,33 @@ func removeDocumentFromIDF(body string, tokenCount int, hash string) error {
 
 	return nil
 }
+
+// topIDF returns up to n tokens of store by IDF descending (ties by id): the distinct ones of ids,
+// or all tokens of the store when ids is nil. Tokens not in the store have IDF 0. The caller holds
+// idfMu.
+func topIDF(store *IDFStore, ids []uint32, n int) []idfTerm {
+	var terms []idfTerm
+	if ids == nil {
+		terms = make([]idfTerm, 0, len(store.IDF))
+		for id, idf := range store.IDF {
+			terms = append(terms, idfTerm{ID: id, IDF: idf, DF: store.DF[id]})
+		}
+	} else {
+		terms = make([]idfTerm, 0, len(ids))
+		seen := make(map[uint32]struct{}, len(ids))
+		for _, id := range ids {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			terms = append(terms, idfTerm{ID: id, IDF: store.IDF[id], DF: store.DF[id]})
+		}
+	}
+	slices.SortFunc(terms, func(a, b idfTerm) int {
+		if c := cmp.Compare(b.IDF, a.IDF); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return terms[:min(n, len(terms))]
+}
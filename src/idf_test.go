@@ -0,0 +1,210 @@
+// idf_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestBackfillRoleIDFStores(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.IDFFile = filepath.Join(t.TempDir(), "idf.json")
+	appCtx.Config.PerRoleIDF = false
+	initEmptyIDFStore()
+
+	vector := make([]float32, appCtx.Config.QdrantVectorSize)
+	vector[0] = 1
+	docs := []struct{ role, body string }{
+		{"rag-user", "alpha beta gamma"},
+		{"rag-user", "beta delta"},
+		{"rag-assistant", "alpha epsilon"},
+	}
+	for i, d := range docs {
+		hash := string(rune('a' + i))
+		tokens := calculateTokens(d.body)
+		if err := upsertPoint(d.body, vector, d.role, tokens, tokens, hash, "", nil, nil, uuid.NewString(), 0); err != nil {
+			t.Fatalf("upsertPoint: %v", err)
+		}
+	}
+	if appCtx.IDFStore.N != uint64(len(docs)) {
+		t.Fatalf("merged N = %d, want %d", appCtx.IDFStore.N, len(docs))
+	}
+
+	appCtx.Config.PerRoleIDF = true
+	missing := loadRoleIDFStores()
+	if len(missing) != len(appConsts.AvailableSearchSources) {
+		t.Fatalf("missing roles = %v, want all of %v", missing, appConsts.AvailableSearchSources)
+	}
+	if err := backfillIDFStores(missing, false); err != nil {
+		t.Fatalf("backfillIDFStores: %v", err)
+	}
+	if n := appCtx.RoleIDFStores["rag-user"].N; n != 2 {
+		t.Errorf("user N = %d, want 2", n)
+	}
+	if n := appCtx.RoleIDFStores["rag-assistant"].N; n != 1 {
+		t.Errorf("assistant N = %d, want 1", n)
+	}
+	if tt := appCtx.RoleIDFStores["rag-user"].TotalTokens; tt != 5 {
+		t.Errorf("user TotalTokens = %d, want 5", tt)
+	}
+}
+
+func TestExportImportIDFWithRoles(t *testing.T) {
+	newTestApp(t)
+	dir := t.TempDir()
+	appCtx.Config.IDFFile = filepath.Join(dir, "idf.json")
+	appCtx.Config.PerRoleIDF = true
+	initEmptyIDFStore()
+
+	ids, _ := tokenIDs("alpha beta")
+	appCtx.idfMu.Lock()
+	updateIDFStore(&appCtx.IDFStore, ids, 2, +1)
+	updateIDFStore(appCtx.RoleIDFStores["rag-user"], ids, 2, +1)
+	appCtx.idfMu.Unlock()
+	if err := saveIDF(); err != nil {
+		t.Fatalf("saveIDF: %v", err)
+	}
+
+	exported := filepath.Join(dir, "export.json")
+	if err := exportIDF(appCtx.Config.IDFFile, exported); err != nil {
+		t.Fatalf("exportIDF: %v", err)
+	}
+
+	target := filepath.Join(dir, "restored", "idf.json")
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := importIDF(exported, target); err != nil {
+		t.Fatalf("importIDF: %v", err)
+	}
+	store, err := readIDFFile(roleIDFFile(target, "rag-user"))
+	if err != nil {
+		t.Fatalf("reading imported user store: %v", err)
+	}
+	if store.N != 1 || store.TotalTokens != 2 {
+		t.Errorf("imported user store N=%d TotalTokens=%d, want 1 and 2", store.N, store.TotalTokens)
+	}
+
+	// A version 1 export carries no role stores: the stale role files must go
+	v1 := filepath.Join(dir, "v1.json")
+	if err := os.WriteFile(v1, []byte(`{"format":"ragproxy-idf","version":1,"store":{"DF":{},"N":0,"IDF":{},"NgramDF":{},"NgramIDF":{},"TotalTokens":0}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := importIDF(v1, target); err != nil {
+		t.Fatalf("importIDF v1: %v", err)
+	}
+	if _, err := os.Stat(roleIDFFile(target, "rag-user")); !os.IsNotExist(err) {
+		t.Errorf("user role file still present after v1 import (err=%v)", err)
+	}
+}
+
+func TestLoadIDFRebuildsOnTokenizerChange(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.IDFFile = filepath.Join(t.TempDir(), "idf.json")
+	initEmptyIDFStore()
+
+	vector := make([]float32, appCtx.Config.QdrantVectorSize)
+	vector[0] = 1
+	for i, body := range []string{"alpha beta", "gamma delta"} {
+		if err := upsertPoint(body, vector, "rag-user", 2, 2, string(rune('a'+i)), "", nil, nil, uuid.NewString(), 0); err != nil {
+			t.Fatalf("upsertPoint: %v", err)
+		}
+	}
+
+	// A store of another tokenizer with counters that do not match the collection
+	stale := newIDFStore()
+	stale.N = 99
+	stale.Tokenizer = "tiktoken:other"
+	data, _ := json.Marshal(stale)
+	if err := os.WriteFile(appCtx.Config.IDFFile, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadIDF(); err != nil {
+		t.Fatalf("loadIDF: %v", err)
+	}
+	if appCtx.IDFStore.N != 2 || appCtx.IDFStore.TotalTokens != 4 {
+		t.Errorf("rebuilt store N=%d TotalTokens=%d, want 2 and 4", appCtx.IDFStore.N, appCtx.IDFStore.TotalTokens)
+	}
+
+	// Saved stores carry the configured tokenizer
+	if err := saveIDF(); err != nil {
+		t.Fatalf("saveIDF: %v", err)
+	}
+	saved, err := readIDFFile(appCtx.Config.IDFFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Tokenizer != tokenizerIdentity(appCtx.Config) {
+		t.Errorf("saved tokenizer = %q, want %q", saved.Tokenizer, tokenizerIdentity(appCtx.Config))
+	}
+}
+
+func TestTopIDF(t *testing.T) {
+	store := &IDFStore{
+		IDF: map[uint32]float64{1: 0.5, 2: 2.0, 3: 1.0, 4: 2.0},
+		DF:  map[uint32]int{1: 9, 2: 1, 3: 4, 4: 1},
+	}
+	all := topIDF(store, nil, 3)
+	if len(all) != 3 || all[0].ID != 2 || all[1].ID != 4 || all[2].ID != 3 || all[0].DF != 1 {
+		t.Errorf("topIDF(all, 3) = %+v, want ids 2, 4, 3 with their DF", all)
+	}
+	some := topIDF(store, []uint32{1, 3, 1, 99}, 5)
+	if len(some) != 3 || some[0].ID != 3 || some[1].ID != 1 || some[2].ID != 99 || some[2].IDF != 0 {
+		t.Errorf("topIDF(ids, 5) = %+v, want distinct ids 3, 1, 99 (unknown at 0)", some)
+	}
+}
+
+func TestIDFConsistencyCheckDetectsDrift(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.PerRoleIDF = false
+	appCtx.Config.IDFDriftThreshold = 0.1
+	initEmptyIDFStore()
+	var errs bytes.Buffer
+	appCtx.ErrorLogger = log.New(&errs, "", 0)
+
+	vector := make([]float32, appCtx.Config.QdrantVectorSize)
+	vector[0] = 1
+	var tokens int64
+	for i, body := range []string{"alpha beta gamma", "beta delta", "alpha epsilon"} {
+		n := calculateTokens(body)
+		tokens += int64(n)
+		if err := upsertPoint(body, vector, "rag-user", n, n, string(rune('a'+i)), "", nil, nil, uuid.NewString(), 0); err != nil {
+			t.Fatalf("upsertPoint: %v", err)
+		}
+	}
+	if err := checkIDFConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if errs.Len() > 0 {
+		t.Fatalf("drift reported for a consistent store: %s", errs.String())
+	}
+
+	// Lost removes leave the store counting documents that are gone
+	appCtx.IDFStore.N += 2
+	appCtx.IDFStore.TotalTokens += 10
+	appCtx.Config.IDFDriftCorrect = false
+	if err := checkIDFConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errs.String(), "drift detected") {
+		t.Errorf("drift not reported, error log: %q", errs.String())
+	}
+	if appCtx.IDFStore.N != 5 {
+		t.Errorf("N = %d corrected with IDFDriftCorrect off", appCtx.IDFStore.N)
+	}
+
+	appCtx.Config.IDFDriftCorrect = true
+	if err := checkIDFConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if appCtx.IDFStore.N != 3 || appCtx.IDFStore.TotalTokens != tokens {
+		t.Errorf("corrected to N=%d TotalTokens=%d, want 3 and %d", appCtx.IDFStore.N, appCtx.IDFStore.TotalTokens, tokens)
+	}
+}
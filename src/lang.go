@@ -0,0 +1,109 @@
+// lang.go
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// langDetectMaxWords bounds how many words of a text are looked at for language detection
+const langDetectMaxWords = 2000
+
+// langFilterMinHits is the number of stopword hits a query language needs before LangMode "filter"
+// drops documents of other languages; short or code-heavy prompts are too easily misdetected
+const langFilterMinHits = 3
+
+// detectLanguage guesses the language of text. Languages with configured StopWords are scored by
+// stopword hits first; without hits the dominant script decides (Cyrillic -> "ru", Latin -> "en").
+// Returns "" when the language cannot be guessed, and the stopword hits of the guess (0 by script).
+func detectLanguage(text string) (string, int) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(words) > langDetectMaxWords {
+		words = words[:langDetectMaxWords]
+	}
+	if len(words) == 0 {
+		return "", 0
+	}
+
+	// Stopword hits
+	bestLang, bestHits := "", 0
+	for lang, set := range appCtx.stopWordSets {
+		hits := 0
+		for _, w := range words {
+			if _, ok := set[w]; ok {
+				hits++
+			}
+		}
+		if hits > bestHits || (hits == bestHits && hits > 0 && lang < bestLang) {
+			bestLang, bestHits = lang, hits
+		}
+	}
+	if bestHits > 0 {
+		return bestLang, bestHits
+	}
+
+	// Dominant script
+	cyrillic, latin := 0, 0
+	for _, w := range words {
+		for _, r := range w {
+			switch {
+			case unicode.Is(unicode.Cyrillic, r):
+				cyrillic++
+			case unicode.Is(unicode.Latin, r):
+				latin++
+			}
+		}
+	}
+	switch {
+	case cyrillic == 0 && latin == 0:
+		return "", 0
+	case cyrillic >= latin:
+		return "ru", 0
+	default:
+		return "en", 0
+	}
+}
+
+// buildStopWords prepares the per-language stopword lookups: lowercased words for detection and
+// single-token ids for dropping stopwords from the query's lexical features.
+func buildStopWords(stopWords map[string][]string) {
+	appCtx.stopWordSets = make(map[string]map[string]struct{}, len(stopWords))
+	appCtx.stopWordIDs = make(map[string]map[uint32]struct{}, len(stopWords))
+	for lang, words := range stopWords {
+		set := make(map[string]struct{}, len(words))
+		ids := make(map[uint32]struct{}, len(words))
+		for _, w := range words {
+			w = strings.ToLower(strings.TrimSpace(w))
+			set[w] = struct{}{}
+			if appCtx.Tokenizer == nil {
+				continue
+			}
+			// Both the bare word and its space-prefixed form, for tokenizers that mark word starts
+			for _, variant := range []string{w, " " + w} {
+				if tok, _ := appCtx.Tokenizer.Encode(variant, false); len(tok) == 1 {
+					ids[tok[0]] = struct{}{}
+				}
+			}
+		}
+		appCtx.stopWordSets[lang] = set
+		appCtx.stopWordIDs[lang] = ids
+	}
+}
+
+// removeStopWordIDs drops the stopword token ids of lang from ids. Returns ids unchanged when
+// there is no list for lang.
+func removeStopWordIDs(ids []uint32, lang string) []uint32 {
+	stop, ok := appCtx.stopWordIDs[lang]
+	if !ok || len(stop) == 0 {
+		return ids
+	}
+	kept := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := stop[id]; !ok {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,25 @@
+// lang_test.go
+package main
+
+import "testing"
+
+func TestDetectLanguageHits(t *testing.T) {
+	newTestApp(t)
+	buildStopWords(map[string][]string{"en": {"the", "is", "of", "and"}, "ru": {"и", "в", "не"}})
+	tests := []struct {
+		text     string
+		wantLang string
+		wantHits int
+	}{
+		{"the size of the collection and the limit", "en", 5},
+		{"я не знаю и в этом", "ru", 3},
+		{"func main() { return }", "en", 0}, // by script only
+		{"12345", "", 0},
+	}
+	for _, tt := range tests {
+		lang, hits := detectLanguage(tt.text)
+		if lang != tt.wantLang || hits != tt.wantHits {
+			t.Errorf("detectLanguage(%q) = %q, %d; want %q, %d", tt.text, lang, hits, tt.wantLang, tt.wantHits)
+		}
+	}
+}
@@ -2,45 +2,302 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Function to set up logging (stdout and file for access, error, and debug logs)
-func setupLogging() (*log.Logger, *log.Logger, *log.Logger, *log.Logger, *log.Logger) {
-	// Access log file
-	accessLogFile, err := os.OpenFile("/var/log/ragproxy/access.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Printf("Error opening access log file:\n %v", err)
+// Default log file paths, used when the matching *LogPath option is empty (variables so tests can
+// point them at an unwritable location)
+var (
+	defaultAccessLogPath = "/var/log/ragproxy/access.log"
+	defaultErrorLogPath  = "/var/log/ragproxy/error.log"
+	defaultDebugLogPath  = "/var/log/ragproxy/debug.log"
+	defaultDumpLogPath   = "/var/log/ragproxy/dump.log"
+)
+
+// setupLogging opens the access, error, debug and dump log files configured in config (creating
+// their directories) and returns their loggers. An unwritable configured path is an error; an
+// unwritable default path falls back to stderr (the dump log to nothing) with a single warning,
+// so a missing /var/log/ragproxy does not stop an otherwise working proxy.
+func setupLogging(config Config) (*log.Logger, *log.Logger, *log.Logger, *log.Logger, error) {
+	files := []struct {
+		name, path, def string
+		fallback        io.Writer
+		out             io.Writer
+	}{
+		{name: "access", path: config.AccessLogPath, def: defaultAccessLogPath, fallback: os.Stderr},
+		{name: "error", path: config.ErrorLogPath, def: defaultErrorLogPath, fallback: os.Stderr},
+		{name: "debug", path: config.DebugLogPath, def: defaultDebugLogPath, fallback: os.Stderr},
+		{name: "dump", path: config.DumpLogPath, def: defaultDumpLogPath, fallback: io.Discard}, // packet dumps would flood stderr
+	}
+	var unavailable []string
+	for i := range files {
+		path := files[i].path
+		if path == "" {
+			path = files[i].def
+		}
+		out, err := openLogFile(path, int64(config.LogMaxSizeMB)<<20, config.LogMaxBackups)
+		if err != nil {
+			if files[i].path != "" {
+				return nil, nil, nil, nil, fmt.Errorf("%s log: %w", files[i].name, err)
+			}
+			out = files[i].fallback
+			target := "stderr"
+			if out == io.Discard {
+				target = "discarded"
+			}
+			unavailable = append(unavailable, fmt.Sprintf("%s log -> %s (%v)", files[i].name, target, err))
+		}
+		files[i].out = out
 	}
 
-	// Error log file
-	errorLogFile, err := os.OpenFile("/var/log/ragproxy/error.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Printf("Error opening error log file: %v\n", err)
+	accessLogger := log.New(files[0].out, "ACCESS: ", log.LstdFlags)
+	errorLogger := log.New(files[1].out, "ERROR: ", log.LstdFlags)
+	debugLogger := log.New(files[2].out, "DEBUG: ", log.LstdFlags)
+	dumpLogger := log.New(files[3].out, "DUMP: ", log.LstdFlags)
+
+	if len(unavailable) > 0 {
+		msg := fmt.Sprintf("WARNING: default log files unavailable: %s", strings.Join(unavailable, "; "))
+		appCtx.JournaldLogger.Print(msg)
+		errorLogger.Print(msg)
 	}
 
-	// Debug log file
-	debugLogFile, err := os.OpenFile("/var/log/ragproxy/debug.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	return accessLogger, errorLogger, debugLogger, dumpLogger, nil
+}
+
+// openLogFile creates the directory of path and opens path for appending. With maxSize > 0 the
+// file is rotated when a write would grow it past maxSize, keeping maxBackups old files.
+func openLogFile(path string, maxSize int64, maxBackups int) (io.Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+	if maxSize <= 0 {
+		return file, nil
+	}
+	info, err := file.Stat()
 	if err != nil {
-		fmt.Printf("Error opening debug log file: %v\n", err)
+		file.Close()
+		return nil, fmt.Errorf("stat log file: %w", err)
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, file: file, size: info.Size()}, nil
+}
+
+// rotatingFile is a log file rotated by size: path is renamed to path.1, path.1 to path.2 and so
+// on up to path.<maxBackups>, then a fresh path is opened
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// Write appends p, rotating first when p would grow the file past maxSize
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.file.Close()
+		f.file = nil
+		f.shiftBackups()
+	}
+	if f.file == nil {
+		// a failed rename leaves the old file in place: keep appending to it
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return 0, err
+		}
+		f.size = 0
+		if info, err := file.Stat(); err == nil {
+			f.size = info.Size()
+		}
+		f.file = file
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// shiftBackups drops the oldest backup and renames path.N to path.N+1 and path to path.1
+// (or removes path when no backups are kept)
+func (f *rotatingFile) shiftBackups() {
+	if f.maxBackups <= 0 {
+		os.Remove(f.path)
+		return
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	os.Rename(f.path, f.path+".1")
+}
+
+// asyncWriter buffers log writes and flushes them periodically, when the buffer fills up,
+// and on demand (errors, shutdown)
+type asyncWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+	buf *bufio.Writer
+}
+
+// Write buffers p
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// Flush writes buffered data to the underlying writer
+func (w *asyncWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Flush()
+}
+
+// flushOnWrite flushes buffered logs before each write, so the context of an error is on disk with it
+type flushOnWrite struct {
+	out io.Writer
+}
+
+// Write flushes async logs, then writes p
+func (w flushOnWrite) Write(p []byte) (int, error) {
+	flushLogs()
+	return w.out.Write(p)
+}
+
+var (
+	asyncWriters   []*asyncWriter
+	asyncLogStop   chan struct{}
+	asyncLogStopWG sync.WaitGroup
+)
+
+// applyLoggingConfig applies AsyncLogging and LogFormat to the loggers. Must be called once after
+// the config is loaded.
+func applyLoggingConfig() {
+	if appCtx.Config.AsyncLogging {
+		startAsyncLogging()
 	}
+	// JSON encoding goes outermost: the async buffer must receive whole encoded lines
+	if appCtx.Config.LogFormat == logFormatJSON {
+		applyJSONLogging()
+	}
+	if appCtx.Config.AsyncLogging {
+		appCtx.JournaldLogger.Printf("Async logging enabled: buffer %d bytes, flush every %s", appCtx.Config.AsyncLogBufferSize, appCtx.Config.AsyncLogFlushInterval.Duration)
+	}
+}
+
+// startAsyncLogging switches the access and debug loggers to buffered writers
+func startAsyncLogging() {
 
-	// Debug log file
-	dumpLogFile, err := os.OpenFile("/var/log/ragproxy/dump.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	for _, logger := range []*log.Logger{appCtx.AccessLogger, appCtx.DebugLogger} {
+		w := &asyncWriter{out: logger.Writer()}
+		w.buf = bufio.NewWriterSize(w.out, appCtx.Config.AsyncLogBufferSize)
+		logger.SetOutput(w)
+		asyncWriters = append(asyncWriters, w)
+	}
+	appCtx.ErrorLogger.SetOutput(flushOnWrite{out: appCtx.ErrorLogger.Writer()})
+
+	asyncLogStop = make(chan struct{})
+	asyncLogStopWG.Add(1)
+	go func() {
+		defer asyncLogStopWG.Done()
+		ticker := time.NewTicker(appCtx.Config.AsyncLogFlushInterval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flushLogs()
+			case <-asyncLogStop:
+				return
+			}
+		}
+	}()
+}
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonLogWriter encodes every log line written to it as one JSON object
+type jsonLogWriter struct {
+	out       io.Writer
+	level     string
+	component string
+}
+
+// jsonLogLine is the structured form of a log line
+type jsonLogLine struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	Message   string `json:"message"`
+}
+
+// Write encodes p (one log.Logger line) and writes it to out
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(jsonLogLine{
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		Level:     w.level,
+		Component: w.component,
+		Message:   strings.TrimSuffix(string(p), "\n"),
+	})
 	if err != nil {
-		fmt.Printf("Error opening dump log file: %v\n", err)
+		return 0, err
 	}
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
 
-	// Create separate loggers for stdout (journald), access log, error log, and debug log
-	journaldLogger := log.New(os.Stdout, "", log.LstdFlags)
-	accessLogger := log.New(accessLogFile, "ACCESS: ", log.LstdFlags)
-	errorLogger := log.New(errorLogFile, "ERROR: ", log.LstdFlags)
-	debugLogger := log.New(debugLogFile, "DEBUG: ", log.LstdFlags)
-	dumpLogger := log.New(dumpLogFile, "DUMP: ", log.LstdFlags)
+// applyJSONLogging makes the journald, access, error and debug loggers write JSON lines to their
+// current destinations. The timestamp and level replace the text flags and prefixes.
+func applyJSONLogging() {
+	for _, l := range []struct {
+		logger    *log.Logger
+		level     string
+		component string
+	}{
+		{appCtx.JournaldLogger, "info", "journald"},
+		{appCtx.AccessLogger, "info", "access"},
+		{appCtx.ErrorLogger, "error", "error"},
+		{appCtx.DebugLogger, "debug", "debug"},
+	} {
+		l.logger.SetOutput(&jsonLogWriter{out: l.logger.Writer(), level: l.level, component: l.component})
+		l.logger.SetFlags(0)
+		l.logger.SetPrefix("")
+	}
+}
 
-	// Return the loggers
+// flushLogs writes out all buffered log data
+func flushLogs() {
+	for _, w := range asyncWriters {
+		if err := w.Flush(); err != nil {
+			fmt.Printf("Error flushing log buffer: %v\n", err)
+		}
+	}
+}
 
-	return journaldLogger, accessLogger, errorLogger, debugLogger, dumpLogger
+// stopAsyncLogging stops the periodic flusher and flushes what is left
+func stopAsyncLogging() {
+	if asyncLogStop != nil {
+		close(asyncLogStop)
+		asyncLogStopWG.Wait()
+		asyncLogStop = nil
+	}
+	flushLogs()
 }
@@ -0,0 +1,226 @@
+// log_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the flusher goroutine and the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAsyncLoggingFlushesPeriodicallyAndOnShutdown(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.AsyncLogFlushInterval.Duration = 20 * time.Millisecond
+	appCtx.Config.AsyncLogBufferSize = 1 << 16
+	var access, debug, errs syncBuffer
+	appCtx.AccessLogger = log.New(&access, "", 0)
+	appCtx.DebugLogger = log.New(&debug, "", 0)
+	appCtx.ErrorLogger = log.New(&errs, "", 0)
+	startAsyncLogging()
+	t.Cleanup(func() {
+		stopAsyncLogging()
+		asyncWriters = nil
+	})
+
+	appCtx.AccessLogger.Printf("first line")
+	for deadline := time.Now().Add(2 * time.Second); !strings.Contains(access.String(), "first line"); {
+		if time.Now().After(deadline) {
+			t.Fatal("buffered line never flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// An error flushes the buffered context first
+	appCtx.DebugLogger.Printf("context of the error")
+	appCtx.ErrorLogger.Printf("the error")
+	if !strings.Contains(debug.String(), "context of the error") {
+		t.Error("error log did not flush the buffered debug line")
+	}
+
+	const n = 500
+	for i := range n {
+		appCtx.AccessLogger.Printf("line %d", i)
+	}
+	stopAsyncLogging()
+	got := access.String()
+	for i := range n {
+		if !strings.Contains(got, fmt.Sprintf("line %d\n", i)) {
+			t.Fatalf("line %d lost on shutdown", i)
+		}
+	}
+}
+
+func TestJSONLogLinesHaveExpectedKeys(t *testing.T) {
+	newTestApp(t)
+	var journald, access, errs, debug bytes.Buffer
+	appCtx.JournaldLogger = log.New(&journald, "JOURNALD: ", log.LstdFlags)
+	appCtx.AccessLogger = log.New(&access, "ACCESS: ", log.LstdFlags)
+	appCtx.ErrorLogger = log.New(&errs, "ERROR: ", log.LstdFlags)
+	appCtx.DebugLogger = log.New(&debug, "DEBUG: ", log.LstdFlags)
+	applyJSONLogging()
+
+	appCtx.JournaldLogger.Printf("started")
+	appCtx.AccessLogger.Printf("request %q", "/api/chat")
+	appCtx.ErrorLogger.Printf("failed: %v", "boom")
+	appCtx.DebugLogger.Printf("multi\nline")
+
+	cases := []struct {
+		out              *bytes.Buffer
+		level, component string
+		message          string
+	}{
+		{&journald, "info", "journald", "started"},
+		{&access, "info", "access", `request "/api/chat"`},
+		{&errs, "error", "error", "failed: boom"},
+		{&debug, "debug", "debug", "multi\nline"},
+	}
+	for _, tc := range cases {
+		lines := strings.Split(strings.TrimSuffix(tc.out.String(), "\n"), "\n")
+		if len(lines) != 1 {
+			t.Fatalf("%s: %d lines, want one JSON object: %q", tc.component, len(lines), tc.out.String())
+		}
+		var got map[string]string
+		if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", tc.component, lines[0], err)
+		}
+		if len(got) != 4 {
+			t.Errorf("%s: keys %v, want timestamp, level, component and message", tc.component, got)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, got["timestamp"]); err != nil {
+			t.Errorf("%s: timestamp %q: %v", tc.component, got["timestamp"], err)
+		}
+		if got["level"] != tc.level || got["component"] != tc.component || got["message"] != tc.message {
+			t.Errorf("%s: line %v, want level %q component %q message %q", tc.component, got, tc.level, tc.component, tc.message)
+		}
+	}
+}
+
+func TestLogFilesCreatedAndRotated(t *testing.T) {
+	newTestApp(t)
+	dir := t.TempDir()
+	config := appCtx.Config
+	config.AccessLogPath = filepath.Join(dir, "nested", "access.log")
+	config.ErrorLogPath = filepath.Join(dir, "error.log")
+	config.DebugLogPath = filepath.Join(dir, "debug.log")
+	config.DumpLogPath = filepath.Join(dir, "dump.log")
+	config.LogMaxSizeMB, config.LogMaxBackups = 1, 2
+	access, _, _, _, err := setupLogging(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{config.AccessLogPath, config.ErrorLogPath, config.DebugLogPath, config.DumpLogPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("log file not created: %v", err)
+		}
+	}
+
+	// Two 0.4 MB lines fit in a file: eight rotate it three times, the oldest pair is dropped
+	line := strings.Repeat("x", 400<<10)
+	for i := range 8 {
+		access.Printf("line %d %s", i, line)
+	}
+	for path, first := range map[string]int{config.AccessLogPath: 6, config.AccessLogPath + ".1": 4, config.AccessLogPath + ".2": 2} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("rotated file missing: %v", err)
+		}
+		if len(data) > 1<<20 {
+			t.Errorf("%s has %d bytes, over LogMaxSizeMB", path, len(data))
+		}
+		for i := first; i < first+2; i++ {
+			if !strings.Contains(string(data), fmt.Sprintf("line %d ", i)) {
+				t.Errorf("%s does not hold line %d", path, i)
+			}
+		}
+	}
+	if _, err := os.Stat(config.AccessLogPath + ".3"); err == nil {
+		t.Error("more than LogMaxBackups backups kept")
+	}
+
+	// An unwritable configured path fails setup
+	blocker := filepath.Join(dir, "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.ErrorLogPath = filepath.Join(blocker, "error.log")
+	if _, _, _, _, err := setupLogging(config); err == nil {
+		t.Error("setupLogging accepted an unwritable ErrorLogPath")
+	}
+}
+
+func TestUnwritableDefaultLogPathsFallBack(t *testing.T) {
+	newTestApp(t)
+	// A regular file where the log directory should be: not creatable, even for root
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaults := []*string{&defaultAccessLogPath, &defaultErrorLogPath, &defaultDebugLogPath, &defaultDumpLogPath}
+	saved := make([]string, len(defaults))
+	for i, p := range defaults {
+		saved[i] = *p
+		*p = filepath.Join(blocker, filepath.Base(*p))
+	}
+	t.Cleanup(func() {
+		for i, p := range defaults {
+			*p = saved[i]
+		}
+	})
+	var journald bytes.Buffer
+	appCtx.JournaldLogger = log.New(&journald, "", 0)
+
+	// The fallback loggers write to stderr
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stderr := os.Stderr
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+
+	config := appCtx.Config
+	config.AccessLogPath, config.ErrorLogPath, config.DebugLogPath, config.DumpLogPath = "", "", "", ""
+	access, errs, debug, dump, err := setupLogging(config)
+	if err != nil {
+		t.Fatalf("setupLogging with unwritable default paths: %v", err)
+	}
+	for _, logger := range []*log.Logger{access, errs, debug, dump} {
+		if logger == nil {
+			t.Fatal("nil logger")
+		}
+		logger.Printf("still logging")
+	}
+	if n := strings.Count(journald.String(), "WARNING"); n != 1 {
+		t.Errorf("%d warnings, want a single one: %q", n, journald.String())
+	}
+	for _, name := range []string{"access", "error", "debug", "dump"} {
+		if !strings.Contains(journald.String(), name+" log -> ") {
+			t.Errorf("warning does not name the %s log: %q", name, journald.String())
+		}
+	}
+}
@@ -4,25 +4,27 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/daulet/tokenizers"
 	"github.com/pelletier/go-toml/v2"
 )
 
 var appCtx AppContext
 
-// initApp initializes the application: checks user, sets up logging, reads config, connects to Qdrant
+// initApp initializes the application: reads config, checks user, sets up logging, connects to Qdrant
 func initApp(configPath string) error {
 
 	var err error
@@ -31,32 +33,23 @@ func initApp(configPath string) error {
 		Config:                       Config{},
 		DB:                           nil, // Will be used with withDB per call
 		Tokenizer:                    nil,
-		JournaldLogger:               nil,
-		AccessLogger:                 nil,
-		ErrorLogger:                  nil,
-		DebugLogger:                  nil,
-		DumpLogger:                   nil,
+		JournaldLogger:               log.New(os.Stdout, "", log.LstdFlags),
+		AccessLogger:                 log.New(io.Discard, "", 0), // replaced by setupLogging; never nil
+		ErrorLogger:                  log.New(os.Stderr, "ERROR: ", log.LstdFlags),
+		DebugLogger:                  log.New(io.Discard, "", 0),
+		DumpLogger:                   log.New(io.Discard, "", 0),
 		IDFChanged:                   false,
 		idfAutoSaveStopChan:          make(chan struct{}),
 		idfAutoSaveWG:                sync.WaitGroup{},
 		responseReplaceRules:         []ResponseReplaceRecord{},
 		responseReplaceMaxTriggerLen: 0,
+		configPath:                   configPath,
 	}
 
-	// Check if the 'ragproxy' user exists
-	err = checkRagproxyUser()
-	if err != nil {
-		return err
-	}
-
-	// Set up logging
-	appCtx.JournaldLogger, appCtx.AccessLogger, appCtx.ErrorLogger, appCtx.DebugLogger, appCtx.DumpLogger = setupLogging()
-
-	// Read and parse config file
+	// Read and parse config file (journald logging only: the log files are set up from the config)
 	var configData []byte
 	configData, err = os.ReadFile(configPath)
 	if err != nil {
-		appCtx.ErrorLogger.Printf("Error reading config file: %v", err)
 		appCtx.JournaldLogger.Printf("Error reading config file: %v", err)
 		return err
 	}
@@ -64,7 +57,6 @@ func initApp(configPath string) error {
 
 	err = toml.Unmarshal(configData, &appCtx.Config)
 	if err != nil {
-		appCtx.ErrorLogger.Printf("Error parsing config file: %v", err)
 		appCtx.JournaldLogger.Printf("Error parsing config file: %v", err)
 		return err
 	}
@@ -72,26 +64,56 @@ func initApp(configPath string) error {
 
 	appCtx.JournaldLogger.Printf("Config file %s parsed successfully", configPath)
 
-	appCtx.Tokenizer, err = tokenizers.FromPretrained(appCtx.Config.TokenizerHFModelName,
-		tokenizers.WithCacheDir(appCtx.Config.TokenizerPretrainedCacheDir),
-		tokenizers.WithAuthToken(appCtx.Config.TokenizerHFAPI))
+	// Validate before anything acts on the config, so a malformed one reports its real problem.
+	// The tag lists it checks against do not need the tokenizer; token sizes follow below.
+	initConsts()
+	err = validateConfig(appCtx.Config)
+	if err != nil {
+		appCtx.ErrorLogger.Printf("Invalid config: %v", err)
+		appCtx.JournaldLogger.Printf("Invalid config: %v", err)
+		return err
+	}
+	appCtx.JournaldLogger.Printf("Configuration validated successfully")
+
+	// Check if the service user exists (RequireRagproxyUser, RagproxyUser)
+	err = checkRagproxyUser(appCtx.Config)
+	if err != nil {
+		return err
+	}
+
+	// Set up file logging
+	appCtx.AccessLogger, appCtx.ErrorLogger, appCtx.DebugLogger, appCtx.DumpLogger, err = setupLogging(appCtx.Config)
+	if err != nil {
+		appCtx.JournaldLogger.Printf("Error setting up logging: %v", err)
+		return err
+	}
+
+	appCtx.Tokenizer, err = newTokenizer(appCtx.Config)
 	if err != nil {
 		appCtx.ErrorLogger.Printf("Error initializing Tokenizer: %v", err)
 		appCtx.JournaldLogger.Printf("Error initializing Tokenizer: %v", err)
 		return err
 	}
-	appCtx.JournaldLogger.Printf("Tokenizer initialized successfully")
+	appCtx.JournaldLogger.Printf("Tokenizer (%s) initialized successfully", appCtx.Config.TokenizerBackend)
 
-	initConsts()
+	initTokenConsts()
 	appCtx.JournaldLogger.Printf("Application constants initialized: %+v", appConsts)
 
-	err = validateConfig(appCtx.Config)
+	if err = initConfigState(); err != nil {
+		appCtx.ErrorLogger.Printf("Error initializing config state: %v", err)
+		appCtx.JournaldLogger.Printf("Error initializing config state: %v", err)
+		return err
+	}
+
+	err = initOllamaBackends(appCtx.Config)
 	if err != nil {
-		appCtx.ErrorLogger.Printf("Invalid config: %v", err)
-		appCtx.JournaldLogger.Printf("Invalid config: %v", err)
+		appCtx.ErrorLogger.Printf("Error initializing Ollama backends: %v", err)
+		appCtx.JournaldLogger.Printf("Error initializing Ollama backends: %v", err)
 		return err
 	}
-	appCtx.JournaldLogger.Printf("Configuration validated successfully")
+
+	// Switch to buffered logging if configured
+	applyLoggingConfig()
 
 	err = initTokenCache()
 	if err != nil {
@@ -104,6 +126,17 @@ func initApp(configPath string) error {
 	// Application initialization log
 	appCtx.JournaldLogger.Printf("Application context initialized")
 
+	// Load the in-memory store before initDB so a snapshot counts as an existing collection
+	if appCtx.Config.StorageBackend == storageInMemory {
+		appCtx.memStore, err = loadMemStore(appCtx.Config.MemoryStoreFile)
+		if err != nil {
+			appCtx.ErrorLogger.Printf("Error loading in-memory store: %v", err)
+			appCtx.JournaldLogger.Printf("Error loading in-memory store: %v", err)
+			return err
+		}
+		appCtx.JournaldLogger.Printf("In-memory store loaded with %d points", len(appCtx.memStore.points))
+	}
+
 	// Initialize database with fresh connection
 	err = withDB(func() error {
 		return initDB()
@@ -114,6 +147,11 @@ func initApp(configPath string) error {
 		return err
 	}
 
+	// Warn when the stored hashes were made with another HashAlgo
+	if err := checkStoredHashAlgo(); err != nil {
+		appCtx.ErrorLogger.Printf("Stored hash check failed: %v", err)
+	}
+
 	// Check embedding normalization
 	if err := checkEmbeddingNormalization(); err != nil {
 		appCtx.ErrorLogger.Printf("Embedding normalization check failed: %v", err)
@@ -135,43 +173,300 @@ func initApp(configPath string) error {
 		startIDFAutoSave(d)
 	}
 
+	// Start IDF consistency check goroutine if interval > 0
+	if d := appCtx.Config.IDFCheckInterval.Duration; d > 0 {
+		startIDFConsistencyCheck(d)
+	}
+
+	// Start TTL sweeper goroutine if interval > 0
+	if d := appCtx.Config.TTLSweepInterval.Duration; d > 0 {
+		startTTLSweeper(d)
+	}
+
 	// Application fully initialized
 	appCtx.JournaldLogger.Printf("Application initialized successfully")
 	return nil
 }
 
+// validateConfigFile parses and validates the config file without connecting to Qdrant or Ollama,
+// loading the tokenizer or IDF store, or checking the ragproxy user
+func validateConfigFile(configPath string) error {
+	appCtx = AppContext{
+		JournaldLogger:      log.New(os.Stdout, "", 0), // validation warnings
+		AccessLogger:        log.New(io.Discard, "", 0),
+		ErrorLogger:         log.New(io.Discard, "", 0),
+		DebugLogger:         log.New(io.Discard, "", 0),
+		DumpLogger:          log.New(io.Discard, "", 0),
+		idfAutoSaveStopChan: make(chan struct{}),
+	}
+
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	if err := toml.Unmarshal(configData, &appCtx.Config); err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+	initConsts()
+	if err := validateConfig(appCtx.Config); err != nil {
+		return err
+	}
+	if err := initConfigState(); err != nil {
+		return err
+	}
+	return initOllamaBackends(appCtx.Config)
+}
+
+// inboundResult carries the results of processInbound across goroutines
+type inboundResult struct {
+	body             string
+	cleanUserContent string
+	attachments      []Attachment
+	promptVector     []float32
+	queryHash        string
+	thread           ThreadRef
+	status           string // ragStatus value of the request
+	degraded         bool   // deadline expired, original data passed through
+	augErr           error  // augmentation failed, the original data is passed through
+	panicValue       any    // recovered panic of processInbound, nil if none
+}
+
+// runInbound calls processInbound and recovers from its panics, returning the original data for passthrough
+func runInbound(ctx context.Context, data string, opts RequestOptions) (res inboundResult) {
+	defer func() {
+		if p := recover(); p != nil {
+			appCtx.ErrorLogger.Printf("Panic in request augmentation: %v\n%s", p, debug.Stack())
+			res = inboundResult{body: data, status: ragStatusError, panicValue: p}
+		}
+	}()
+	res.body, res.cleanUserContent, res.attachments, res.promptVector, res.queryHash, res.thread, res.status, res.augErr = processInbound(ctx, data, opts)
+	return res
+}
+
+// processInboundWithDeadline runs processInbound bounded by RequestMaxDuration, cancelled with ctx
+// (the client request). When the deadline expires first, the original data is returned for plain
+// passthrough and degraded is set. The stream itself is not bounded.
+func processInboundWithDeadline(ctx context.Context, data string, opts RequestOptions) inboundResult {
+	maxDuration := appCtx.Config.RequestMaxDuration.Duration
+	if maxDuration <= 0 {
+		return runInbound(ctx, data, opts)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, maxDuration)
+	defer cancel()
+
+	resultCh := make(chan inboundResult, 1) // buffered: a late result must not block the goroutine
+	appCtx.inboundWG.Add(1)
+	go func() {
+		defer appCtx.inboundWG.Done()
+		resultCh <- runInbound(ctx, data, opts)
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return inboundResult{body: data, status: ragStatusError, augErr: ctx.Err()}
+		}
+		appCtx.ErrorLogger.Printf("Request augmentation exceeded %s, falling back to passthrough", maxDuration)
+		return inboundResult{body: data, status: ragStatusError, degraded: true}
+	}
+}
+
+// inboundErrorReason describes why the augmentation of res failed, empty when it did not
+func inboundErrorReason(res inboundResult) string {
+	switch {
+	case res.augErr != nil:
+		return augmentationErrorValue(res.augErr)
+	case res.degraded:
+		return "augmentation deadline exceeded"
+	case res.panicValue != nil:
+		return "panic in request augmentation"
+	}
+	return ""
+}
+
+// errTooManyRequests is returned by feedPrompt when no augmentation slot freed up in time
+var errTooManyRequests = errors.New("too many concurrent requests")
+
+// acquireRequestSlot takes one of MaxConcurrentRequests augmentation slots, waiting up to
+// ConcurrencyQueueTimeout. Returns false when no slot freed up in time or ctx is done.
+func acquireRequestSlot(ctx context.Context) bool {
+	if appCtx.requestSlots == nil {
+		return true
+	}
+	select {
+	case appCtx.requestSlots <- struct{}{}:
+		return true
+	default:
+	}
+	wait := appCtx.Config.ConcurrencyQueueTimeout.Duration
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case appCtx.requestSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseRequestSlot frees a slot taken by acquireRequestSlot
+func releaseRequestSlot() {
+	if appCtx.requestSlots != nil {
+		<-appCtx.requestSlots
+	}
+}
+
 // runApp runs the main application logic: starts the proxy server
 func runApp() error {
 	// Log program startup in journald (stdout)
-	appCtx.JournaldLogger.Printf("Starting ragproxy on %s, forwarding requests to %s", appCtx.Config.Listen, appCtx.Config.OllamaBase)
+	appCtx.JournaldLogger.Printf("Starting ragproxy on %s, forwarding requests to %v", appCtx.Config.Listen, ollamaBackendBases(appCtx.Config))
 
-	// Parse the Ollama server URL
-	ollamaURL, err := url.Parse(appCtx.Config.OllamaBase)
-	if err != nil {
-		appCtx.ErrorLogger.Printf("Error parsing Ollama URL: %v", err)
-		appCtx.JournaldLogger.Printf("Error parsing Ollama URL: %v", err)
-		return err
+	// Create outbound to Ollama (backends parsed in initApp)
+	outbound := newOllamaProxy()
+
+	// Register admin endpoints (if enabled)
+	registerAdminHandlers()
+
+	// Start background store workers (if enabled)
+	if appCtx.Config.AsyncStore {
+		startStoreWorkers(appCtx.Config.AsyncStoreWorkers, appCtx.Config.AsyncStoreQueueSize)
 	}
 
-	// Create outbound to Ollama
-	outbound := httputil.NewSingleHostReverseProxy(ollamaURL)
+	// Limit concurrent augmentation (if enabled)
+	if appCtx.Config.MaxConcurrentRequests > 0 {
+		appCtx.requestSlots = make(chan struct{}, appCtx.Config.MaxConcurrentRequests)
+	}
 
 	// Handle incoming requests
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/", withRecover(withCORS(proxyHandler(outbound))))
+
+	// Create inbound
+	inbound := &http.Server{
+		Addr: appCtx.Config.Listen,
+	}
+
+	// Channel to listen for interrupt signal (and SIGHUP for config reload)
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	// Start inbound in a goroutine
+	go func() {
+		appCtx.JournaldLogger.Printf("Inbound is listening on %s", appCtx.Config.Listen)
+		if err := inbound.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			appCtx.ErrorLogger.Printf("Error starting inbound: %v", err)
+			appCtx.JournaldLogger.Printf("Error starting inbound: %v", err)
+		}
+	}()
+
+	// Wait for interrupt signal, reloading the config on SIGHUP
+	waitForShutdown(done)
+	appCtx.JournaldLogger.Printf("Shutting down inbound...")
+
+	// Graceful shutdown of inbound
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := inbound.Shutdown(ctx); err != nil {
+		appCtx.ErrorLogger.Printf("Inbound forced to shutdown: %v", err)
+		appCtx.JournaldLogger.Printf("Inbound forced to shutdown: %v", err)
+	}
+
+	appCtx.JournaldLogger.Printf("Inbound exited")
+
+	// Finish queued stores before IDF and in-memory points are saved
+	drainStoreWorkers()
+	return nil
+}
+
+// proxyHandler augments an Ollama request, forwards it to outbound and stores the exchange
+func proxyHandler(outbound http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		var requestBody string
 		var cleanUserContent string
 		var attachments []Attachment
 		var promptVector []float32
 		var queryHash string
-		// Read and log request body
+		var thread ThreadRef
+		opts := requestOptionsFromHeaders(r.Header)
+		// Read and log request body (bounded by MaxRequestBytes)
+		if maxBytes := appCtx.Config.MaxRequestBytes; maxBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
 		bodyBytes, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		// A gzip body is processed decompressed and forwarded without Content-Encoding; one that
+		// cannot be decompressed is forwarded as received, unprocessed
+		undecodable := false
+		if err == nil && isGzipEncoded(r.Header) {
+			var decoded []byte
+			if decoded, err = gunzipBody(bodyBytes, appCtx.Config.MaxRequestBytes); err == nil {
+				bodyBytes = decoded
+				r.Header.Del("Content-Encoding")
+			} else if !errors.As(err, &tooLarge) {
+				appCtx.ErrorLogger.Printf("Error decompressing gzip request body, passing it through unprocessed: %v", err)
+				err = nil
+				undecodable = true
+			}
+		}
+		if errors.As(err, &tooLarge) {
+			appCtx.AccessLogger.Printf("Request %s %s rejected: body exceeds %d bytes", r.Method, r.URL, tooLarge.Limit)
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)})
+			return
+		}
 		if err != nil {
 			if appCtx.Config.VerboseDiskLogs {
 				appCtx.ErrorLogger.Printf("Error reading request body: %v", err)
 			}
+			if appCtx.Config.RAGStatusHeader {
+				w.Header().Set(ragStatusHeader, ragStatusError)
+				w.Header().Set(augmentationErrorHeader, augmentationErrorValue(fmt.Errorf("reading request body: %w", err)))
+			}
+		} else if undecodable {
+			r.Body = io.NopCloser(bytes.NewReader(bodyBytes)) // Restore body
+			r.ContentLength = int64(len(bodyBytes))
+			if appCtx.Config.RAGStatusHeader {
+				w.Header().Set(ragStatusHeader, ragStatusSkipped)
+			}
 		} else {
 			requestBody = string(bodyBytes)
-			requestBody, cleanUserContent, attachments, promptVector, queryHash = processInbound(requestBody)
+			res := processInboundWithDeadline(r.Context(), requestBody, opts)
+			if res.panicValue != nil && !appCtx.Config.PanicPassthrough {
+				panic(res.panicValue) // handled by withRecover
+			}
+			if appCtx.Config.RAGStatusHeader {
+				w.Header().Set(ragStatusHeader, res.status)
+				if reason := inboundErrorReason(res); reason != "" {
+					w.Header().Set(augmentationErrorHeader, reason)
+				}
+			}
+			if res.augErr != nil {
+				if errors.Is(res.augErr, errTooManyRequests) {
+					appCtx.AccessLogger.Printf("Request %s %s rejected: %d concurrent requests in progress", r.Method, r.URL, appCtx.Config.MaxConcurrentRequests)
+					writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": res.augErr.Error()})
+					return
+				}
+				if rejectsWindowOverflow(res.augErr) {
+					appCtx.AccessLogger.Printf("Request %s %s rejected: %v", r.Method, r.URL, res.augErr)
+					writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": res.augErr.Error()})
+					return
+				}
+				if appCtx.Config.ExposeAugmentationErrors {
+					w.Header().Set(augmentationErrorHeader, augmentationErrorValue(res.augErr))
+				}
+			}
+			if res.degraded {
+				w.Header().Set("X-Ragproxy-Degraded", "deadline")
+			} else if res.panicValue != nil {
+				w.Header().Set("X-Ragproxy-Degraded", "panic")
+			}
+			requestBody, cleanUserContent, attachments, promptVector, queryHash, thread = res.body, res.cleanUserContent, res.attachments, res.promptVector, res.queryHash, res.thread
 			r.Body = io.NopCloser(bytes.NewReader([]byte(requestBody))) // Restore body
 			r.ContentLength = int64(len(requestBody))
 			r.Header.Set("Content-Type", "application/json")
@@ -206,48 +501,40 @@ func runApp() error {
 		}
 		// Stop the outgoing loop and finish goroutine
 		collector.StopOutgoingLoop()
-		if wasMessages && len(cleanAssistantContent) > 0 {
-			processOutbound(cleanAssistantContent, cleanUserContent, attachments, promptVector, queryHash)
+		if wasMessages && len(cleanAssistantContent) > 0 && cleanUserContent != "" {
+			storeOutbound(outboundJob{
+				cleanAssistantContent: cleanAssistantContent,
+				cleanUserContent:      cleanUserContent,
+				attachments:           attachments,
+				promptVector:          promptVector,
+				queryHash:             queryHash,
+				thread:                thread,
+				ttl:                   opts.TTL,
+			})
 		}
-
-	})
-
-	// Create inbound
-	inbound := &http.Server{
-		Addr: appCtx.Config.Listen,
 	}
+}
 
-	// Channel to listen for interrupt signal
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-
-	// Start inbound in a goroutine
-	go func() {
-		appCtx.JournaldLogger.Printf("Inbound is listening on %s", appCtx.Config.Listen)
-		if err := inbound.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			appCtx.ErrorLogger.Printf("Error starting inbound: %v", err)
-			appCtx.JournaldLogger.Printf("Error starting inbound: %v", err)
+// waitForShutdown blocks until a signal other than SIGHUP arrives on sigs. SIGHUP reloads the
+// config and keeps waiting, so the inbound listener is not interrupted.
+func waitForShutdown(sigs <-chan os.Signal) {
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			return
+		}
+		appCtx.JournaldLogger.Printf("SIGHUP received, reloading config %s", appCtx.configPath)
+		if err := reloadConfig(); err != nil {
+			appCtx.ErrorLogger.Printf("Config reload failed, running config kept: %v", err)
+			appCtx.JournaldLogger.Printf("Config reload failed, running config kept: %v", err)
 		}
-	}()
-
-	// Wait for interrupt signal
-	<-done
-	appCtx.JournaldLogger.Printf("Shutting down inbound...")
-
-	// Graceful shutdown of inbound
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := inbound.Shutdown(ctx); err != nil {
-		appCtx.ErrorLogger.Printf("Inbound forced to shutdown: %v", err)
-		appCtx.JournaldLogger.Printf("Inbound forced to shutdown: %v", err)
 	}
-
-	appCtx.JournaldLogger.Printf("Inbound exited")
-	return nil
 }
 
 // shutdownApp handles application shutdown: closes connections, logs
 func shutdownApp(dontSaveIDF bool) {
+	// Augmentations cut off by RequestMaxDuration may still be searching
+	appCtx.inboundWG.Wait()
+
 	// Close database connection if open
 	if appCtx.DB != nil {
 		err := appCtx.DB.Close()
@@ -258,18 +545,34 @@ func shutdownApp(dontSaveIDF bool) {
 		}
 	}
 
+	// Store in-memory points to the snapshot file; skipped with IDF in test runs
+	if appCtx.memStore != nil && appCtx.Config.MemoryStoreFile != "" && !dontSaveIDF {
+		if err := saveMemStore(appCtx.memStore, appCtx.Config.MemoryStoreFile); err != nil {
+			appCtx.ErrorLogger.Printf("Error saving in-memory store: %v", err)
+			appCtx.JournaldLogger.Printf("Error saving in-memory store: %v", err)
+		} else {
+			appCtx.JournaldLogger.Printf("In-memory store saved to %s", appCtx.Config.MemoryStoreFile)
+		}
+	}
+
 	if !dontSaveIDF {
+		// Stop IDF autosave, consistency check and TTL sweep goroutines first: they may change IDF
+		close(appCtx.idfAutoSaveStopChan)
+		appCtx.idfAutoSaveWG.Wait()
 		// Store IDF store to file
-		err := saveIDF(true)
+		err := saveIDF()
 		if err != nil {
 			appCtx.ErrorLogger.Printf("Error storing IDF store: %v", err)
 			appCtx.JournaldLogger.Printf("Error storing IDF store: %v", err)
 		} else {
 			appCtx.JournaldLogger.Printf("IDF store saved successfully")
 		}
-		// Stop IDF autosave goroutine
-		close(appCtx.idfAutoSaveStopChan)
-		appCtx.idfAutoSaveWG.Wait()
+	}
+
+	// Stop token cache sweep
+	if appCtx.tokenCacheStopChan != nil {
+		close(appCtx.tokenCacheStopChan)
+		appCtx.tokenCacheStopChan = nil
 	}
 
 	// Close tokenizer
@@ -280,6 +583,9 @@ func shutdownApp(dontSaveIDF bool) {
 
 	// Log shutdown completion
 	appCtx.JournaldLogger.Printf("Ragproxy stopped")
+
+	// Write out buffered logs
+	stopAsyncLogging()
 }
 
 func main() {
@@ -290,6 +596,18 @@ func main() {
 	qhost := flag.String("qhost", "", "Qdrant host for flush-db")
 	qport := flag.Int("qport", 0, "Qdrant port for flush-db")
 	qcollection := flag.String("qcollection", "", "Qdrant collection for flush-db")
+	qapikey := flag.String("qapikey", "", "Qdrant API key for flush-db")
+	qtls := flag.Bool("qtls", false, "Use TLS to connect to Qdrant for flush-db")
+	exportIDFPath := flag.String("export-idf", "", "Export the IDF store of --config to a file and exit")
+	importIDFPath := flag.String("import-idf", "", "Import an exported IDF store into IDFFile of --config and exit (stop the service first)")
+	replayDeadLetter := flag.Bool("replay-deadletter", false, "Re-attempt the failed stores in DeadLetterDir of --config and exit (stop the service first)")
+	prune := flag.Bool("prune", false, "Delete the points matching --older-than-days, --role and --file-id from the database of --config and exit (stop the service first)")
+	olderThanDays := flag.Int("older-than-days", 0, "Prune: only points stored more than this many days ago")
+	pruneRole := flag.String("role", "", "Prune: only points of this role (rag-user, rag-assistant, rag-file)")
+	pruneFileID := flag.String("file-id", "", "Prune: only points of this file id")
+	reembed := flag.Bool("reembed", false, "Copy all points of --from-collection into QdrantCollection of --config, re-embedded with its EmbeddingModel, and exit (stop the service first)")
+	fromCollection := flag.String("from-collection", "", "Re-embed: source Qdrant collection")
+	validateOnly := flag.Bool("validate-config", false, "Validate --config and exit (no Qdrant, Ollama or user checks)")
 	flag.Parse()
 
 	// Handle flush-db flag
@@ -298,7 +616,7 @@ func main() {
 			fmt.Printf("Error: --flush-db requires --qhost, --qport, and --qcollection flags\n")
 			os.Exit(1)
 		}
-		err := flushDatabase(*qhost, *qport, *qcollection)
+		err := flushDatabase(*qhost, *qport, *qcollection, *qapikey, *qtls)
 		if err != nil {
 			fmt.Printf("Error flushing database: %v\n", err)
 			os.Exit(1)
@@ -313,13 +631,130 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Handle validate-config flag
+	if *validateOnly {
+		if err := validateConfigFile(*configPath); err != nil {
+			fmt.Printf("Config '%s' is invalid: %v\n", *configPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Config '%s' is valid.\n", *configPath)
+		os.Exit(0)
+	}
+
+	// Handle export-idf / import-idf flags
+	if *exportIDFPath != "" || *importIDFPath != "" {
+		if *exportIDFPath != "" && *importIDFPath != "" {
+			fmt.Printf("Error: --export-idf and --import-idf cannot be used together\n")
+			os.Exit(1)
+		}
+		var config Config
+		configData, err := os.ReadFile(*configPath)
+		if err == nil {
+			err = toml.Unmarshal(configData, &config)
+		}
+		if err == nil && config.IDFFile == "" {
+			err = fmt.Errorf("`IDFFile` is not set")
+		}
+		if err != nil {
+			fmt.Printf("Error reading config: %v\n", err)
+			os.Exit(1)
+		}
+		initConsts() // roles of the per-role IDF files
+		if *exportIDFPath != "" {
+			if err := exportIDF(config.IDFFile, *exportIDFPath); err != nil {
+				fmt.Printf("Error exporting IDF store: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("IDF store exported to '%s'.\n", *exportIDFPath)
+		} else {
+			if err := importIDF(*importIDFPath, config.IDFFile); err != nil {
+				fmt.Printf("Error importing IDF store: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("IDF store imported into '%s'.\nYou can now start the service: sudo systemctl restart ragproxy\n", config.IDFFile)
+		}
+		os.Exit(0)
+	}
+
+	// Check prune flags before starting anything
+	if *prune {
+		if *olderThanDays <= 0 && *pruneRole == "" && *pruneFileID == "" {
+			fmt.Printf("Error: --prune requires --older-than-days, --role or --file-id\n")
+			os.Exit(1)
+		}
+		if *olderThanDays < 0 {
+			fmt.Printf("Error: --older-than-days must not be negative\n")
+			os.Exit(1)
+		}
+	}
+
+	if *reembed && *fromCollection == "" {
+		fmt.Printf("Error: --reembed requires --from-collection\n")
+		os.Exit(1)
+	}
+
 	// Initialize application
 	err := initApp(*configPath)
 	if err != nil {
 		fmt.Println(err)
+		stopAsyncLogging()
 		os.Exit(1)
 	}
 
+	// Handle replay-deadletter flag
+	if *replayDeadLetter {
+		if appCtx.Config.DeadLetterDir == "" {
+			fmt.Printf("Error: --replay-deadletter requires DeadLetterDir in config\n")
+			shutdownApp(true)
+			os.Exit(1)
+		}
+		replayed, failed, err := replayDeadLetters(appCtx.Config.DeadLetterDir)
+		shutdownApp(false)
+		if err != nil {
+			fmt.Printf("Error replaying dead letters: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Dead letters replayed: %d, still failing: %d\n", replayed, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Handle prune flag
+	if *prune {
+		if *pruneRole != "" && !slices.Contains(appConsts.AvailableSearchSources, *pruneRole) {
+			fmt.Printf("Error: --role must be one of %v\n", appConsts.AvailableSearchSources)
+			shutdownApp(true)
+			os.Exit(1)
+		}
+		deleted, err := prunePoints(*olderThanDays, *pruneRole, *pruneFileID)
+		shutdownApp(false)
+		if err != nil {
+			fmt.Printf("Error pruning database after %d points: %v\n", deleted, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Pruned %d points from '%s'.\n", deleted, appCtx.Config.QdrantCollection)
+		os.Exit(0)
+	}
+
+	// Handle reembed flag
+	if *reembed {
+		if appCtx.Config.StorageBackend == storageInMemory {
+			fmt.Printf("Error: --reembed requires StorageBackend = \"qdrant\"\n")
+			shutdownApp(true)
+			os.Exit(1)
+		}
+		copied, err := reembedCollection(*fromCollection)
+		shutdownApp(false)
+		if err != nil {
+			fmt.Printf("Error re-embedding after %d points: %v\n", copied, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Re-embedded %d points from '%s' into '%s'.\nSet QdrantCollection in the service config and restart it: sudo systemctl restart ragproxy\n", copied, *fromCollection, appCtx.Config.QdrantCollection)
+		os.Exit(0)
+	}
+
 	dontSaveIDF := false
 	if !*test {
 		// Run application
@@ -0,0 +1,226 @@
+// main_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// testTokenizer splits text on whitespace and uses the FNV hash of each word as its token id,
+// so tests run without tokenizer files
+type testTokenizer struct{}
+
+func (testTokenizer) Encode(text string, addSpecialTokens bool) ([]uint32, []string) {
+	words := strings.Fields(text)
+	ids := make([]uint32, len(words))
+	for i, w := range words {
+		h := fnv.New32a()
+		h.Write([]byte(w))
+		ids[i] = h.Sum32()
+	}
+	return ids, words
+}
+
+func (testTokenizer) Decode(ids []uint32, skipSpecialTokens bool) string { return "" }
+
+func (testTokenizer) Close() error { return nil }
+
+// newTestApp sets up appCtx from deploy/config.toml with silent loggers, the test tokenizer, an
+// empty IDF store and the in-memory storage backend. Tests sharing appCtx must not run in parallel.
+func newTestApp(t testing.TB) {
+	t.Helper()
+	if err := validateConfigFile("../deploy/config.toml"); err != nil {
+		t.Fatalf("validateConfigFile: %v", err)
+	}
+	discard := log.New(io.Discard, "", 0)
+	appCtx.JournaldLogger, appCtx.AccessLogger, appCtx.ErrorLogger = discard, discard, discard
+	appCtx.DebugLogger, appCtx.DumpLogger = discard, discard
+
+	appCtx.Tokenizer = testTokenizer{}
+	initTokenConsts()
+	ttl := appCtx.Config.TokensCacheTTL
+	appCtx.Config.TokensCacheTTL.Duration = 0 // no sweep goroutine per test
+	if err := initTokenCache(); err != nil {
+		t.Fatalf("initTokenCache: %v", err)
+	}
+	appCtx.Config.TokensCacheTTL = ttl
+	initEmptyIDFStore()
+	appCtx.Config.StorageBackend = storageInMemory
+	appCtx.memStore = newMemStore()
+	appCtx.memStore.collection = appCtx.Config.QdrantCollection
+	appCtx.memStore.size = uint64(appCtx.Config.QdrantVectorSize)
+}
+
+// storedPoints returns the points of role held by the in-memory store, with payload and vectors
+func storedPoints(t *testing.T, role string) []*qdrant.RetrievedPoint {
+	t.Helper()
+	points, err := appCtx.memStore.Scroll(context.Background(), &qdrant.ScrollPoints{
+		CollectionName: appCtx.Config.QdrantCollection,
+		Filter:         &qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewMatch("role", role)}},
+		Limit:          qdrant.PtrOf(uint32(1000)),
+		WithPayload:    qdrant.NewWithPayload(true),
+		WithVectors:    qdrant.NewWithVectors(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+// countingUpstream answers every request with an empty JSON object, counts the calls and keeps
+// the last request body
+type countingUpstream struct {
+	calls atomic.Int32
+	mu    sync.Mutex
+	body  []byte
+}
+
+func (u *countingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.calls.Add(1)
+	body, _ := io.ReadAll(r.Body)
+	u.mu.Lock()
+	u.body = body
+	u.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}")
+}
+
+func TestOversizedRequestRejectedBeforeUpstream(t *testing.T) {
+	newTestApp(t)
+	config := appCtx.Config
+	config.MaxRequestBytes = 0
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("MaxRequestBytes 0 (unset) rejected: %v", err)
+	}
+
+	appCtx.Config.MaxRequestBytes = 64
+	upstream := &countingUpstream{}
+	handler := proxyHandler(upstream)
+	body := []byte(`{"model":"m","messages":[{"role":"user","content":"` + strings.Repeat("x", 100) + `"}]}`)
+
+	for _, gzipped := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", bytes.NewReader(body))
+		if gzipped {
+			req = httptest.NewRequest(http.MethodPost, "/api/chat", bytes.NewReader(gzipBytes(t, body)))
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("gzip %v: status %d, want 413", gzipped, rec.Code)
+		}
+	}
+	if n := upstream.calls.Load(); n != 0 {
+		t.Errorf("upstream called %d times for oversized requests", n)
+	}
+}
+
+func TestInitAppSkipsUserCheckWhenDisabled(t *testing.T) {
+	t.Cleanup(func() { newTestApp(t) }) // initApp replaces appCtx
+	// The step after the user check fails on purpose: a log path under a regular file
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	logPath := `AccessLogPath = "` + filepath.Join(notDir, "access.log") + `"`
+
+	required := writeTestConfig(t, `RagproxyUser = ""`, `RagproxyUser = "no-such-ragproxy-user"`, `AccessLogPath = ""`, logPath)
+	if err := initApp(required); err == nil || !strings.Contains(err.Error(), "no-such-ragproxy-user") {
+		t.Fatalf("initApp with a missing required user: %v, want the user check error", err)
+	}
+
+	skipped := writeTestConfig(t, `RequireRagproxyUser = true`, `RequireRagproxyUser = false`,
+		`RagproxyUser = ""`, `RagproxyUser = "no-such-ragproxy-user"`, `AccessLogPath = ""`, logPath)
+	err := initApp(skipped)
+	if err == nil || strings.Contains(err.Error(), "no-such-ragproxy-user") || !strings.Contains(err.Error(), "access log") {
+		t.Errorf("initApp with the user check disabled: %v, want it to fail later at logging setup", err)
+	}
+}
+
+func (u *countingUpstream) lastBody() []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.body
+}
+
+func TestAugmentationDeadlinePassesRequestThrough(t *testing.T) {
+	newTestApp(t)
+	// The embedding stage hangs until the test ends
+	release := make(chan struct{})
+	useFakeOllama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.Error(w, "too slow", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(func() {
+		// before the server is closed; the augmentation left behind must end before the next test
+		close(release)
+		appCtx.inboundWG.Wait()
+	})
+	appCtx.Config.RequestMaxDuration.Duration = 50 * time.Millisecond
+	appCtx.Config.EmbeddingSingleFlight = false // a shared call would outlive the augmentation
+	appCtx.Config.RAGStatusHeader = true
+	upstream := &countingUpstream{}
+	body := `{"model":"m","messages":[{"role":"user","content":"<userRequest>what changed in the parser?</userRequest>"}]}`
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	proxyHandler(upstream)(rec, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body)))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %s with a 50ms deadline", elapsed)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("X-Ragproxy-Degraded"); got != "deadline" {
+		t.Errorf("X-Ragproxy-Degraded = %q, want deadline", got)
+	}
+	if got := rec.Header().Get(ragStatusHeader); got != ragStatusError {
+		t.Errorf("%s = %q, want %q", ragStatusHeader, got, ragStatusError)
+	}
+	if got := string(upstream.lastBody()); got != body {
+		t.Errorf("upstream got %s, want the request unchanged", got)
+	}
+}
+
+func TestAugmentationErrorExposedInHeader(t *testing.T) {
+	newTestApp(t)
+	useFakeOllama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not found", http.StatusInternalServerError)
+	}))
+	appCtx.Config.RAGStatusHeader = false
+	body := `{"model":"m","messages":[{"role":"user","content":"<userRequest>what changed in the parser?</userRequest>"}]}`
+
+	for _, expose := range []bool{false, true} {
+		appCtx.Config.ExposeAugmentationErrors = expose
+		upstream := &countingUpstream{}
+		rec := httptest.NewRecorder()
+		proxyHandler(upstream)(rec, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body)))
+		if rec.Code != http.StatusOK || upstream.calls.Load() != 1 {
+			t.Fatalf("expose %v: status %d after %d upstream calls, want the answer", expose, rec.Code, upstream.calls.Load())
+		}
+		if got := string(upstream.lastBody()); got != body {
+			t.Errorf("expose %v: upstream got %s, want the request unaugmented", expose, got)
+		}
+		got := rec.Header().Get(augmentationErrorHeader)
+		if expose && got == "" {
+			t.Errorf("no %s header on a failed embedding", augmentationErrorHeader)
+		}
+		if !expose && got != "" {
+			t.Errorf("%s = %q with ExposeAugmentationErrors off", augmentationErrorHeader, got)
+		}
+	}
+}
@@ -0,0 +1,719 @@
+// memstore.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/qdrant/go-client/qdrant"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// storageInMemory is the StorageBackend value selecting memStore instead of Qdrant
+const storageInMemory = "in-memory"
+
+// memPoint is one point held by memStore. Payload maps are never modified in place.
+type memPoint struct {
+	id      *qdrant.PointId
+	vector  []float32
+	payload map[string]*qdrant.Value
+}
+
+// memStore is a VectorStore keeping a single collection in process memory.
+// Search is a brute-force scan over all points, fine for modest corpora.
+type memStore struct {
+	mu         sync.RWMutex
+	collection string // "" until the collection is created
+	size       uint64
+	distance   qdrant.Distance
+	indexes    map[string]*qdrant.PayloadSchemaInfo
+	metadata   map[string]*qdrant.Value
+	points     map[string]*memPoint // by pointIDString
+}
+
+// newMemStore returns an empty in-memory store
+func newMemStore() *memStore {
+	return &memStore{
+		indexes:  make(map[string]*qdrant.PayloadSchemaInfo),
+		metadata: make(map[string]*qdrant.Value),
+		points:   make(map[string]*memPoint),
+	}
+}
+
+// checkCollection returns an error when name is not the collection of the store
+func (s *memStore) checkCollection(name string) error {
+	if s.collection == "" || s.collection != name {
+		return fmt.Errorf("collection '%s' not found", name)
+	}
+	return nil
+}
+
+func (s *memStore) CollectionExists(ctx context.Context, collectionName string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.collection != "" && s.collection == collectionName, nil
+}
+
+func (s *memStore) GetCollectionInfo(ctx context.Context, collectionName string) (*qdrant.CollectionInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.checkCollection(collectionName); err != nil {
+		return nil, err
+	}
+	count := uint64(len(s.points))
+	schema := make(map[string]*qdrant.PayloadSchemaInfo, len(s.indexes))
+	for field, info := range s.indexes {
+		schema[field] = info
+	}
+	return &qdrant.CollectionInfo{
+		Status: qdrant.CollectionStatus_Green,
+		Config: &qdrant.CollectionConfig{
+			Params: &qdrant.CollectionParams{
+				VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{Size: s.size, Distance: s.distance}),
+			},
+			Metadata: maps.Clone(s.metadata),
+		},
+		PayloadSchema: schema,
+		PointsCount:   &count,
+	}, nil
+}
+
+func (s *memStore) CreateCollection(ctx context.Context, request *qdrant.CreateCollection) error {
+	params := request.GetVectorsConfig().GetParams()
+	if params == nil {
+		return fmt.Errorf("collection '%s': only a single unnamed vector is supported", request.GetCollectionName())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.collection != "" {
+		return fmt.Errorf("collection '%s' already exists", s.collection)
+	}
+	s.collection = request.GetCollectionName()
+	s.size = params.GetSize()
+	s.distance = params.GetDistance()
+	maps.Copy(s.metadata, request.GetMetadata())
+	return nil
+}
+
+// UpdateCollection merges the metadata of request into the collection's; other settings are ignored
+func (s *memStore) UpdateCollection(ctx context.Context, request *qdrant.UpdateCollection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return err
+	}
+	maps.Copy(s.metadata, request.GetMetadata())
+	return nil
+}
+
+func (s *memStore) CreateFieldIndex(ctx context.Context, request *qdrant.CreateFieldIndexCollection) (*qdrant.UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return nil, err
+	}
+	// Filters scan all points anyway; the index is only recorded for the collection schema
+	s.indexes[request.GetFieldName()] = &qdrant.PayloadSchemaInfo{}
+	return &qdrant.UpdateResult{Status: qdrant.UpdateStatus_Completed}, nil
+}
+
+func (s *memStore) Upsert(ctx context.Context, request *qdrant.UpsertPoints) (*qdrant.UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return nil, err
+	}
+
+	// Validate all points first so a bad point leaves the store untouched
+	points := make([]*memPoint, 0, len(request.GetPoints()))
+	for _, p := range request.GetPoints() {
+		key := pointIDString(p.GetId())
+		if key == "" {
+			return nil, errors.New("upsert: point without id")
+		}
+		vector := p.GetVectors().GetVector().GetDense().GetData()
+		if vector == nil {
+			vector = p.GetVectors().GetVector().GetData()
+		}
+		if uint64(len(vector)) != s.size {
+			return nil, fmt.Errorf("upsert point %s: vector size %d, collection expects %d", key, len(vector), s.size)
+		}
+		payload := make(map[string]*qdrant.Value, len(p.GetPayload()))
+		for k, v := range p.GetPayload() {
+			payload[k] = v
+		}
+		points = append(points, &memPoint{id: p.GetId(), vector: slices.Clone(vector), payload: payload})
+	}
+	for _, p := range points {
+		s.points[pointIDString(p.id)] = p
+	}
+	return &qdrant.UpdateResult{Status: qdrant.UpdateStatus_Completed}, nil
+}
+
+func (s *memStore) Get(ctx context.Context, request *qdrant.GetPoints) ([]*qdrant.RetrievedPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return nil, err
+	}
+	resp := make([]*qdrant.RetrievedPoint, 0, len(request.GetIds()))
+	for _, id := range request.GetIds() {
+		if p, ok := s.points[pointIDString(id)]; ok {
+			resp = append(resp, p.retrieved(request.GetWithPayload(), request.GetWithVectors()))
+		}
+	}
+	return resp, nil
+}
+
+func (s *memStore) Scroll(ctx context.Context, request *qdrant.ScrollPoints) ([]*qdrant.RetrievedPoint, error) {
+	resp, _, err := s.ScrollAndOffset(ctx, request)
+	return resp, err
+}
+
+// ScrollAndOffset returns the matching points in id order starting at request.Offset, and the id
+// to pass as Offset for the next page (nil on the last page)
+func (s *memStore) ScrollAndOffset(ctx context.Context, request *qdrant.ScrollPoints) ([]*qdrant.RetrievedPoint, *qdrant.PointId, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return nil, nil, err
+	}
+
+	limit := 10
+	if request.Limit != nil {
+		limit = int(request.GetLimit())
+	}
+	start := ""
+	if request.GetOffset() != nil {
+		start = pointIDString(request.GetOffset())
+	}
+
+	var resp []*qdrant.RetrievedPoint
+	for _, key := range s.sortedKeys() {
+		if key < start {
+			continue
+		}
+		p := s.points[key]
+		ok, err := matchFilter(request.GetFilter(), p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		if len(resp) == limit {
+			return resp, p.id, nil
+		}
+		resp = append(resp, p.retrieved(request.GetWithPayload(), request.GetWithVectors()))
+	}
+	return resp, nil, nil
+}
+
+// Query scores every point matching the filter against the dense query vector
+func (s *memStore) Query(ctx context.Context, request *qdrant.QueryPoints) ([]*qdrant.ScoredPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return nil, err
+	}
+	query := request.GetQuery().GetNearest().GetDense().GetData()
+	if query == nil {
+		return nil, errors.New("query: only nearest search by a dense vector is supported")
+	}
+	if uint64(len(query)) != s.size {
+		return nil, fmt.Errorf("query: vector size %d, collection expects %d", len(query), s.size)
+	}
+
+	type scored struct {
+		point *memPoint
+		score float32
+	}
+	var hits []scored
+	for _, p := range s.points {
+		ok, err := matchFilter(request.GetFilter(), p)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		score := vectorScore(s.distance, query, p.vector)
+		if t := request.ScoreThreshold; t != nil {
+			if (s.distance == qdrant.Distance_Euclid && score > *t) || (s.distance != qdrant.Distance_Euclid && score < *t) {
+				continue
+			}
+		}
+		hits = append(hits, scored{point: p, score: score})
+	}
+
+	// Best first: smallest distance for Euclid, highest similarity otherwise; ties by id
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			if s.distance == qdrant.Distance_Euclid {
+				return hits[i].score < hits[j].score
+			}
+			return hits[i].score > hits[j].score
+		}
+		return pointIDString(hits[i].point.id) < pointIDString(hits[j].point.id)
+	})
+
+	offset := int(request.GetOffset())
+	if offset > len(hits) {
+		offset = len(hits)
+	}
+	hits = hits[offset:]
+	limit := 10
+	if request.Limit != nil {
+		limit = int(request.GetLimit())
+	}
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	resp := make([]*qdrant.ScoredPoint, 0, len(hits))
+	for _, h := range hits {
+		rp := h.point.retrieved(request.GetWithPayload(), request.GetWithVectors())
+		resp = append(resp, &qdrant.ScoredPoint{
+			Id:      rp.Id,
+			Payload: rp.Payload,
+			Score:   h.score,
+			Vectors: rp.Vectors,
+		})
+	}
+	return resp, nil
+}
+
+func (s *memStore) SetPayload(ctx context.Context, request *qdrant.SetPayloadPoints) (*qdrant.UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return nil, err
+	}
+	if request.Key != nil {
+		return nil, errors.New("set payload: nested key is not supported")
+	}
+
+	targets, err := s.selectPoints(request.GetPointsSelector())
+	if err != nil {
+		return nil, fmt.Errorf("set payload: %w", err)
+	}
+	for _, p := range targets {
+		// Copy on write: payload maps already handed out stay unchanged
+		payload := make(map[string]*qdrant.Value, len(p.payload)+len(request.GetPayload()))
+		for k, v := range p.payload {
+			payload[k] = v
+		}
+		for k, v := range request.GetPayload() {
+			payload[k] = v
+		}
+		p.payload = payload
+	}
+	return &qdrant.UpdateResult{Status: qdrant.UpdateStatus_Completed}, nil
+}
+
+func (s *memStore) Delete(ctx context.Context, request *qdrant.DeletePoints) (*qdrant.UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkCollection(request.GetCollectionName()); err != nil {
+		return nil, err
+	}
+	targets, err := s.selectPoints(request.GetPoints())
+	if err != nil {
+		return nil, fmt.Errorf("delete: %w", err)
+	}
+	for _, p := range targets {
+		delete(s.points, pointIDString(p.id))
+	}
+	return &qdrant.UpdateResult{Status: qdrant.UpdateStatus_Completed}, nil
+}
+
+// selectPoints returns the existing points chosen by ids or by filter. Caller holds s.mu.
+func (s *memStore) selectPoints(selector *qdrant.PointsSelector) ([]*memPoint, error) {
+	var targets []*memPoint
+	switch {
+	case selector.GetPoints() != nil:
+		for _, id := range selector.GetPoints().GetIds() {
+			if p, ok := s.points[pointIDString(id)]; ok {
+				targets = append(targets, p)
+			}
+		}
+	case selector.GetFilter() != nil:
+		for _, p := range s.points {
+			ok, err := matchFilter(selector.GetFilter(), p)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				targets = append(targets, p)
+			}
+		}
+	default:
+		return nil, errors.New("no points selector")
+	}
+	return targets, nil
+}
+
+// Close does nothing: the store lives as long as the process
+func (s *memStore) Close() error {
+	return nil
+}
+
+// sortedKeys returns the point keys in scroll order. Caller holds s.mu.
+func (s *memStore) sortedKeys() []string {
+	keys := make([]string, 0, len(s.points))
+	for key := range s.points {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// retrieved converts the point to the client representation, applying the payload and vector selectors
+func (p *memPoint) retrieved(withPayload *qdrant.WithPayloadSelector, withVectors *qdrant.WithVectorsSelector) *qdrant.RetrievedPoint {
+	rp := &qdrant.RetrievedPoint{Id: p.id, Payload: map[string]*qdrant.Value{}}
+
+	switch {
+	case withPayload.GetEnable():
+		for k, v := range p.payload {
+			rp.Payload[k] = v
+		}
+	case withPayload.GetInclude() != nil:
+		for _, field := range withPayload.GetInclude().GetFields() {
+			// Nested paths return the whole top-level field
+			top, _, _ := strings.Cut(field, ".")
+			if v, ok := p.payload[top]; ok {
+				rp.Payload[top] = v
+			}
+		}
+	case withPayload.GetExclude() != nil:
+		for k, v := range p.payload {
+			if !slices.Contains(withPayload.GetExclude().GetFields(), k) {
+				rp.Payload[k] = v
+			}
+		}
+	}
+
+	if withVectors.GetEnable() {
+		data := slices.Clone(p.vector)
+		rp.Vectors = &qdrant.VectorsOutput{
+			VectorsOptions: &qdrant.VectorsOutput_Vector{
+				Vector: &qdrant.VectorOutput{
+					Data:   data,
+					Vector: &qdrant.VectorOutput_Dense{Dense: &qdrant.DenseVector{Data: data}},
+				},
+			},
+		}
+	}
+	return rp
+}
+
+// vectorScore is the Qdrant score of v for query q: similarity for Cosine and Dot, distance for Euclid
+func vectorScore(distance qdrant.Distance, q, v []float32) float32 {
+	var dot, qq, vv, sq float64
+	for i := range q {
+		a, b := float64(q[i]), float64(v[i])
+		dot += a * b
+		qq += a * a
+		vv += b * b
+		sq += (a - b) * (a - b)
+	}
+	switch distance {
+	case qdrant.Distance_Euclid:
+		return float32(math.Sqrt(sq))
+	case qdrant.Distance_Dot:
+		return float32(dot)
+	default:
+		if qq == 0 || vv == 0 {
+			return 0
+		}
+		return float32(dot / math.Sqrt(qq*vv))
+	}
+}
+
+// matchFilter reports whether point p satisfies filter. A nil filter matches every point.
+func matchFilter(filter *qdrant.Filter, p *memPoint) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	if filter.MinShould != nil {
+		return false, errors.New("filter: min_should is not supported")
+	}
+	for _, c := range filter.GetMust() {
+		ok, err := matchCondition(c, p)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	for _, c := range filter.GetMustNot() {
+		ok, err := matchCondition(c, p)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	if len(filter.GetShould()) == 0 {
+		return true, nil
+	}
+	for _, c := range filter.GetShould() {
+		ok, err := matchCondition(c, p)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// matchCondition evaluates one filter condition against point p
+func matchCondition(c *qdrant.Condition, p *memPoint) (bool, error) {
+	switch cond := c.GetConditionOneOf().(type) {
+	case *qdrant.Condition_Field:
+		return matchField(cond.Field, p)
+	case *qdrant.Condition_IsEmpty:
+		return len(payloadValues(p.payload, cond.IsEmpty.GetKey())) == 0, nil
+	case *qdrant.Condition_IsNull:
+		values, present := payloadLookup(p.payload, cond.IsNull.GetKey())
+		return present && isNullValue(values), nil
+	case *qdrant.Condition_HasId:
+		key := pointIDString(p.id)
+		for _, id := range cond.HasId.GetHasId() {
+			if pointIDString(id) == key {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *qdrant.Condition_Filter:
+		return matchFilter(cond.Filter, p)
+	default:
+		return false, fmt.Errorf("filter: unsupported condition %T", cond)
+	}
+}
+
+// matchField evaluates a match or range condition. Array fields match when any element does.
+func matchField(fc *qdrant.FieldCondition, p *memPoint) (bool, error) {
+	values := payloadValues(p.payload, fc.GetKey())
+	switch {
+	case fc.GetMatch() != nil:
+		m := fc.GetMatch()
+		switch mv := m.GetMatchValue().(type) {
+		case *qdrant.Match_Keyword:
+			return anyValue(values, func(v *qdrant.Value) bool { return isString(v) && v.GetStringValue() == mv.Keyword }), nil
+		case *qdrant.Match_Keywords:
+			return anyValue(values, func(v *qdrant.Value) bool {
+				return isString(v) && slices.Contains(mv.Keywords.GetStrings(), v.GetStringValue())
+			}), nil
+		case *qdrant.Match_ExceptKeywords:
+			return anyValue(values, func(v *qdrant.Value) bool {
+				return isString(v) && !slices.Contains(mv.ExceptKeywords.GetStrings(), v.GetStringValue())
+			}), nil
+		case *qdrant.Match_Integer:
+			return anyValue(values, func(v *qdrant.Value) bool { return isInteger(v) && v.GetIntegerValue() == mv.Integer }), nil
+		case *qdrant.Match_Integers:
+			return anyValue(values, func(v *qdrant.Value) bool {
+				return isInteger(v) && slices.Contains(mv.Integers.GetIntegers(), v.GetIntegerValue())
+			}), nil
+		case *qdrant.Match_ExceptIntegers:
+			return anyValue(values, func(v *qdrant.Value) bool {
+				return isInteger(v) && !slices.Contains(mv.ExceptIntegers.GetIntegers(), v.GetIntegerValue())
+			}), nil
+		case *qdrant.Match_Boolean:
+			return anyValue(values, func(v *qdrant.Value) bool {
+				_, ok := v.GetKind().(*qdrant.Value_BoolValue)
+				return ok && v.GetBoolValue() == mv.Boolean
+			}), nil
+		case *qdrant.Match_Text:
+			// Without a full-text index Qdrant matches text as a substring
+			return anyValue(values, func(v *qdrant.Value) bool { return isString(v) && strings.Contains(v.GetStringValue(), mv.Text) }), nil
+		default:
+			return false, fmt.Errorf("filter: unsupported match %T on '%s'", mv, fc.GetKey())
+		}
+	case fc.GetRange() != nil:
+		r := fc.GetRange()
+		return anyValue(values, func(v *qdrant.Value) bool {
+			var x float64
+			switch kind := v.GetKind().(type) {
+			case *qdrant.Value_IntegerValue:
+				x = float64(kind.IntegerValue)
+			case *qdrant.Value_DoubleValue:
+				x = kind.DoubleValue
+			default:
+				return false
+			}
+			return (r.Lt == nil || x < r.GetLt()) && (r.Gt == nil || x > r.GetGt()) &&
+				(r.Lte == nil || x <= r.GetLte()) && (r.Gte == nil || x >= r.GetGte())
+		}), nil
+	default:
+		return false, fmt.Errorf("filter: unsupported field condition on '%s'", fc.GetKey())
+	}
+}
+
+// payloadLookup resolves a dotted key ("file_meta.id") in payload. Returns the values found (array
+// elements flattened) and whether the key is present at all.
+func payloadLookup(payload map[string]*qdrant.Value, key string) ([]*qdrant.Value, bool) {
+	head, rest, nested := strings.Cut(key, ".")
+	v, ok := payload[head]
+	if !ok {
+		return nil, false
+	}
+	var candidates []*qdrant.Value
+	if list := v.GetListValue(); list != nil {
+		candidates = list.GetValues()
+	} else {
+		candidates = []*qdrant.Value{v}
+	}
+	if !nested {
+		return candidates, true
+	}
+
+	var values []*qdrant.Value
+	present := false
+	for _, c := range candidates {
+		if st := c.GetStructValue(); st != nil {
+			if found, ok := payloadLookup(st.GetFields(), rest); ok {
+				values = append(values, found...)
+				present = true
+			}
+		}
+	}
+	return values, present
+}
+
+// payloadValues returns the non-null values under key
+func payloadValues(payload map[string]*qdrant.Value, key string) []*qdrant.Value {
+	found, _ := payloadLookup(payload, key)
+	var values []*qdrant.Value
+	for _, v := range found {
+		if _, null := v.GetKind().(*qdrant.Value_NullValue); !null && v.GetKind() != nil {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// isNullValue reports whether values is a single explicit null
+func isNullValue(values []*qdrant.Value) bool {
+	if len(values) != 1 {
+		return false
+	}
+	_, null := values[0].GetKind().(*qdrant.Value_NullValue)
+	return null
+}
+
+func anyValue(values []*qdrant.Value, pred func(*qdrant.Value) bool) bool {
+	return slices.ContainsFunc(values, pred)
+}
+
+func isString(v *qdrant.Value) bool {
+	_, ok := v.GetKind().(*qdrant.Value_StringValue)
+	return ok
+}
+
+func isInteger(v *qdrant.Value) bool {
+	_, ok := v.GetKind().(*qdrant.Value_IntegerValue)
+	return ok
+}
+
+// memSnapshotPoint is one line of the MemoryStoreFile snapshot. Id and payload values use the
+// protobuf JSON form so integer and double payloads keep their types across restarts.
+type memSnapshotPoint struct {
+	ID      json.RawMessage            `json:"id"`
+	Vector  []float32                  `json:"vector"`
+	Payload map[string]json.RawMessage `json:"payload"`
+}
+
+// saveMemStore writes all points of the store to path as JSON lines
+func saveMemStore(store *memStore, path string) error {
+	store.mu.RLock()
+	var buf bytes.Buffer
+	for _, key := range store.sortedKeys() {
+		p := store.points[key]
+		id, err := protojson.Marshal(p.id)
+		if err != nil {
+			store.mu.RUnlock()
+			return fmt.Errorf("encode point %s: %w", key, err)
+		}
+		line := memSnapshotPoint{ID: id, Vector: p.vector, Payload: make(map[string]json.RawMessage, len(p.payload))}
+		for k, v := range p.payload {
+			raw, err := protojson.Marshal(v)
+			if err != nil {
+				store.mu.RUnlock()
+				return fmt.Errorf("encode payload '%s' of point %s: %w", k, key, err)
+			}
+			line.Payload[k] = raw
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			store.mu.RUnlock()
+			return fmt.Errorf("encode point %s: %w", key, err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	store.mu.RUnlock()
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// loadMemStore creates the in-memory store with the configured collection and fills it from the
+// snapshot at path. A missing file (or empty path) gives an empty store.
+func loadMemStore(path string) (*memStore, error) {
+	store := newMemStore()
+	if path == "" {
+		return store, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Points of a snapshot belong to the configured collection; initDB then finds it existing
+	store.collection = appCtx.Config.QdrantCollection
+	store.size = uint64(appCtx.Config.QdrantVectorSize)
+	store.distance = qdrant.Distance(qdrant.Distance_value[appCtx.Config.QdrantMetric])
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 256*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line memSnapshotPoint
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		p := &memPoint{id: &qdrant.PointId{}, vector: line.Vector, payload: make(map[string]*qdrant.Value, len(line.Payload))}
+		if err := protojson.Unmarshal(line.ID, p.id); err != nil {
+			return nil, fmt.Errorf("%s:%d: id: %w", path, lineNo, err)
+		}
+		if uint64(len(p.vector)) != store.size {
+			return nil, fmt.Errorf("%s:%d: vector size %d, `QdrantVectorSize` is %d", path, lineNo, len(p.vector), store.size)
+		}
+		for k, raw := range line.Payload {
+			v := &qdrant.Value{}
+			if err := protojson.Unmarshal(raw, v); err != nil {
+				return nil, fmt.Errorf("%s:%d: payload '%s': %w", path, lineNo, k, err)
+			}
+			p.payload[k] = v
+		}
+		store.points[pointIDString(p.id)] = p
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return store, nil
+}
@@ -0,0 +1,207 @@
+// memstore_test.go
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// newFilledMemStore returns a store with collection "c" of 2-dim cosine vectors holding the given points
+func newFilledMemStore(t *testing.T, points ...*qdrant.PointStruct) *memStore {
+	t.Helper()
+	s := newMemStore()
+	ctx := context.Background()
+	if err := s.CreateCollection(ctx, &qdrant.CreateCollection{
+		CollectionName: "c",
+		VectorsConfig:  qdrant.NewVectorsConfig(&qdrant.VectorParams{Size: 2, Distance: qdrant.Distance_Cosine}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(points) > 0 {
+		if _, err := s.Upsert(ctx, &qdrant.UpsertPoints{CollectionName: "c", Points: points}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func memTestPoint(id uint64, x, y float32, payload map[string]any) *qdrant.PointStruct {
+	return &qdrant.PointStruct{
+		Id:      qdrant.NewIDNum(id),
+		Vectors: qdrant.NewVectors(x, y),
+		Payload: qdrant.NewValueMap(payload),
+	}
+}
+
+func memQueryIDs(t *testing.T, s *memStore, filter *qdrant.Filter) []string {
+	t.Helper()
+	hits, err := s.Query(context.Background(), &qdrant.QueryPoints{
+		CollectionName: "c",
+		Query:          qdrant.NewQuery(1, 0),
+		Filter:         filter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(hits))
+	for _, h := range hits {
+		ids = append(ids, pointIDString(h.GetId()))
+	}
+	return ids
+}
+
+func TestMemStoreQueryFilters(t *testing.T) {
+	s := newFilledMemStore(t,
+		memTestPoint(1, 1, 0, map[string]any{"role": "rag-user", "ts": 10, "tags": []any{"a", "b"}}),
+		memTestPoint(2, 1, 0.5, map[string]any{"role": "rag-assistant", "ts": 20}),
+		memTestPoint(3, 0, 1, map[string]any{"role": "rag-file", "ts": 30, "tags": []any{}}),
+	)
+
+	cases := []struct {
+		name   string
+		filter *qdrant.Filter
+		want   []string
+	}{
+		{"nil", nil, []string{"1", "2", "3"}},
+		{"must", &qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewMatch("role", "rag-user")}}, []string{"1"}},
+		{"must all", &qdrant.Filter{Must: []*qdrant.Condition{
+			qdrant.NewMatchKeywords("role", "rag-user", "rag-assistant"),
+			qdrant.NewRange("ts", &qdrant.Range{Gt: qdrant.PtrOf(15.0)}),
+		}}, []string{"2"}},
+		{"must not", &qdrant.Filter{MustNot: []*qdrant.Condition{qdrant.NewMatch("role", "rag-file")}}, []string{"1", "2"}},
+		{"should", &qdrant.Filter{Should: []*qdrant.Condition{
+			qdrant.NewMatch("role", "rag-user"),
+			qdrant.NewMatch("role", "rag-file"),
+		}}, []string{"1", "3"}},
+		{"should none", &qdrant.Filter{Should: []*qdrant.Condition{qdrant.NewMatch("role", "other")}}, []string{}},
+		{"range", &qdrant.Filter{Must: []*qdrant.Condition{
+			qdrant.NewRange("ts", &qdrant.Range{Gte: qdrant.PtrOf(10.0), Lt: qdrant.PtrOf(30.0)}),
+		}}, []string{"1", "2"}},
+		{"is empty", &qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewIsEmpty("tags")}}, []string{"2", "3"}},
+		{"array element", &qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewMatch("tags", "b")}}, []string{"1"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := memQueryIDs(t, s, tc.filter)
+			if len(got) != len(tc.want) {
+				t.Fatalf("ids = %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("ids = %v, want %v (best first)", got, tc.want)
+				}
+			}
+		})
+	}
+
+	if _, err := s.Query(context.Background(), &qdrant.QueryPoints{
+		CollectionName: "c",
+		Query:          qdrant.NewQuery(1, 0),
+		Filter:         &qdrant.Filter{MinShould: &qdrant.MinShould{MinCount: 1}},
+	}); err == nil {
+		t.Error("min_should filter accepted")
+	}
+}
+
+func TestMemStoreUpsertOverwrites(t *testing.T) {
+	s := newFilledMemStore(t, memTestPoint(1, 1, 0, map[string]any{"role": "rag-user", "old": true}))
+	ctx := context.Background()
+	if _, err := s.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: "c",
+		Points:         []*qdrant.PointStruct{memTestPoint(1, 0, 1, map[string]any{"role": "rag-file"})},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get(ctx, &qdrant.GetPoints{
+		CollectionName: "c",
+		Ids:            []*qdrant.PointId{qdrant.NewIDNum(1)},
+		WithPayload:    qdrant.NewWithPayload(true),
+		WithVectors:    qdrant.NewWithVectors(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(s.points) != 1 {
+		t.Fatalf("got %d points, store holds %d; want one", len(got), len(s.points))
+	}
+	payload := got[0].GetPayload()
+	if payload["role"].GetStringValue() != "rag-file" {
+		t.Errorf("role = %q, want the new one", payload["role"].GetStringValue())
+	}
+	if _, ok := payload["old"]; ok {
+		t.Error("payload of the replaced point kept a stale field")
+	}
+	if v := got[0].GetVectors().GetVector().GetData(); len(v) != 2 || v[0] != 0 || v[1] != 1 {
+		t.Errorf("vector = %v, want [0 1]", v)
+	}
+
+	// A bad point in the batch leaves the store untouched
+	if _, err := s.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: "c",
+		Points: []*qdrant.PointStruct{
+			memTestPoint(1, 1, 1, nil),
+			{Id: qdrant.NewIDNum(2), Vectors: qdrant.NewVectors(1, 2, 3)},
+		},
+	}); err == nil {
+		t.Fatal("upsert with a wrong vector size accepted")
+	}
+	if v := s.points["1"].vector; v[0] != 0 {
+		t.Errorf("failed upsert modified point 1: %v", v)
+	}
+}
+
+func TestMemStoreScrollLimitOffset(t *testing.T) {
+	var points []*qdrant.PointStruct
+	for id := uint64(1); id <= 5; id++ {
+		points = append(points, memTestPoint(id, 1, 0, map[string]any{"even": id%2 == 0}))
+	}
+	s := newFilledMemStore(t, points...)
+	ctx := context.Background()
+
+	var seen []string
+	var offset *qdrant.PointId
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("scroll did not terminate")
+		}
+		page, next, err := s.ScrollAndOffset(ctx, &qdrant.ScrollPoints{
+			CollectionName: "c",
+			Limit:          qdrant.PtrOf(uint32(2)),
+			Offset:         offset,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 2 {
+			t.Fatalf("page of %d points, limit 2", len(page))
+		}
+		for _, p := range page {
+			seen = append(seen, pointIDString(p.GetId()))
+		}
+		if next == nil {
+			break
+		}
+		offset = next
+	}
+	if want := "1 2 3 4 5"; strings.Join(seen, " ") != want {
+		t.Errorf("scrolled %q, want %q", strings.Join(seen, " "), want)
+	}
+
+	// The offset is inclusive and the filter applies before the limit
+	page, next, err := s.ScrollAndOffset(ctx, &qdrant.ScrollPoints{
+		CollectionName: "c",
+		Limit:          qdrant.PtrOf(uint32(1)),
+		Offset:         qdrant.NewIDNum(3),
+		Filter:         &qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewMatchBool("even", true)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || pointIDString(page[0].GetId()) != "4" || next != nil {
+		t.Errorf("filtered page = %v next %v, want [4] and no next page", page, next)
+	}
+}
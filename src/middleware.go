@@ -0,0 +1,80 @@
+// middleware.go
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// withRecover keeps the server alive when a handler panics: the panic is logged with its stack
+// and a request id, and the client gets a 500 instead of a dropped connection.
+func withRecover(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p) // deliberate abort (e.g. from the reverse proxy), let net/http handle it
+			}
+			requestID := uuid.NewString()
+			appCtx.ErrorLogger.Printf("Panic in handler, request id %s, %s %s: %v\n%s", requestID, r.Method, r.URL, p, debug.Stack())
+			appCtx.JournaldLogger.Printf("Panic in handler, request id %s: %v", requestID, p)
+			w.Header().Set("X-Ragproxy-Request-Id", requestID)
+			http.Error(w, "internal proxy error, request id "+requestID, http.StatusInternalServerError)
+			flushLogs()
+		}()
+		next(w, r)
+	}
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight requests before any
+// body processing or admin auth. Disabled unless CORSEnabled is set. Origin is removed before next
+// runs: ragproxy answers CORS itself, so upstream must not apply its own origin checks too.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if !appCtx.Config.CORSEnabled || origin == "" {
+			next(w, r)
+			return
+		}
+
+		allowed := slices.Contains(appCtx.Config.CORSAllowedOrigins, "*") || slices.Contains(appCtx.Config.CORSAllowedOrigins, origin)
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if allowed {
+			if slices.Contains(appCtx.Config.CORSAllowedOrigins, "*") && !appCtx.Config.CORSAllowCredentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if appCtx.Config.CORSAllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		// Preflight
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				appCtx.AccessLogger.Printf("CORS preflight rejected for origin %s", origin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			if len(appCtx.Config.CORSAllowedHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(appCtx.Config.CORSAllowedHeaders, ", "))
+			}
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		r.Header.Del("Origin")
+		next(w, r)
+	}
+}
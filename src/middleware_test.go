@@ -0,0 +1,82 @@
+// middleware_test.go
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflightBeforeAdminAuth(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.CORSEnabled = true
+	appCtx.Config.CORSAllowedOrigins = []string{"http://app.example"}
+	appCtx.Config.AdminAPIKey = "secret"
+	reached := false
+	handler := withCORS(withAdminAuth(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+
+	req := httptest.NewRequest(http.MethodOptions, "/admin/weights", nil)
+	req.Header.Set("Origin", "http://app.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "http://app.example" {
+		t.Errorf("preflight: status %d, allow origin %q", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if reached {
+		t.Error("preflight reached the admin handler")
+	}
+}
+
+func TestCORSStripsOriginBeforeNext(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.CORSEnabled = true
+	appCtx.Config.CORSAllowedOrigins = []string{"*"}
+	var forwarded string
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) { forwarded = r.Header.Get("Origin") })
+
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+	req.Header.Set("Origin", "http://app.example")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if forwarded != "" {
+		t.Errorf("Origin %q reached the proxied handler", forwarded)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("allow origin %q, want *", rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestRecoverTurnsPanicInto500AndKeepsServing(t *testing.T) {
+	newTestApp(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", withRecover(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]any
+		m["boom"] = 1 // nil map write
+	}))
+	mux.HandleFunc("/ok", withRecover(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/panic")
+	if err != nil {
+		t.Fatalf("panicking handler dropped the connection: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("X-Ragproxy-Request-Id") == "" {
+		t.Errorf("status %d, request id %q; want 500 with a request id", resp.StatusCode, resp.Header.Get("X-Ragproxy-Request-Id"))
+	}
+
+	resp, err = http.Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatalf("server stopped serving after a panic: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("after a panic: status %d, body %q", resp.StatusCode, body)
+	}
+}
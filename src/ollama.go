@@ -3,27 +3,44 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sync/singleflight"
 )
 
-// ollamaRequest makes a POST request to Ollama API endpoint with payload, logs if verbose
-func ollamaRequest(endpoint string, payload map[string]any) (map[string]any, error) {
-	// Add keep alive to payload
-	payload["keep_alive"] = appCtx.Config.OllamaKeepAlive
+// crossEncoderScoreReg extracts the first number from a cross-encoder answer
+var crossEncoderScoreReg = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// crossEncoderScale is the top of the rating scale the cross-encoder is prompted for
+const crossEncoderScale = 10
+
+// ollamaRequest makes a POST request to Ollama API endpoint with payload, logs if verbose.
+// The request is aborted when ctx is done.
+func ollamaRequest(ctx context.Context, endpoint string, payload map[string]any) (map[string]any, error) {
+	// Add keep alive to payload unless the caller set its own
+	if _, ok := payload["keep_alive"]; !ok {
+		payload["keep_alive"] = appCtx.Config.OllamaKeepAlive
+	}
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		appCtx.ErrorLogger.Printf("error marshaling payload for Ollama %s: %v", endpoint, err)
 		return nil, fmt.Errorf("error marshaling payload: %w", err)
 	}
 
-	url := appCtx.Config.OllamaBase + endpoint
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	// ollamaClient sends it to the picked backend
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		appCtx.ErrorLogger.Printf("error creating request for Ollama %s: %v", endpoint, err)
 		return nil, fmt.Errorf("error creating request: %w", err)
@@ -31,11 +48,11 @@ func ollamaRequest(endpoint string, payload map[string]any) (map[string]any, err
 	req.Header.Set("Content-Type", "application/json")
 
 	if appCtx.Config.VerboseDiskLogs {
-		dump, _ := httputil.DumpRequestOut(req, true)
+		dump, _ := httputil.DumpRequest(req, true)
 		appCtx.AccessLogger.Printf("Ollama HTTP request:\n%s", string(dump))
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := ollamaClient.Do(req)
 	if err != nil {
 		appCtx.ErrorLogger.Printf("Ollama request to %s failed: %v", endpoint, err)
 		return nil, fmt.Errorf("error calling Ollama %s: %w", endpoint, err)
@@ -74,20 +91,155 @@ func ollamaRequest(endpoint string, payload map[string]any) (map[string]any, err
 	return result, nil
 }
 
-// embedText generates a 4096-dimensional vector for the given text using Ollama embeddings API
-func embedText(text string) (vector []float32, err error) {
+// embedGroup collapses concurrent embeddings of identical text into one Ollama call
+var embedGroup singleflight.Group
+
+// embedText generates a 4096-dimensional vector for the given text using Ollama embeddings API.
+// With EmbeddingSingleFlight enabled, concurrent calls for the same content share one in-flight request;
+// that request is not cancelled with ctx (other callers may wait on it), only this caller stops waiting.
+func embedText(ctx context.Context, text string) (vector []float32, err error) {
+	text = capEmbeddingInput(text)
+	if !appCtx.Config.EmbeddingSingleFlight {
+		return embedTextNormalized(ctx, text)
+	}
+
+	detached := context.WithoutCancel(ctx)
+	ch := embedGroup.DoChan(hashContent(text), func() (any, error) {
+		return embedTextNormalized(detached, text)
+	})
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	vector = res.Val.([]float32)
+	if res.Shared {
+		if appCtx.Config.VerboseDiskLogs {
+			appCtx.AccessLogger.Printf("Embedding shared with a concurrent identical request")
+		}
+		// callers own their vector
+		vector = append([]float32(nil), vector...)
+	}
+	return vector, nil
+}
+
+// embedTextNormalized embeds text and L2-normalizes the vector when NormalizeEmbeddings is set
+func embedTextNormalized(ctx context.Context, text string) ([]float32, error) {
+	vector, err := embedTextOnce(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	if appCtx.Config.NormalizeEmbeddings {
+		normalizeL2(vector)
+	}
+	return vector, nil
+}
+
+// normalizeL2 scales v in place to unit L2 norm (a zero vector is left as is)
+func normalizeL2(v []float32) {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := math.Sqrt(sum)
+	for i := range v {
+		v[i] = float32(float64(v[i]) / norm)
+	}
+}
+
+// capEmbeddingInput cuts text to its first EmbeddingMaxTokens tokens, so the embedding model never
+// truncates silently. The cut is decoded back from whole tokens; a partial rune left by byte-level
+// tokens is dropped.
+func capEmbeddingInput(text string) string {
+	maxTokens := appCtx.Config.EmbeddingMaxTokens
+	if maxTokens <= 0 || appCtx.Tokenizer == nil {
+		return text
+	}
+	ids, _ := appCtx.Tokenizer.Encode(text, false)
+	if len(ids) <= maxTokens {
+		return text
+	}
+	capped := appCtx.Tokenizer.Decode(ids[:maxTokens], true)
+	for len(capped) > 0 {
+		r, size := utf8.DecodeLastRuneInString(capped)
+		if r != utf8.RuneError || size > 1 {
+			break
+		}
+		capped = capped[:len(capped)-size]
+	}
+	appCtx.AccessLogger.Printf("Embedding input truncated from %d to %d tokens (%d to %d bytes)", len(ids), maxTokens, len(text), len(capped))
+	return capped
+}
+
+// embeddingsUseNewAPI reports whether EmbeddingsEndpoint speaks the /api/embed shape
+// ({"input"} -> {"embeddings":[[...]]}) rather than the legacy /api/embeddings one ({"prompt"} -> {"embedding":[...]}).
+// In "auto" mode the endpoint path decides.
+func embeddingsUseNewAPI() bool {
+	switch appCtx.Config.EmbeddingsAPIVersion {
+	case "new":
+		return true
+	case "auto":
+		return strings.HasSuffix(strings.TrimRight(appCtx.Config.EmbeddingsEndpoint, "/"), "/embed")
+	default:
+		return false
+	}
+}
+
+// embeddingsRequestKey returns the request field carrying the text to embed
+func embeddingsRequestKey() string {
+	if embeddingsUseNewAPI() {
+		return "input"
+	}
+	return "prompt"
+}
+
+// embeddingFromResponse extracts the embedding from either response shape. Both shapes are
+// accepted in "auto" mode, the configured one otherwise.
+func embeddingFromResponse(result map[string]any) ([]any, error) {
+	auto := appCtx.Config.EmbeddingsAPIVersion == "auto"
+	if auto || embeddingsUseNewAPI() {
+		if embeddings, ok := result["embeddings"].([]any); ok {
+			if len(embeddings) == 0 {
+				return nil, fmt.Errorf("empty embeddings list in response")
+			}
+			if embedding, ok := embeddings[0].([]any); ok {
+				return embedding, nil
+			}
+		}
+	}
+	if auto || !embeddingsUseNewAPI() {
+		if embedding, ok := result["embedding"].([]any); ok {
+			return embedding, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid embedding format in response")
+}
+
+// embedTextOnce performs the actual embedding call (with the optional unload-and-retry)
+func embedTextOnce(ctx context.Context, text string) (vector []float32, err error) {
 
 	tryEmbedding := func() ([]float32, error) {
-		result, err := ollamaRequest(appCtx.Config.EmbeddingsEndpoint, map[string]any{
-			"model":  appCtx.Config.EmbeddingModel,
-			"prompt": text,
-		})
+		payload := map[string]any{
+			"model":                appCtx.Config.EmbeddingModel,
+			embeddingsRequestKey(): text,
+		}
+		if appCtx.Config.EmbeddingKeepAlive != "" {
+			payload["keep_alive"] = appCtx.Config.EmbeddingKeepAlive
+		}
+		result, err := ollamaRequest(ctx, appCtx.Config.EmbeddingsEndpoint, payload)
 		if err != nil {
 			return nil, err
 		}
-		embedding, ok := result["embedding"].([]any)
-		if !ok {
-			return nil, fmt.Errorf("invalid embedding format in response")
+		embedding, err := embeddingFromResponse(result)
+		if err != nil {
+			return nil, err
 		}
 		vector := make([]float32, len(embedding))
 		for i, v := range embedding {
@@ -111,6 +263,11 @@ func embedText(text string) (vector []float32, err error) {
 		return vector, nil
 	}
 
+	// The caller gave up: no unload and retry
+	if ctx.Err() != nil {
+		return nil, err
+	}
+
 	// If embedding failed and unload before embedding is enabled, try unloading main model and reranking model and retry
 	if appCtx.Config.OllamaUnloadOnLoVRAM {
 		appCtx.AccessLogger.Printf("Embedding failed, trying to unload main model and reranking model and retry: %v", err)
@@ -131,3 +288,46 @@ func embedText(text string) (vector []float32, err error) {
 	appCtx.ErrorLogger.Printf("Initial embedding attempt failed, OllamaUnloadOnLoVRAM is false: %v", err)
 	return nil, err
 }
+
+// crossEncoderRelevance asks CrossEncoderModel to rate query/document relevance and returns it in [0,1].
+// The model is prompted for a 0-crossEncoderScale rating.
+func crossEncoderRelevance(ctx context.Context, query string, body string) (float64, error) {
+	prompt := fmt.Sprintf("Rate how relevant the document is to the query on a scale from 0 to %d. "+
+		"Answer with a single number only.\n\nQuery:\n%s\n\nDocument:\n%s\n\nRelevance:", crossEncoderScale, query, body)
+
+	result, err := ollamaRequest(ctx, appCtx.Config.CrossEncoderEndpoint, map[string]any{
+		"model":  appCtx.Config.CrossEncoderModel,
+		"prompt": prompt,
+		"stream": false,
+		"options": map[string]any{
+			"temperature": 0,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// /api/generate answers in "response", /api/chat in "message.content"
+	answer, _ := result["response"].(string)
+	if answer == "" {
+		if msg, ok := result["message"].(map[string]any); ok {
+			answer, _ = msg["content"].(string)
+		}
+	}
+
+	return parseCrossEncoderScore(answer)
+}
+
+// parseCrossEncoderScore reads the first number of a cross-encoder answer as a rating on the
+// 0-crossEncoderScale scale and returns it in [0,1]
+func parseCrossEncoderScore(answer string) (float64, error) {
+	match := crossEncoderScoreReg.FindString(answer)
+	if match == "" {
+		return 0, fmt.Errorf("no score in cross-encoder answer: %q", answer)
+	}
+	score, err := strconv.ParseFloat(match, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cross-encoder score %q: %w", match, err)
+	}
+	return math.Min(score/crossEncoderScale, 1), nil
+}
@@ -0,0 +1,364 @@
+// ollama_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useFakeOllama points the Ollama pool at a test server running handler
+func useFakeOllama(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	appCtx.Config.OllamaBase, appCtx.Config.OllamaBackends = srv.URL, nil
+	appCtx.Config.OllamaUnloadOnLoVRAM = false
+	if err := initOllamaBackends(appCtx.Config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ollamaPool.backends = nil })
+	return srv
+}
+
+// testVector is the embedding fakeEmbeddings returns for text: a unit vector picked by the text hash
+func testVector(text string) []float32 {
+	h := fnv.New32a()
+	h.Write([]byte(text))
+	v := make([]float32, appCtx.Config.QdrantVectorSize)
+	v[int(h.Sum32()%uint32(len(v)))] = 1
+	return v
+}
+
+// fakeEmbeddings answers Ollama embedding requests of either API shape with testVector and
+// records the embedded texts
+type fakeEmbeddings struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (f *fakeEmbeddings) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prompt string `json:"prompt"`
+		Input  string `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	text := req.Prompt + req.Input
+	f.mu.Lock()
+	f.texts = append(f.texts, text)
+	f.mu.Unlock()
+	vector := testVector(text)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"embedding": vector, "embeddings": [][]float32{vector}})
+}
+
+// embedded returns the texts embedded so far
+func (f *fakeEmbeddings) embedded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.texts...)
+}
+
+func TestParseCrossEncoderScore(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   float64
+	}{
+		{"1", 0.1},
+		{"0", 0},
+		{"10", 1},
+		{"7.5", 0.75},
+		{"Relevance: 8/10", 0.8},
+		{"12", 1}, // above the scale
+	}
+	for _, tt := range tests {
+		got, err := parseCrossEncoderScore(tt.answer)
+		if err != nil || got != tt.want {
+			t.Errorf("parseCrossEncoderScore(%q) = %v, %v; want %v", tt.answer, got, err, tt.want)
+		}
+	}
+	if _, err := parseCrossEncoderScore("not relevant"); err == nil {
+		t.Error("answer without a number was accepted")
+	}
+}
+
+func TestConcurrentIdenticalEmbeddingsShareOneCall(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.EmbeddingSingleFlight = true
+	var calls atomic.Int32
+	release := make(chan struct{})
+	embeddings := &fakeEmbeddings{}
+	useFakeOllama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release // hold the call until every caller is waiting on it
+		embeddings.ServeHTTP(w, r)
+	}))
+
+	const n = 10
+	vectors := make([][]float32, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vectors[i], errs[i] = embedText(context.Background(), "the same query")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if c := calls.Load(); c != 1 {
+		t.Errorf("%d upstream calls for %d identical concurrent embeddings, want 1", c, n)
+	}
+	for i := range n {
+		if errs[i] != nil || !slices.Equal(vectors[i], testVector("the same query")) {
+			t.Fatalf("caller %d: %v, wrong vector %t", i, errs[i], errs[i] == nil)
+		}
+	}
+	vectors[0][0] = 42
+	if vectors[1][0] == 42 {
+		t.Error("callers share one vector slice")
+	}
+}
+
+// shapedEmbeddings serves Ollama's two embedding APIs on their own paths: /api/embeddings takes
+// {"prompt"} and answers {"embedding"}, /api/embed takes {"input"} and answers {"embeddings"}
+type shapedEmbeddings struct {
+	size int
+	mu   sync.Mutex
+	keys []string // path and request key of each call
+}
+
+func (s *shapedEmbeddings) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	for key := range req {
+		if key != "model" && key != "keep_alive" {
+			s.mu.Lock()
+			s.keys = append(s.keys, path+" "+key)
+			s.mu.Unlock()
+		}
+	}
+	vector := make([]float32, s.size)
+	vector[0] = 1
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case path == "/api/embeddings" && req["prompt"] != nil:
+		json.NewEncoder(w).Encode(map[string]any{"embedding": vector})
+	case path == "/api/embed" && req["input"] != nil:
+		json.NewEncoder(w).Encode(map[string]any{"model": req["model"], "embeddings": [][]float32{vector}})
+	default:
+		http.Error(w, `{"error":"missing field"}`, http.StatusBadRequest)
+	}
+}
+
+func TestEmbeddingsAPIVersions(t *testing.T) {
+	cases := []struct {
+		version, endpoint string
+		size              int
+		wantKey           string // "" when the call must fail
+	}{
+		{"", "/api/embeddings", 0, "/api/embeddings prompt"},
+		{"legacy", "/api/embeddings", 0, "/api/embeddings prompt"},
+		{"new", "/api/embed", 0, "/api/embed input"},
+		{"auto", "/api/embed", 0, "/api/embed input"},
+		{"auto", "/api/embed/", 0, "/api/embed input"},
+		{"auto", "/api/embeddings", 0, "/api/embeddings prompt"},
+		{"legacy", "/api/embed", 0, ""}, // wrong shape for the path
+		{"new", "/api/embeddings", 0, ""},
+		{"new", "/api/embed", 3, ""}, // dimension mismatch
+		{"auto", "/api/embeddings", 3, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.version+tc.endpoint, func(t *testing.T) {
+			newTestApp(t)
+			config := appCtx.Config
+			config.EmbeddingsAPIVersion = tc.version
+			if err := validateConfig(config); err != nil {
+				t.Fatal(err)
+			}
+			size := tc.size
+			if size == 0 {
+				size = appCtx.Config.QdrantVectorSize
+			}
+			server := &shapedEmbeddings{size: size}
+			useFakeOllama(t, server)
+			appCtx.Config.EmbeddingsAPIVersion = tc.version
+			appCtx.Config.EmbeddingsEndpoint = tc.endpoint
+
+			vector, err := embedText(context.Background(), "some text")
+			if tc.wantKey == "" {
+				if err == nil {
+					t.Fatalf("embedding succeeded with %d values", len(vector))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vector) != appCtx.Config.QdrantVectorSize || vector[0] != 1 {
+				t.Errorf("vector of %d values starting %v", len(vector), vector[:1])
+			}
+			if len(server.keys) != 1 || server.keys[0] != tc.wantKey {
+				t.Errorf("requests %q, want %q", server.keys, tc.wantKey)
+			}
+		})
+	}
+
+	config := appCtx.Config
+	config.EmbeddingsAPIVersion = "v2"
+	if validateConfig(config) == nil {
+		t.Error("unknown EmbeddingsAPIVersion accepted")
+	}
+}
+
+func TestNormalizeEmbeddingsGivesUnitVectors(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.EmbeddingSingleFlight = false
+	// The stub answers (3, 4, 0, ...), norm 5
+	useFakeOllama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vector := make([]float32, appCtx.Config.QdrantVectorSize)
+		vector[0], vector[1] = 3, 4
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"embedding": vector, "embeddings": [][]float32{vector}})
+	}))
+
+	norm := func(v []float32) float64 {
+		var sum float64
+		for _, x := range v {
+			sum += float64(x) * float64(x)
+		}
+		return math.Sqrt(sum)
+	}
+	for _, normalize := range []bool{false, true} {
+		appCtx.Config.NormalizeEmbeddings = normalize
+		vector, err := embedText(context.Background(), "some text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 5.0
+		if normalize {
+			want = 1
+		}
+		if got := norm(vector); math.Abs(got-want) > 1e-6 {
+			t.Errorf("NormalizeEmbeddings %v: norm %f, want %f", normalize, got, want)
+		}
+		if ratio := vector[1] / vector[0]; math.Abs(float64(ratio)-4.0/3) > 1e-6 {
+			t.Errorf("NormalizeEmbeddings %v: direction changed to %v", normalize, vector[:2])
+		}
+	}
+}
+
+// decodingTokenizer is the test tokenizer that can also decode the words it has encoded
+type decodingTokenizer struct {
+	testTokenizer
+	words map[uint32]string
+}
+
+func (d decodingTokenizer) Encode(text string, addSpecialTokens bool) ([]uint32, []string) {
+	ids, words := d.testTokenizer.Encode(text, addSpecialTokens)
+	for i, id := range ids {
+		d.words[id] = words[i]
+	}
+	return ids, words
+}
+
+func (d decodingTokenizer) Decode(ids []uint32, skipSpecialTokens bool) string {
+	words := make([]string, len(ids))
+	for i, id := range ids {
+		words[i] = d.words[id]
+	}
+	return strings.Join(words, " ")
+}
+
+func TestEmbeddingInputCappedToMaxTokens(t *testing.T) {
+	newTestApp(t)
+	appCtx.Tokenizer = decodingTokenizer{words: make(map[uint32]string)}
+	appCtx.Config.EmbeddingSingleFlight = false
+	embeddings := &fakeEmbeddings{}
+	useFakeOllama(t, embeddings)
+
+	cases := []struct {
+		maxTokens  int
+		text, want string
+	}{
+		{3, "one two three four five", "one two three"},
+		{3, "one two", "one two"},
+		{0, "one two three four five", "one two three four five"},
+	}
+	for _, tc := range cases {
+		appCtx.Config.EmbeddingMaxTokens = tc.maxTokens
+		if _, err := embedText(context.Background(), tc.text); err != nil {
+			t.Fatal(err)
+		}
+		texts := embeddings.embedded()
+		if got := texts[len(texts)-1]; got != tc.want {
+			t.Errorf("EmbeddingMaxTokens %d: embedded %q, want %q", tc.maxTokens, got, tc.want)
+		}
+	}
+}
+
+func TestEmbeddingKeepAliveInEmbeddingPayload(t *testing.T) {
+	newTestApp(t)
+	var mu sync.Mutex
+	keepAlive := make(map[string]any) // by request path
+	useFakeOllama(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		keepAlive[r.URL.Path] = req["keep_alive"]
+		mu.Unlock()
+		vector := make([]float32, appCtx.Config.QdrantVectorSize)
+		vector[0] = 1
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"embedding": vector, "embeddings": [][]float32{vector}, "response": "7"})
+	}))
+	appCtx.Config.OllamaKeepAlive = "0s"
+	appCtx.Config.CrossEncoderModel = "reranker"
+
+	for _, tc := range []struct{ embedding, want string }{{"24h", "24h"}, {"", "0s"}} {
+		appCtx.Config.EmbeddingKeepAlive = tc.embedding
+		if _, err := embedTextOnce(context.Background(), "some text"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := crossEncoderRelevance(context.Background(), "query", "document"); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		embedded, other := keepAlive[appCtx.Config.EmbeddingsEndpoint], keepAlive[appCtx.Config.CrossEncoderEndpoint]
+		mu.Unlock()
+		if embedded != tc.want {
+			t.Errorf("EmbeddingKeepAlive %q: embedding keep_alive %v, want %q", tc.embedding, embedded, tc.want)
+		}
+		if other != "0s" {
+			t.Errorf("EmbeddingKeepAlive %q: cross-encoder keep_alive %v, want OllamaKeepAlive", tc.embedding, other)
+		}
+	}
+
+	config := appCtx.Config
+	config.EmbeddingKeepAlive = "forever"
+	if err := validateConfig(config); err == nil {
+		t.Error("EmbeddingKeepAlive \"forever\" accepted")
+	}
+}
@@ -2,11 +2,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path"
 	"regexp"
+	"slices"
 	"strings"
+
+	"github.com/tidwall/gjson"
 )
 
 // normalizePath normalizes and sanitizes a candidate file path for comparison.
@@ -54,17 +58,11 @@ func isFileAllowed(filePath string) bool {
 // parseAttachments scans content for tag blocks and extracts attachments.
 func parseAttachments(content string, tagList []string) (attachments []Attachment) {
 
-	var fpLineRe, userFileRemoveRe, attrFilePathRe *regexp.Regexp
-
-	if fpLineRe, _ = regexp.Compile(`(?i)^[ \t]*//[ \t]*filepath:[ \t]*(.+)$`); fpLineRe == nil {
-		return attachments
-	}
-	if userFileRemoveRe, _ = regexp.Compile(`(?im)^[ \t]*user(?:'s)?[ \t]+active[ \t]+file(?:[ \t]+for[ \t]+additional[ \t]+context)?:[ \t]*$`); userFileRemoveRe == nil {
-		return attachments
-	}
-	if attrFilePathRe, _ = regexp.Compile(`(?i)\bfilepath\s*=\s*"([^"]+)"`); attrFilePathRe == nil {
-		return attachments
-	}
+	// Path rules compiled from the config (AttachmentPathPatterns etc.)
+	pathLineRegs := appCtx.Config.AttachmentPathPatternsReg
+	pathAttrRegs := appCtx.Config.AttachmentPathAttrPatternsReg
+	stripRegs := appCtx.Config.AttachmentStripPatternsReg
+	dropped := 0 // over MaxAttachmentsPerRequest
 
 	for _, rawTag := range tagList {
 		tag := strings.TrimSpace(rawTag)
@@ -95,21 +93,28 @@ func parseAttachments(content string, tagList []string) (attachments []Attachmen
 			filePath := ""
 			matchedLine := ""
 
+			// Line patterns in priority order, each tried on the first lines
 			const maxLinesToCheck = 6
 			lines := strings.SplitN(bodyRaw, "\n", maxLinesToCheck+1)
-			for _, ln := range lines {
-				if fpMatch := fpLineRe.FindStringSubmatch(ln); len(fpMatch) > 1 {
-					filePath = strings.TrimSpace(fpMatch[1])
-					matchedLine = fpMatch[0]
-					break
+		linePatterns:
+			for _, re := range pathLineRegs {
+				for _, ln := range lines {
+					if fpMatch := re.FindStringSubmatch(ln); len(fpMatch) > 1 && strings.TrimSpace(fpMatch[1]) != "" {
+						filePath = strings.TrimSpace(fpMatch[1])
+						matchedLine = fpMatch[0]
+						break linePatterns
+					}
 				}
 			}
 
 			if filePath == "" {
-				if attrMatch := attrFilePathRe.FindStringSubmatch(attrStr); len(attrMatch) > 1 {
-					candidate := strings.TrimSpace(attrMatch[1])
-					if candidate != "" && !strings.Contains(candidate, "%s") && !strings.Contains(candidate, "regexp.MustCompile") {
-						filePath = candidate
+				for _, re := range pathAttrRegs {
+					if attrMatch := re.FindStringSubmatch(attrStr); len(attrMatch) > 1 {
+						candidate := strings.TrimSpace(attrMatch[1])
+						if candidate != "" && !strings.Contains(candidate, "%s") && !strings.Contains(candidate, "regexp.MustCompile") {
+							filePath = candidate
+							break
+						}
 					}
 				}
 			}
@@ -132,7 +137,9 @@ func parseAttachments(content string, tagList []string) (attachments []Attachmen
 				bodyAfter = strings.Replace(bodyAfter, matchedLine, "", 1)
 			}
 
-			bodyAfter = userFileRemoveRe.ReplaceAllString(bodyAfter, "")
+			for _, re := range stripRegs {
+				bodyAfter = re.ReplaceAllString(bodyAfter, "")
+			}
 			bodyAfter = strings.Trim(bodyAfter, "\r\n")
 
 			if len(bodyAfter) == 0 {
@@ -147,21 +154,36 @@ func parseAttachments(content string, tagList []string) (attachments []Attachmen
 				continue
 			}
 
+			if attachmentsFull(attachments) {
+				dropped++
+				continue
+			}
+
 			attachments = append(attachments, Attachment{
 				ID:   id,
 				Body: bodyAfter,
 				Path: filePath,
-				Hash: sha512sum(bodyAfter),
+				Hash: hashContent(bodyAfter),
 			})
 
 		}
 	}
 
+	if dropped > 0 {
+		appCtx.AccessLogger.Printf("Dropped %d attachments over MaxAttachmentsPerRequest %d", dropped, appCtx.Config.MaxAttachmentsPerRequest)
+	}
 	return attachments
 }
 
+// attachmentsFull reports whether attachments reached MaxAttachmentsPerRequest
+func attachmentsFull(attachments []Attachment) bool {
+	max := appCtx.Config.MaxAttachmentsPerRequest
+	return max > 0 && len(attachments) >= max
+}
+
 // readAttachments scans editor-like blocks
 func readAttachments(existing []Attachment, content string, tagList []string) []Attachment {
+	dropped := 0 // over MaxAttachmentsPerRequest
 	for _, rawTag := range tagList {
 		tag := strings.TrimSpace(rawTag)
 		if tag == "" {
@@ -202,6 +224,24 @@ func readAttachments(existing []Attachment, content string, tagList []string) []
 					continue
 				}
 
+				if !isFileAllowed(filePath) {
+					continue
+				}
+
+				if attachmentsFull(existing) {
+					dropped++
+					continue
+				}
+
+				// Size from the file system first: an oversized file is not read at all
+				info, err := os.Stat(filePath)
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				if appCtx.Config.MaxFileSize > 0 && info.Size() > int64(appCtx.Config.MaxFileSize) {
+					continue
+				}
+
 				data, err := os.ReadFile(filePath)
 				if err != nil {
 					continue
@@ -217,21 +257,20 @@ func readAttachments(existing []Attachment, content string, tagList []string) []
 					continue
 				}
 
-				if !isFileAllowed(filePath) {
-					continue
-				}
-
 				newAtt := Attachment{
 					ID:   id,
 					Body: body,
 					Path: filePath,
-					Hash: sha512sum(body),
+					Hash: hashContent(body),
 				}
 				existing = append(existing, newAtt)
 			}
 		}
 	}
 
+	if dropped > 0 {
+		appCtx.AccessLogger.Printf("Dropped %d attachments over MaxAttachmentsPerRequest %d", dropped, appCtx.Config.MaxAttachmentsPerRequest)
+	}
 	return existing
 }
 
@@ -263,8 +302,57 @@ func extractByTags(content string, tagsList []string) []string {
 	return results
 }
 
-// processMessages parses the JSON data and extracts required elements
-func processMessages(req map[string]any) (cleanUserContent string, attachments []Attachment, err error) {
+// messageContent returns the text of a request message, looked up through RequestContentPaths
+// (gjson syntax, first string match wins; "content" when not configured)
+func messageContent(msg map[string]any) (string, bool) {
+	paths := appCtx.Config.RequestContentPaths
+	if len(paths) == 0 {
+		paths = []string{"content"}
+	}
+	var raw []byte
+	for _, p := range paths {
+		// plain top-level key, no need to marshal
+		if c, ok := msg[p].(string); ok {
+			return c, true
+		}
+		if raw == nil {
+			var err error
+			if raw, err = json.Marshal(msg); err != nil {
+				return "", false
+			}
+		}
+		if res := gjson.GetBytes(raw, p); res.Type == gjson.String {
+			return res.String(), true
+		}
+	}
+	return "", false
+}
+
+// messageAttachments returns the attachments of one user message content
+func messageAttachments(content string) []Attachment {
+	attachments := parseAttachments(content, appCtx.Config.UserMessageAskAttachmentTags)
+	return readAttachments(attachments, content, appCtx.Config.UserMessageAgentAttachmentTags)
+}
+
+// removeTagBlocks removes the <tag ...>...</tag> blocks of tagList from content
+func removeTagBlocks(content string, tagList []string) string {
+	for _, rawTag := range tagList {
+		tag := strings.TrimSpace(rawTag)
+		if tag == "" {
+			continue
+		}
+		pattern := `(?is)<` + regexp.QuoteMeta(tag) + `\b[^>]*>.*?</` + regexp.QuoteMeta(tag) + `>`
+		if re, err := regexp.Compile(pattern); err == nil {
+			content = re.ReplaceAllString(content, "")
+		}
+	}
+	return strings.TrimSpace(content)
+}
+
+// processMessages returns the clean prompt of the last user message, the text to embed for the search
+// (the clean prompt, or with EmbedFullUserMessage the whole message without its attachment blocks)
+// and the attachments
+func processMessages(req map[string]any) (cleanUserContent string, embedContent string, attachments []Attachment, err error) {
 
 	msgsRaw, ok := req["messages"]
 	if !ok {
@@ -283,15 +371,57 @@ func processMessages(req map[string]any) (cleanUserContent string, attachments [
 	}
 
 	if role, ok := lastMsg["role"].(string); ok && role == "user" {
-		if content, ok := lastMsg["content"].(string); ok {
+		if content, ok := messageContent(lastMsg); ok {
 			if appCtx.Config.VerboseDiskLogs {
 				appCtx.AccessLogger.Printf("User message content: %s", content)
 			}
 			cleanUserContentParts := extractByTags(content, appCtx.Config.UserMessageTags)
 			cleanUserContent = strings.Join(cleanUserContentParts, " ")
-			attachments = parseAttachments(content, appCtx.Config.UserMessageAskAttachmentTags)
-			attachments = readAttachments(attachments, content, appCtx.Config.UserMessageAgentAttachmentTags)
+			embedContent = cleanUserContent
+			if appCtx.Config.EmbedFullUserMessage {
+				tags := slices.Concat(appCtx.Config.UserMessageAskAttachmentTags, appCtx.Config.UserMessageAgentAttachmentTags)
+				if full := removeTagBlocks(content, tags); full != "" {
+					embedContent = full
+				}
+			}
+			attachments = messageAttachments(content)
 			appCtx.AccessLogger.Printf("Extracted %d attachments from user message", len(attachments))
+
+			// Earlier user messages (AttachmentScanDepth), newest first: a file attached again is kept
+			// in its latest version
+			scanned := 1
+			for i := len(msgs) - 2; i >= 0 && scanned < appCtx.Config.AttachmentScanDepth; i-- {
+				msg, ok := msgs[i].(map[string]any)
+				if !ok {
+					continue
+				}
+				if role, _ := msg["role"].(string); role != "user" {
+					continue
+				}
+				earlier, ok := messageContent(msg)
+				if !ok {
+					continue
+				}
+				scanned++
+				found, dropped := 0, 0
+				for _, att := range messageAttachments(earlier) {
+					if isDuplicate(attachments, att.Path) {
+						continue
+					}
+					if attachmentsFull(attachments) {
+						dropped++
+						continue
+					}
+					attachments = append(attachments, att)
+					found++
+				}
+				if dropped > 0 {
+					appCtx.AccessLogger.Printf("Dropped %d attachments of earlier user message %d over MaxAttachmentsPerRequest %d", dropped, i, appCtx.Config.MaxAttachmentsPerRequest)
+				}
+				if found > 0 {
+					appCtx.AccessLogger.Printf("Extracted %d attachments from earlier user message %d", found, i)
+				}
+			}
 		}
 	}
 
@@ -300,5 +430,5 @@ func processMessages(req map[string]any) (cleanUserContent string, attachments [
 		return
 	}
 
-	return cleanUserContent, attachments, nil
+	return cleanUserContent, embedContent, attachments, nil
 }
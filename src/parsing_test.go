@@ -0,0 +1,126 @@
+// parsing_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessageContent(t *testing.T) {
+	newTestApp(t)
+	msg := map[string]any{
+		"role":    "user",
+		"content": []any{map[string]any{"type": "text", "text": "nested prompt"}},
+	}
+
+	appCtx.Config.RequestContentPaths = nil
+	if _, ok := messageContent(msg); ok {
+		t.Error("non-string content found without RequestContentPaths")
+	}
+
+	appCtx.Config.RequestContentPaths = []string{"content", "content.0.text"}
+	if got, ok := messageContent(msg); !ok || got != "nested prompt" {
+		t.Errorf("messageContent = %q, %t; want the nested text", got, ok)
+	}
+	if got, ok := messageContent(map[string]any{"content": "plain"}); !ok || got != "plain" {
+		t.Errorf("messageContent = %q, %t; want the plain content", got, ok)
+	}
+}
+
+func TestReadAttachmentsChecksBeforeReading(t *testing.T) {
+	newTestApp(t)
+	dir := t.TempDir()
+	small, big := filepath.Join(dir, "small.go"), filepath.Join(dir, "big.go")
+	if err := os.WriteFile(small, []byte("package small"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(big, []byte(strings.Repeat("x", 64)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	block := func(p string) string { return "<editorContext>The current file is " + p + "\n</editorContext>" }
+	tags := []string{"editorContext"}
+	appCtx.Config.FilePatternsReg = nil
+	appCtx.Config.MaxFileSize = 32
+
+	got := readAttachments(nil, block(big)+block(small)+block(dir), tags)
+	if len(got) != 1 || got[0].Path != small {
+		t.Errorf("got %v, want only %s (big file and directory skipped)", got, small)
+	}
+
+	appCtx.Config.MaxAttachmentsPerRequest = 1
+	if got := readAttachments([]Attachment{{Path: "/other.go"}}, block(small), tags); len(got) != 1 {
+		t.Errorf("got %d attachments over MaxAttachmentsPerRequest 1", len(got))
+	}
+}
+
+func TestCustomAttachmentPathPattern(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FilePatternsReg = nil
+	content := "<attachment>\n# path: src/x.go\npackage x\n</attachment>"
+
+	if err := compileAttachmentPatterns(&appCtx.Config); err != nil {
+		t.Fatal(err)
+	}
+	if got := parseAttachments(content, []string{"attachment"}); len(got) != 0 {
+		t.Fatalf("default patterns extracted %v from a `# path:` comment", got)
+	}
+
+	appCtx.Config.AttachmentPathPatterns = []string{`^#[ \t]*path:[ \t]*(.+)$`, `(?i)^[ \t]*//[ \t]*filepath:[ \t]*(.+)$`}
+	if err := compileAttachmentPatterns(&appCtx.Config); err != nil {
+		t.Fatal(err)
+	}
+	got := parseAttachments(content, []string{"attachment"})
+	if len(got) != 1 {
+		t.Fatalf("got %d attachments, want 1", len(got))
+	}
+	if got[0].Path != "src/x.go" || got[0].ID != "x.go" || got[0].Body != "package x" {
+		t.Errorf("attachment = %+v, want src/x.go with the path line stripped", got[0])
+	}
+
+	appCtx.Config.AttachmentPathPatterns = []string{`# path: .+`}
+	if err := compileAttachmentPatterns(&appCtx.Config); err == nil {
+		t.Error("path pattern without a capture group accepted")
+	}
+}
+
+func TestAttachmentFromEarlierTurnExtracted(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FilePatternsReg = nil
+	attach := func(p, body string) string {
+		return "<attachment>\n// filepath: " + p + "\n" + body + "\n</attachment>"
+	}
+	req := testRequest(t,
+		"user", "<userRequest>look at these</userRequest>"+attach("a.go", "package a // old")+attach("b.go", "package b"),
+		"assistant", "ok",
+		"user", "<userRequest>and this one</userRequest>"+attach("a.go", "package a // new"),
+		"assistant", "ok",
+		"user", "<userRequest>what does b do?</userRequest>",
+	)
+
+	appCtx.Config.AttachmentScanDepth = 1
+	clean, _, attachments, err := processMessages(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clean != "what does b do?" || len(attachments) != 0 {
+		t.Errorf("depth 1: prompt %q, attachments %v; want the last prompt and none", clean, attachments)
+	}
+
+	appCtx.Config.AttachmentScanDepth = 3
+	clean, _, attachments, err = processMessages(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clean != "what does b do?" {
+		t.Errorf("prompt %q, want the last user turn only", clean)
+	}
+	bodies := make(map[string]string)
+	for _, a := range attachments {
+		bodies[a.ID] = a.Body
+	}
+	if len(attachments) != 2 || bodies["b.go"] != "package b" || bodies["a.go"] != "package a // new" {
+		t.Errorf("attachments %v, want b.go from two turns back and the latest a.go once", attachments)
+	}
+}
@@ -2,17 +2,28 @@
 package main
 
 import (
-	"crypto/sha512"
+	"context"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net/http"
 	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
+	"github.com/qdrant/go-client/qdrant"
+	"github.com/tidwall/gjson"
 	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
 )
 
 // saveSystemMessage: rewrite existing system message
@@ -28,7 +39,7 @@ func saveSystemMessage(content string) error {
 }
 
 func patchSystemMessage(systemMessage string) string {
-	cfg := appCtx.Config.SystemMessagePatch
+	cfg := configSnapshot().SystemMessagePatch
 
 	msg := systemMessage // Работаем с копией строки
 
@@ -93,7 +104,12 @@ func patchSystemMessage(systemMessage string) string {
 
 // normalizeText: normalizes text by converting to lowercase and removing non-alphanumeric and non-punctuation characters
 func normalizeText(s string) string {
-	s = norm.NFC.String(s) // нормализуем в NFC
+	if appCtx.Config.AggressiveNormalization {
+		// NFKC folds compatibility forms, width folding covers the CJK width variants NFKC keeps
+		s = width.Fold.String(norm.NFKC.String(s))
+	} else {
+		s = norm.NFC.String(s) // нормализуем в NFC
+	}
 	var b strings.Builder
 	for _, r := range s {
 		r = unicode.ToLower(r)
@@ -107,20 +123,118 @@ func normalizeText(s string) string {
 	return b.String()
 }
 
-// messageExists: checks if a message with the given content already exists in the request
-func messageExists(req map[string]any, content string) bool {
-	normContent := normalizeText(content)
+// feedDedupSet holds the texts already in a request (its messages and the feeds added so far), so that
+// a feed repeating one of them is not added. Built once per request by newFeedDedupSet.
+type feedDedupSet struct {
+	keys     map[string][]string // dedupKey of each text: the normalized texts with that key
+	pending  []string            // texts whose token sets are not computed yet, only with FeedDedupSimilarity
+	tokenSet [][]uint32          // unique token ids of each text, only with FeedDedupSimilarity
+}
+
+// newFeedDedupSet collects the messages of req
+func newFeedDedupSet(req map[string]any) *feedDedupSet {
+	set := &feedDedupSet{keys: make(map[string][]string)}
 
 	// guaranteee that req["messages"] is []any
 	messages := req["messages"].([]any)
 
 	for _, m := range messages {
 		if mm, ok := m.(map[string]any); ok {
-			if c, ok2 := mm["content"].(string); ok2 && normalizeText(c) == normContent {
-				return true
+			if c, ok2 := messageContent(mm); ok2 {
+				set.add(c)
 			}
 		}
-		if s, ok := m.(string); ok && normalizeText(s) == normContent {
+		if s, ok := m.(string); ok {
+			set.add(s)
+		}
+	}
+	return set
+}
+
+// dedupText bounds text to its first FeedDedupPrefixChars runes (0 keeps it whole)
+func dedupText(text string) string {
+	limit := appCtx.Config.FeedDedupPrefixChars
+	if limit <= 0 || len(text) <= limit {
+		return text
+	}
+	n := 0
+	for i := range text {
+		if n == limit {
+			return text[:i]
+		}
+		n++
+	}
+	return text
+}
+
+// dedupKey returns the normalized text and its lookup key: the hash of the normalized text, bounded
+// to FeedDedupPrefixChars plus the full normalized length when the text is longer. Texts sharing a
+// key only may be equal; comparing their normalized texts tells.
+func dedupKey(text string) (key, norm string) {
+	norm = normalizeText(text)
+	if bounded := dedupText(norm); len(bounded) < len(norm) {
+		return fmt.Sprintf("%s:%d", hashContent(bounded), len(norm)), norm
+	}
+	return hashContent(norm), norm
+}
+
+// dedupTokenSet returns the unique token ids of the lowercased, bounded text
+func dedupTokenSet(text string) []uint32 {
+	ids, err := tokenIDs(strings.ToLower(dedupText(text)))
+	if err != nil {
+		return nil
+	}
+	return uniqueInts(ids)
+}
+
+// jaccardIDs returns |a ∩ b| / |a ∪ b| of two sets of unique token ids
+func jaccardIDs(a, b []uint32) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	inA := make(map[uint32]struct{}, len(a))
+	for _, id := range a {
+		inA[id] = struct{}{}
+	}
+	common := 0
+	for _, id := range b {
+		if _, ok := inA[id]; ok {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// add records text as present in the request. Its token set is computed by the first contains
+// that needs it, so requests without feed candidates never tokenize their history.
+func (s *feedDedupSet) add(text string) {
+	key, norm := dedupKey(text)
+	s.keys[key] = append(s.keys[key], norm)
+	if appCtx.Config.FeedDedupSimilarity > 0 {
+		s.pending = append(s.pending, text)
+	}
+}
+
+// contains reports whether text equals a recorded text after normalization or, with
+// FeedDedupSimilarity, has a token set Jaccard similarity at or above it with one of them
+func (s *feedDedupSet) contains(text string) bool {
+	key, norm := dedupKey(text)
+	if slices.Contains(s.keys[key], norm) {
+		return true
+	}
+	threshold := appCtx.Config.FeedDedupSimilarity
+	if threshold <= 0 {
+		return false
+	}
+	for _, pending := range s.pending {
+		if ids := dedupTokenSet(pending); len(ids) > 0 {
+			s.tokenSet = append(s.tokenSet, ids)
+		}
+	}
+	s.pending = nil
+	ids := dedupTokenSet(text)
+	for _, other := range s.tokenSet {
+		if jaccardIDs(ids, other) >= threshold {
 			return true
 		}
 	}
@@ -132,17 +246,67 @@ func decodeTag(b64 string) string {
 	return string(b)
 }
 
-func prepareFeeds(historySize *int, feedSize *int, relevantContent []Payload, req map[string]any) []map[string]any {
+// feedTruncatedMarker ends a file body cut down to fit the feed budget
+const feedTruncatedMarker = "\n...(truncated)"
+
+// truncateFileToFit returns the longest prefix of a file body (plus feedTruncatedMarker) whose
+// attachment token count fits budget, with that count. ok is false if not even an empty prefix fits.
+func truncateFileToFit(payload Payload, budget int) (body string, tokenCount int, ok bool) {
+	runes := []rune(payload.Body)
+	size := func(n int) int {
+		t, _ := calcFileSize(Attachment{
+			ID:   payload.FileMeta.ID,
+			Path: payload.FileMeta.Path,
+			Body: string(runes[:n]) + feedTruncatedMarker,
+		})
+		return t
+	}
+
+	// Binary search for the longest prefix that fits
+	lo, hi := 0, len(runes)
+	if size(0) > budget {
+		return "", 0, false
+	}
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if size(mid) <= budget {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	body = string(runes[:lo]) + feedTruncatedMarker
+	return body, size(lo), true
+}
+
+func prepareFeeds(historySize *int, feedSize *int, relevantContent []Payload, req map[string]any, seen *feedDedupSet) []map[string]any {
 
 	var feeds []map[string]any
+	var feedPayloads []Payload // source payload of each feed
 	// Create slice of relevant content within feed size
 	// openFilesTag := "<" + decodeTag(appConsts.Base64FilesTag) + ">"
 	// closeFilesTag := "</" + decodeTag(appConsts.Base64FilesTag) + ">"
 	openFileTag := "<" + decodeTag(appConsts.Base64FileTag) + ` id="%s" isSummarized="true">`
 	closeFileTag := "</" + decodeTag(appConsts.Base64FileTag) + ">"
-	for _, payload := range relevantContent {
-		if *feedSize < payload.TokenCount {
-			continue // Trying to fit with another payload
+	added := make([]int, 0, len(relevantContent)) // indexes into relevantContent, for relevance order
+	handled := make([]bool, len(relevantContent))
+	feedByIndex := make(map[int]map[string]any, len(relevantContent))
+
+	// tryAdd adds relevantContent[i] if it fits budget (charging it), or marks it handled if already present
+	tryAdd := func(i int, budget *int) {
+		payload := relevantContent[i]
+		body := payload.Body
+		tokenCount := payload.TokenCount
+		if *budget < tokenCount {
+			// Optionally cut a file down to the remaining budget, otherwise try to fit smaller payloads
+			if !appCtx.Config.FeedTruncateFiles || payload.Role != "rag-file" || *budget < appCtx.Config.FeedTruncateMinTokens {
+				return
+			}
+			var ok bool
+			if body, tokenCount, ok = truncateFileToFit(payload, *budget); !ok {
+				return
+			}
+			appCtx.AccessLogger.Printf("Truncated file %s from %d to %d tokens to fit feed budget", payload.FileMeta.Path, payload.TokenCount, tokenCount)
 		}
 
 		n := 64
@@ -150,10 +314,11 @@ func prepareFeeds(historySize *int, feedSize *int, relevantContent []Payload, re
 			n = len(payload.Body)
 		}
 		txt := payload.Body[:n]
-		if messageExists(req, payload.Body) {
+		handled[i] = true
+		if seen.contains(payload.Body) {
 			appCtx.AccessLogger.Printf("Skipping already existing message in request: %s", txt)
 			// appCtx.DebugLogger.Printf("Skipping already existing message in request: %s", txt)
-			continue
+			return
 		} else {
 			appCtx.AccessLogger.Printf("Adding new message to request: %s", txt)
 			// appCtx.DebugLogger.Printf("Adding new message to request: %s", txt)
@@ -170,19 +335,48 @@ func prepareFeeds(historySize *int, feedSize *int, relevantContent []Payload, re
 `,
 				fmt.Sprintf(openFileTag, payload.FileMeta.ID),
 				payload.FileMeta.Path,
-				payload.Body,
+				body,
 				closeFileTag,
 			)
 		} else {
-			content = payload.Body
+			content = body
 		}
 
-		feeds = append(feeds, map[string]any{
+		feedByIndex[i] = map[string]any{
 			"content": content,
 			"role":    payload.Role,
-		})
+		}
+		added = append(added, i)
+		seen.add(payload.Body)
+
+		*budget -= tokenCount
+	}
+
+	if percent := appCtx.Config.FileFeedPercent; percent > 0 {
+		// Files and conversation turns fill their own sub-budgets first...
+		fileBudget := *feedSize * percent / 100
+		convBudget := *feedSize - fileBudget
+		for i, payload := range relevantContent {
+			if payload.Role == "rag-file" {
+				tryAdd(i, &fileBudget)
+			} else {
+				tryAdd(i, &convBudget)
+			}
+		}
+		appCtx.AccessLogger.Printf("Feed sub-budgets left - Files: %d, Conversation: %d", fileBudget, convBudget)
+		// ...then the leftover of both is shared by whatever did not fit
+		*feedSize = fileBudget + convBudget
+	}
+	for i := range relevantContent {
+		if !handled[i] {
+			tryAdd(i, feedSize)
+		}
+	}
 
-		*feedSize -= payload.TokenCount
+	slices.Sort(added)
+	for _, i := range added {
+		feeds = append(feeds, feedByIndex[i])
+		feedPayloads = append(feedPayloads, relevantContent[i])
 	}
 
 	*historySize += *feedSize // Use remaining for history
@@ -205,13 +399,53 @@ func prepareFeeds(historySize *int, feedSize *int, relevantContent []Payload, re
 	// appCtx.DebugLogger.Printf("FEEDS END ======================")
 
 	appCtx.AccessLogger.Printf("Prepared %d feed messages. Remaining feed size: %d", len(feeds), feedSize)
-	return feeds
+	return orderFeeds(feeds, feedPayloads)
+}
+
+// orderFeeds arranges feeds (given best first) in the order they are placed into the request, per FeedOrder:
+//   - relevance-asc (default): least relevant first, most relevant closest to the history and prompt
+//   - relevance-desc: most relevant first, right after the system message
+//   - recency: oldest first
+//   - files-last: conversational feeds, then file feeds, each least relevant first
+func orderFeeds(feeds []map[string]any, payloads []Payload) []map[string]any {
+	idx := make([]int, len(feeds))
+	for i := range idx {
+		idx[i] = i
+	}
+
+	switch appCtx.Config.FeedOrder {
+	case "relevance-desc":
+		// already best first
+	case "recency":
+		sort.SliceStable(idx, func(a, b int) bool {
+			return payloads[idx[a]].Timestamp < payloads[idx[b]].Timestamp
+		})
+	case "files-last":
+		slices.Reverse(idx)
+		sort.SliceStable(idx, func(a, b int) bool {
+			return payloads[idx[a]].Role != "rag-file" && payloads[idx[b]].Role == "rag-file"
+		})
+	default: // relevance-asc
+		slices.Reverse(idx)
+	}
+
+	ordered := make([]map[string]any, len(feeds))
+	for i, j := range idx {
+		ordered[i] = feeds[j]
+	}
+	return ordered
 }
 
 func prepareHistory(historySize *int, systemMsg map[string]any, req map[string]any) ([]map[string]any, error) {
 	// Create slice for history messages within updated history size
 	var history []map[string]any
 
+	// With truncate-history whole turns (a user message and the answers and tool results after it)
+	// are kept or dropped together, so a cut history never opens without its question
+	byTurn := appCtx.Config.OnWindowOverflow == "truncate-history"
+	var turn []map[string]any // messages of the turn being collected, newest first
+	turnSize := 0
+
 	// Guarantee that we have at least one message in history
 	messages := req["messages"].([]any)
 	startIdx := len(messages) - 2
@@ -234,7 +468,22 @@ func prepareHistory(historySize *int, systemMsg map[string]any, req map[string]a
 			return nil, err
 		}
 		msgStr := string(msgBytes)
-		msgSize := calculateTokens(msgStr)
+		msgSize := calculateTokensWithReserve(msgStr)
+
+		if byTurn {
+			turn = append(turn, msgMap)
+			turnSize += msgSize
+			if msgMap["role"] != "user" && i > endIdx {
+				continue // the turn is complete at its user message (or the oldest message)
+			}
+			if *historySize < turnSize {
+				break
+			}
+			history = append(history, turn...)
+			*historySize -= turnSize
+			turn, turnSize = turn[:0], 0
+			continue
+		}
 
 		if *historySize < msgSize {
 			break
@@ -256,10 +505,8 @@ func updateReq(systemMsg, userPromptMsg map[string]any, history, feeds []map[str
 		resultMessages = append(resultMessages, systemMsg)
 	}
 
-	// 2. feeds: from low relevance to high relevance (reverse order)
-	for i := len(feeds) - 1; i >= 0; i-- {
-		resultMessages = append(resultMessages, feeds[i])
-	}
+	// 2. feeds: already arranged by FeedOrder (see orderFeeds)
+	resultMessages = append(resultMessages, feeds...)
 
 	// 3. history: from oldest to second last (as is)
 	for i := len(history) - 1; i >= 0; i-- {
@@ -271,6 +518,10 @@ func updateReq(systemMsg, userPromptMsg map[string]any, history, feeds []map[str
 		resultMessages = append(resultMessages, userPromptMsg)
 	}
 
+	if systemMsg != nil && appCtx.Config.SystemMessageMode == "prepend-user" {
+		resultMessages = foldSystemMessage(resultMessages)
+	}
+
 	// Transform to []any for req["messages"]
 	msgs := make([]any, len(resultMessages))
 	for i, msg := range resultMessages {
@@ -279,9 +530,32 @@ func updateReq(systemMsg, userPromptMsg map[string]any, history, feeds []map[str
 	req["messages"] = msgs
 }
 
-// feedPrompt processes the parsed request elements (placeholder for RAG logic)
-func feedPrompt(cleanUserContent string, req map[string]any) (changed bool, promptVector []float32, queryHash string, err error) {
+// foldSystemMessage merges the leading system message into the first user message with text content
+// (system text first) and drops it. Its tokens are already budgeted by calcSizes.
+// Messages are returned unchanged when there is no such user message.
+func foldSystemMessage(messages []map[string]any) []map[string]any {
+	systemText, _ := messages[0]["content"].(string)
+	for i := 1; i < len(messages); i++ {
+		if role, _ := messages[i]["role"].(string); role != "user" {
+			continue
+		}
+		content, ok := messages[i]["content"].(string)
+		if !ok {
+			continue
+		}
+		merged := maps.Clone(messages[i])
+		merged["content"] = systemText + "\n\n" + content
+		messages[i] = merged
+		return messages[1:]
+	}
+	return messages
+}
+
+// feedPrompt processes the parsed request elements (placeholder for RAG logic).
+// Embedding and retrieval are aborted when ctx (the client request) is done.
+func feedPrompt(ctx context.Context, cleanUserContent string, embedContent string, req map[string]any, opts RequestOptions) (changed bool, promptVector []float32, queryHash string, err error) {
 
+	// The window is checked before anything is embedded or retrieved
 	feedSize, historySize, systemMsg, userPromptMsg, err := calcSizes(req)
 	if err != nil {
 		return false, nil, "", err
@@ -290,39 +564,63 @@ func feedPrompt(cleanUserContent string, req map[string]any) (changed bool, prom
 
 	// check if systemMsg has content field
 	if systemMsg != nil {
-		if content, ok := systemMsg["content"].(string); ok {
+		if content, ok := systemMsg["content"].(string); !ok {
+			systemMsg = nil // discard invalid system message
+		} else if !opts.PatchSystem {
+			appCtx.AccessLogger.Printf("System message patch disabled for this request")
+		} else {
 
 			systemMsgText := patchSystemMessage(content)
 			saveSystemMessage(content + "\n\n=======================================\n\nPatched version:\n\n" + systemMsgText)
 			appCtx.AccessLogger.Printf("Patched system message. and saved orifinal to file if configured. Length: %d", len(systemMsgText))
 			systemMsg["content"] = systemMsgText
-		} else {
-			systemMsg = nil // discard invalid system message
 		}
 	}
 
-	// Get prompt embeddings
-	promptVector, err = embedText(cleanUserContent)
-	if err != nil {
-		return false, nil, "", err
-	}
+	// Hash the clean user content
+	queryHash = hashContent(cleanUserContent)
 
-	if appCtx.Config.VerboseDiskLogs {
-		appCtx.AccessLogger.Printf("Prompt vector generated. Length: %d, Content: %v", len(promptVector), promptVector)
-	} else {
-		appCtx.AccessLogger.Printf("Prompt vector generated. Length: %d", len(promptVector))
-	}
+	var feeds []map[string]any
+	if feedSize > 0 {
+		// Only embedding and retrieval take an augmentation slot (MaxConcurrentRequests)
+		if !acquireRequestSlot(ctx) {
+			return false, nil, queryHash, errTooManyRequests
+		}
+		defer releaseRequestSlot()
 
-	// Hash the clean user content
-	queryHash = sha512sum(cleanUserContent)
+		// Get prompt embeddings (of the whole message with EmbedFullUserMessage)
+		promptVector, err = embedText(ctx, embedContent)
+		if err != nil {
+			return false, nil, "", err
+		}
 
-	// Search for relevant content
-	relevantContent, err := SearchRelevantContentWithRerank(promptVector, cleanUserContent, queryHash)
-	if err != nil {
-		return false, nil, queryHash, err
+		if appCtx.Config.VerboseDiskLogs {
+			appCtx.AccessLogger.Printf("Prompt vector generated. Length: %d, Content: %v", len(promptVector), promptVector)
+		} else {
+			appCtx.AccessLogger.Printf("Prompt vector generated. Length: %d", len(promptVector))
+		}
+
+		// Required terms: supplied with the request and/or extracted from the prompt
+		opts.MustInclude = mergeTerms(opts.MustInclude, extractMustInclude(cleanUserContent))
+		if len(opts.MustInclude) > 0 {
+			appCtx.AccessLogger.Printf("Must-include terms: %q", opts.MustInclude)
+		}
+		if opts.TopN > 0 || opts.Sources != nil {
+			appCtx.AccessLogger.Printf("Retrieval overridden by request headers: top N %d, sources %v", opts.TopN, opts.Sources)
+		}
+
+		// Search for relevant content
+		relevantContent, err := SearchRelevantContentWithRerank(ctx, promptVector, cleanUserContent, queryHash, opts)
+		if err != nil {
+			return false, nil, queryHash, err
+		}
+		// Prepare feeds from relevant content, chunks of one file joined
+		relevantContent = mergeFileChunks(relevantContent)
+		feeds = prepareFeeds(&historySize, &feedSize, relevantContent, req, newFeedDedupSet(req))
+	} else {
+		// Nothing could be fed: the prompt is embedded for storing by the outbound job
+		appCtx.AccessLogger.Printf("No feed budget left in the window, skipping retrieval")
 	}
-	// Prepare feeds from relevant content
-	feeds := prepareFeeds(&historySize, &feedSize, relevantContent, req)
 
 	// Prepare history messages within history size
 	history, err := prepareHistory(&historySize, systemMsg, req)
@@ -358,62 +656,342 @@ func feedPrompt(cleanUserContent string, req map[string]any) (changed bool, prom
 	return true, promptVector, queryHash, nil
 }
 
-// processInbound processes the inbound request data (placeholder)
-func processInbound(data string) (
+// isRAGDisabledModel reports whether model is excluded from RAG: it matches none of RAGModels (when
+// set; a request without a model matches none) or one of RAGDisabledModels (path.Match patterns)
+func isRAGDisabledModel(model string) bool {
+	if len(appCtx.Config.RAGModels) > 0 && !matchesAnyModel(appCtx.Config.RAGModels, model) {
+		return true
+	}
+	return model != "" && matchesAnyModel(appCtx.Config.RAGDisabledModels, model)
+}
+
+// matchesAnyModel reports whether model matches one of the path.Match patterns
+func matchesAnyModel(patterns []string, model string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// patchSystemHeader turns SystemMessagePatch on or off for one request
+const patchSystemHeader = "X-Ragproxy-Patch-System"
+
+// Retrieval overrides of one request; absent or malformed headers leave the config values
+const (
+	topNHeader       = "X-Ragproxy-Top-N"       // RerankTopN: positive integer
+	sourcesHeader    = "X-Ragproxy-Sources"     // SearchSource: comma-separated rag-user, rag-assistant, rag-file
+	disableRAGHeader = "X-Ragproxy-Disable-RAG" // true|false, like a RAGDisabledModels model
+)
+
+// ragStatusHeader tells the client whether the request was augmented (RAGStatusHeader)
+const ragStatusHeader = "X-RAG-Status"
+
+// Values of ragStatusHeader, returned by processInbound
+const (
+	ragStatusAugmented = "augmented" // retrieved context was added to the request
+	ragStatusSkipped   = "skipped"   // the request was passed through as there was nothing to do
+	ragStatusError     = "error"     // augmentation failed, the request was passed through unaugmented
+)
+
+// augmentationErrorHeader carries the augmentation failure to the client (ExposeAugmentationErrors)
+const augmentationErrorHeader = "X-Ragproxy-Error"
+
+// augmentationErrorValue makes err fit a header value: one line, at most 512 bytes
+func augmentationErrorValue(err error) string {
+	v := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, err.Error())
+	if len(v) > 512 {
+		cut := 512
+		for cut > 0 && !utf8.RuneStart(v[cut]) {
+			cut--
+		}
+		v = v[:cut]
+	}
+	return v
+}
+
+// maxRequestTopN is the highest topNHeader value honoured: RerankTopN, or with RerankTopN -1 the
+// number of points one search returns
+func maxRequestTopN() int {
+	appCtx.configMu.RLock()
+	defer appCtx.configMu.RUnlock()
+	if appCtx.Config.RerankTopN > 0 {
+		return appCtx.Config.RerankTopN
+	}
+	return int(searchLimit(appCtx.Config.SearchTopK, appCtx.Config.SearchHardLimit))
+}
+
+// requestOptionsFromHeaders collects per-request options sent by the client in headers
+func requestOptionsFromHeaders(h http.Header) RequestOptions {
+	opts := RequestOptions{PatchSystem: !appCtx.Config.SystemMessagePatchDisabled}
+	if v := h.Get(patchSystemHeader); v != "" {
+		if patch, err := strconv.ParseBool(v); err == nil {
+			opts.PatchSystem = patch
+		} else {
+			appCtx.AccessLogger.Printf("Ignoring invalid %s header: %q", patchSystemHeader, v)
+		}
+	}
+	if appCtx.Config.ThreadHeader != "" {
+		opts.SessionID = h.Get(appCtx.Config.ThreadHeader)
+	}
+	if appCtx.Config.TTLHeader != "" {
+		if v := h.Get(appCtx.Config.TTLHeader); v != "" {
+			if ttl, err := time.ParseDuration(v); err == nil && ttl > 0 {
+				opts.TTL = ttl
+			} else {
+				appCtx.AccessLogger.Printf("Ignoring invalid %s header: %q", appCtx.Config.TTLHeader, v)
+			}
+		}
+	}
+	if appCtx.Config.MustIncludeEnabled && appCtx.Config.MustIncludeHeader != "" {
+		opts.MustInclude = mergeTerms(strings.Split(h.Get(appCtx.Config.MustIncludeHeader), ","))
+	}
+	if v := h.Get(topNHeader); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			if limit := maxRequestTopN(); n > limit {
+				appCtx.AccessLogger.Printf("%s header %d clipped to %d", topNHeader, n, limit)
+				n = limit
+			}
+			opts.TopN = n
+		} else {
+			appCtx.AccessLogger.Printf("Ignoring invalid %s header: %q", topNHeader, v)
+		}
+	}
+	if v := h.Get(sourcesHeader); v != "" {
+		var sources []string
+		for _, s := range strings.Split(v, ",") {
+			sources = append(sources, strings.TrimSpace(s))
+		}
+		if err := validateEnumList(sources, appConsts.AvailableSearchSources); err == nil {
+			opts.Sources = sources
+		} else {
+			appCtx.AccessLogger.Printf("Ignoring invalid %s header: %q", sourcesHeader, v)
+		}
+	}
+	if v := h.Get(disableRAGHeader); v != "" {
+		if disable, err := strconv.ParseBool(v); err == nil {
+			opts.DisableRAG = disable
+		} else {
+			appCtx.AccessLogger.Printf("Ignoring invalid %s header: %q", disableRAGHeader, v)
+		}
+	}
+	return opts
+}
+
+// extractMustInclude returns the terms marked in the prompt by MustIncludeExtractReg (first capture group)
+func extractMustInclude(prompt string) []string {
+	if !appCtx.Config.MustIncludeEnabled || appCtx.mustIncludeExtractReg == nil {
+		return nil
+	}
+	var terms []string
+	for _, m := range appCtx.mustIncludeExtractReg.FindAllStringSubmatch(prompt, -1) {
+		if len(m) > 1 {
+			terms = append(terms, m[1])
+		}
+	}
+	return mergeTerms(terms)
+}
+
+// mergeTerms joins term lists, trimming blanks and dropping case-insensitive duplicates
+func mergeTerms(lists ...[]string) []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, list := range lists {
+		for _, term := range list {
+			term = strings.TrimSpace(term)
+			key := strings.ToLower(term)
+			if term == "" {
+				continue
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			out = append(out, term)
+		}
+	}
+	if len(out) > appCtx.Config.MustIncludeMaxTerms {
+		out = out[:appCtx.Config.MustIncludeMaxTerms]
+	}
+	return out
+}
+
+// threadFromRequest derives the conversation thread of a request: the session header value when present,
+// otherwise a hash of the opening exchange (system messages, first user message and the first answer),
+// so conversations that start alike still get threads of their own. A first turn has no answer yet:
+// its Opening is kept and completeThread sets the ID once the answer is known.
+// Seq is the number of user turns in the conversation so far.
+func threadFromRequest(sessionID string, req map[string]any) ThreadRef {
+	messages, _ := req["messages"].([]any)
+	var thread ThreadRef
+	var opening []string
+	firstAnswer, answered := "", false
+	for _, m := range messages {
+		mm, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch mm["role"] {
+		case "system":
+			if thread.Seq == 0 {
+				opening = append(opening, threadMessageText(mm))
+			}
+		case "user":
+			if thread.Seq == 0 {
+				opening = append(opening, threadMessageText(mm))
+			}
+			thread.Seq++
+		case "assistant":
+			if thread.Seq == 1 && !answered {
+				firstAnswer, answered = threadMessageText(mm), true
+			}
+		}
+	}
+	switch {
+	case sessionID != "":
+		thread.ID = hashContent("session:" + sessionID)
+	case thread.Seq == 0:
+	case answered:
+		thread.ID = openingThreadID(strings.Join(opening, "\x00"), firstAnswer)
+	default:
+		thread.Opening = strings.Join(opening, "\x00")
+	}
+	return thread
+}
+
+// threadMessageText returns the text of a message for thread ids, its raw content when it has none
+func threadMessageText(msg map[string]any) string {
+	if c, ok := messageContent(msg); ok {
+		return c
+	}
+	b, _ := json.Marshal(msg["content"])
+	return string(b)
+}
+
+// openingThreadID hashes the opening of a conversation with its first answer. Whitespace in the
+// answer is collapsed: the client sends it back as it was shown, not always byte for byte.
+func openingThreadID(opening, answer string) string {
+	return hashContent("conversation:" + opening + "\x00" + strings.Join(strings.Fields(answer), " "))
+}
+
+// completeThread sets the ID of a first turn's thread from the answer sent to the client
+func completeThread(thread *ThreadRef, answer string) {
+	if thread.ID == "" && thread.Opening != "" {
+		thread.ID = openingThreadID(thread.Opening, answer)
+	}
+}
+
+// processInbound processes the inbound request data. status is one of the ragStatus values, augErr
+// the reason of ragStatusError
+func processInbound(ctx context.Context, data string, opts RequestOptions) (
 	responseBody string,
 	cleanUserContent string,
 	attachments []Attachment,
 	promptVector []float32,
-	queryHash string) {
+	queryHash string,
+	thread ThreadRef,
+	status string,
+	augErr error) {
 
 	req := make(map[string]any)
 	if err := json.Unmarshal([]byte(data), &req); err != nil {
 		if appCtx.Config.VerboseDiskLogs {
 			appCtx.AccessLogger.Printf("Skipping processing. Reason: data is not valid JSON: %s", data)
 		}
-		return data, "", nil, nil, ""
+		return data, "", nil, nil, "", ThreadRef{}, ragStatusSkipped, nil
 	}
 
 	if appCtx.Config.VerboseDiskLogs {
 		appCtx.AccessLogger.Printf("Inbound data: %s", truncateJSONStrings(data))
 	}
 
+	// Models excluded from RAG skip the augmentation pipeline
+	model := gjson.Get(data, appCtx.Config.ModelNamePath).String()
+	ragDisabled := opts.DisableRAG || isRAGDisabledModel(model)
+	if ragDisabled && !appCtx.Config.RAGDisabledModelsStore {
+		appCtx.AccessLogger.Printf("Skipping processing. Reason: RAG is disabled for model %q (header %t)", model, opts.DisableRAG)
+		return data, "", nil, nil, "", ThreadRef{}, ragStatusSkipped, nil
+	}
+
 	var err error
-	cleanUserContent, attachments, err = processMessages(req)
+	var embedContent string
+	cleanUserContent, embedContent, attachments, err = processMessages(req)
 	if err != nil {
 		if appCtx.Config.VerboseDiskLogs {
 			appCtx.AccessLogger.Printf("Skipping processing. Reason: %v", err)
 		}
-		return data, "", nil, nil, ""
+		return data, "", nil, nil, "", ThreadRef{}, ragStatusSkipped, nil
 	}
 
 	if appCtx.Config.VerboseDiskLogs {
 		appCtx.AccessLogger.Printf("Clean user content: %s", cleanUserContent)
+		if embedContent != cleanUserContent {
+			appCtx.AccessLogger.Printf("Embedded user content: %s", embedContent)
+		}
 		appCtx.AccessLogger.Printf("Attachments: %v", attachments)
 		appCtx.AccessLogger.Printf("Attachments count: %d", len(attachments))
 	}
 
-	changed, promptVector, queryHash, err := feedPrompt(cleanUserContent, req)
+	// Link the turn to its conversation before the messages get rewritten
+	if appCtx.Config.ThreadsEnabled {
+		thread = threadFromRequest(opts.SessionID, req)
+		appCtx.AccessLogger.Printf("Conversation thread: %s, seq: %d", thread.ID, thread.Seq)
+	}
+
+	// RAG disabled but storing enabled: forward untouched, keep what is needed to store the turn
+	if ragDisabled {
+		appCtx.AccessLogger.Printf("RAG is disabled for model %q (header %t), request is passed through and only stored", model, opts.DisableRAG)
+		promptVector, err = embedText(ctx, embedContent)
+		if err != nil {
+			appCtx.ErrorLogger.Printf("Error embedding prompt for storing: %v", err)
+			return data, "", nil, nil, "", ThreadRef{}, ragStatusSkipped, nil
+		}
+		return data, cleanUserContent, attachments, promptVector, hashContent(cleanUserContent), thread, ragStatusSkipped, nil
+	}
+
+	changed, promptVector, queryHash, err := feedPrompt(ctx, cleanUserContent, embedContent, req, opts)
 	if err != nil {
-		appCtx.ErrorLogger.Printf("Error in feedPrompt: %v", err)
-		return data, "", nil, nil, queryHash
+		// Forward the original request untouched: a partly rewritten one is worse than none
+		switch {
+		case ctx.Err() != nil:
+			appCtx.AccessLogger.Printf("Request augmentation aborted: %v", ctx.Err())
+		case rejectsWindowOverflow(err), errors.Is(err, errTooManyRequests):
+			// answered by the handler
+		case errors.Is(err, errWindowOverflow):
+			// OnWindowOverflow proxy-unmodified: forwarding it as is is the configured behaviour
+			appCtx.AccessLogger.Printf("WARNING: %v, passing request through unmodified", err)
+			return data, "", nil, nil, queryHash, ThreadRef{}, ragStatusSkipped, nil
+		case errors.Is(err, errRetrievalUnavailable):
+			appCtx.AccessLogger.Printf("WARNING: %v, passing request through unaugmented", err)
+		default:
+			appCtx.ErrorLogger.Printf("Error in feedPrompt: %v, passing request through unaugmented", err)
+		}
+		return data, "", nil, nil, queryHash, ThreadRef{}, ragStatusError, err
 	}
 
 	if !changed {
 		if appCtx.Config.VerboseDiskLogs {
 			appCtx.AccessLogger.Printf("No changes made to the request.")
 		}
-		return data, "", nil, nil, queryHash
+		return data, "", nil, nil, queryHash, ThreadRef{}, ragStatusSkipped, nil
 	}
 
-	// Change temperature
-	req["temperature"] = appCtx.Config.Temperature
+	// Change temperature (otherwise the client's value, or its absence, is kept)
+	if appCtx.Config.OverrideTemperature {
+		req["temperature"] = appCtx.Config.Temperature
+	}
 
 	// Marhall and return modified request (currently unchanged)
 	modifiedData, err := json.Marshal(req)
 	if err != nil {
 		appCtx.ErrorLogger.Printf("Error marshaling modified req: %v", err)
-		return data, "", nil, nil, queryHash
+		return data, "", nil, nil, queryHash, ThreadRef{}, ragStatusError, fmt.Errorf("marshal augmented request: %w", err)
 	}
 
 	if appCtx.Config.VerboseDiskLogs {
@@ -423,13 +1001,7 @@ func processInbound(data string) (
 	} else {
 		appCtx.AccessLogger.Printf("Modified request object prepared. Original: %d bytes, Modified: %d bytes", len(data), len(modifiedData))
 	}
-	return string(modifiedData), cleanUserContent, attachments, promptVector, queryHash
-}
-
-// sha512sum computes the SHA-512 hash of the given text and returns it as a hexadecimal string
-func sha512sum(text string) string {
-	hash := sha512.Sum512([]byte(text))
-	return hex.EncodeToString(hash[:])
+	return string(modifiedData), cleanUserContent, attachments, promptVector, queryHash, thread, ragStatusAugmented, nil
 }
 
 func calcFileSize(att Attachment) (tokenCount int, err error) {
@@ -453,11 +1025,15 @@ func calcFileSize(att Attachment) (tokenCount int, err error) {
 	)
 
 	// Calculate token count with reserve
-	return calculateTokens(appConsts.AttachmentLeftWrapper + content + appConsts.AttachmentRightWrapper), nil
+	return calculateTokensWithReserve(appConsts.AttachmentLeftWrapper + content + appConsts.AttachmentRightWrapper), nil
 }
 
 // Attachment represents a user message attachment
-func storeAttachments(attachments []Attachment, packetID string) error {
+func storeAttachments(attachments []Attachment, packetID string, ttl time.Duration) error {
+
+	if !storesRole("rag-file") {
+		return nil
+	}
 
 	toInsert, toReplace, err := planAttachmentSync(attachments)
 	if err != nil {
@@ -465,53 +1041,108 @@ func storeAttachments(attachments []Attachment, packetID string) error {
 	}
 
 	proc := func(listAttachments []AttachmentReplacement) error {
-		replace := false
-		var pointID string
 		for _, att := range listAttachments {
 
-			replace = len(att.OldPointID) > 1
-
-			attachmentVector, err := embedText(att.Attachment.Body)
-			if err != nil {
-				return fmt.Errorf("error embedding attachment ID %s: %w", att.Attachment.ID, err)
-			}
+			replace := len(att.OldPoints) > 0
 
-			tokenCount, err := calcFileSize(att.Attachment)
-			cleanTokenCount := calculateTokens(att.Attachment.Body)
-			if err != nil {
-				return fmt.Errorf("error calculating token size for attachment ID %s: %w", att.Attachment.ID, err)
+			// All chunks are embedded before the stored version is touched
+			chunks := splitAttachment(att.Attachment)
+			vectors := make([][]float32, len(chunks))
+			for i, chunk := range chunks {
+				vectors[i], err = embedText(context.Background(), chunk.Body)
+				if err != nil {
+					return fmt.Errorf("error embedding attachment ID %s: %w", att.Attachment.ID, err)
+				}
 			}
 
 			if appCtx.Config.VerboseDiskLogs {
 				if replace {
-					// appCtx.DebugLogger.Printf("Replacing attachment ID %s token count: %d, path: %s, old point ID: %s", att.Attachment.ID, tokenCount, att.Attachment.Path, att.OldPointID)
+					// appCtx.DebugLogger.Printf("Replacing attachment ID %s chunks: %d, path: %s, old points: %d", att.Attachment.ID, len(chunks), att.Attachment.Path, len(att.OldPoints))
 				} else {
-					// appCtx.DebugLogger.Printf("Inserting attachment ID %s token count: %d, path: %s", att.Attachment.ID, tokenCount, att.Attachment.Path)
+					// appCtx.DebugLogger.Printf("Inserting attachment ID %s chunks: %d, path: %s", att.Attachment.ID, len(chunks), att.Attachment.Path)
 				}
 			}
 
-			if replace {
-				pointID = att.OldPointID
-				oldBody, err := getPointBodyByID(pointID)
+			// Old bodies are read before the upserts overwrite them
+			oldBodies := make([]string, len(att.OldPoints))
+			for i, old := range att.OldPoints {
+				oldBodies[i], err = getPointBodyByID(old.PointID)
 				if err != nil {
 					return fmt.Errorf("error fetching old attachment body for ID %s: %w", att.Attachment.ID, err)
 				}
-				// Remove old from IDF
-				if err := removeDocumentFromIDF(oldBody, att.OldCleanTokenCount, att.OldHash); err != nil {
-					return fmt.Errorf("error removing old attachment from IDF for ID %s: %w", att.Attachment.ID, err)
+			}
+
+			// Chunks take over the point IDs of the stored version, its spare points are deleted after
+			// the new chunks are stored in one batch
+			var points []*qdrant.PointStruct
+			var staleSummaries []string
+			var newDocs []Attachment
+			var newCounts []int
+			var pointID string
+			for i, chunk := range chunks {
+				chunkAtt := Attachment{ID: att.Attachment.ID, Path: att.Attachment.Path, Body: chunk.Body, Hash: att.Attachment.Hash}
+				fileMeta := &FileMeta{
+					ID:   att.Attachment.ID,
+					Path: att.Attachment.Path,
 				}
-				appCtx.AccessLogger.Printf("Replaced attachment ID %s with body size %d at point ID %s", att.Attachment.ID, len(oldBody), pointID)
-			} else {
-				pointID = uuid.NewString()
-				appCtx.AccessLogger.Printf("Inserted attachment ID %s with body size %d at new point ID %s", att.Attachment.ID, len(att.Attachment.Body), pointID)
+				if len(chunks) > 1 {
+					chunkAtt.Hash = hashContent(chunk.Body)
+					fileMeta.Hash = att.Attachment.Hash
+					fileMeta.Chunk = i
+					fileMeta.Chunks = len(chunks)
+					fileMeta.Offset = chunk.Offset
+				}
+
+				tokenCount, err := calcFileSize(chunkAtt)
+				cleanTokenCount := calculateTokens(chunkAtt.Body)
+				if err != nil {
+					return fmt.Errorf("error calculating token size for attachment ID %s: %w", att.Attachment.ID, err)
+				}
+
+				if i < len(att.OldPoints) {
+					pointID = att.OldPoints[i].PointID
+				} else {
+					pointID = uuid.NewString()
+				}
+				chunkPoints, err := buildPoints(chunkAtt.Body, vectors[i], "rag-file", tokenCount, cleanTokenCount, chunkAtt.Hash, packetID, fileMeta, nil, pointID, ttl)
+				if err != nil {
+					return fmt.Errorf("error building attachment point: %w", err)
+				}
+				// A chunk that became too short for a summary must not keep the old one
+				if len(chunkPoints) == 1 && appCtx.Config.SummaryEmbedding && i < len(att.OldPoints) {
+					staleSummaries = append(staleSummaries, summaryPointID(pointID))
+				}
+				points = append(points, chunkPoints...)
+				newDocs = append(newDocs, chunkAtt)
+				newCounts = append(newCounts, cleanTokenCount)
+			}
+
+			var spare []AttachmentPoint
+			if len(att.OldPoints) > len(chunks) {
+				spare = att.OldPoints[len(chunks):]
+			}
+			if err := upsertFilePoints(points, spare, staleSummaries); err != nil {
+				return fmt.Errorf("error storing attachment ID %s: %w", att.Attachment.ID, err)
 			}
-			// Upsert attachment
-			err = upsertPoint(att.Attachment.Body, attachmentVector, "rag-file", tokenCount, cleanTokenCount, att.Attachment.Hash, packetID, &FileMeta{
-				ID:   att.Attachment.ID,
-				Path: att.Attachment.Path,
-			}, pointID)
-			if err != nil {
-				return fmt.Errorf("error upserting attachment point: %w", err)
+
+			// IDF is updated only after the new version is in place, so a failed store leaves it untouched
+			for i, doc := range newDocs {
+				if err := addDocumentToIDF(doc.Body, newCounts[i], doc.Hash, "rag-file"); err != nil {
+					return fmt.Errorf("error adding attachment ID %s to IDF: %w", att.Attachment.ID, err)
+				}
+			}
+			if replace {
+				oldSize := 0
+				for i, old := range att.OldPoints {
+					if err := removeDocumentFromIDF(oldBodies[i], old.CleanTokenCount, old.Hash, "rag-file"); err != nil {
+						return fmt.Errorf("error removing old attachment from IDF for ID %s: %w", att.Attachment.ID, err)
+					}
+					oldSize += len(oldBodies[i])
+				}
+				recordFileEdit(att.Attachment.ID)
+				appCtx.AccessLogger.Printf("Replaced attachment ID %s with body size %d (%d points) by %d points", att.Attachment.ID, oldSize, len(att.OldPoints), len(chunks))
+			} else {
+				appCtx.AccessLogger.Printf("Inserted attachment ID %s with body size %d at %d new points", att.Attachment.ID, len(att.Attachment.Body), len(chunks))
 			}
 		}
 		return nil
@@ -542,22 +1173,75 @@ func storeAttachments(attachments []Attachment, packetID string) error {
 	return nil
 }
 
-// processOutbound processes the outbound response data (placeholder)
-func processOutbound(cleanAssistantContent string, cleanUserContent string, attachments []Attachment, promptVector []float32, queryHash string) {
+// storesRole reports whether points of role are stored (StoreRoles, empty means all roles)
+func storesRole(role string) bool {
+	return len(appCtx.Config.StoreRoles) == 0 || slices.Contains(appCtx.Config.StoreRoles, role)
+}
+
+// limitTurnBody applies MaxTurnBodyBytes to a conversation turn before it is stored. Returns the
+// body to store (cut at a rune boundary plus feedTruncatedMarker in truncate mode) and false when
+// the turn must not be stored (skip mode).
+func limitTurnBody(body string, role string) (string, bool) {
+	limit := appCtx.Config.MaxTurnBodyBytes
+	if limit <= 0 || len(body) <= limit {
+		return body, true
+	}
+	if appCtx.Config.MaxTurnBodyMode == "skip" {
+		appCtx.AccessLogger.Printf("Skipping %s turn of %d bytes (MaxTurnBodyBytes %d)", role, len(body), limit)
+		return "", false
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	appCtx.AccessLogger.Printf("Truncating %s turn from %d to %d bytes (MaxTurnBodyBytes)", role, len(body), cut)
+	return body[:cut] + feedTruncatedMarker, true
+}
+
+// processOutbound stores the exchange of job. Steps that succeed are marked in job, so a failed
+// job can be retried (dead-letter replay) without storing the same turn twice.
+// The response is already sent, so storing runs detached from the client request.
+func processOutbound(job *outboundJob) error {
+	ctx := context.Background()
+	cleanAssistantContent, cleanUserContent, attachments := job.cleanAssistantContent, job.cleanUserContent, job.attachments
+	promptVector, queryHash, thread := job.promptVector, job.queryHash, job.thread
 
 	if appCtx.Config.VerboseDiskLogs {
 		appCtx.AccessLogger.Printf("Request parsed data: Vector length: %d, Clean user content: %s, Attachments count: %d, Attachments: %v, Prompt vector: %v", len(promptVector), cleanUserContent, len(attachments), attachments, promptVector)
 	}
 
-	packetID := uuid.NewString()
+	if job.packetID == "" {
+		job.packetID = uuid.NewString()
+	}
+	completeThread(&job.thread, job.cleanAssistantContent)
+	thread = job.thread
+	packetID := job.packetID
 	if appCtx.Config.VerboseDiskLogs {
 		appCtx.AccessLogger.Printf("Generated packet ID: %s", packetID)
 	}
 
-	responseVector, err := embedText(cleanAssistantContent)
-	if err != nil {
-		appCtx.ErrorLogger.Printf("Error embedding assistant content: %v", err)
-		return
+	// Bound stored turn sizes (before embedding)
+	limitedUserContent, storeUser := limitTurnBody(cleanUserContent, "rag-user")
+	storeUser = storeUser && storesRole("rag-user") && !job.userStored
+	if storeUser && (limitedUserContent != cleanUserContent || promptVector == nil) {
+		// the prompt was not embedded (no feed budget) or is stored truncated
+		cleanUserContent = limitedUserContent
+		queryHash = hashContent(cleanUserContent)
+		var err error
+		if promptVector, err = embedText(ctx, cleanUserContent); err != nil {
+			return fmt.Errorf("error embedding user content: %w", err)
+		}
+	}
+	cleanAssistantContent, storeAssistant := limitTurnBody(cleanAssistantContent, "rag-assistant")
+	storeAssistant = storeAssistant && storesRole("rag-assistant") && !job.assistantStored
+
+	var responseVector []float32
+	var err error
+	if storeAssistant {
+		responseVector, err = embedText(ctx, cleanAssistantContent)
+		if err != nil {
+			return fmt.Errorf("error embedding assistant content: %w", err)
+		}
 	}
 
 	if appCtx.Config.VerboseDiskLogs {
@@ -566,37 +1250,40 @@ func processOutbound(cleanAssistantContent string, cleanUserContent string, atta
 		appCtx.AccessLogger.Printf("Response vector generated. Length: %d", len(responseVector))
 	}
 
-	promptSize := calculateTokens(appConsts.UserMessageLeftWrapper + cleanUserContent + appConsts.UserMessageRightWrapper)
+	promptSize := calculateTokensWithReserve(appConsts.UserMessageLeftWrapper + cleanUserContent + appConsts.UserMessageRightWrapper)
 	cleanPromptSize := calculateTokens(cleanUserContent)
-	assistantSize := calculateTokens(appConsts.AssistantMessageLeftWrapper + cleanAssistantContent + appConsts.AssistantMessageRightWrapper)
+	assistantSize := calculateTokensWithReserve(appConsts.AssistantMessageLeftWrapper + cleanAssistantContent + appConsts.AssistantMessageRightWrapper)
 	cleanAssistantSize := calculateTokens(cleanAssistantContent)
 
 	appCtx.AccessLogger.Printf("Calculated token sizes - Prompt: %d, Assistant: %d", promptSize, assistantSize)
 
-	assistantHash := sha512sum(cleanAssistantContent)
+	assistantHash := hashContent(cleanAssistantContent)
 
 	appCtx.AccessLogger.Printf("Calculated content hashes - Prompt: %s, Assistant: %s", queryHash, assistantHash)
 
 	// Store user message
-	appCtx.AccessLogger.Printf("Inserted point with packet_id: %s, role: %s", packetID, "rag-user")
-	err = upsertPoint(cleanUserContent, promptVector, "rag-user", promptSize, cleanPromptSize, queryHash, packetID, nil, uuid.NewString())
-	if err != nil {
-		appCtx.ErrorLogger.Printf("Error storing user message: %v", err)
-		return
+	if storeUser {
+		err = upsertOrTouchPoint(cleanUserContent, promptVector, "rag-user", promptSize, cleanPromptSize, queryHash, packetID, &thread, job.ttl)
+		if err != nil {
+			return fmt.Errorf("error storing user message: %w", err)
+		}
+		job.userStored = true
 	}
 
 	// Store assistant message
-	appCtx.AccessLogger.Printf("Inserted point with packet_id: %s, role: %s", packetID, "rag-assistant")
-	err = upsertPoint(cleanAssistantContent, responseVector, "rag-assistant", assistantSize, cleanAssistantSize, assistantHash, packetID, nil, uuid.NewString())
-	if err != nil {
-		appCtx.ErrorLogger.Printf("Error storing assistant message: %v", err)
-		return
+	if storeAssistant {
+		err = upsertOrTouchPoint(cleanAssistantContent, responseVector, "rag-assistant", assistantSize, cleanAssistantSize, assistantHash, packetID, &thread, job.ttl)
+		if err != nil {
+			return fmt.Errorf("error storing assistant message: %w", err)
+		}
+		job.assistantStored = true
 	}
 
-	err = storeAttachments(attachments, packetID)
+	// Already stored files are skipped by the attachment sync, so this step is safe to repeat
+	err = storeAttachments(attachments, packetID, job.ttl)
 	if err != nil {
-		appCtx.ErrorLogger.Printf("Error storing attachments: %v", err)
-		return
+		return fmt.Errorf("error storing attachments: %w", err)
 	}
 
+	return nil
 }
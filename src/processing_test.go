@@ -0,0 +1,731 @@
+// processing_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRequest builds a chat request of role/content pairs
+func testRequest(t *testing.T, pairs ...string) map[string]any {
+	t.Helper()
+	var msgs []map[string]string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		msgs = append(msgs, map[string]string{"role": pairs[i], "content": pairs[i+1]})
+	}
+	data, _ := json.Marshal(map[string]any{"model": "m", "messages": msgs})
+	req := make(map[string]any)
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestJaccardIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []uint32
+		want float64
+	}{
+		{"equal", []uint32{1, 2, 3}, []uint32{3, 2, 1}, 1},
+		{"disjoint", []uint32{1, 2}, []uint32{3, 4}, 0},
+		{"half", []uint32{1, 2, 3}, []uint32{2, 3, 4}, 0.5},
+		{"empty", nil, []uint32{1}, 0},
+	}
+	for _, tt := range tests {
+		if got := jaccardIDs(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: jaccardIDs(%v, %v) = %v, want %v", tt.name, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDedupKeyNormalizes(t *testing.T) {
+	newTestApp(t)
+	k1, n1 := dedupKey("Hello World")
+	k2, n2 := dedupKey("hello   world")
+	if k1 != k2 || n1 != n2 {
+		t.Error("texts equal after normalization have different keys")
+	}
+	if k, _ := dedupKey("hello there"); k == k1 {
+		t.Error("different texts have the same key")
+	}
+}
+
+func TestAggressiveNormalizationFoldsJapaneseWidths(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FeedDedupPrefixChars = 0
+	appCtx.Config.FeedDedupSimilarity = 0
+	full := "ﾃｽﾄ用のＡＰＩを１２３回呼びます｡" // half-width katakana and punctuation, full-width Latin and digits
+	half := "テスト用のAPIを123回呼びます。"
+
+	for _, aggressive := range []bool{false, true} {
+		appCtx.Config.AggressiveNormalization = aggressive
+		if equal := normalizeText(full) == normalizeText(half); equal != aggressive {
+			t.Errorf("AggressiveNormalization %v: normalized %q and %q, equal %v", aggressive, normalizeText(full), normalizeText(half), equal)
+		}
+		set := newFeedDedupSet(testRequest(t, "user", full))
+		if got := set.contains(half); got != aggressive {
+			t.Errorf("AggressiveNormalization %v: other width form present %v", aggressive, got)
+		}
+	}
+}
+
+func TestDedupKeyPrefixIsConfirmedByFullText(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FeedDedupPrefixChars = 10
+	appCtx.Config.FeedDedupSimilarity = 0
+	a, b := "same prefix here, first ending", "same prefix here, other ending"
+	ka, na := dedupKey(a)
+	kb, nb := dedupKey(b)
+	if ka != kb || na == nb {
+		t.Fatalf("keys %q/%q, texts %q/%q: want the same prefix key and different texts", ka, kb, na, nb)
+	}
+	if ka == hashContent(na) {
+		t.Error("the key of a text over FeedDedupPrefixChars hashes the whole text")
+	}
+
+	set := newFeedDedupSet(testRequest(t, "user", a))
+	if set.contains(b) {
+		t.Error("a text sharing only the prefix key is reported as present")
+	}
+	if !set.contains("Same  prefix here, FIRST ending") {
+		t.Error("the normalized equal text is not reported as present")
+	}
+}
+
+func TestFeedDedupSetTokenizesLazily(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FeedDedupSimilarity = 0.5
+	set := newFeedDedupSet(testRequest(t, "user", "alpha beta gamma", "assistant", "delta epsilon"))
+	if len(set.tokenSet) != 0 {
+		t.Fatalf("history tokenized before any feed was checked: %d token sets", len(set.tokenSet))
+	}
+	if !set.contains("alpha beta gamma zeta") {
+		t.Error("a paraphrase above FeedDedupSimilarity is not reported as present")
+	}
+	if len(set.tokenSet) != 2 || len(set.pending) != 0 {
+		t.Errorf("after contains: %d token sets, %d pending; want 2 and 0", len(set.tokenSet), len(set.pending))
+	}
+}
+
+func TestIsRAGDisabledModel(t *testing.T) {
+	newTestApp(t)
+	tests := []struct {
+		name            string
+		ragModels       []string
+		ragDisabled     []string
+		model           string
+		wantRAGDisabled bool
+	}{
+		{"no lists", nil, nil, "llama3", false},
+		{"disabled pattern", nil, []string{"embed-*"}, "embed-small", true},
+		{"not in disabled", nil, []string{"embed-*"}, "llama3", false},
+		{"empty model never disabled", nil, []string{"*"}, "", false},
+		{"allowlisted", []string{"qwen*"}, nil, "qwen2.5", false},
+		{"not allowlisted", []string{"qwen*"}, nil, "llama3", true},
+		{"empty model with allowlist", []string{"qwen*"}, nil, "", true},
+		{"allowlisted but disabled", []string{"qwen*"}, []string{"qwen2.5"}, "qwen2.5", true},
+	}
+	for _, tt := range tests {
+		appCtx.Config.RAGModels, appCtx.Config.RAGDisabledModels = tt.ragModels, tt.ragDisabled
+		if got := isRAGDisabledModel(tt.model); got != tt.wantRAGDisabled {
+			t.Errorf("%s: isRAGDisabledModel(%q) = %t, want %t", tt.name, tt.model, got, tt.wantRAGDisabled)
+		}
+	}
+}
+
+func TestPrepareHistoryKeepsWholeTurns(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.OnWindowOverflow = "truncate-history"
+	req := testRequest(t,
+		"system", "be brief",
+		"user", "first question with quite a few words in it",
+		"assistant", "first answer",
+		"user", "second question",
+		"assistant", "second answer",
+		"tool", "tool output",
+		"user", "prompt",
+	)
+	msgs := req["messages"].([]any)
+	size := func(i int) int {
+		b, _ := json.Marshal(msgs[i])
+		return calculateTokensWithReserve(string(b))
+	}
+	// Room for the last turn (second question, answer, tool output) and the first answer only
+	budget := size(3) + size(4) + size(5) + size(2)
+	systemMsg := msgs[0].(map[string]any)
+
+	history, err := prepareHistory(&budget, systemMsg, req)
+	if err != nil {
+		t.Fatalf("prepareHistory: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("kept %d messages, want the 3 of the last turn", len(history))
+	}
+	if oldest := history[len(history)-1]; oldest["role"] != "user" || oldest["content"] != "second question" {
+		t.Errorf("history opens with %v, want the second question", oldest)
+	}
+	if budget != size(2) {
+		t.Errorf("remaining budget = %d, want %d", budget, size(2))
+	}
+}
+
+func TestFeedPromptSkipsRetrievalWithoutFeedBudget(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FeedAugmentationPercent = 1
+	req := testRequest(t, "system", "be brief", "user", "earlier", "assistant", "reply", "user", "prompt")
+
+	appCtx.Config.MainModelWindowSize = 1_000_000
+	feed, history, _, _, err := calcSizes(req)
+	if err != nil {
+		t.Fatalf("calcSizes: %v", err)
+	}
+	appCtx.Config.MainModelWindowSize = 1_000_000 - feed - history + 50 // 1% of 50 tokens is no feed
+
+	changed, vector, _, err := feedPrompt(context.Background(), "prompt", "prompt", req, RequestOptions{})
+	if err != nil {
+		t.Fatalf("feedPrompt: %v", err)
+	}
+	if !changed || vector != nil {
+		t.Errorf("feedPrompt = changed %t, vector %v; want changed without a prompt vector", changed, vector)
+	}
+}
+
+func TestPrependUserLeavesNoSystemEntry(t *testing.T) {
+	newTestApp(t)
+	useFakeOllama(t, &fakeEmbeddings{})
+	useRerankTestConfig(appCtx.Config.DefaultWeights)
+	putTestPoint(t, appCtx.memStore, "the proxy listens on port 11435", "rag-user", time.Hour)
+	appCtx.Config.MainModelWindowSize = 1_000_000
+	appCtx.Config.SystemMessagePatchDisabled = true
+	appCtx.Config.SystemMessageMode = "prepend-user"
+	req := testRequest(t, "system", "be brief", "user", "earlier", "assistant", "reply", "user", "which port?")
+
+	changed, _, _, err := feedPrompt(context.Background(), "which port?", "which port?", req, RequestOptions{})
+	if err != nil || !changed {
+		t.Fatalf("feedPrompt = changed %t, err %v", changed, err)
+	}
+	var roles []string
+	var firstUser string
+	for _, m := range req["messages"].([]any) {
+		msg := m.(map[string]any)
+		role, _ := msg["role"].(string)
+		roles = append(roles, role)
+		if role == "user" && firstUser == "" {
+			firstUser, _ = msg["content"].(string)
+		}
+	}
+	if slices.Contains(roles, "system") {
+		t.Errorf("messages have roles %q, want no system entry", roles)
+	}
+	if !strings.HasPrefix(firstUser, "be brief\n\n") {
+		t.Errorf("first user message %q does not open with the system text", firstUser)
+	}
+}
+
+func TestPatchSystemHeaderSkipsPatching(t *testing.T) {
+	newTestApp(t)
+	useFakeOllama(t, &fakeEmbeddings{})
+	appCtx.Config.MainModelWindowSize = 1_000_000
+	appCtx.Config.SystemMessageMode = ""
+	appCtx.Config.SystemMessageFile = ""
+	appCtx.Config.SystemMessagePatch = SystemMessagePatchConfig{Replace: map[string]string{"brief": "verbose"}}
+
+	cases := []struct {
+		disabled bool
+		header   string
+		want     string
+	}{
+		{false, "", "be verbose"},
+		{false, "false", "be brief"},
+		{true, "", "be brief"},
+		{true, "true", "be verbose"},
+	}
+	for _, tc := range cases {
+		appCtx.Config.SystemMessagePatchDisabled = tc.disabled
+		h := http.Header{}
+		if tc.header != "" {
+			h.Set(patchSystemHeader, tc.header)
+		}
+		req := testRequest(t, "system", "be brief", "user", "prompt")
+		if _, _, _, err := feedPrompt(context.Background(), "prompt", "prompt", req, requestOptionsFromHeaders(h)); err != nil {
+			t.Fatalf("feedPrompt: %v", err)
+		}
+		system := req["messages"].([]any)[0].(map[string]any)
+		if system["role"] != "system" || system["content"] != tc.want {
+			t.Errorf("disabled %v, header %q: system message %v, want content %q", tc.disabled, tc.header, system, tc.want)
+		}
+	}
+}
+
+func TestRejectsWindowOverflow(t *testing.T) {
+	newTestApp(t)
+	for mode, want := range map[string]bool{"": false, "proxy-unmodified": false, "reject": true, "truncate-history": true} {
+		appCtx.Config.OnWindowOverflow = mode
+		if got := rejectsWindowOverflow(errWindowOverflow); got != want {
+			t.Errorf("%q: rejectsWindowOverflow = %t, want %t", mode, got, want)
+		}
+	}
+	appCtx.Config.OnWindowOverflow = "reject"
+	if rejectsWindowOverflow(errors.New("other")) {
+		t.Error("an unrelated error is rejected")
+	}
+}
+
+func TestFeedPromptTakesSlotOnlyForRetrieval(t *testing.T) {
+	newTestApp(t)
+	appCtx.requestSlots = make(chan struct{}, 1)
+	appCtx.requestSlots <- struct{}{} // all slots busy
+	t.Cleanup(func() { appCtx.requestSlots = nil })
+	appCtx.Config.ConcurrencyQueueTimeout.Duration = 0
+
+	appCtx.Config.MainModelWindowSize = 1_000_000
+	req := testRequest(t, "user", "prompt")
+	if _, _, _, err := feedPrompt(context.Background(), "prompt", "prompt", req, RequestOptions{}); !errors.Is(err, errTooManyRequests) {
+		t.Fatalf("feedPrompt with busy slots: err = %v, want errTooManyRequests", err)
+	}
+
+	// Without feed budget nothing is retrieved, so no slot is needed
+	appCtx.Config.FeedAugmentationPercent = 1
+	req = testRequest(t, "user", "prompt")
+	feed, history, _, _, _ := calcSizes(req)
+	appCtx.Config.MainModelWindowSize = 1_000_000 - feed - history + 50
+	if _, _, _, err := feedPrompt(context.Background(), "prompt", "prompt", req, RequestOptions{}); err != nil {
+		t.Fatalf("feedPrompt without feed budget: %v", err)
+	}
+}
+
+func TestRequestOptionsFromHeaders(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.RerankTopN = 20
+
+	h := http.Header{}
+	h.Set(topNHeader, "5")
+	h.Set(sourcesHeader, "rag-file, rag-user")
+	h.Set(disableRAGHeader, "true")
+	opts := requestOptionsFromHeaders(h)
+	if opts.TopN != 5 || !slices.Equal(opts.Sources, []string{"rag-file", "rag-user"}) || !opts.DisableRAG {
+		t.Errorf("overrides = top N %d, sources %v, disable %t; want 5, [rag-file rag-user], true", opts.TopN, opts.Sources, opts.DisableRAG)
+	}
+
+	h.Set(topNHeader, "500")
+	if opts := requestOptionsFromHeaders(h); opts.TopN != 20 {
+		t.Errorf("top N above RerankTopN = %d, want clipped to 20", opts.TopN)
+	}
+	appCtx.Config.RerankTopN, appCtx.Config.SearchTopK = -1, 50
+	if opts := requestOptionsFromHeaders(h); opts.TopN != 50 {
+		t.Errorf("top N with RerankTopN -1 = %d, want clipped to SearchTopK 50", opts.TopN)
+	}
+
+	bad := http.Header{}
+	bad.Set(topNHeader, "-3")
+	bad.Set(sourcesHeader, "rag-user,nope")
+	bad.Set(disableRAGHeader, "maybe")
+	if opts := requestOptionsFromHeaders(bad); opts.TopN != 0 || opts.Sources != nil || opts.DisableRAG {
+		t.Errorf("invalid headers = top N %d, sources %v, disable %t; want the config values", opts.TopN, opts.Sources, opts.DisableRAG)
+	}
+}
+
+func TestProcessInboundEmbeddingError(t *testing.T) {
+	newTestApp(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	appCtx.Config.OllamaBase, appCtx.Config.OllamaBackends = srv.URL, nil
+	appCtx.Config.OllamaUnloadOnLoVRAM = false
+	if err := initOllamaBackends(appCtx.Config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ollamaPool.backends = nil })
+
+	data := `{"model":"m","messages":[{"role":"user","content":"<userRequest>hello there</userRequest>"}]}`
+	body, _, _, _, _, _, status, augErr := processInbound(context.Background(), data, RequestOptions{})
+	if status != ragStatusError || augErr == nil {
+		t.Errorf("status %q, err %v; want %q with the embedding error", status, augErr, ragStatusError)
+	}
+	if body != data {
+		t.Errorf("body was changed on error: %s", body)
+	}
+}
+
+func TestProcessInboundOverflowPassthroughIsNotError(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.OnWindowOverflow = "proxy-unmodified"
+	appCtx.Config.MainModelWindowSize = 1
+
+	data := `{"model":"m","messages":[{"role":"user","content":"<userRequest>a prompt that cannot fit</userRequest>"}]}`
+	body, _, _, _, _, _, status, augErr := processInbound(context.Background(), data, RequestOptions{})
+	if status != ragStatusSkipped || augErr != nil || body != data {
+		t.Errorf("status %q, err %v, changed %t; want %q, no error, unchanged", status, augErr, body != data, ragStatusSkipped)
+	}
+}
+
+func TestThreadFromRequestFallback(t *testing.T) {
+	newTestApp(t)
+	msg := func(role, content string) any { return map[string]any{"role": role, "content": content} }
+	request := func(messages ...any) map[string]any { return map[string]any{"messages": messages} }
+
+	first := threadFromRequest("", request(msg("system", "be brief"), msg("user", "hello")))
+	if first.ID != "" || first.Opening == "" || first.Seq != 1 {
+		t.Fatalf("first turn %+v, want a pending thread of seq 1", first)
+	}
+	completeThread(&first, "Hi!  How can I help?")
+
+	second := threadFromRequest("", request(msg("system", "be brief"), msg("user", "hello"),
+		msg("assistant", "Hi! How can I help?"), msg("user", "more")))
+	if second.ID != first.ID || second.Seq != 2 {
+		t.Errorf("second turn %+v, want thread %s seq 2", second, first.ID)
+	}
+
+	other := threadFromRequest("", request(msg("system", "be brief"), msg("user", "hello"),
+		msg("assistant", "Hello there."), msg("user", "more")))
+	if other.ID == first.ID {
+		t.Error("conversations with the same opening prompt but another answer share a thread")
+	}
+
+	session := threadFromRequest("abc", request(msg("user", "hello")))
+	if session.ID != hashContent("session:abc") || session.Opening != "" {
+		t.Errorf("session thread %+v, want the session id", session)
+	}
+}
+
+func TestOversizedTurnStoredTruncatedAndReembedded(t *testing.T) {
+	newTestApp(t)
+	config := appCtx.Config
+	config.MaxTurnBodyBytes = 0
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("MaxTurnBodyBytes 0 (unset) rejected: %v", err)
+	}
+	if body, ok := limitTurnBody(strings.Repeat("x", 100), "rag-user"); !ok || len(body) != 100 {
+		t.Errorf("MaxTurnBodyBytes 0 cut the turn to %d bytes", len(body))
+	}
+
+	embeddings := &fakeEmbeddings{}
+	useFakeOllama(t, embeddings)
+	appCtx.Config.MaxTurnBodyBytes = 40
+	appCtx.Config.MaxTurnBodyMode = "truncate"
+
+	prompt := strings.Repeat("long prompt ", 20)
+	job := outboundJob{
+		cleanUserContent:      prompt,
+		cleanAssistantContent: "short answer",
+		promptVector:          testVector(prompt),
+		queryHash:             hashContent(prompt),
+	}
+	if err := processOutbound(&job); err != nil {
+		t.Fatal(err)
+	}
+
+	points := storedPoints(t, "rag-user")
+	if len(points) != 1 {
+		t.Fatalf("%d user points stored, want 1", len(points))
+	}
+	body := payloadBody(points[0].GetPayload())
+	want := prompt[:40] + feedTruncatedMarker
+	if body != want {
+		t.Errorf("stored body %q, want %q", body, want)
+	}
+	if !slices.Contains(embeddings.embedded(), want) {
+		t.Errorf("embedded texts %q do not include the truncated turn", embeddings.embedded())
+	}
+	if got := points[0].GetVectors().GetVector().GetData(); !slices.Equal(got, testVector(want)) {
+		t.Error("stored vector is not the embedding of the truncated turn")
+	}
+	if got := points[0].GetPayload()["hash"].GetStringValue(); got != hashContent(want) {
+		t.Errorf("stored hash %q, want the hash of the truncated turn", got)
+	}
+}
+
+func TestStoreRolesLimitsStoredPoints(t *testing.T) {
+	cases := []struct {
+		roles []string
+		want  map[string]int // points per role
+	}{
+		{nil, map[string]int{"rag-user": 1, "rag-assistant": 1, "rag-file": 1}},
+		{[]string{"rag-user"}, map[string]int{"rag-user": 1}},
+		{[]string{"rag-assistant", "rag-file"}, map[string]int{"rag-assistant": 1, "rag-file": 1}},
+	}
+	for _, tc := range cases {
+		t.Run("store "+strings.Join(tc.roles, ","), func(t *testing.T) {
+			newTestApp(t)
+			embeddings := &fakeEmbeddings{}
+			useFakeOllama(t, embeddings)
+			appCtx.Config.SummaryEmbedding = false
+			// Searching assistant turns stays possible without storing them
+			appCtx.Config.SearchSource = []string{"rag-user", "rag-assistant", "rag-file"}
+			appCtx.Config.StoreRoles = tc.roles
+			if err := validateConfig(appCtx.Config); err != nil {
+				t.Fatal(err)
+			}
+
+			file := "package main // the whole file"
+			job := outboundJob{
+				cleanUserContent:      "what does main do?",
+				cleanAssistantContent: "It starts the proxy.",
+				attachments:           []Attachment{{ID: "f1", Path: "main.go", Body: file, Hash: hashContent(file)}},
+			}
+			if err := processOutbound(&job); err != nil {
+				t.Fatal(err)
+			}
+			for _, role := range []string{"rag-user", "rag-assistant", "rag-file"} {
+				if n := len(storedPoints(t, role)); n != tc.want[role] {
+					t.Errorf("%d %s points stored, want %d", n, role, tc.want[role])
+				}
+			}
+			if tc.want["rag-assistant"] == 0 && slices.Contains(embeddings.embedded(), job.cleanAssistantContent) {
+				t.Error("assistant turn embedded although it is not stored")
+			}
+		})
+	}
+}
+
+func TestRAGExcludedModelProxiedUnchanged(t *testing.T) {
+	cases := []struct {
+		name             string
+		allow, block     []string
+		model            string
+		wantAugmentation bool
+	}{
+		{"not allowed", []string{"llama*"}, nil, "nomic-embed-text", false},
+		{"blocked", nil, []string{"nomic-*"}, "nomic-embed-text", false},
+		{"allowed", []string{"llama*"}, nil, "llama3", true},
+		{"not blocked", nil, []string{"nomic-*"}, "llama3", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestApp(t)
+			embeddings := &fakeEmbeddings{}
+			useFakeOllama(t, embeddings)
+			useRerankTestConfig(appCtx.Config.DefaultWeights)
+			putTestPoint(t, appCtx.memStore, "the proxy listens on port 11435", "rag-file", time.Hour)
+			appCtx.Config.RAGModels, appCtx.Config.RAGDisabledModels = tc.allow, tc.block
+			appCtx.Config.RAGStatusHeader = true
+
+			body := `{"model":"` + tc.model + `","messages":[{"role":"user","content":"<userRequest>which port?</userRequest>"}]}`
+			upstream := &countingUpstream{}
+			rec := httptest.NewRecorder()
+			proxyHandler(upstream)(rec, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body)))
+
+			forwarded := string(upstream.lastBody())
+			if augmented := forwarded != body; augmented != tc.wantAugmentation {
+				t.Errorf("forwarded %s, augmented %t, want %t", forwarded, augmented, tc.wantAugmentation)
+			}
+			if !tc.wantAugmentation {
+				if got := rec.Header().Get(ragStatusHeader); got != ragStatusSkipped {
+					t.Errorf("%s = %q, want %q", ragStatusHeader, got, ragStatusSkipped)
+				}
+				if got := embeddings.embedded(); len(got) != 0 {
+					t.Errorf("excluded model request embedded %q", got)
+				}
+			}
+		})
+	}
+}
+
+// feedBodies returns the body of relevant behind each message, in request order; messages that are
+// not a feed are returned as they are
+func feedBodies(messages []map[string]any, relevant []Payload) []string {
+	bodies := make([]string, len(messages))
+	for i, msg := range messages {
+		bodies[i], _ = msg["content"].(string)
+		for _, p := range relevant {
+			// file feeds wrap the body in a file tag
+			if bodies[i] == p.Body || strings.Contains(bodies[i], "\n"+p.Body+"\n") {
+				bodies[i] = p.Body
+			}
+		}
+	}
+	return bodies
+}
+
+func TestPrepareFeedsSkipsTooBigForSmallerOnes(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FileFeedPercent = 0
+	appCtx.Config.FeedTruncateFiles = false
+	appCtx.Config.FeedOrder = "relevance-desc"
+	relevant := []Payload{
+		{Body: "big", Role: "rag-user", TokenCount: 1000},
+		{Body: "small one", Role: "rag-assistant", TokenCount: 100},
+		{Body: "small two", Role: "rag-user", TokenCount: 100},
+	}
+	req := testRequest(t, "user", "prompt")
+
+	historySize, feedSize := 0, 250
+	feeds := prepareFeeds(&historySize, &feedSize, relevant, req, newFeedDedupSet(req))
+	if got, want := feedBodies(feeds, relevant), []string{"small one", "small two"}; !slices.Equal(got, want) {
+		t.Errorf("feeds = %q, want %q", got, want)
+	}
+	if historySize != 50 {
+		t.Errorf("history size = %d, want the 50 tokens left over", historySize)
+	}
+}
+
+func TestFeedOrderStrategies(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FileFeedPercent = 0
+	appCtx.Config.SystemMessageMode = ""
+	// Best first; Timestamp gives the recency order B, C, A, D
+	relevant := []Payload{
+		{Body: "A", Role: "rag-file", TokenCount: 1, Timestamp: 3, FileMeta: FileMeta{ID: "a", Path: "a.go"}},
+		{Body: "B", Role: "rag-user", TokenCount: 1, Timestamp: 1},
+		{Body: "C", Role: "rag-file", TokenCount: 1, Timestamp: 2, FileMeta: FileMeta{ID: "c", Path: "c.go"}},
+		{Body: "D", Role: "rag-assistant", TokenCount: 1, Timestamp: 4},
+	}
+
+	cases := []struct {
+		order string
+		want  string
+	}{
+		{"", "DCBA"},
+		{"relevance-asc", "DCBA"},
+		{"relevance-desc", "ABCD"},
+		{"recency", "BCAD"},
+		{"files-last", "DBCA"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.order, func(t *testing.T) {
+			appCtx.Config.FeedOrder = tc.order
+			req := testRequest(t, "system", "be brief", "user", "prompt")
+			msgs := req["messages"].([]any)
+			systemMsg, promptMsg := msgs[0].(map[string]any), msgs[1].(map[string]any)
+			historySize, feedSize := 0, 100
+			feeds := prepareFeeds(&historySize, &feedSize, relevant, req, newFeedDedupSet(req))
+			updateReq(systemMsg, promptMsg, nil, feeds, req)
+
+			var messages []map[string]any
+			for _, m := range req["messages"].([]any) {
+				messages = append(messages, m.(map[string]any))
+			}
+			got := feedBodies(messages, relevant)
+			if want := append([]string{"be brief"}, append(strings.Split(tc.want, ""), "prompt")...); !slices.Equal(got, want) {
+				t.Errorf("messages = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFileFeedPercentKeepsConversationShare(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.FeedTruncateFiles = false
+	appCtx.Config.FeedOrder = "relevance-desc"
+	huge := Payload{Body: "huge file", Role: "rag-file", TokenCount: 350, FileMeta: FileMeta{ID: "f", Path: "f.go"}}
+	turns := []Payload{
+		{Body: "turn one", Role: "rag-user", TokenCount: 100},
+		{Body: "turn two", Role: "rag-assistant", TokenCount: 100},
+	}
+	fed := func(relevant []Payload) []string {
+		req := testRequest(t, "user", "prompt")
+		historySize, feedSize := 0, 400
+		return feedBodies(prepareFeeds(&historySize, &feedSize, relevant, req, newFeedDedupSet(req)), relevant)
+	}
+	withFile := append([]Payload{huge}, turns...)
+
+	appCtx.Config.FileFeedPercent = 0
+	if got, want := fed(withFile), []string{"huge file"}; !slices.Equal(got, want) {
+		t.Errorf("shared budget: feeds = %q, want %q", got, want)
+	}
+	appCtx.Config.FileFeedPercent = 50
+	if got, want := fed(withFile), []string{"turn one", "turn two"}; !slices.Equal(got, want) {
+		t.Errorf("50/50 split: feeds = %q, want %q", got, want)
+	}
+	// The unused conversation share spills over to files
+	if got, want := fed([]Payload{huge}), []string{"huge file"}; !slices.Equal(got, want) {
+		t.Errorf("50/50 split without turns: feeds = %q, want %q", got, want)
+	}
+}
+
+func TestEmbedFullUserMessageKeepsCleanBody(t *testing.T) {
+	newTestApp(t)
+	embeddings := &fakeEmbeddings{}
+	useFakeOllama(t, embeddings)
+	appCtx.Config.EmbedFullUserMessage = true
+	appCtx.Config.FilePatternsReg = nil
+
+	content := "I am on branch dev after the rebase.\n<userRequest>why does the build fail?</userRequest>\n" +
+		"<attachment>\n// filepath: main.go\npackage main\n</attachment>"
+	data, _ := json.Marshal(map[string]any{
+		"model":    "m",
+		"messages": []map[string]string{{"role": "user", "content": content}},
+	})
+	_, clean, attachments, promptVector, queryHash, _, status, augErr := processInbound(context.Background(), string(data), RequestOptions{})
+	if augErr != nil || status == ragStatusError {
+		t.Fatalf("status %q, err %v", status, augErr)
+	}
+
+	wantEmbedded := "I am on branch dev after the rebase.\n<userRequest>why does the build fail?</userRequest>"
+	if clean != "why does the build fail?" {
+		t.Errorf("clean prompt %q, want the tag-extracted text", clean)
+	}
+	if got := embeddings.embedded(); len(got) != 1 || got[0] != wantEmbedded {
+		t.Fatalf("embedded %q, want the whole message without the attachment block", got)
+	}
+	if len(attachments) != 1 {
+		t.Errorf("%d attachments, want the attached file", len(attachments))
+	}
+
+	job := outboundJob{
+		cleanUserContent:      clean,
+		cleanAssistantContent: "a missing import",
+		promptVector:          promptVector,
+		queryHash:             queryHash,
+	}
+	if err := processOutbound(&job); err != nil {
+		t.Fatal(err)
+	}
+	points := storedPoints(t, "rag-user")
+	if len(points) != 1 {
+		t.Fatalf("%d user points stored, want 1", len(points))
+	}
+	body := payloadBody(points[0].GetPayload())
+	if body != clean || body == embeddings.embedded()[0] {
+		t.Errorf("stored body %q, want the clean prompt, not the embedded text", body)
+	}
+	if got := points[0].GetVectors().GetVector().GetData(); !slices.Equal(got, testVector(wantEmbedded)) {
+		t.Error("stored vector is not the embedding of the whole message")
+	}
+}
+
+func TestOverrideTemperature(t *testing.T) {
+	cases := []struct {
+		name     string
+		override bool
+		client   string // temperature field of the request, if any
+		want     any
+	}{
+		{"client value kept", false, `,"temperature":0.9`, 0.9},
+		{"absence kept", false, "", nil},
+		{"client value replaced", true, `,"temperature":0.9`, 0.15},
+		{"set when absent", true, "", 0.15},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestApp(t)
+			useFakeOllama(t, &fakeEmbeddings{})
+			useRerankTestConfig(appCtx.Config.DefaultWeights)
+			putTestPoint(t, appCtx.memStore, "the proxy listens on port 11435", "rag-file", time.Hour)
+			appCtx.Config.OverrideTemperature = tc.override
+			appCtx.Config.Temperature = 0.15
+
+			data := `{"model":"m","messages":[{"role":"user","content":"<userRequest>which port?</userRequest>"}]` + tc.client + `}`
+			body, _, _, _, _, _, status, augErr := processInbound(context.Background(), data, RequestOptions{})
+			if status != ragStatusAugmented || augErr != nil {
+				t.Fatalf("status %q, err %v; want %q", status, augErr, ragStatusAugmented)
+			}
+			var req map[string]any
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := req["temperature"]; got != tc.want || (tc.want == nil && ok) {
+				t.Errorf("temperature = %v (present %t), want %v", got, ok, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// proxy.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+)
+
+// newOllamaProxy creates the reverse proxy to Ollama, remapping inbound paths by PathRewrite.
+// ollamaTransport sends each request to the backend it picks, under the base path of that backend.
+func newOllamaProxy() *httputil.ReverseProxy {
+	proxy := &httputil.ReverseProxy{Transport: ollamaTransport}
+	proxy.Director = func(r *http.Request) {
+		if len(appCtx.Config.PathRewrite) > 0 {
+			if rewritten, ok := rewritePath(r.URL.Path); ok {
+				if appCtx.Config.VerboseDiskLogs {
+					appCtx.AccessLogger.Printf("Path rewritten: %s -> %s", r.URL.Path, rewritten)
+				}
+				r.URL.Path = rewritten
+				r.URL.RawPath = ""
+			}
+		}
+		// The transport then asks for gzip itself and hands the ResponseCollector the decompressed body
+		r.Header.Del("Accept-Encoding")
+		if _, ok := r.Header["User-Agent"]; !ok {
+			r.Header.Set("User-Agent", "") // no default User-Agent of Go
+		}
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := gunzipResponse(resp); err != nil {
+			return err
+		}
+		if appCtx.Config.ResponseHeaderSanitize {
+			return sanitizeResponseHeaders(resp)
+		}
+		return nil
+	}
+
+	return proxy
+}
+
+// isGzipEncoded reports whether the headers declare a gzip Content-Encoding
+func isGzipEncoded(h http.Header) bool {
+	enc := strings.TrimSpace(h.Get("Content-Encoding"))
+	return strings.EqualFold(enc, "gzip") || strings.EqualFold(enc, "x-gzip")
+}
+
+// maxGunzipBytes bounds a decompressed request body when MaxRequestBytes is unlimited (-1 or 0), so a
+// small gzip body cannot expand without bound
+const maxGunzipBytes = 64 << 20
+
+// gunzipBody decompresses a gzip request body. A decompressed body bigger than maxBytes (maxGunzipBytes
+// when not positive) is an *http.MaxBytesError, like an oversized plain body.
+func gunzipBody(body []byte, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 {
+		maxBytes = maxGunzipBytes
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > maxBytes {
+		return nil, &http.MaxBytesError{Limit: maxBytes}
+	}
+	return out, nil
+}
+
+// gzipReadCloser reads the decompressed body and closes the original one
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// gunzipResponse decompresses a gzip response the transport did not (the upstream compressed it
+// unasked), so the ResponseCollector parses plain JSON/SSE
+func gunzipResponse(resp *http.Response) error {
+	if !isGzipEncoded(resp.Header) {
+		return nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = gzipReadCloser{Reader: zr, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// rewrittenHeader marks responses whose body passes through the ResponseCollector
+const rewrittenHeader = "X-Ragproxy-Rewritten"
+
+// sanitizeResponseHeaders drops the upstream headers that describe the original body of a response
+// the ResponseCollector may rewrite (successful JSON, NDJSON or SSE), and marks streams as not
+// cacheable or bufferable. Content-Length is set by the collector itself; the framing
+// (Transfer-Encoding) is hop-by-hop and chosen by net/http for the client connection.
+func sanitizeResponseHeaders(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	streaming := mediaType == "application/x-ndjson" || mediaType == "text/event-stream"
+	if !streaming && mediaType != "application/json" {
+		return nil
+	}
+
+	for _, h := range []string{"ETag", "Last-Modified", "Content-MD5", "Digest", "Accept-Ranges"} {
+		resp.Header.Del(h)
+	}
+	if streaming {
+		resp.Header.Set("Cache-Control", "no-cache")
+		resp.Header.Set("X-Accel-Buffering", "no") // nginx and similar must pass chunks on at once
+	} else {
+		resp.Header.Set("Cache-Control", "no-store")
+	}
+	resp.Header.Set(rewrittenHeader, "1")
+	return nil
+}
+
+// rewritePath replaces the longest PathRewrite prefix matching p (on a path segment boundary)
+func rewritePath(p string) (string, bool) {
+	prefixes := make([]string, 0, len(appCtx.Config.PathRewrite))
+	for from := range appCtx.Config.PathRewrite {
+		prefixes = append(prefixes, from)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	for _, from := range prefixes {
+		rest, ok := strings.CutPrefix(p, from)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasSuffix(from, "/")) {
+			continue
+		}
+		return appCtx.Config.PathRewrite[from] + rest, true
+	}
+	return p, false
+}
@@ -0,0 +1,146 @@
+// proxy_test.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGunzipBodyRoundTrip(t *testing.T) {
+	body := []byte(`{"model":"m","messages":[{"role":"user","content":"hello"}]}`)
+	for _, limit := range []int64{-1, int64(len(body))} {
+		got, err := gunzipBody(gzipBytes(t, body), limit)
+		if err != nil {
+			t.Fatalf("gunzipBody(limit %d): %v", limit, err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("gunzipBody(limit %d) = %q, want %q", limit, got, body)
+		}
+	}
+}
+
+func TestGunzipBodyLimits(t *testing.T) {
+	var tooLarge *http.MaxBytesError
+	body := bytes.Repeat([]byte("a"), 100)
+	if _, err := gunzipBody(gzipBytes(t, body), 99); !errors.As(err, &tooLarge) || tooLarge.Limit != 99 {
+		t.Errorf("gunzipBody over the limit: err = %v, want MaxBytesError{99}", err)
+	}
+
+	// Unlimited MaxRequestBytes still stops at maxGunzipBytes
+	bomb := gzipBytes(t, make([]byte, maxGunzipBytes+1))
+	if _, err := gunzipBody(bomb, -1); !errors.As(err, &tooLarge) || tooLarge.Limit != maxGunzipBytes {
+		t.Errorf("gunzipBody without limit: err = %v, want MaxBytesError{%d}", err, maxGunzipBytes)
+	}
+
+	if _, err := gunzipBody([]byte("not gzip"), -1); err == nil || errors.As(err, &tooLarge) {
+		t.Errorf("gunzipBody of plain bytes: err = %v, want a decode error", err)
+	}
+}
+
+func TestPathRewriteReachesUpstream(t *testing.T) {
+	newTestApp(t)
+	upstream := &pathRecorder{}
+	srv := httptest.NewServer(upstream)
+	defer srv.Close()
+	appCtx.Config.PathRewrite = map[string]string{"/chat": "/api/chat", "/v1": "/api"}
+	useOllamaBackends(t, srv.URL)
+
+	proxy := newOllamaProxy()
+	for _, path := range []string{"/chat", "/v1/tags", "/chatter", "/api/show"} {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: proxied status %d", path, rec.Code)
+		}
+	}
+	// Prefixes match whole path segments only
+	want := []string{"POST /api/chat", "POST /api/tags", "POST /chatter", "POST /api/show"}
+	if got := upstream.requested(); !slices.Equal(got, want) {
+		t.Errorf("upstream got %q, want %q", got, want)
+	}
+
+	for _, rules := range []map[string]string{{"chat": "/api/chat"}, {"/chat": "/api/chat?x=1"}} {
+		config := appCtx.Config
+		config.PathRewrite = rules
+		if err := validateConfig(config); err == nil {
+			t.Errorf("PathRewrite %q accepted", rules)
+		}
+	}
+}
+
+func TestRewrittenStreamHeadersAreConsistent(t *testing.T) {
+	newWriterTestApp(t, false)
+	appCtx.Config.ResponseHeaderSanitize = true
+
+	// The upstream response as the reverse proxy receives it
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":  {"application/x-ndjson"},
+			"Etag":          {`"v1"`},
+			"Last-Modified": {"Thu, 01 Jan 2026 00:00:00 GMT"},
+			"Cache-Control": {"max-age=60"},
+		},
+		ContentLength: -1,
+		Body:          io.NopCloser(strings.NewReader("")),
+	}
+	if err := newOllamaProxy().ModifyResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...then copies the headers and the stream, chunk by chunk, into the collector
+	rec := httptest.NewRecorder()
+	maps.Copy(rec.Header(), resp.Header)
+	c := NewResponseCollector(rec)
+	c.WriteHeader(resp.StatusCode)
+	// The default ResponseReplacer rewrites "меня зовут" into "зовут меня eeeeee"
+	c.Write([]byte(`{"model":"m","created_at":"2026-01-01T00:00:01Z","response":"Привет, меня зовут Бот.","done":false}` + "\n"))
+	c.Write([]byte(`{"model":"m","created_at":"2026-01-01T00:00:02Z","response":"","done":true}` + "\n"))
+	content, _, err := c.CloseAndProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StopOutgoingLoop()
+	if !strings.Contains(content, "зовут меня eeeeee") || strings.Contains(rec.Body.String(), "меня зовут") {
+		t.Fatalf("stream not rewritten: %s", rec.Body)
+	}
+
+	h := rec.Header()
+	for _, stale := range []string{"ETag", "Last-Modified", "Content-Length"} {
+		if v := h.Get(stale); v != "" {
+			t.Errorf("rewritten stream keeps %s: %q", stale, v)
+		}
+	}
+	want := map[string]string{
+		"Content-Type":      "application/x-ndjson",
+		"Cache-Control":     "no-cache",
+		"X-Accel-Buffering": "no",
+		rewrittenHeader:     "1",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// reembed.go
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// reembedCollection copies every document point of collection from into QdrantCollection, embedding
+// its body with the configured EmbeddingModel under the same point ID. Summary points are rebuilt by
+// upsertPoint, the rest of the payload (timestamp, feedback, expiry, ...) is copied as stored. The IDF
+// store is left as is: it already counts the copied documents. Returns the number of copied points.
+func reembedCollection(from string) (int, error) {
+	if from == appCtx.Config.QdrantCollection {
+		return 0, fmt.Errorf("source collection is the target collection '%s'", from)
+	}
+	ctx := context.Background()
+	limit := uint32(64)
+	var offset *qdrant.PointId
+	copied := 0
+	for {
+		var page []*qdrant.RetrievedPoint
+		var next *qdrant.PointId
+		err := withDB(func() error {
+			var err error
+			page, next, err = appCtx.DB.ScrollAndOffset(ctx, &qdrant.ScrollPoints{
+				CollectionName: from,
+				Filter:         &qdrant.Filter{Must: []*qdrant.Condition{notSummary()}},
+				Limit:          &limit,
+				Offset:         offset,
+				WithPayload:    qdrant.NewWithPayload(true),
+				WithVectors:    qdrant.NewWithVectors(false),
+			})
+			return err
+		})
+		if err != nil {
+			return copied, fmt.Errorf("scroll collection '%s': %w", from, err)
+		}
+
+		for _, point := range page {
+			if err := reembedPoint(ctx, point); err != nil {
+				return copied, fmt.Errorf("re-embed point %s: %w", pointIDString(point.GetId()), err)
+			}
+			copied++
+		}
+		appCtx.JournaldLogger.Printf("Re-embedded %d points from '%s' into '%s'", copied, from, appCtx.Config.QdrantCollection)
+
+		if next == nil || len(page) == 0 {
+			return copied, nil
+		}
+		offset = next
+	}
+}
+
+// reembedPoint stores one document point of the source collection in QdrantCollection with a new vector
+func reembedPoint(ctx context.Context, point *qdrant.RetrievedPoint) error {
+	p := payloadFromQdrant(point.GetPayload())
+	pointID := pointIDString(point.GetId())
+
+	vector, err := embedText(ctx, p.Body)
+	if err != nil {
+		return fmt.Errorf("embedding: %w", err)
+	}
+	var thread *ThreadRef
+	if p.ThreadID != "" {
+		thread = &ThreadRef{ID: p.ThreadID, Seq: p.Seq}
+	}
+	if err := upsertPoint(p.Body, vector, p.Role, p.TokenCount, p.CleanTokenCount, p.Hash, p.PacketID, &p.FileMeta, thread, pointID, 0); err != nil {
+		return err
+	}
+	// upsertPoint counted the body in IDF once more
+	if err := removeDocumentFromIDF(p.Body, p.CleanTokenCount, p.Hash, p.Role); err != nil {
+		return fmt.Errorf("IDF: %w", err)
+	}
+
+	// Restore the stored payload; the body stays as upsertPoint encoded it
+	payload := make(map[string]*qdrant.Value, len(point.GetPayload()))
+	for k, v := range point.GetPayload() {
+		if k != "body" && k != "body_encoding" {
+			payload[k] = v
+		}
+	}
+	ids := []*qdrant.PointId{qdrant.NewID(pointID)}
+	if appCtx.Config.SummaryEmbedding && p.CleanTokenCount >= appCtx.Config.SummaryMinTokens {
+		ids = append(ids, qdrant.NewID(summaryPointID(pointID)))
+	}
+	wait := true
+	return withDB(func() error {
+		_, err := appCtx.DB.SetPayload(ctx, &qdrant.SetPayloadPoints{
+			CollectionName: appCtx.Config.QdrantCollection,
+			Wait:           &wait,
+			Payload:        payload,
+			PointsSelector: qdrant.NewPointsSelector(ids...),
+		})
+		return err
+	})
+}
@@ -0,0 +1,70 @@
+// reembed_test.go
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReembedCollectionMovesPointsToNewVectorSize(t *testing.T) {
+	newTestApp(t)
+	appCtx.Config.SummaryEmbedding = false
+	appCtx.Config.QdrantVectorSize = 128
+	stores := useCollectionStores(t, "old")
+	old := stores.stores["old"]
+	bodies := []string{"first stored turn", "second stored answer"}
+	putTestPoint(t, old, bodies[0], "rag-user", 24*time.Hour)
+	putTestPoint(t, old, bodies[1], "rag-assistant", time.Hour)
+	before := make(map[string]*memPoint, len(old.points))
+	for id, p := range old.points {
+		before[id] = p
+	}
+
+	// The new stub model embeds into 256 dimensions
+	appCtx.Config.QdrantVectorSize = 256
+	appCtx.Config.EmbeddingModel = "stub-256"
+	appCtx.memStore.size = 256
+	embeddings := &fakeEmbeddings{}
+	useFakeOllama(t, embeddings)
+
+	copied, err := reembedCollection("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 2 || len(appCtx.memStore.points) != 2 {
+		t.Fatalf("copied %d, target holds %d points; want 2", copied, len(appCtx.memStore.points))
+	}
+	if got := embeddings.embedded(); len(got) != 2 {
+		t.Errorf("embedded %q, want each body once", got)
+	}
+	for id, src := range before {
+		dst, ok := appCtx.memStore.points[id]
+		if !ok {
+			t.Errorf("point %s missing from the new collection", id)
+			continue
+		}
+		body := payloadBody(dst.payload)
+		if !slices.Contains(bodies, body) {
+			t.Errorf("point %s body = %q", id, body)
+		}
+		if !slices.Equal(dst.vector, testVector(body)) {
+			t.Errorf("point %s has a %d-dim vector, not the new embedding", id, len(dst.vector))
+		}
+		for _, key := range []string{"role", "timestamp", "packet_id", "hash", "token_count"} {
+			if got, want := dst.payload[key].String(), src.payload[key].String(); got != want {
+				t.Errorf("point %s %s = %s, want %s as stored", id, key, got, want)
+			}
+		}
+		if len(src.vector) != 128 {
+			t.Errorf("source point %s changed to a %d-dim vector", id, len(src.vector))
+		}
+	}
+	if n := stores.written("old"); n != 0 {
+		t.Errorf("source collection written %d times", n)
+	}
+
+	if _, err := reembedCollection(appCtx.Config.QdrantCollection); err == nil {
+		t.Error("re-embedding a collection into itself accepted")
+	}
+}
@@ -0,0 +1,150 @@
+// reload.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// hotReloadFields are the Config fields a reload applies to the running process.
+// Changes to any other field are reported as deferred until restart.
+var hotReloadFields = map[string]bool{
+	"DefaultWeights":        true,
+	"MinRankScore":          true,
+	"SearchTopK":            true,
+	"SearchHardLimit":       true,
+	"RerankTopN":            true,
+	"ResponseReplacer":      true,
+	"ResponseReplacerClose": true,
+	"SystemMessagePatch":    true,
+}
+
+// ConfigChange describes one changed Config field between two configurations
+type ConfigChange struct {
+	Field   string `json:"field"`
+	Old     any    `json:"old"`
+	New     any    `json:"new"`
+	Applied bool   `json:"applied"` // false: takes effect after restart
+}
+
+// configReloadReport is the outcome of the last config reload
+type configReloadReport struct {
+	At      time.Time      `json:"at"`
+	Changes []ConfigChange `json:"changes"`
+}
+
+// diffConfig lists the fields that differ between old and new, with secrets redacted.
+// Derived fields (json:"-") are skipped.
+func diffConfig(old, new Config) []ConfigChange {
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	orv, nrv := reflect.ValueOf(redactConfig(old)), reflect.ValueOf(redactConfig(new))
+	t := ov.Type()
+
+	var changes []ConfigChange
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("json") == "-" {
+			continue
+		}
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		// A changed secret shows as redacted on both sides
+		changes = append(changes, ConfigChange{
+			Field:   field.Name,
+			Old:     orv.Field(i).Interface(),
+			New:     nrv.Field(i).Interface(),
+			Applied: hotReloadFields[field.Name],
+		})
+	}
+	return changes
+}
+
+// recordConfigReload logs the differences between old and new config and keeps them for
+// /ragproxy/config/last-reload. Does nothing unless ConfigReloadDiff is set.
+func recordConfigReload(old, new Config) []ConfigChange {
+	if !new.ConfigReloadDiff {
+		return nil
+	}
+	changes := diffConfig(old, new)
+	if len(changes) == 0 {
+		appCtx.JournaldLogger.Printf("Config reload: no changes")
+	}
+	for _, c := range changes {
+		state := "applied"
+		if !c.Applied {
+			state = "deferred until restart"
+		}
+		appCtx.JournaldLogger.Printf("Config reload: %s changed from %v to %v (%s)", c.Field, c.Old, c.New, state)
+	}
+
+	appCtx.configMu.Lock()
+	appCtx.lastReload = &configReloadReport{At: time.Now(), Changes: changes}
+	appCtx.configMu.Unlock()
+	return changes
+}
+
+// setHotReloadFields copies the hotReloadFields of src into dst
+func setHotReloadFields(dst *Config, src Config) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src)
+	for name := range hotReloadFields {
+		dv.FieldByName(name).Set(sv.FieldByName(name))
+	}
+}
+
+// reloadConfig re-reads the config file and applies its hotReloadFields to the running process;
+// Listen, Qdrant, tokenizer and every other field keep their values until restart. The running
+// config with the new values is validated and the response replace rules are rebuilt before the
+// config mutex is taken, which then only guards the swap. A config that fails changes nothing.
+func reloadConfig() error {
+	configData, err := os.ReadFile(appCtx.configPath)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	var next Config
+	if err := toml.Unmarshal(configData, &next); err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	merged := configSnapshot()
+	setHotReloadFields(&merged, next)
+	if err := validateConfig(merged); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	rules, maxTriggerLen, err := buildResponseReplaceRules(merged)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	appCtx.configMu.Lock()
+	old := appCtx.Config
+	setHotReloadFields(&appCtx.Config, next)
+	appCtx.responseReplaceRules, appCtx.responseReplaceMaxTriggerLen = rules, maxTriggerLen
+	appCtx.configMu.Unlock()
+
+	recordConfigReload(old, next)
+	appCtx.JournaldLogger.Printf("Config reloaded from %s", appCtx.configPath)
+	return nil
+}
+
+// handleLastReload returns the changes of the last config reload
+func handleLastReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	appCtx.configMu.RLock()
+	report := appCtx.lastReload
+	appCtx.configMu.RUnlock()
+	if report == nil {
+		http.Error(w, "no reload since start", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
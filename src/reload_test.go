@@ -0,0 +1,138 @@
+// reload_test.go
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes deploy/config.toml with the replacements old -> new applied to a temp file
+func writeTestConfig(t *testing.T, replacements ...string) string {
+	t.Helper()
+	data, err := os.ReadFile("../deploy/config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for i := 0; i+1 < len(replacements); i += 2 {
+		if !strings.Contains(text, replacements[i]) {
+			t.Fatalf("config has no %q", replacements[i])
+		}
+		text = strings.Replace(text, replacements[i], replacements[i+1], 1)
+	}
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSetHotReloadFields(t *testing.T) {
+	dst := Config{Listen: ":1", MinRankScore: 0.1, DefaultWeights: []float64{1}}
+	src := Config{Listen: ":2", MinRankScore: 0.2, DefaultWeights: []float64{2}, RerankTopN: 7}
+	setHotReloadFields(&dst, src)
+	if dst.Listen != ":1" {
+		t.Errorf("Listen = %q, not hot-reloadable and must stay", dst.Listen)
+	}
+	if dst.MinRankScore != 0.2 || dst.RerankTopN != 7 || dst.DefaultWeights[0] != 2 {
+		t.Errorf("hot fields not copied: %+v %d %v", dst.MinRankScore, dst.RerankTopN, dst.DefaultWeights)
+	}
+}
+
+func TestReloadConfigOnSIGHUP(t *testing.T) {
+	newTestApp(t)
+	appCtx.configPath = writeTestConfig(t,
+		"    0.35, # EmbSim", "    0.5, # EmbSim",
+		"MinRankScore = 0.45", "MinRankScore = 0.3",
+		`Listen = "0.0.0.0:11434"`, `Listen = ":9999"`)
+	listen := appCtx.Config.Listen
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	stopped := make(chan struct{})
+	go func() {
+		waitForShutdown(sigs)
+		close(stopped)
+	}()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for currentWeights()[0] != 0.5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("weights not reloaded: %v", currentWeights())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cfg := configSnapshot()
+	if cfg.MinRankScore != 0.3 {
+		t.Errorf("MinRankScore = %v, want 0.3", cfg.MinRankScore)
+	}
+	if cfg.Listen != listen {
+		t.Errorf("Listen = %q, want %q kept until restart", cfg.Listen, listen)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("SIGHUP stopped the server loop")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sigs <- os.Interrupt
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("interrupt did not stop the server loop")
+	}
+}
+
+func TestReloadConfigInvalidKeepsRunningConfig(t *testing.T) {
+	newTestApp(t)
+	appCtx.configPath = writeTestConfig(t,
+		"    0.35, # EmbSim", "    0.5, # EmbSim",
+		"MinRankScore = 0.45", "MinRankScore = 5.0")
+	rules, _ := currentReplaceRules()
+
+	if err := reloadConfig(); err == nil {
+		t.Fatal("reloadConfig accepted MinRankScore = 5.0")
+	}
+	if got := configSnapshot().MinRankScore; got != 0.45 {
+		t.Errorf("MinRankScore = %v, want 0.45 kept", got)
+	}
+	if got := currentWeights()[0]; got != 0.35 {
+		t.Errorf("first weight = %v, want 0.35 kept", got)
+	}
+	if after, _ := currentReplaceRules(); len(after) != len(rules) {
+		t.Errorf("replace rules changed by a failed reload: %d -> %d", len(rules), len(after))
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	old := Config{Listen: ":1", MinRankScore: 0.1, AdminAPIKey: "old-key"}
+	next := Config{Listen: ":2", MinRankScore: 0.2, AdminAPIKey: "new-key"}
+	changes := diffConfig(old, next)
+
+	byField := make(map[string]ConfigChange, len(changes))
+	for _, c := range changes {
+		byField[c.Field] = c
+	}
+	if len(changes) != 3 {
+		t.Fatalf("got changes %v, want Listen, MinRankScore and AdminAPIKey", changes)
+	}
+	if c := byField["Listen"]; c.Applied || c.Old != ":1" || c.New != ":2" {
+		t.Errorf("Listen change %+v, want :1 -> :2 deferred until restart", c)
+	}
+	if c := byField["MinRankScore"]; !c.Applied {
+		t.Errorf("MinRankScore change %+v, want applied", c)
+	}
+	if c := byField["AdminAPIKey"]; c.Old != redactedValue || c.New != redactedValue {
+		t.Errorf("AdminAPIKey change %+v leaks the secret", c)
+	}
+}
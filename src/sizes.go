@@ -2,9 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
+// errWindowOverflow is returned by calcSizes when the prompt alone does not fit MainModelWindowSize
+var errWindowOverflow = errors.New("not enough window size after accounting for meta, system, and user prompt sizes")
+
+// rejectsWindowOverflow reports whether err is a window overflow to answer with 413 rather than
+// forward: the prompt does not fit with reject, and neither does it with truncate-history, as
+// dropping history and feeds cannot make it fit
+func rejectsWindowOverflow(err error) bool {
+	mode := appCtx.Config.OnWindowOverflow
+	return errors.Is(err, errWindowOverflow) && (mode == "reject" || mode == "truncate-history")
+}
+
 // calcMetaSize calculates metadata token size and remaining window size
 func calcMetaSize(req map[string]any) (metaSize int, err error) {
 	meta := make(map[string]any)
@@ -18,7 +30,7 @@ func calcMetaSize(req map[string]any) (metaSize int, err error) {
 		return 0, err
 	}
 	metaStr := string(metaBytes)
-	metaSize = calculateTokens(metaStr)
+	metaSize = calculateTokensWithReserve(metaStr)
 
 	return metaSize, nil
 }
@@ -43,7 +55,7 @@ func calcSystemMsgSize(req map[string]any) (systemMsgSize int, systemMsg map[str
 		systemMsgStr += ","
 	}
 
-	systemMsgSize = calculateTokens(systemMsgStr)
+	systemMsgSize = calculateTokensWithReserve(systemMsgStr)
 	return systemMsgSize, systemMsg, true, nil
 }
 
@@ -61,7 +73,7 @@ func calcUserPromptSize(req map[string]any) (userPromptSize int, userPromptMsg m
 		return 0, nil, err
 	}
 
-	userPromptSize = calculateTokens(string(msgBytes))
+	userPromptSize = calculateTokensWithReserve(string(msgBytes))
 	return userPromptSize, userPromptMsg, nil
 }
 
@@ -91,7 +103,7 @@ func calcSizes(req map[string]any) (feedSize int, historySize int, systemMsg map
 	windowSize -= appConsts.MessagesWrapperSize
 	if windowSize < 0 {
 		windowSize = 0
-		return 0, 0, systemMsg, userPromptMsg, fmt.Errorf("not enough window size after accounting for meta, system, and user prompt sizes")
+		return 0, 0, systemMsg, userPromptMsg, errWindowOverflow
 	}
 
 	feedPercent := appCtx.Config.FeedAugmentationPercent
@@ -9,6 +9,7 @@ package main
 import "C"
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"regexp"
@@ -18,69 +19,190 @@ import (
 	"github.com/gammazero/deque"
 	lru "github.com/hashicorp/golang-lru"
 
-	// "github.com/pkoukk/tiktoken-go"
-	"github.com/daulet/tokenizers"
 	"github.com/qdrant/go-client/qdrant"
 )
 
 // Config struct for TOML configuration
 type Config struct {
 	Listen                             string                       `toml:"Listen"`
+	RequireRagproxyUser                *bool                        `toml:"RequireRagproxyUser"` // nil: true
+	RagproxyUser                       string                       `toml:"RagproxyUser"`
 	IDFFile                            string                       `toml:"IDFFile"`
 	AutoSaveIDFInterval                Duration                     `toml:"AutoSaveIDFInterval"`
+	IDFCheckInterval                   Duration                     `toml:"IDFCheckInterval"`
+	IDFDriftThreshold                  float64                      `toml:"IDFDriftThreshold"`
+	IDFDriftCorrect                    bool                         `toml:"IDFDriftCorrect"`
+	TokenReservePercent                int                          `toml:"TokenReservePercent"`
+	TokenizerBackend                   string                       `toml:"TokenizerBackend"`
+	TokenizerTiktokenEncoding          string                       `toml:"TokenizerTiktokenEncoding"`
 	TokenizerPretrainedCacheDir        string                       `toml:"TokenizerPretrainedCacheDir"`
 	TokenizerHFModelName               string                       `toml:"TokenizerHFModelName"`
-	TokenizerHFAPI                     string                       `toml:"TokenizerHFAPI"`
+	TokenizerHFAPI                     string                       `toml:"TokenizerHFAPI" redact:"true"`
+	RequestMaxDuration                 Duration                     `toml:"RequestMaxDuration"`
+	MaxConcurrentRequests              int                          `toml:"MaxConcurrentRequests"`
+	ConcurrencyQueueTimeout            Duration                     `toml:"ConcurrencyQueueTimeout"`
+	PanicPassthrough                   bool                         `toml:"PanicPassthrough"`
+	ExposeAugmentationErrors           bool                         `toml:"ExposeAugmentationErrors"`
+	RAGStatusHeader                    bool                         `toml:"RAGStatusHeader"`
+	RequestContentPaths                []string                     `toml:"RequestContentPaths"`
 	UserMessageTags                    []string                     `toml:"UserMessageTags"`
+	EmbedFullUserMessage               bool                         `toml:"EmbedFullUserMessage"`
 	UserMessageAskAttachmentTags       []string                     `toml:"UserMessageAskAttachmentTags"`
 	UserMessageAgentAttachmentTags     []string                     `toml:"UserMessageAgentAttachmentTags"`
+	AttachmentScanDepth                int                          `toml:"AttachmentScanDepth"`
+	OverrideTemperature                bool                         `toml:"OverrideTemperature"`
 	Temperature                        float64                      `toml:"Temperature"`
 	OllamaBase                         string                       `toml:"OllamaBase"`
+	OllamaBackends                     []string                     `toml:"OllamaBackends"`
+	OllamaBalancing                    string                       `toml:"OllamaBalancing"`
+	OllamaBackendCooldown              Duration                     `toml:"OllamaBackendCooldown"`
+	PathRewrite                        map[string]string            `toml:"PathRewrite"`
+	PathConflictsAllowed               bool                         `toml:"PathConflictsAllowed"`
 	OllamaKeepAlive                    string                       `toml:"OllamaKeepAlive"`
 	OllamaUnloadOnLoVRAM               bool                         `toml:"OllamaUnloadOnLoVRAM"`
 	EmbeddingModel                     string                       `toml:"EmbeddingModel"`
 	EmbeddingsEndpoint                 string                       `toml:"EmbeddingsEndpoint"`
+	EmbeddingKeepAlive                 string                       `toml:"EmbeddingKeepAlive"`
+	EmbeddingsAPIVersion               string                       `toml:"EmbeddingsAPIVersion"`
 	EmbeddingsModeWindowSize           int64                        `toml:"EmbeddingsModeWindowSize"`
+	EmbeddingMaxTokens                 int                          `toml:"EmbeddingMaxTokens"`
+	EmbeddingSingleFlight              bool                         `toml:"EmbeddingSingleFlight"`
+	NormalizeEmbeddings                bool                         `toml:"NormalizeEmbeddings"`
+	ModelNamePath                      string                       `toml:"ModelNamePath"`
+	RAGModels                          []string                     `toml:"RAGModels"`
+	RAGDisabledModels                  []string                     `toml:"RAGDisabledModels"`
+	RAGDisabledModelsStore             bool                         `toml:"RAGDisabledModelsStore"`
 	MainModel                          string                       `toml:"MainModel"`
 	MainModelWindowSize                int                          `toml:"MainModelWindowSize"`
+	StorageBackend                     string                       `toml:"StorageBackend"`
+	MemoryStoreFile                    string                       `toml:"MemoryStoreFile"`
 	QdrantHost                         string                       `toml:"QdrantHost"`
 	QdrantPort                         int                          `toml:"QdrantPort"`
+	QdrantAPIKey                       string                       `toml:"QdrantAPIKey" redact:"true"`
+	QdrantUseTLS                       bool                         `toml:"QdrantUseTLS"`
 	QdrantKeepAlive                    int                          `toml:"QdrantKeepAlive"`
+	QdrantBreakerThreshold             int                          `toml:"QdrantBreakerThreshold"`
+	QdrantBreakerCooldown              Duration                     `toml:"QdrantBreakerCooldown"`
 	QdrantCollection                   string                       `toml:"QdrantCollection"`
+	KnowledgeBaseCollection            string                       `toml:"KnowledgeBaseCollection"`
+	SearchCollections                  map[string]float64           `toml:"SearchCollections"`
 	QdrantMetric                       string                       `toml:"QdrantMetric"`
 	QdrantVectorSize                   int                          `toml:"QdrantVectorSize"`
+	StoreBodyCompressed                bool                         `toml:"StoreBodyCompressed"`
+	DedupCosineThreshold               float32                      `toml:"DedupCosineThreshold"`
 	MaxFileSize                        int                          `toml:"MaxFileSize"`
+	MaxTurnBodyBytes                   int                          `toml:"MaxTurnBodyBytes"`
+	MaxRequestBytes                    int64                        `toml:"MaxRequestBytes"`
+	MaxTurnBodyMode                    string                       `toml:"MaxTurnBodyMode"`
+	MaxAttachmentIDsPerRequest         int                          `toml:"MaxAttachmentIDsPerRequest"`
+	MaxAttachmentsPerRequest           int                          `toml:"MaxAttachmentsPerRequest"`
+	AttachmentScrollPageSize           int                          `toml:"AttachmentScrollPageSize"`
+	AttachmentChunkTokens              int                          `toml:"AttachmentChunkTokens"`
+	AttachmentChunkOverlap             int                          `toml:"AttachmentChunkOverlap"`
+	StoreRoles                         []string                     `toml:"StoreRoles"`
+	SummaryEmbedding                   bool                         `toml:"SummaryEmbedding"`
+	SummaryMinTokens                   int                          `toml:"SummaryMinTokens"`
+	SummaryHeadTokens                  int                          `toml:"SummaryHeadTokens"`
+	SummaryTailTokens                  int                          `toml:"SummaryTailTokens"`
+	AsyncStore                         bool                         `toml:"AsyncStore"`
+	AsyncStoreWorkers                  int                          `toml:"AsyncStoreWorkers"`
+	AsyncStoreQueueSize                int                          `toml:"AsyncStoreQueueSize"`
+	DeadLetterDir                      string                       `toml:"DeadLetterDir"`
+	TTLHeader                          string                       `toml:"TTLHeader"`
+	TTLByRole                          map[string]Duration          `toml:"TTLByRole"`
+	TTLSweepInterval                   Duration                     `toml:"TTLSweepInterval"`
 	FilePatterns                       []string                     `toml:"FilePatterns"`
-	FilePatternsReg                    []*regexp.Regexp             `toml:"-"`
+	FilePatternsReg                    []*regexp.Regexp             `toml:"-" json:"-"`
+	AttachmentPathPatterns             []string                     `toml:"AttachmentPathPatterns"`
+	AttachmentPathPatternsReg          []*regexp.Regexp             `toml:"-" json:"-"`
+	AttachmentPathAttrPatterns         []string                     `toml:"AttachmentPathAttrPatterns"`
+	AttachmentPathAttrPatternsReg      []*regexp.Regexp             `toml:"-" json:"-"`
+	AttachmentStripPatterns            []string                     `toml:"AttachmentStripPatterns"`
+	AttachmentStripPatternsReg         []*regexp.Regexp             `toml:"-" json:"-"`
+	ThreadsEnabled                     bool                         `toml:"ThreadsEnabled"`
+	ThreadHeader                       string                       `toml:"ThreadHeader"`
+	ThreadNeighborWindow               int                          `toml:"ThreadNeighborWindow"`
 	SearchSource                       []string                     `toml:"SearchSource"`
+	MustIncludeEnabled                 bool                         `toml:"MustIncludeEnabled"`
+	MustIncludeHeader                  string                       `toml:"MustIncludeHeader"`
+	MustIncludeExtractReg              string                       `toml:"MustIncludeExtractReg"`
+	MustIncludeMaxTerms                int                          `toml:"MustIncludeMaxTerms"`
 	SearchMaxAgeDays                   int64                        `toml:"SearchMaxAgeDays"`
+	SearchMinAgeHours                  int64                        `toml:"SearchMinAgeHours"`
+	LangDetectEnabled                  bool                         `toml:"LangDetectEnabled"`
+	LangMode                           string                       `toml:"LangMode"`
+	LangBoost                          float64                      `toml:"LangBoost"`
+	EditRecencyBoost                   float64                      `toml:"EditRecencyBoost"`
+	EditRecencyWindow                  Duration                     `toml:"EditRecencyWindow"`
+	StopWords                          map[string][]string          `toml:"StopWords"`
 	SearchTopK                         int64                        `toml:"SearchTopK"`
+	SearchHardLimit                    int64                        `toml:"SearchHardLimit"`
 	CosineMinScore                     float32                      `toml:"CosineMinScore"`
 	EuclidMaxDistance                  float32                      `toml:"EuclidMaxDistance"`
 	RerankTopN                         int                          `toml:"RerankTopN"`
+	FeedDedupCosine                    float64                      `toml:"FeedDedupCosine"`
+	FeedDedupSimilarity                float64                      `toml:"FeedDedupSimilarity"`
+	FeedDedupPrefixChars               int                          `toml:"FeedDedupPrefixChars"`
 	MinRankScore                       float64                      `toml:"MinRankScore"`
+	MinRankScoreMode                   string                       `toml:"MinRankScoreMode"`
+	RankScoreNormalization             string                       `toml:"RankScoreNormalization"`
+	RankSigmoidMidpoint                float64                      `toml:"RankSigmoidMidpoint"`
+	RankSigmoidSlope                   float64                      `toml:"RankSigmoidSlope"`
 	MaxQueryTokens                     int                          `toml:"MaxQueryTokens"`
+	QueryTokenStrategy                 string                       `toml:"QueryTokenStrategy"`
 	TokensCacheTTL                     Duration                     `toml:"TokensCacheTTL"`
 	TokensCacheSize                    int                          `toml:"TokensCacheSize"`
+	HashAlgo                           string                       `toml:"HashAlgo"`
 	TauDays                            float64                      `toml:"TauDays"`
+	TauDaysByRole                      map[string]float64           `toml:"TauDaysByRole"`
 	MaxTokensNormalization             int                          `toml:"MaxTokensNormalization"`
 	MinTokensNormalization             int                          `toml:"MinTokensNormalization"`
 	DefaultWeights                     []float64                    `toml:"DefaultWeights"`
+	CrossEncoderModel                  string                       `toml:"CrossEncoderModel"`
+	CrossEncoderEndpoint               string                       `toml:"CrossEncoderEndpoint"`
+	CrossEncoderTopM                   int                          `toml:"CrossEncoderTopM"`
+	CrossEncoderWorkers                int                          `toml:"CrossEncoderWorkers"`
+	FeedbackScale                      float64                      `toml:"FeedbackScale"`
 	ReturnVectors                      bool                         `toml:"ReturnVectors"`
+	FetchRerankVectors                 bool                         `toml:"FetchRerankVectors"`
 	BM25K1                             float64                      `toml:"BM25K1"`
 	BM25B                              float64                      `toml:"BM25B"`
+	BM25NormMode                       string                       `toml:"BM25NormMode"`
 	BM25NormMidpoint                   float64                      `toml:"BM25NormMidpoint"`
 	BM25NormSlope                      float64                      `toml:"BM25NormSlope"`
 	BM25UseLogNorm                     bool                         `toml:"BM25UseLogNorm"`
 	BM25LogNormScale                   float64                      `toml:"BM25LogNormScale"`
 	UseBM25IDF                         bool                         `toml:"UseBM25IDF"`
+	PerRoleIDF                         bool                         `toml:"PerRoleIDF"`
 	RoleWeights                        map[string]float64           `toml:"RoleWeights"`
 	FeedAugmentationPercent            int                          `toml:"FeedAugmentationPercent"`
+	OnWindowOverflow                   string                       `toml:"OnWindowOverflow"`
+	FileFeedPercent                    int                          `toml:"FileFeedPercent"`
+	FeedOrder                          string                       `toml:"FeedOrder"`
+	FeedTruncateFiles                  bool                         `toml:"FeedTruncateFiles"`
+	FeedTruncateMinTokens              int                          `toml:"FeedTruncateMinTokens"`
+	AggressiveNormalization            bool                         `toml:"AggressiveNormalization"`
 	VerboseDiskLogs                    bool                         `toml:"VerboseDiskLogs"`
 	DumpPackets                        bool                         `toml:"DumpPackets"`
+	DebugRerankTable                   bool                         `toml:"DebugRerankTable"`
+	LogFormat                          string                       `toml:"LogFormat"`
+	AccessLogPath                      string                       `toml:"AccessLogPath"`
+	ErrorLogPath                       string                       `toml:"ErrorLogPath"`
+	DebugLogPath                       string                       `toml:"DebugLogPath"`
+	DumpLogPath                        string                       `toml:"DumpLogPath"`
+	LogMaxSizeMB                       int                          `toml:"LogMaxSizeMB"`
+	LogMaxBackups                      int                          `toml:"LogMaxBackups"`
+	AsyncLogging                       bool                         `toml:"AsyncLogging"`
+	AsyncLogFlushInterval              Duration                     `toml:"AsyncLogFlushInterval"`
+	AsyncLogBufferSize                 int                          `toml:"AsyncLogBufferSize"`
 	InitialIncomingBufferPreAllocation int                          `toml:"InitialIncomingBufferPreAllocation"`
 	InitialOutgoingGorutineBufferCount int                          `toml:"InitialOutgoingGorutineBufferCount"`
+	SmallResponseFastPath              bool                         `toml:"SmallResponseFastPath"`
+	SmallResponseMaxBytes              int                          `toml:"SmallResponseMaxBytes"`
+	DedupIdenticalChunks               bool                         `toml:"DedupIdenticalChunks"`
+	SynthesizedChunkSpacing            Duration                     `toml:"SynthesizedChunkSpacing"`
 	MessageBodyPaths                   []string                     `toml:"MessageBodyPaths"`
+	ToolCallPaths                      []string                     `toml:"ToolCallPaths"`
 	SSEPrefixReg                       string                       `toml:"SSEPrefixReg"`
 	StreamingPacketFlagReg             string                       `toml:"StreamingPacketFlagReg"`
 	StreamingPacketStopReg             string                       `toml:"StreamingPacketStopReg"`
@@ -88,7 +210,18 @@ type Config struct {
 	MaxTriggerLengthMultiplier         int                          `toml:"MaxTriggerLengthMultiplier"`
 	MaxTriggerLengthAdditional         int                          `toml:"MaxTriggerLengthAdditional"`
 	ResponseReplacer                   map[string]map[string]string `toml:"ResponseReplacer"`
+	ResponseReplacerClose              map[string]string            `toml:"ResponseReplacerClose"`
+	ResponseHeaderSanitize             bool                         `toml:"ResponseHeaderSanitize"`
+	CORSEnabled                        bool                         `toml:"CORSEnabled"`
+	CORSAllowedOrigins                 []string                     `toml:"CORSAllowedOrigins"`
+	CORSAllowedHeaders                 []string                     `toml:"CORSAllowedHeaders"`
+	CORSAllowCredentials               bool                         `toml:"CORSAllowCredentials"`
+	ConfigEndpointEnabled              bool                         `toml:"ConfigEndpointEnabled"`
+	ConfigReloadDiff                   bool                         `toml:"ConfigReloadDiff"`
+	AdminAPIKey                        string                       `toml:"AdminAPIKey" redact:"true"`
 	SystemMessageFile                  string                       `toml:"SystemMessageFile"`
+	SystemMessageMode                  string                       `toml:"SystemMessageMode"`
+	SystemMessagePatchDisabled         bool                         `toml:"SystemMessagePatchDisabled"`
 	SystemMessagePatch                 SystemMessagePatchConfig     `toml:"SystemMessagePatch"`
 }
 
@@ -96,6 +229,7 @@ type ResponsePacket struct {
 	PacketType  int
 	IsSSE       bool
 	Prefix      string
+	SSEFields   string // non-data SSE lines of the frame (event:, id:, retry:, comments), verbatim with newlines
 	MessagePath string
 	RawData     string
 }
@@ -110,6 +244,10 @@ type ResponseCollector struct {
 	complete          bool
 	collecting        bool
 	wasMessages       bool
+	toolCalls         bool // tool-call response: passed through verbatim, not stored
+	queued            bool // packets went out through the queue, later ones have to follow them
+
+	trailingPackets []ResponsePacket // other packets after the finish packet (data: [DONE]), sent last
 
 	templateStreamPacket ResponsePacket
 	templateFinishPacket ResponsePacket
@@ -119,6 +257,17 @@ type ResponseCollector struct {
 	stopCh     chan struct{}
 	doneCh     chan struct{}
 
+	// Small-response fast path
+	fastPath     bool
+	fastExpected int
+	fastBuf      []byte
+
+	// Held-back header for fixed-length responses
+	statusCode     int
+	upstreamLength int
+	headerOnce     sync.Once
+
+	loopOnce sync.Once
 	stopOnce sync.Once
 }
 
@@ -134,6 +283,7 @@ type ResponseMsgReplaceRule struct {
 
 type ResponseReplaceRecord struct {
 	Trigger string
+	Close   string // closing marker ending the collected region early (empty: collect to the end)
 	Rules   []ResponseMsgReplaceRule
 }
 
@@ -160,18 +310,52 @@ func (d *Duration) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// MarshalText formats a Duration back into its string form
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// VectorStore is the part of the Qdrant client API ragproxy uses. It is implemented by
+// *qdrant.Client and by memStore (StorageBackend = "in-memory").
+type VectorStore interface {
+	CollectionExists(ctx context.Context, collectionName string) (bool, error)
+	GetCollectionInfo(ctx context.Context, collectionName string) (*qdrant.CollectionInfo, error)
+	CreateCollection(ctx context.Context, request *qdrant.CreateCollection) error
+	UpdateCollection(ctx context.Context, request *qdrant.UpdateCollection) error
+	CreateFieldIndex(ctx context.Context, request *qdrant.CreateFieldIndexCollection) (*qdrant.UpdateResult, error)
+	Upsert(ctx context.Context, request *qdrant.UpsertPoints) (*qdrant.UpdateResult, error)
+	Delete(ctx context.Context, request *qdrant.DeletePoints) (*qdrant.UpdateResult, error)
+	Get(ctx context.Context, request *qdrant.GetPoints) ([]*qdrant.RetrievedPoint, error)
+	Scroll(ctx context.Context, request *qdrant.ScrollPoints) ([]*qdrant.RetrievedPoint, error)
+	ScrollAndOffset(ctx context.Context, request *qdrant.ScrollPoints) ([]*qdrant.RetrievedPoint, *qdrant.PointId, error)
+	Query(ctx context.Context, request *qdrant.QueryPoints) ([]*qdrant.ScoredPoint, error)
+	SetPayload(ctx context.Context, request *qdrant.SetPayloadPoints) (*qdrant.UpdateResult, error)
+	Close() error
+}
+
 // AppContext holds global application state
 type AppContext struct {
 	Config                       Config
-	DB                           *qdrant.Client
-	Tokenizer                    *tokenizers.Tokenizer // *tiktoken.Tiktoken
+	configMu                     sync.RWMutex
+	lastReload                   *configReloadReport // guarded by configMu
+	configPath                   string              // config file re-read on SIGHUP
+	DB                           VectorStore
+	memStore                     *memStore        // StorageBackend = "in-memory" only
+	storeQueue                   chan outboundJob // AsyncStore jobs, nil when storing synchronously; guarded by storeMu
+	storeMu                      sync.RWMutex
+	storeWG                      sync.WaitGroup
+	requestSlots                 chan struct{}  // MaxConcurrentRequests semaphore, nil when unlimited
+	inboundWG                    sync.WaitGroup // augmentations, which may run on past RequestMaxDuration
+	Tokenizer                    Tokenizer
 	JournaldLogger               *log.Logger
 	AccessLogger                 *log.Logger
 	ErrorLogger                  *log.Logger
 	DebugLogger                  *log.Logger
 	DumpLogger                   *log.Logger
 	TokenCache                   *TokenCacheWrapper
+	tokenCacheStopChan           chan struct{} // stops the TokensCacheTTL sweep, nil when not running
 	IDFStore                     IDFStore
+	RoleIDFStores                map[string]*IDFStore // PerRoleIDF stores by role, empty when off
 	idfMu                        sync.RWMutex
 	IDFChanged                   bool
 	idfAutoSaveStopChan          chan struct{}
@@ -179,6 +363,9 @@ type AppContext struct {
 	responseReplaceRules         []ResponseReplaceRecord
 	responseReplaceMaxTriggerLen int
 	ssePrefixReg                 *regexp.Regexp
+	mustIncludeExtractReg        *regexp.Regexp
+	stopWordSets                 map[string]map[string]struct{} // per language, for detection
+	stopWordIDs                  map[string]map[uint32]struct{} // per language, for query features
 	streamingPacketFlagReg       *regexp.Regexp
 	streamingPacketStopReg       *regexp.Regexp
 	directPacketFlagReg          *regexp.Regexp
@@ -192,12 +379,17 @@ type IDFStore struct {
 	NgramDF     map[uint64]int
 	NgramIDF    map[uint64]float64
 	TotalTokens int64
+	Tokenizer   string `json:",omitempty"` // tokenizerIdentity of the token ids, set when saved
 }
 
-// Qdrant FileMeta structure
+// Qdrant FileMeta structure. Chunks > 1 marks one chunk of a file split by AttachmentChunkTokens.
 type FileMeta struct {
-	ID   string `json:"ID"`
-	Path string `json:"Path"`
+	ID     string `json:"ID"`
+	Path   string `json:"Path"`
+	Hash   string `json:"Hash"`   // hash of the whole file (chunks only)
+	Chunk  int    `json:"Chunk"`  // chunk index
+	Chunks int    `json:"Chunks"` // number of chunks of the file
+	Offset int    `json:"Offset"` // byte offset of the chunk in the file
 }
 
 type TokenCacheWrapper struct {
@@ -222,6 +414,30 @@ type Payload struct {
 	CleanTokenCount int      `json:"CleanTokenCount"`
 	Hash            string   `json:"Hash"`
 	FileMeta        FileMeta `json:"FileMeta"`
+	ThreadID        string   `json:"ThreadID"`
+	Seq             int      `json:"Seq"`
+	Feedback        float64  `json:"Feedback"`
+	Lang            string   `json:"Lang"`
+	SummaryOf       string   `json:"SummaryOf"` // document point id, set on summary points only
+	ExpiresAt       float64  `json:"ExpiresAt"` // UnixNano, 0 when the point does not expire
+}
+
+// RequestOptions holds per-request options supplied by the client in headers
+type RequestOptions struct {
+	SessionID   string        // conversation session id (ThreadHeader)
+	MustInclude []string      // terms every retrieved document must contain (MustIncludeHeader)
+	PatchSystem bool          // apply SystemMessagePatch (SystemMessagePatchDisabled, patchSystemHeader)
+	TTL         time.Duration // lifetime of the stored exchange (TTLHeader), 0 for the TTLByRole defaults
+	TopN        int           // RerankTopN of this request (topNHeader), 0 for the config value
+	Sources     []string      // SearchSource of this request (sourcesHeader), nil for the config value
+	DisableRAG  bool          // pass the request through without augmentation (disableRAGHeader)
+}
+
+// ThreadRef links a stored conversation turn to its thread and position in it
+type ThreadRef struct {
+	ID      string
+	Seq     int
+	Opening string // no session: the opening of a first turn, ID follows from it and the answer
 }
 
 // Features structure for candidate scoring
@@ -237,14 +453,19 @@ type Features struct {
 	BM25            float64 // [0,1]
 	NgramOverlap    float64 // [0,1]
 	WeightedNgram   float64 // [0,1]
+	CrossEncoder    float64 // [0,1] (optional, top-M only)
+	FeedbackScore   float64 // [0,1] (from stored feedback signals)
+	LocalCosine     float64 // [0,1] (cosine of the stored and query vectors, when vectors are loaded)
 }
 
 // First Step Candidate structure
 type Candidate struct {
+	PointID         string
 	Payload         Payload
 	EmbeddingVector []float64
 	Features        Features
 	Score           float64
+	Collection      string // source collection when not QdrantCollection (KnowledgeBaseCollection, SearchCollections)
 }
 
 // Attachment represents a file attachment
@@ -256,9 +477,14 @@ type Attachment struct {
 }
 
 type AttachmentReplacement struct {
-	Attachment         Attachment
-	OldPointID         string
-	OldHash            string
-	OldTokenCount      int
-	OldCleanTokenCount int
+	Attachment Attachment
+	OldPoints  []AttachmentPoint // stored points (chunks) of the file, none for an insert
+}
+
+// AttachmentPoint is one stored point of a file
+type AttachmentPoint struct {
+	PointID         string
+	Hash            string
+	TokenCount      int
+	CleanTokenCount int
 }
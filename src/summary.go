@@ -0,0 +1,86 @@
+// summary.go
+package main
+
+import (
+	"context"
+	"maps"
+
+	"github.com/google/uuid"
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// summaryNamespace derives summary point ids from their document point ids
+var summaryNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("ragproxy:summary"))
+
+// summaryPointID returns the id of the summary point of the document point pointID. It is stable,
+// so re-storing a document (file replacement) overwrites its old summary.
+func summaryPointID(pointID string) string {
+	return uuid.NewSHA1(summaryNamespace, []byte(pointID)).String()
+}
+
+// extractiveSummary returns the first SummaryHeadTokens and last SummaryTailTokens tokens of body,
+// or body itself when it is not longer than both together
+func extractiveSummary(body string) string {
+	ids, _ := appCtx.Tokenizer.Encode(body, false)
+	head, tail := appCtx.Config.SummaryHeadTokens, appCtx.Config.SummaryTailTokens
+	if len(ids) <= head+tail {
+		return body
+	}
+	summary := appCtx.Tokenizer.Decode(ids[:head], true)
+	if tail > 0 {
+		summary += "\n...\n" + appCtx.Tokenizer.Decode(ids[len(ids)-tail:], true)
+	}
+	return summary
+}
+
+// summaryPoint builds the summary point of a document stored at pointID: the same payload plus
+// summary_of, with the embedding of the extractive summary as vector. Returns nil when
+// SummaryEmbedding is off or the document is shorter than SummaryMinTokens.
+func summaryPoint(pointID string, body string, cleanTokenCount int, payload map[string]*qdrant.Value) (*qdrant.PointStruct, error) {
+	if !appCtx.Config.SummaryEmbedding || cleanTokenCount < appCtx.Config.SummaryMinTokens {
+		return nil, nil
+	}
+	vector, err := embedText(context.Background(), extractiveSummary(body))
+	if err != nil {
+		return nil, err
+	}
+	summaryPayload := maps.Clone(payload)
+	summaryPayload["summary_of"] = qdrant.NewValueString(pointID)
+	return &qdrant.PointStruct{
+		Id:      qdrant.NewID(summaryPointID(pointID)),
+		Vectors: qdrant.NewVectors(vector...),
+		Payload: summaryPayload,
+	}, nil
+}
+
+// notSummary is the filter condition selecting document points only
+func notSummary() *qdrant.Condition {
+	return qdrant.NewIsEmpty("summary_of")
+}
+
+// collapseSummaries keeps one candidate per document when both a document and its summary point
+// were found: the document point (payload and vector) with the higher embedding similarity of the two.
+// A summary found alone stands for its document, under the document point id.
+func collapseSummaries(candidates []Candidate) []Candidate {
+	best := make(map[string]int, len(candidates))
+	out := make([]Candidate, 0, len(candidates))
+	for _, cand := range candidates {
+		if cand.Payload.SummaryOf != "" {
+			cand.PointID = cand.Payload.SummaryOf
+			cand.EmbeddingVector = nil // the summary vector does not represent the document
+		}
+		i, seen := best[cand.PointID]
+		if !seen {
+			best[cand.PointID] = len(out)
+			out = append(out, cand)
+			continue
+		}
+		if cand.Payload.SummaryOf == "" {
+			cand.Features.EmbSim = max(cand.Features.EmbSim, out[i].Features.EmbSim)
+			out[i] = cand
+		} else {
+			out[i].Features.EmbSim = max(out[i].Features.EmbSim, cand.Features.EmbSim)
+		}
+	}
+	return out
+}
@@ -0,0 +1,33 @@
+// summary_test.go
+package main
+
+import "testing"
+
+func TestCollapseSummariesKeepsDocumentWithBestSimilarity(t *testing.T) {
+	doc := Candidate{PointID: "doc", Payload: Payload{Body: "full body"}, EmbeddingVector: []float64{1}}
+	doc.Features.EmbSim = 0.6
+	summary := Candidate{PointID: "sum", Payload: Payload{Body: "full body", SummaryOf: "doc"}, EmbeddingVector: []float64{2}}
+	summary.Features.EmbSim = 0.9
+
+	for name, order := range map[string][]Candidate{
+		"summary first":  {summary, doc},
+		"document first": {doc, summary},
+	} {
+		out := collapseSummaries(order)
+		if len(out) != 1 {
+			t.Fatalf("%s: %d candidates, want 1", name, len(out))
+		}
+		got := out[0]
+		if got.PointID != "doc" || got.Payload.SummaryOf != "" || len(got.EmbeddingVector) != 1 || got.EmbeddingVector[0] != 1 {
+			t.Errorf("%s: kept %+v, want the document point", name, got)
+		}
+		if got.Features.EmbSim != 0.9 {
+			t.Errorf("%s: EmbSim = %v, want the summary's 0.9", name, got.Features.EmbSim)
+		}
+	}
+
+	alone := collapseSummaries([]Candidate{summary})
+	if len(alone) != 1 || alone[0].PointID != "doc" || alone[0].EmbeddingVector != nil {
+		t.Errorf("summary alone = %+v, want it under the document id without its vector", alone)
+	}
+}
@@ -5,13 +5,21 @@ import (
 	"os/exec"
 )
 
-// Function to check if user ragproxy exists
-func checkRagproxyUser() error {
-	// Check if user ragproxy exists
-	cmd := exec.Command("id", "ragproxy")
+// Function to check if the service user (RagproxyUser, default ragproxy) exists.
+// Skipped when RequireRagproxyUser is false, e.g. in containers.
+func checkRagproxyUser(config Config) error {
+	if config.RequireRagproxyUser != nil && !*config.RequireRagproxyUser {
+		return nil
+	}
+	user := config.RagproxyUser
+	if user == "" {
+		user = "ragproxy"
+	}
+	// Check if the user exists
+	cmd := exec.Command("id", user)
 	err := cmd.Run()
 	if err != nil {
-		return fmt.Errorf("user 'ragproxy' not found. Please create the user: sudo useradd ragproxy")
+		return fmt.Errorf("user '%s' not found. Please create the user: sudo useradd %s", user, user)
 	}
 	return nil
 }
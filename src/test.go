@@ -59,45 +59,6 @@ package main
 // 	return out, len(out)
 // }
 
-// // topIDF returns up to n tokens from ids sorted by IDF descending (reads IDFStore under RLock).
-// func topIDF(ids []int, n int) []struct {
-// 	ID  int
-// 	IDF float64
-// } {
-// 	appCtx.idfMu.RLock()
-// 	defer appCtx.idfMu.RUnlock()
-// 	type kv struct {
-// 		ID  int
-// 		IDF float64
-// 	}
-// 	out := make([]kv, 0, len(ids))
-// 	seen := make(map[int]struct{})
-// 	for _, id := range ids {
-// 		if _, ok := seen[id]; ok {
-// 			continue
-// 		}
-// 		seen[id] = struct{}{}
-// 		w, ok := appCtx.IDFStore.IDF[id]
-// 		if !ok {
-// 			w = 0.0
-// 		}
-// 		out = append(out, kv{ID: id, IDF: w})
-// 	}
-// 	sort.Slice(out, func(i, j int) bool { return out[i].IDF > out[j].IDF })
-// 	if len(out) > n {
-// 		out = out[:n]
-// 	}
-// 	res := make([]struct {
-// 		ID  int
-// 		IDF float64
-// 	}, len(out))
-// 	for i := range out {
-// 		res[i].ID = out[i].ID
-// 		res[i].IDF = out[i].IDF
-// 	}
-// 	return res
-// }
-
 // // generateTestCandidate is unchanged, kept here for completeness.
 // func generateTestCandidate(doc string) Candidate {
 // 	payload := Payload{
@@ -189,8 +150,8 @@ package main
 // 	commonPreview := fmtIDs(commonIDs, 12)
 
 // 	// top IDF tokens in query and doc (for quick inspection)
-// 	topQ := topIDF(qUnique, 5)
-// 	topD := topIDF(docUnique, 5)
+// 	topQ := topIDF(&appCtx.IDFStore, qUnique, 5)
+// 	topD := topIDF(&appCtx.IDFStore, docUnique, 5)
 
 // 	// prepare decoded strings (safe)
 // 	qDecoded := decodeIDs(qFull)
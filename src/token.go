@@ -41,7 +41,25 @@ func (w *TokenCacheWrapper) Remove(k string) {
 	w.c.Remove(k)
 }
 
-// initTokenCache: initializes the token cache
+// removeExpired removes the entries created before now-ttl and returns their number
+func (w *TokenCacheWrapper) removeExpired(now time.Time, ttl time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	removed := 0
+	for _, k := range w.c.Keys() {
+		v, ok := w.c.Peek(k) // Peek keeps the LRU order
+		if !ok {
+			continue
+		}
+		if e, ok := v.(*cachedEntry); ok && now.Sub(e.created) >= ttl {
+			w.c.Remove(k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// initTokenCache: initializes the token cache and, with TokensCacheTTL, its expiry sweep
 func initTokenCache() error {
 	var err error
 	wrapper, err := NewTokenCacheWrapper(appCtx.Config.TokensCacheSize)
@@ -49,9 +67,33 @@ func initTokenCache() error {
 		return err
 	}
 	appCtx.TokenCache = wrapper
+	if ttl := appCtx.Config.TokensCacheTTL.Duration; ttl > 0 {
+		startTokenCacheSweep(ttl)
+	}
 	return nil
 }
 
+// startTokenCacheSweep starts a goroutine that removes expired token cache entries every ttl, so
+// entries never looked up again do not hold memory until LRU pressure evicts them
+func startTokenCacheSweep(ttl time.Duration) {
+	stop := make(chan struct{})
+	appCtx.tokenCacheStopChan = stop
+	go func() {
+		ticker := time.NewTicker(ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				if n := appCtx.TokenCache.removeExpired(now, ttl); n > 0 && appCtx.Config.VerboseDiskLogs {
+					appCtx.AccessLogger.Printf("Token cache sweep removed %d expired entries", n)
+				}
+			}
+		}
+	}()
+}
+
 // Calculates token count with reserve percentage
 func calculateTokens(text string) int {
 	if appCtx.Tokenizer == nil {
@@ -61,6 +103,21 @@ func calculateTokens(text string) int {
 	return len(ids)
 }
 
+// calculateTokensWithReserve: token count of text plus TokenReservePercent on top (rounded up, at least +1
+// when the reserve is enabled). Used for budgeting so estimates err on the safe side.
+func calculateTokensWithReserve(text string) int {
+	n := calculateTokens(text)
+	percent := appCtx.Config.TokenReservePercent
+	if percent <= 0 {
+		return n
+	}
+	reserve := (n*percent + 99) / 100
+	if reserve < 1 {
+		reserve = 1
+	}
+	return n + reserve
+}
+
 // tokenIDs: slice of int token IDs for given text.
 func tokenIDs(text string) ([]uint32, error) {
 	if appCtx.Tokenizer == nil {
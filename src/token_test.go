@@ -0,0 +1,64 @@
+// token_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalculateTokensWithReserve(t *testing.T) {
+	newTestApp(t)
+	hundred := strings.Repeat("word ", 100) // 100 tokens with testTokenizer
+
+	cases := []struct {
+		percent int
+		text    string
+		want    int
+	}{
+		{10, hundred, 110},
+		{0, hundred, 100},
+		{100, hundred, 200},
+		{10, "three small words", 4}, // 0.3 rounds up to +1
+		{1, "one", 2},                // at least +1
+	}
+	for _, tc := range cases {
+		appCtx.Config.TokenReservePercent = tc.percent
+		if got := calculateTokensWithReserve(tc.text); got != tc.want {
+			t.Errorf("%d%% reserve on %d tokens = %d, want %d", tc.percent, calculateTokens(tc.text), got, tc.want)
+		}
+	}
+}
+
+func TestTokenCacheSweepRemovesStaleEntries(t *testing.T) {
+	newTestApp(t)
+	ttl := time.Hour
+	appCtx.Config.TokensCacheTTL.Duration = ttl
+	for _, body := range []string{"first cached body", "second cached body", "third cached body"} {
+		if _, err := getCachedTokenIDs(hashContent(body), body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first entry was cached two hours before the others
+	first, _ := appCtx.TokenCache.Get(hashContent("first cached body"))
+	first.(*cachedEntry).created = first.(*cachedEntry).created.Add(-2 * ttl)
+
+	now := time.Now()
+	if n := appCtx.TokenCache.removeExpired(now, ttl); n != 1 {
+		t.Errorf("sweep at now removed %d entries, want the stale one", n)
+	}
+	if _, ok := appCtx.TokenCache.Get(hashContent("first cached body")); ok {
+		t.Error("stale entry still cached after the sweep")
+	}
+	if _, ok := appCtx.TokenCache.Get(hashContent("second cached body")); !ok {
+		t.Error("fresh entry removed by the sweep")
+	}
+
+	// One TTL later every remaining entry is stale
+	if n := appCtx.TokenCache.removeExpired(now.Add(ttl), ttl); n != 2 {
+		t.Errorf("sweep one TTL later removed %d entries, want 2", n)
+	}
+	if n := appCtx.TokenCache.c.Len(); n != 0 {
+		t.Errorf("%d entries left after the sweeps", n)
+	}
+}
@@ -0,0 +1,98 @@
+// tokenizer.go
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/daulet/tokenizers"
+	"github.com/pkoukk/tiktoken-go"
+)
+
+const (
+	tokenizerBackendHF       = "hf"
+	tokenizerBackendTiktoken = "tiktoken"
+)
+
+// Tokenizer is the token counting backend selected by TokenizerBackend.
+// *tokenizers.Tokenizer (HF) implements it as is.
+type Tokenizer interface {
+	// Encode returns the token ids of text and their string forms
+	Encode(text string, addSpecialTokens bool) ([]uint32, []string)
+	// Decode returns the text of ids
+	Decode(ids []uint32, skipSpecialTokens bool) string
+	Close() error
+}
+
+// tiktokenTokenizer adapts a tiktoken encoding to Tokenizer. BPE encodings have no BOS/EOS, so
+// the special token flags are no-ops; special token text in the input is encoded as plain text.
+type tiktokenTokenizer struct {
+	enc *tiktoken.Tiktoken
+}
+
+func (t *tiktokenTokenizer) Encode(text string, _ bool) ([]uint32, []string) {
+	raw := t.enc.EncodeOrdinary(text)
+	ids := make([]uint32, len(raw))
+	tokens := make([]string, len(raw))
+	for i, id := range raw {
+		ids[i] = uint32(id)
+		tokens[i] = t.enc.Decode([]int{id})
+	}
+	return ids, tokens
+}
+
+func (t *tiktokenTokenizer) Decode(ids []uint32, _ bool) string {
+	raw := make([]int, len(ids))
+	for i, id := range ids {
+		raw[i] = int(id)
+	}
+	return t.enc.Decode(raw)
+}
+
+func (t *tiktokenTokenizer) Close() error {
+	return nil
+}
+
+// tokenizerMetadataKey is the collection metadata key holding the tokenizerIdentity of its token counts
+const tokenizerMetadataKey = "tokenizer"
+
+// tokenizerIdentity names the tokenizer of config, e.g. "hf:<model>" or "tiktoken:cl100k_base".
+// It is saved with the IDF stores and in the collection metadata: their token ids and counts are
+// only valid for the tokenizer that made them.
+func tokenizerIdentity(config Config) string {
+	if config.TokenizerBackend == tokenizerBackendTiktoken {
+		encoding := config.TokenizerTiktokenEncoding
+		if encoding == "" {
+			encoding = tiktoken.MODEL_CL100K_BASE
+		}
+		return tokenizerBackendTiktoken + ":" + encoding
+	}
+	return tokenizerBackendHF + ":" + config.TokenizerHFModelName
+}
+
+// newTokenizer loads the tokenizer of TokenizerBackend: the HF model TokenizerHFModelName, or the
+// tiktoken encoding TokenizerTiktokenEncoding. Both cache their files in TokenizerPretrainedCacheDir.
+func newTokenizer(config Config) (Tokenizer, error) {
+	switch config.TokenizerBackend {
+	case "", tokenizerBackendHF:
+		return tokenizers.FromPretrained(config.TokenizerHFModelName,
+			tokenizers.WithCacheDir(config.TokenizerPretrainedCacheDir),
+			tokenizers.WithAuthToken(config.TokenizerHFAPI))
+	case tokenizerBackendTiktoken:
+		// tiktoken-go downloads the BPE file on first use and caches it in TIKTOKEN_CACHE_DIR
+		if os.Getenv("TIKTOKEN_CACHE_DIR") == "" && config.TokenizerPretrainedCacheDir != "" {
+			os.Setenv("TIKTOKEN_CACHE_DIR", config.TokenizerPretrainedCacheDir)
+		}
+		encoding := config.TokenizerTiktokenEncoding
+		if encoding == "" {
+			encoding = tiktoken.MODEL_CL100K_BASE
+		}
+		enc, err := tiktoken.GetEncoding(encoding)
+		if err != nil {
+			return nil, err
+		}
+		return &tiktokenTokenizer{enc: enc}, nil
+	default:
+		return nil, fmt.Errorf("unknown TokenizerBackend %q", config.TokenizerBackend)
+	}
+}
@@ -0,0 +1,65 @@
+// ttl.go
+package main
+
+import (
+	"time"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// ttlEnabled reports whether stored points can carry expires_at (TTLHeader or TTLByRole set)
+func ttlEnabled() bool {
+	return appCtx.Config.TTLHeader != "" || len(appCtx.Config.TTLByRole) > 0
+}
+
+// expiresAt returns the expires_at payload value (UnixNano, like timestamp) of a point of role stored
+// now: ttl from the request, otherwise the TTLByRole default. 0 means the point does not expire.
+func expiresAt(role string, ttl time.Duration) float64 {
+	if ttl <= 0 {
+		ttl = appCtx.Config.TTLByRole[role].Duration
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return float64(time.Now().Add(ttl).UnixNano())
+}
+
+// notExpired is the filter condition selecting points without expires_at or not expired yet
+func notExpired() *qdrant.Condition {
+	now := float64(time.Now().UnixNano())
+	return qdrant.NewFilterAsCondition(&qdrant.Filter{
+		Should: []*qdrant.Condition{
+			qdrant.NewIsEmpty("expires_at"),
+			qdrant.NewRange("expires_at", &qdrant.Range{Gt: &now}),
+		},
+	})
+}
+
+// startTTLSweeper starts a goroutine that periodically deletes expired points
+func startTTLSweeper(interval time.Duration) {
+	appCtx.idfAutoSaveWG.Add(1)
+	go func() {
+		defer appCtx.idfAutoSaveWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-appCtx.idfAutoSaveStopChan:
+				return
+			case <-ticker.C:
+				if n, err := sweepExpiredPoints(); err != nil {
+					appCtx.ErrorLogger.Printf("TTL sweep failed after %d points: %v", n, err)
+				} else if n > 0 {
+					appCtx.JournaldLogger.Printf("TTL sweep deleted %d expired points", n)
+				}
+			}
+		}
+	}()
+}
+
+// sweepExpiredPoints deletes the points whose expires_at has passed and removes the documents
+// among them from IDF. Returns the number of deleted points.
+func sweepExpiredPoints() (int, error) {
+	now := float64(time.Now().UnixNano())
+	return deleteMatchingPoints(&qdrant.Filter{Must: []*qdrant.Condition{qdrant.NewRange("expires_at", &qdrant.Range{Lte: &now})}})
+}
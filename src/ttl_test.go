@@ -0,0 +1,58 @@
+// ttl_test.go
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qdrant/go-client/qdrant"
+)
+
+func TestExpiredPointsNotRetrievedAndSwept(t *testing.T) {
+	newTestApp(t)
+	useRerankTestConfig(appCtx.Config.DefaultWeights)
+	appCtx.Config.SummaryEmbedding = false
+	appCtx.Config.TTLByRole = map[string]Duration{"rag-user": {Duration: time.Hour}}
+
+	store := func(body, role string, ttl time.Duration) string {
+		t.Helper()
+		id := uuid.NewString()
+		tokens := calculateTokens(body)
+		if err := upsertPoint(body, testVector(body), role, tokens, tokens, hashContent(body), "", nil, nil, id, ttl); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	expired := store("expired temp question", "rag-user", 0) // TTLByRole default
+	store("fresh temp question", "rag-user", 0)
+	store("kept for a day", "rag-assistant", 24*time.Hour) // request TTL
+	store("permanent answer", "rag-assistant", 0)          // no TTL for the role
+	if appCtx.memStore.points[expired].payload["expires_at"] == nil {
+		t.Fatal("TTLByRole default not stored as expires_at")
+	}
+	appCtx.memStore.points[expired].payload["expires_at"] = qdrant.NewValueDouble(float64(time.Now().Add(-time.Minute).UnixNano()))
+
+	want := []string{"fresh temp question", "kept for a day", "permanent answer"}
+	slices.Sort(want)
+	bodies := rerankBodies(t, "expired temp question", RequestOptions{})
+	slices.Sort(bodies)
+	if !slices.Equal(bodies, want) {
+		t.Errorf("retrieved %q, want %q", bodies, want)
+	}
+	if _, ok := appCtx.memStore.points[expired]; !ok {
+		t.Fatal("search deleted the expired point, the sweep should")
+	}
+
+	n, err := sweepExpiredPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := appCtx.memStore.points[expired]; n != 1 || ok {
+		t.Errorf("sweep deleted %d points, expired one left: %t", n, ok)
+	}
+	if got := appCtx.IDFStore.N; got != 3 {
+		t.Errorf("IDF counts %d documents after the sweep, want 3", got)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -30,16 +31,57 @@ func NewResponseCollector(w http.ResponseWriter) *ResponseCollector {
 		stopCh:     make(chan struct{}),
 		doneCh:     make(chan struct{}),
 	}
-	go rc.StartOutgoingLoop()
+	// With the fast path the loop is started lazily on the first queued packet
+	if !appCtx.Config.SmallResponseFastPath {
+		rc.ensureOutgoingLoop()
+	}
 	return rc
 }
 
+func (w *ResponseCollector) ensureOutgoingLoop() {
+	w.loopOnce.Do(func() { go w.StartOutgoingLoop() })
+}
+
 func (w *ResponseCollector) WriteHeader(statusCode int) {
 	// мы потенциально переписываем body (Direct/Stream), поэтому фиксированную длину убираем
 	h := w.ResponseWriter.Header()
+	n, err := strconv.Atoi(h.Get("Content-Length"))
+	if err != nil || n <= 0 {
+		n = 0
+	}
+	if appCtx.Config.SmallResponseFastPath && n > 0 && n <= appCtx.Config.SmallResponseMaxBytes {
+		w.fastPath = true
+		w.fastExpected = n
+		w.fastBuf = make([]byte, 0, n)
+	}
 	h.Del("Content-Length")
 
-	w.ResponseWriter.WriteHeader(statusCode)
+	// Fixed-length (non-stream) body: hold the header back so a DirectPacket can set the length of the rewritten body
+	w.statusCode = statusCode
+	w.upstreamLength = n
+	if n == 0 {
+		w.flushHeader(-1)
+	}
+}
+
+// flushHeader sends the held-back status line once; contentLength >= 0 sets Content-Length.
+func (w *ResponseCollector) flushHeader(contentLength int) {
+	w.headerOnce.Do(func() {
+		if w.statusCode == 0 {
+			// Write without WriteHeader — implicit 200 as in net/http
+			w.statusCode = http.StatusOK
+		}
+		if contentLength >= 0 {
+			w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(contentLength))
+		}
+		w.ResponseWriter.WriteHeader(w.statusCode)
+	})
+}
+
+// writeBody writes b to the client, sending the header first if it is still held back.
+func (w *ResponseCollector) writeBody(b []byte) (int, error) {
+	w.flushHeader(-1)
+	return w.ResponseWriter.Write(b)
 }
 
 func packetWireData(pkt ResponsePacket) string {
@@ -59,7 +101,82 @@ func packetWireData(pkt ResponsePacket) string {
 	}
 
 	// Обычный случай: RawData = JSON или "[DONE]" -> оборачиваем
-	return pkt.Prefix + ": " + trimmed + "\n\n"
+	return sseFrame(pkt, trimmed)
+}
+
+// sseFrame builds an SSE frame: the packet's non-data fields verbatim, then data as one
+// prefixed line per data line, then the blank line.
+func sseFrame(pkt ResponsePacket, data string) string {
+	var sb strings.Builder
+	sb.WriteString(pkt.SSEFields)
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString(pkt.Prefix)
+		sb.WriteString(": ")
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// parseSSEBlock parses one SSE frame. Lines of the data field (matched by SSEPrefixReg) are
+// joined with newlines; event:, id:, retry: and comment lines are kept verbatim in fields.
+// ok is false when the block has other lines or no data at all.
+func parseSSEBlock(block string) (prefix, data, fields string, ok bool) {
+	var dataLines []string
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(block, "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			sb.WriteString(line + "\n") // comment
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return "", "", "", false
+		}
+		name = strings.TrimSpace(name)
+		switch {
+		case appCtx.ssePrefixReg.MatchString(name):
+			if prefix != "" && prefix != name {
+				return "", "", "", false
+			}
+			prefix = name
+			dataLines = append(dataLines, strings.TrimPrefix(value, " "))
+		case name == "event" || name == "id" || name == "retry":
+			sb.WriteString(line + "\n")
+		default:
+			return "", "", "", false
+		}
+	}
+	if len(dataLines) == 0 {
+		return "", "", "", false
+	}
+	return prefix, strings.TrimSpace(strings.Join(dataLines, "\n")), sb.String(), true
+}
+
+// splitSSEBlocks splits buf into SSE frames on blank lines. Returns nil unless buf starts like an
+// SSE field line, so plain JSON bodies are never split.
+func splitSSEBlocks(buf string) []string {
+	first := strings.TrimLeft(buf, "\r\n")
+	name, _, found := strings.Cut(first, ":")
+	if !found || strings.ContainsAny(name, "{\"\n") {
+		return nil
+	}
+	name = strings.TrimSpace(name)
+	if name != "" && name != "event" && name != "id" && name != "retry" && !appCtx.ssePrefixReg.MatchString(name) {
+		return nil
+	}
+	var blocks []string
+	for _, b := range strings.Split(strings.ReplaceAll(buf, "\r\n", "\n"), "\n\n") {
+		if strings.TrimSpace(b) != "" {
+			blocks = append(blocks, b+"\n\n")
+		}
+	}
+	return blocks
 }
 
 func (w *ResponseCollector) StartOutgoingLoop() {
@@ -74,7 +191,7 @@ func (w *ResponseCollector) StartOutgoingLoop() {
 			w.mu.Unlock()
 
 			out := packetWireData(pkt)
-			_, _ = w.ResponseWriter.Write([]byte(out))
+			_, _ = w.writeBody([]byte(out))
 
 			// важно для streaming через reverse-proxy/буферы
 			if f, ok := w.ResponseWriter.(http.Flusher); ok {
@@ -100,14 +217,18 @@ func (w *ResponseCollector) StartOutgoingLoop() {
 }
 
 func (w *ResponseCollector) StopOutgoingLoop() {
+	// Loop never started (fast path) — nothing to wait for
+	w.loopOnce.Do(func() { close(w.doneCh) })
 	w.stopOnce.Do(func() { close(w.stopCh) })
 	<-w.doneCh
 }
 
 func (w *ResponseCollector) EnqueuePacket(pkt ResponsePacket) {
+	w.ensureOutgoingLoop()
 	w.mu.Lock()
-	// Предотвращаем подряд идущие дубли по идентичному RawData (простая защита)
-	if w.outgoingPackets.Len() > 0 {
+	// Предотвращаем подряд идущие дубли по идентичному RawData (простая защита, DedupIdenticalChunks).
+	// Выключено по умолчанию: модель может законно прислать один и тот же токен дважды подряд
+	if appCtx.Config.DedupIdenticalChunks && pkt.PacketType != ToolCallPacket && w.outgoingPackets.Len() > 0 {
 		last := w.outgoingPackets.At(w.outgoingPackets.Len() - 1)
 		if last.RawData == pkt.RawData {
 			w.mu.Unlock()
@@ -115,6 +236,7 @@ func (w *ResponseCollector) EnqueuePacket(pkt ResponsePacket) {
 		}
 	}
 	w.outgoingPackets.PushBack(pkt)
+	w.queued = true
 	// Сигнализируем, если канал пуст (чтобы не блокировать)
 	select {
 	case w.notifyCh <- struct{}{}:
@@ -123,9 +245,81 @@ func (w *ResponseCollector) EnqueuePacket(pkt ResponsePacket) {
 	w.mu.Unlock()
 }
 
+// writeFastPath buffers a small fixed-length response and, once it is complete JSON of a
+// DirectPacket, applies replace rules and writes it straight through without the outgoing loop.
+// Anything else falls back to the regular packet handling.
+func (w *ResponseCollector) writeFastPath(data []byte) (int, error) {
+	w.fastBuf = append(w.fastBuf, data...)
+	if len(w.fastBuf) < w.fastExpected {
+		return len(data), nil
+	}
+	w.fastPath = false
+	buf := w.fastBuf
+	w.fastBuf = nil
+
+	if !gjson.ValidBytes(buf) {
+		if _, err := w.Write(buf); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	incomingPacket, err := parseIncomingBuffer(string(buf))
+	if err != nil || incomingPacket.PacketType != DirectPacket {
+		if _, err := w.Write(buf); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	jsonStr, replacedStr, rerr := applyResponseReplaceToPacket(incomingPacket)
+	if rerr != nil {
+		if appCtx.Config.DumpPackets {
+			appCtx.DumpLogger.Printf("applyResponseReplaceToString error (fast path fallback): %v\n<---- OUTGOING PACKET:\n%s", rerr, string(buf))
+		}
+		if _, err := w.writeBody(buf); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if replacedStr == "" {
+		replacedStr = gjson.Get(incomingPacket.RawData, incomingPacket.MessagePath).String()
+	}
+
+	// сохраняем то, что реально ушло пользователю
+	w.mu.Lock()
+	w.wasMessages = true
+	w.globalTextBuffer = replacedStr
+	w.complete = true
+	w.mu.Unlock()
+
+	if appCtx.Config.DumpPackets {
+		appCtx.DumpLogger.Printf("<---- OUTGOING PACKET (fast path): \n%s", jsonStr)
+	}
+	w.flushHeader(len(jsonStr))
+	if _, werr := w.writeBody([]byte(jsonStr)); werr != nil {
+		return 0, werr
+	}
+	return len(data), nil
+}
+
 func (w *ResponseCollector) Write(data []byte) (int, error) {
+	if w.fastPath {
+		return w.writeFastPath(data)
+	}
+
 	rawStr := string(data)
 
+	// Several SSE frames in one write — handle them one by one
+	if blocks := splitSSEBlocks(rawStr); len(blocks) > 1 {
+		for _, block := range blocks {
+			if _, err := w.Write([]byte(block)); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+
 	if appCtx.Config.DumpPackets {
 		appCtx.DumpLogger.Printf("----> INCOMING PACKET: \n%s", rawStr)
 	}
@@ -139,13 +333,34 @@ func (w *ResponseCollector) Write(data []byte) (int, error) {
 		appCtx.ErrorLogger.Printf("Error parsing incoming buffer: %v\n", err)
 	}
 
+	// ------- ToolCallPacket --------
+
+	if incomingPacket.PacketType == ToolCallPacket || w.toolCalls {
+		return w.writeToolCall(data)
+	}
+
 	// ------- OtherPacket --------
 
 	if incomingPacket.PacketType == OtherPacket {
 		if appCtx.Config.DumpPackets {
 			appCtx.DumpLogger.Printf("<---- OUTGOING PACKET: \n%s", string(data))
 		}
-		return w.ResponseWriter.Write(data)
+		// Not written past packets still queued or held: after the finish packet it waits for
+		// CloseAndProcess, otherwise it joins the queue (RawData without IsSSE goes out as is)
+		other := ResponsePacket{PacketType: OtherPacket, RawData: string(data)}
+		w.mu.Lock()
+		if w.complete {
+			w.trailingPackets = append(w.trailingPackets, other)
+			w.mu.Unlock()
+			return len(data), nil
+		}
+		queued := w.queued
+		w.mu.Unlock()
+		if queued {
+			w.EnqueuePacket(other)
+			return len(data), nil
+		}
+		return w.writeBody(data)
 	}
 
 	// ------- DirectPacket --------
@@ -157,7 +372,7 @@ func (w *ResponseCollector) Write(data []byte) (int, error) {
 			if appCtx.Config.DumpPackets {
 				appCtx.DumpLogger.Printf("applyResponseReplaceToString error (fallback): %v\n<---- OUTGOING PACKET:\n%s", rerr, rawStr)
 			}
-			return w.ResponseWriter.Write(data)
+			return w.writeBody(data)
 		}
 
 		// сохраняем то, что реально ушло пользователю
@@ -171,8 +386,13 @@ func (w *ResponseCollector) Write(data []byte) (int, error) {
 			appCtx.DumpLogger.Printf("<---- OUTGOING PACKET: \n%s", jsonStr)
 		}
 
+		// Whole fixed-length body in one write: its rewritten length is known
+		if w.upstreamLength > 0 && len(data) == w.upstreamLength {
+			w.flushHeader(len(jsonStr))
+		}
+
 		// IMPORTANT: вернуть len(data), иначе reverseproxy может считать short write
-		if _, werr := w.ResponseWriter.Write([]byte(jsonStr)); werr != nil {
+		if _, werr := w.writeBody([]byte(jsonStr)); werr != nil {
 			return 0, werr
 		}
 		return len(data), nil
@@ -187,6 +407,7 @@ func (w *ResponseCollector) Write(data []byte) (int, error) {
 		w.templateFinishPacket = ResponsePacket{
 			RawData:     incomingPacket.RawData,
 			Prefix:      incomingPacket.Prefix,
+			SSEFields:   incomingPacket.SSEFields,
 			IsSSE:       incomingPacket.IsSSE,
 			MessagePath: incomingPacket.MessagePath,
 			PacketType:  incomingPacket.PacketType,
@@ -224,7 +445,7 @@ func (w *ResponseCollector) Write(data []byte) (int, error) {
 		if appCtx.Config.DumpPackets {
 			appCtx.DumpLogger.Printf("<---- OUTGOING PACKET: \n%s", string(data))
 		}
-		return w.ResponseWriter.Write(data)
+		return w.writeBody(data)
 	}
 	// Append to buffers
 	w.mu.Lock()
@@ -234,13 +455,28 @@ func (w *ResponseCollector) Write(data []byte) (int, error) {
 
 	var needFlush bool
 
-	if !w.collecting && utf8.RuneCountInString(w.currentTextBuffer) >= appCtx.responseReplaceMaxTriggerLen {
+	_, maxTriggerLen := currentReplaceRules()
+	if !w.collecting && utf8.RuneCountInString(w.currentTextBuffer) >= maxTriggerLen {
 		if containsTrigger(w.currentTextBuffer) {
 			w.collecting = true
 		} else {
 			needFlush = true
 		}
 	}
+	// The triggered region closed: replace and send it now, then resume streaming
+	if w.collecting && regionClosed(w.currentTextBuffer) {
+		w.collecting = false
+		needFlush = true
+		replaced, changed := applyReplaceRulesToString(w.currentTextBuffer)
+		if appCtx.Config.DumpPackets {
+			appCtx.DumpLogger.Printf("ResponseCollector region closed, changed=%v, replaced len=%d, content:\n%s", changed, utf8.RuneCountInString(replaced), replaced)
+		}
+		if changed {
+			clock := newRegionClock(w.incomingPackets[0].RawData, w.incomingPackets[len(w.incomingPackets)-1].RawData)
+			w.incomingPackets = synthesizePackets(w.incomingPackets[0], replaced, clock)
+			w.currentTextBuffer = replaced
+		}
+	}
 	collecting := w.collecting
 	packetsToFlush := []ResponsePacket(nil)
 	if needFlush {
@@ -272,6 +508,41 @@ func (w *ResponseCollector) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// writeToolCall switches the collector to passthrough on the first tool-call packet: text packets
+// held so far are sent as they are, then this and every later packet go out verbatim through the
+// queue, keeping their order.
+func (w *ResponseCollector) writeToolCall(data []byte) (int, error) {
+	w.mu.Lock()
+	var pending []ResponsePacket
+	if !w.toolCalls {
+		w.toolCalls = true
+		w.collecting = false
+		pending = append(pending, w.incomingPackets...)
+		w.incomingPackets = w.incomingPackets[:0]
+		w.currentTextBuffer = ""
+		w.globalTextBuffer = ""
+	}
+	w.mu.Unlock()
+
+	if len(pending) > 0 && appCtx.Config.DumpPackets {
+		appCtx.DumpLogger.Printf("ResponseCollector tool call detected, flushing %d held packets", len(pending))
+	}
+	for _, pkt := range pending {
+		w.EnqueuePacket(pkt)
+	}
+
+	// Whole fixed-length body in one write: its length is unchanged
+	if w.upstreamLength > 0 && len(data) == w.upstreamLength {
+		w.flushHeader(len(data))
+	}
+	if appCtx.Config.DumpPackets {
+		appCtx.DumpLogger.Printf("<---- OUTGOING PACKET (tool call passthrough): \n%s", string(data))
+	}
+	// Not SSE-wrapped: packetWireData writes RawData as is
+	w.EnqueuePacket(ResponsePacket{PacketType: ToolCallPacket, RawData: string(data)})
+	return len(data), nil
+}
+
 func (w *ResponseCollector) WriteTemplatePacket() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -283,6 +554,7 @@ func (w *ResponseCollector) WriteTemplatePacket() error {
 	w.templateStreamPacket = ResponsePacket{
 		RawData:     first.RawData,
 		Prefix:      first.Prefix,
+		SSEFields:   first.SSEFields,
 		IsSSE:       first.IsSSE,
 		MessagePath: first.MessagePath,
 		PacketType:  first.PacketType,
@@ -291,6 +563,26 @@ func (w *ResponseCollector) WriteTemplatePacket() error {
 }
 
 func (w *ResponseCollector) CloseAndProcess() (cleanAssistantContent string, wasMessages bool, err error) {
+	// Empty body — the held-back header still has to go out
+	defer w.flushHeader(-1)
+
+	// Fast path body ended short of Content-Length — push what we have through the regular path
+	if w.fastPath {
+		w.fastPath = false
+		if len(w.fastBuf) > 0 {
+			_, _ = w.Write(w.fastBuf)
+		}
+		w.fastBuf = nil
+	}
+
+	// Tool-call response was passed through as is — nothing to process or store
+	w.mu.Lock()
+	if w.toolCalls {
+		w.mu.Unlock()
+		appCtx.AccessLogger.Printf("Tool-call response passed through, not stored")
+		return "", false, nil
+	}
+	w.mu.Unlock()
 
 	// Only if the final chunk was received
 	w.mu.Lock()
@@ -330,52 +622,20 @@ func (w *ResponseCollector) CloseAndProcess() (cleanAssistantContent string, was
 				return "", wasMessages, err
 			}
 
-			// Get tokens for replaced text
-			ids, _ := appCtx.Tokenizer.Encode(replaced, false) // false = без спец. токенов
-
 			// Resize incomingPackets
 			w.mu.Lock()
-			w.incomingPackets = make([]ResponsePacket, 0, len(ids)+1) // +1 finish packet
-			baseT := time.Now().UTC()
-			for i, id := range ids {
-				tokenStr := appCtx.Tokenizer.Decode([]uint32{id}, true)
-
-				pkt := ResponsePacket{
-					RawData:     w.templateStreamPacket.RawData,
-					Prefix:      w.templateStreamPacket.Prefix,
-					IsSSE:       w.templateStreamPacket.IsSSE,
-					MessagePath: w.templateStreamPacket.MessagePath,
-					PacketType:  w.templateStreamPacket.PacketType,
-				}
-
-				// Обновляем created_at (чтобы не было одинакового времени на всех чанках)
-				pkt.RawData = setCreatedAtIfPresent(pkt.RawData, baseT.Add(time.Duration(i)*25*time.Millisecond))
-
-				// Вставляем response/content/text
-				if pkt.MessagePath != "" {
-					if newRaw, err := sjson.Set(pkt.RawData, pkt.MessagePath, tokenStr); err == nil {
-						pkt.RawData = newRaw
-					}
-				}
-
-				if pkt.IsSSE && pkt.Prefix != "" {
-					pkt.RawData = pkt.Prefix + ": " + pkt.RawData + "\n\n"
-				}
-
-				w.incomingPackets = append(w.incomingPackets, pkt)
-			}
+			clock := newChunkClock(w.templateStreamPacket.RawData)
+			w.incomingPackets = synthesizePackets(w.templateStreamPacket, replaced, clock)
 
 			finalPkt := ResponsePacket{
 				RawData:     w.templateFinishPacket.RawData,
 				Prefix:      w.templateFinishPacket.Prefix,
+				SSEFields:   w.templateFinishPacket.SSEFields,
 				IsSSE:       w.templateFinishPacket.IsSSE,
 				MessagePath: w.templateFinishPacket.MessagePath,
 				PacketType:  w.templateFinishPacket.PacketType,
 			}
-			finalPkt.RawData = setCreatedAtIfPresent(finalPkt.RawData, time.Now().UTC())
-			if finalPkt.IsSSE && finalPkt.Prefix != "" {
-				finalPkt.RawData = finalPkt.Prefix + ": " + finalPkt.RawData + "\n\n"
-			}
+			finalPkt.RawData = clock.stamp(preserveIdentity(finalPkt.RawData, w.templateStreamPacket.RawData))
 			w.incomingPackets = append(w.incomingPackets, finalPkt)
 
 			w.mu.Unlock()
@@ -402,8 +662,9 @@ func (w *ResponseCollector) CloseAndProcess() (cleanAssistantContent string, was
 	// Finally, enqueue all packets
 	w.mu.Lock()
 	cleanAssistantContent = w.globalTextBuffer
-	pktsToEnqueue := append([]ResponsePacket(nil), w.incomingPackets...)
+	pktsToEnqueue := append(append([]ResponsePacket(nil), w.incomingPackets...), w.trailingPackets...)
 	w.incomingPackets = w.incomingPackets[:0] // чтобы не энкьюить повторно при странных вызовах
+	w.trailingPackets = nil
 	w.mu.Unlock()
 
 	for _, pkt := range pktsToEnqueue {
@@ -416,17 +677,127 @@ func (w *ResponseCollector) CloseAndProcess() (cleanAssistantContent string, was
 	return cleanAssistantContent, wasMessages, nil
 }
 
-func setCreatedAtIfPresent(raw string, t time.Time) string {
+// synthesizePackets splits text into one stream packet per token, built on template and stamped by clock
+func synthesizePackets(template ResponsePacket, text string, clock *chunkClock) []ResponsePacket {
+	ids, _ := appCtx.Tokenizer.Encode(text, false)   // false = без спец. токенов
+	packets := make([]ResponsePacket, 0, len(ids)+1) // +1 finish packet
+	clock.spread(len(ids))
+	for _, id := range ids {
+		tokenStr := appCtx.Tokenizer.Decode([]uint32{id}, true)
+
+		pkt := ResponsePacket{
+			RawData:     template.RawData,
+			Prefix:      template.Prefix,
+			SSEFields:   template.SSEFields,
+			IsSSE:       template.IsSSE,
+			MessagePath: template.MessagePath,
+			PacketType:  template.PacketType,
+		}
+
+		// Обновляем created_at/created (строго возрастающие, чтобы не было одинакового времени на всех чанках)
+		pkt.RawData = clock.stamp(pkt.RawData)
+
+		// Вставляем response/content/text
+		if pkt.MessagePath != "" {
+			if newRaw, err := sjson.Set(pkt.RawData, pkt.MessagePath, tokenStr); err == nil {
+				pkt.RawData = newRaw
+			}
+		}
+
+		packets = append(packets, pkt)
+	}
+	return packets
+}
+
+// chunkClock hands out strictly increasing timestamps for synthesized packets: created_at advances
+// by SynthesizedChunkSpacing, second-granularity created is bumped by 1 on collisions. A bounded
+// clock (mid-stream region) stays within the region's upstream times instead, so the packets
+// upstream sends afterwards still follow it.
+type chunkClock struct {
+	next    time.Time
+	spacing time.Duration
+	lastSec int64
+	until   time.Time // bounded clock: created_at stays before until, created is left as is
+	bounded bool
+}
+
+// newChunkClock starts after now and after the timestamps of the template packet, so synthesized
+// packets also follow whatever was already sent.
+func newChunkClock(template string) *chunkClock {
+	c := &chunkClock{next: time.Now().UTC(), spacing: appCtx.Config.SynthesizedChunkSpacing.Duration}
+	if c.spacing <= 0 {
+		c.spacing = 25 * time.Millisecond
+	}
+	if t, err := time.Parse(time.RFC3339Nano, gjson.Get(template, "created_at").String()); err == nil && !t.Before(c.next) {
+		c.next = t.Add(c.spacing)
+	}
+	c.lastSec = gjson.Get(template, "created").Int()
+	return c
+}
+
+// newRegionClock spreads synthesized packets over the created_at span of the collected region,
+// from its first packet to its last one. Without both timestamps the template's time is kept.
+func newRegionClock(first, last string) *chunkClock {
+	c := &chunkClock{bounded: true}
+	from, ferr := time.Parse(time.RFC3339Nano, gjson.Get(first, "created_at").String())
+	until, uerr := time.Parse(time.RFC3339Nano, gjson.Get(last, "created_at").String())
+	if ferr == nil && uerr == nil && !until.Before(from) {
+		c.next, c.until = from, until
+	}
+	return c
+}
+
+// spread sets the spacing of a bounded clock so n packets fit in its span
+func (c *chunkClock) spread(n int) {
+	if !c.bounded || c.until.IsZero() || n <= 0 {
+		return
+	}
+	c.spacing = c.until.Sub(c.next) / time.Duration(n)
+}
+
+// stamp sets created_at/created of raw (when present) to the next timestamp
+func (c *chunkClock) stamp(raw string) string {
+	t := c.next
+	c.next = c.next.Add(c.spacing)
+
+	if c.bounded {
+		if !c.until.IsZero() && gjson.Get(raw, "created_at").Exists() {
+			if out, err := sjson.Set(raw, "created_at", t.Format(time.RFC3339Nano)); err == nil {
+				raw = out
+			}
+		}
+		return raw
+	}
+
 	// /api/generate
 	if gjson.Get(raw, "created_at").Exists() {
-		if out, err := sjson.Set(raw, "created_at", t.UTC().Format(time.RFC3339Nano)); err == nil {
-			return out
+		if out, err := sjson.Set(raw, "created_at", t.Format(time.RFC3339Nano)); err == nil {
+			raw = out
 		}
 	}
-	// на будущее: /v1/completions (обычно int seconds)
+	// /v1/completions (обычно int seconds)
 	if gjson.Get(raw, "created").Exists() {
-		if out, err := sjson.Set(raw, "created", t.UTC().Unix()); err == nil {
-			return out
+		sec := t.Unix()
+		if sec <= c.lastSec {
+			sec = c.lastSec + 1
+		}
+		c.lastSec = sec
+		if out, err := sjson.Set(raw, "created", sec); err == nil {
+			raw = out
+		}
+	}
+	return raw
+}
+
+// preserveIdentity copies id and model of the template packet into raw where raw has them too
+func preserveIdentity(raw, template string) string {
+	for _, field := range []string{"id", "model"} {
+		v := gjson.Get(template, field)
+		if !v.Exists() || !gjson.Get(raw, field).Exists() {
+			continue
+		}
+		if out, err := sjson.SetRaw(raw, field, v.Raw); err == nil {
+			raw = out
 		}
 	}
 	return raw
@@ -465,16 +836,21 @@ func parseIncomingBuffer(buf string) (incomingPacket ResponsePacket, err error)
 	incomingPacket.MessagePath = ""
 	incomingPacket.PacketType = OtherPacket
 
-	// Определяем SSE
+	// Определяем SSE (целый фрейм: data + event/id/retry/комментарии)
 	rest := buf
-	parts := strings.SplitN(buf, ":", 2)
-	if len(parts) == 2 && appCtx.ssePrefixReg.MatchString(strings.TrimSpace(parts[0])) {
-		incomingPacket.Prefix = strings.TrimSpace(parts[0])
+	if prefix, sseData, fields, ok := parseSSEBlock(buf); ok {
+		incomingPacket.Prefix = prefix
 		incomingPacket.IsSSE = true
-		rest = strings.TrimSpace(parts[1])
+		incomingPacket.SSEFields = fields
+		rest = sseData
 	}
 	incomingPacket.RawData = rest
 
+	if isToolCallPacket(rest) {
+		incomingPacket.PacketType = ToolCallPacket
+		return incomingPacket, nil
+	}
+
 	if appCtx.streamingPacketStopReg.MatchString(rest) {
 		incomingPacket.PacketType = FinishStreamPacket
 		return incomingPacket, nil
@@ -503,6 +879,18 @@ func parseIncomingBuffer(buf string) (incomingPacket ResponsePacket, err error)
 	return incomingPacket, nil
 }
 
+// isToolCallPacket reports whether a packet body has a non-empty value at any of ToolCallPaths
+func isToolCallPacket(s string) bool {
+	for _, path := range appCtx.Config.ToolCallPaths {
+		r := gjson.Get(s, path)
+		if !r.Exists() || r.Type == gjson.Null || (r.IsArray() && len(r.Array()) == 0) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
 func patchUsageForCompletionTokens(jsonStr string, repl string) (string, error) {
 	usage := gjson.Get(jsonStr, "usage")
 	if !usage.Exists() {
@@ -565,7 +953,8 @@ func patchUsageForCompletionTokens(jsonStr string, repl string) (string, error)
 func applyReplaceRulesToString(src string) (string, bool) {
 	changed := false
 	out := src
-	for _, rec := range appCtx.responseReplaceRules {
+	rules, _ := currentReplaceRules()
+	for _, rec := range rules {
 		for _, rule := range rec.Rules {
 			if rule.Find == nil {
 				continue
@@ -590,9 +979,9 @@ func applyReplaceRulesToString(src string) (string, bool) {
 
 func applyResponseReplaceToPacket(pkt ResponsePacket) (jsonStr string, replacedStr string, err error) {
 	// Ничего не меняем
-	if pkt.MessagePath == "" || len(appCtx.responseReplaceRules) == 0 {
+	if rules, _ := currentReplaceRules(); pkt.MessagePath == "" || len(rules) == 0 {
 		if pkt.IsSSE && pkt.Prefix != "" {
-			return pkt.Prefix + ": " + pkt.RawData + "\n\n", "", nil
+			return sseFrame(pkt, pkt.RawData), "", nil
 		}
 		return pkt.RawData, "", nil
 	}
@@ -601,7 +990,7 @@ func applyResponseReplaceToPacket(pkt ResponsePacket) (jsonStr string, replacedS
 	repl, changed := applyReplaceRulesToString(src)
 	if !changed {
 		if pkt.IsSSE && pkt.Prefix != "" {
-			return pkt.Prefix + ": " + pkt.RawData + "\n\n", "", nil
+			return sseFrame(pkt, pkt.RawData), "", nil
 		}
 		return pkt.RawData, "", nil
 	}
@@ -619,17 +1008,39 @@ func applyResponseReplaceToPacket(pkt ResponsePacket) (jsonStr string, replacedS
 	}
 
 	if pkt.IsSSE && pkt.Prefix != "" {
-		return pkt.Prefix + ": " + newJSONWithUsage + "\n\n", repl, nil
+		return sseFrame(pkt, newJSONWithUsage), repl, nil
 	}
 	return newJSONWithUsage, repl, nil
 }
 
+// regionClosed reports whether every trigger found in inStr has a closing marker after it, so
+// collection can end before the stream does. Triggers without a closing marker collect to the end.
+func regionClosed(inStr string) bool {
+	found := false
+	rules, _ := currentReplaceRules()
+	for _, rule := range rules {
+		if rule.Trigger == "" {
+			continue
+		}
+		i := strings.Index(inStr, rule.Trigger)
+		if i < 0 {
+			continue
+		}
+		if rule.Close == "" || !strings.Contains(inStr[i+len(rule.Trigger):], rule.Close) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
 // containsTrigger проверяет, встречается ли один из триггеров в буфере.
 func containsTrigger(inStr string) bool {
-	if len(appCtx.responseReplaceRules) == 0 {
+	rules, _ := currentReplaceRules()
+	if len(rules) == 0 {
 		return false
 	}
-	for _, rule := range appCtx.responseReplaceRules {
+	for _, rule := range rules {
 		if rule.Trigger == "" {
 			continue
 		}
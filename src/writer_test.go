@@ -0,0 +1,281 @@
+// writer_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRegionClockStaysWithinUpstreamTimes(t *testing.T) {
+	newTestApp(t)
+	first := ResponsePacket{RawData: `{"created_at":"2026-01-01T00:00:01Z","response":"<think>"}`, MessagePath: "response"}
+	last := `{"created_at":"2026-01-01T00:00:02Z","response":"</think>"}`
+	next, _ := time.Parse(time.RFC3339Nano, "2026-01-01T00:00:02.001Z") // upstream packet after the region
+
+	packets := synthesizePackets(first, "a b c d e f g h", newRegionClock(first.RawData, last))
+	if len(packets) != 8 {
+		t.Fatalf("got %d packets, want 8", len(packets))
+	}
+	var prev time.Time
+	for i, pkt := range packets {
+		ts, err := time.Parse(time.RFC3339Nano, gjson.Get(pkt.RawData, "created_at").String())
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if ts.Before(prev) || ts.After(next) {
+			t.Errorf("packet %d stamped %v, want between %v and %v", i, ts, prev, next)
+		}
+		prev = ts
+	}
+}
+
+func TestRegionClockLeavesCreatedAlone(t *testing.T) {
+	newTestApp(t)
+	first := ResponsePacket{RawData: `{"created":100,"choices":[{"delta":{"content":"x"}}]}`, MessagePath: "choices.0.delta.content"}
+	for i, pkt := range synthesizePackets(first, "a b c", newRegionClock(first.RawData, `{"created":100}`)) {
+		if got := gjson.Get(pkt.RawData, "created").Int(); got != 100 {
+			t.Errorf("packet %d created = %d, want 100", i, got)
+		}
+	}
+}
+
+// smallResponse is a complete non-streaming /api/generate answer
+const smallResponse = `{"model":"m","created_at":"2026-01-01T00:00:01Z","response":"The answer is 42.","done":true,"eval_count":6}`
+
+// writeSmallResponse sends smallResponse through a ResponseCollector the way the proxy does
+func writeSmallResponse(tb testing.TB) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "application/json")
+	rec.Header().Set("Content-Length", strconv.Itoa(len(smallResponse)))
+	c := NewResponseCollector(rec)
+	c.WriteHeader(http.StatusOK)
+	if _, err := c.Write([]byte(smallResponse)); err != nil {
+		tb.Fatal(err)
+	}
+	if _, _, err := c.CloseAndProcess(); err != nil {
+		tb.Fatal(err)
+	}
+	c.StopOutgoingLoop()
+	return rec
+}
+
+func newWriterTestApp(tb testing.TB, fast bool) {
+	newTestApp(tb)
+	if err := initConfigState(); err != nil {
+		tb.Fatal(err)
+	}
+	appCtx.Config.SmallResponseFastPath = fast
+	appCtx.Config.SmallResponseMaxBytes = 65536
+}
+
+func TestSmallResponseFastPathMatchesLoop(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		newWriterTestApp(t, fast)
+		if got := writeSmallResponse(t).Body.String(); got != smallResponse {
+			t.Errorf("fast path %t wrote %s", fast, got)
+		}
+	}
+}
+
+// BenchmarkSmallResponse compares the small-response fast path with the outgoing packet loop
+func BenchmarkSmallResponse(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		fast bool
+	}{{"loop", false}, {"fast-path", true}} {
+		b.Run(bench.name, func(b *testing.B) {
+			newWriterTestApp(b, bench.fast)
+			b.ReportAllocs()
+			for b.Loop() {
+				writeSmallResponse(b)
+			}
+		})
+	}
+}
+
+func TestToolCallStreamForwardedVerbatimAndNotStored(t *testing.T) {
+	newWriterTestApp(t, false)
+	frames := []string{
+		"data: {\"id\":\"c1\",\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"Let me check.\"},\"finish_reason\":null}]}\n\n",
+		"data: {\"id\":\"c1\",\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"get_weather\",\"arguments\":\"\"}}]},\"finish_reason\":null}]}\n\n",
+		"data: {\"id\":\"c1\",\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"city\\\": \\\"Oslo\\\"}\"}}]},\"finish_reason\":null}]}\n\n",
+		"data: {\"id\":\"c1\",\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\n\n",
+		"data: [DONE]\n\n",
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "text/event-stream")
+	c := NewResponseCollector(rec)
+	c.WriteHeader(http.StatusOK)
+	for _, frame := range frames {
+		if _, err := c.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, _, err := c.CloseAndProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StopOutgoingLoop()
+
+	if want := strings.Join(frames, ""); rec.Body.String() != want {
+		t.Errorf("forwarded:\n%s\nwant byte for byte:\n%s", rec.Body, want)
+	}
+	if content != "" {
+		t.Errorf("assistant content to store = %q, want none for a tool-call response", content)
+	}
+}
+
+func TestParseIncomingBufferSSEFields(t *testing.T) {
+	newWriterTestApp(t, false)
+	chunk := `{"id":"c1","model":"m","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":null}]}`
+	cases := []struct {
+		name, frame, fields, data string
+		typ                       int
+	}{
+		{"data only", "data: " + chunk + "\n\n", "", chunk, StreamPacket},
+		{"event and id", "event: message\nid: 7\ndata: " + chunk + "\n\n", "event: message\nid: 7\n", chunk, StreamPacket},
+		{"comment and retry", ": keep-alive\nretry: 500\ndata: " + chunk + "\n\n", ": keep-alive\nretry: 500\n", chunk, StreamPacket},
+		{"multiline data", "event: message\ndata: {\"id\":\"c1\",\"model\":\"m\",\ndata: \"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"},\"finish_reason\":null}]}\n\n",
+			"event: message\n", "{\"id\":\"c1\",\"model\":\"m\",\n\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"},\"finish_reason\":null}]}", StreamPacket},
+		{"done", "event: done\ndata: [DONE]\n\n", "event: done\n", "[DONE]", OtherPacket},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt, err := parseIncomingBuffer(tc.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pkt.IsSSE || pkt.Prefix != "data" || pkt.SSEFields != tc.fields || pkt.RawData != tc.data || pkt.PacketType != tc.typ {
+				t.Errorf("parsed %+v", pkt)
+			}
+			if tc.typ == StreamPacket {
+				if pkt.MessagePath != "choices.0.delta.content" {
+					t.Errorf("message path %q", pkt.MessagePath)
+				}
+				if got := packetWireData(pkt); got != tc.frame {
+					t.Errorf("written back as %q, want %q", got, tc.frame)
+				}
+			}
+		})
+	}
+}
+
+func TestSSEEventFramesPassThroughCollector(t *testing.T) {
+	newWriterTestApp(t, false)
+	frame := func(id int, content, finish string) string {
+		return fmt.Sprintf("event: message\nid: %d\ndata: {\"id\":\"c1\",\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q},\"finish_reason\":%s}]}\n\n", id, content, finish)
+	}
+	frames := []string{
+		frame(1, "Hello", "null"),
+		frame(2, " wide", "null"),
+		frame(3, " world", "null"),
+		frame(4, "", `"stop"`),
+		"event: done\ndata: [DONE]\n\n",
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "text/event-stream")
+	c := NewResponseCollector(rec)
+	c.WriteHeader(http.StatusOK)
+	for _, f := range frames {
+		if _, err := c.Write([]byte(f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, wasMessages, err := c.CloseAndProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StopOutgoingLoop()
+
+	if want := strings.Join(frames, ""); rec.Body.String() != want {
+		t.Errorf("forwarded:\n%s\nwant:\n%s", rec.Body, want)
+	}
+	if !wasMessages || content != "Hello wide world" {
+		t.Errorf("collected %q (messages %t), want the streamed text", content, wasMessages)
+	}
+}
+
+func TestDirectResponseContentLengthMatchesRewrittenBody(t *testing.T) {
+	// The default ResponseReplacer rewrites "меня зовут" into "зовут меня eeeeee"
+	direct := `{"model":"m","created_at":"2026-01-01T00:00:01Z","response":"Привет, меня зовут Бот.","done":true}`
+	for _, fast := range []bool{false, true} {
+		newWriterTestApp(t, fast)
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "application/json")
+		rec.Header().Set("Content-Length", strconv.Itoa(len(direct)))
+		c := NewResponseCollector(rec)
+		c.WriteHeader(http.StatusOK)
+		if _, err := c.Write([]byte(direct)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.CloseAndProcess(); err != nil {
+			t.Fatal(err)
+		}
+		c.StopOutgoingLoop()
+
+		body := rec.Body.String()
+		if !strings.Contains(body, "зовут меня eeeeee") {
+			t.Fatalf("fast path %t: body not rewritten: %s", fast, body)
+		}
+		if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) {
+			t.Errorf("fast path %t: Content-Length %q for a %d-byte body", fast, got, len(body))
+		}
+	}
+
+	// A stream has no length to keep
+	newWriterTestApp(t, false)
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "application/x-ndjson")
+	c := NewResponseCollector(rec)
+	c.WriteHeader(http.StatusOK)
+	c.Write([]byte(`{"model":"m","created_at":"2026-01-01T00:00:01Z","response":"Hi","done":false}` + "\n"))
+	c.Write([]byte(`{"model":"m","created_at":"2026-01-01T00:00:02Z","response":"","done":true}` + "\n"))
+	c.CloseAndProcess()
+	c.StopOutgoingLoop()
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Errorf("stream sent with Content-Length %q", got)
+	}
+}
+
+func TestIdenticalChunksReachClientUnlessDeduped(t *testing.T) {
+	chunk := `{"model":"m","created_at":"2026-01-01T00:00:01Z","response":"na","done":false}` + "\n"
+	last := `{"model":"m","created_at":"2026-01-01T00:00:02Z","response":"","done":true}` + "\n"
+	for _, dedup := range []bool{false, true} {
+		newWriterTestApp(t, false)
+		appCtx.Config.DedupIdenticalChunks = dedup
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "application/x-ndjson")
+		c := NewResponseCollector(rec)
+		c.WriteHeader(http.StatusOK)
+		for _, pkt := range []string{chunk, chunk, last} {
+			if _, err := c.Write([]byte(pkt)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		content, _, err := c.CloseAndProcess()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.StopOutgoingLoop()
+
+		want := chunk + chunk + last
+		if dedup {
+			want = chunk + last
+		}
+		if rec.Body.String() != want {
+			t.Errorf("dedup %t: client got\n%s\nwant\n%s", dedup, rec.Body, want)
+		}
+		if content != "nana" {
+			t.Errorf("dedup %t: collected %q, want the model's text", dedup, content)
+		}
+	}
+}